@@ -0,0 +1,58 @@
+package bitbucket
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/minorhacks/funhouse/webhook"
+)
+
+// ParsePush parses a Bitbucket Server refs changed webhook. If secret is set,
+// the request must carry a matching X-Hub-Signature header.
+func ParsePush(r *http.Request, secret string) (*webhook.PushEvent, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body: %v", err)
+	}
+
+	switch event := r.Header.Get("X-Event-Key"); event {
+	case "repo:refs_changed":
+	case "diagnostics:ping":
+		// Pings from the "Test connection" button are unsigned.
+		return nil, webhook.ErrPing
+	default:
+		return nil, fmt.Errorf("%w: %q", webhook.ErrUnsupportedEvent, event)
+	}
+
+	if err := webhook.CheckSignature(body, r.Header.Get("X-Hub-Signature"), secret); err != nil {
+		return nil, err
+	}
+	var payload RefsChangedPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("failed to decode payload: %v", err)
+	}
+
+	ev := &webhook.PushEvent{
+		DeliveryID: r.Header.Get("X-Request-Id"),
+	}
+	if payload.Repository != nil {
+		ev.Repository = payload.Repository.Slug
+		if payload.Repository.Project != nil {
+			ev.Repository = payload.Repository.Project.Key + "/" + ev.Repository
+		}
+	}
+	for _, c := range payload.Changes {
+		u := webhook.RefUpdate{
+			Ref:    c.RefID,
+			Before: c.FromHash,
+			After:  c.ToHash,
+		}
+		if c.Type == "DELETE" {
+			u.After = webhook.ZeroHash
+		}
+		ev.Updates = append(ev.Updates, u)
+	}
+	return ev, nil
+}
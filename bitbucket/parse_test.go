@@ -0,0 +1,83 @@
+package bitbucket
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/minorhacks/funhouse/webhook"
+	"github.com/minorhacks/funhouse/webhook/webhooktest"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParsePush(t *testing.T) {
+	const secret = "hunter2"
+	body := webhooktest.ReadFile(t, "bitbucket/testdata/refs_changed_response.json")
+
+	testCases := []struct {
+		desc       string
+		event      string
+		signSecret string
+		want       *webhook.PushEvent
+		wantErr    error
+	}{
+		{
+			desc:       "refs changed",
+			event:      "repo:refs_changed",
+			signSecret: secret,
+			want: &webhook.PushEvent{
+				Repository: "MH/advent_2020",
+				Updates: []webhook.RefUpdate{
+					{
+						Ref:    "refs/heads/master",
+						Before: "0802d5e6cee084a8f867c5406e46a3fca556bf4e",
+						After:  "89b269b3c313d05c182e5ff829727f2b5132c2e5",
+					},
+					{
+						Ref:    "refs/heads/feature",
+						Before: "89b269b3c313d05c182e5ff829727f2b5132c2e5",
+						After:  webhook.ZeroHash,
+					},
+				},
+			},
+		},
+		{
+			desc:       "bad signature",
+			event:      "repo:refs_changed",
+			signSecret: "wrong",
+			wantErr:    webhook.ErrUnauthorized,
+		},
+		{
+			desc:    "ping",
+			event:   "diagnostics:ping",
+			wantErr: webhook.ErrPing,
+		},
+		{
+			desc:       "unsupported event",
+			event:      "pr:opened",
+			signSecret: secret,
+			wantErr:    webhook.ErrUnsupportedEvent,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/hook/bitbucket", bytes.NewReader(body))
+			req.Header.Set("X-Event-Key", tc.event)
+			if tc.signSecret != "" {
+				req.Header.Set("X-Hub-Signature", "sha256="+hex.EncodeToString(webhook.Sign(body, tc.signSecret)))
+			}
+
+			got, err := ParsePush(req, secret)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("ParsePush() got error %v; want %v", err, tc.wantErr)
+			}
+			if diff := cmp.Diff(got, tc.want); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,27 @@
+package bitbucket
+
+// RefsChangedPayload is the body of Bitbucket Server's "repo:refs_changed"
+// event. A single push may change several refs.
+type RefsChangedPayload struct {
+	EventKey   string      `json:"eventKey"`
+	Repository *Repository `json:"repository"`
+	Changes    []*Change   `json:"changes"`
+}
+
+type Change struct {
+	// RefID is the fully-qualified ref name, e.g. "refs/heads/master".
+	RefID    string `json:"refId"`
+	FromHash string `json:"fromHash"`
+	ToHash   string `json:"toHash"`
+	// Type is one of "ADD", "UPDATE" or "DELETE".
+	Type string `json:"type"`
+}
+
+type Repository struct {
+	Slug    string   `json:"slug"`
+	Project *Project `json:"project"`
+}
+
+type Project struct {
+	Key string `json:"key"`
+}
@@ -0,0 +1,411 @@
+// Package cache serves the GitReadFs API from a cache in front of another
+// GitReadFs server, its upstream, so that servers in other regions can serve
+// repos without fetching from origin themselves.
+//
+// Responses that are fixed by a commit hash (files, attributes, directory
+// listings and commits) are kept in memory until they are evicted to make room
+// for others. That holds for views of a repo too, so a change to how the
+// upstream configures a view only shows once its old responses are evicted.
+// Branches are kept up to date by following the upstream's WatchBranches
+// stream for each repo that has been read, and the commit list is cached until
+// the branches next change.
+package cache
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minorhacks/funhouse/flight"
+	fspb "github.com/minorhacks/funhouse/proto/git_read_fs_proto"
+
+	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	defaultMaxBytes        = 1 << 30
+	defaultWatchBackoff    = time.Second
+	defaultWatchMaxBackoff = time.Minute
+	// fillTimeout bounds a fill shared by concurrent misses, which doesn't
+	// stop when the request that started it is cancelled.
+	fillTimeout = 5 * time.Minute
+)
+
+// fullHash matches the commit hashes whose responses can be cached. Any other
+// commit name is passed upstream every time.
+var fullHash = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// Options configure a Cache.
+type Options struct {
+	// MaxBytes bounds the total size of the cached responses. It defaults to
+	// 1 GiB.
+	MaxBytes int64
+	// WatchBackoff is the delay before following a repo's branches again
+	// after the upstream's stream breaks. It doubles with each failure in a
+	// row, up to WatchMaxBackoff.
+	WatchBackoff    time.Duration
+	WatchMaxBackoff time.Duration
+}
+
+// Cache is a GitReadFs server that serves from a cache of upstream.
+type Cache struct {
+	upstream fspb.GitReadFsClient
+	opts     Options
+
+	// ctx is cancelled by Close, stopping the watches of upstream branches.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	objects *lru
+	fills   flight.Group
+
+	mu    sync.Mutex
+	repos map[string]*repoState
+}
+
+// New returns a Cache of upstream.
+func New(upstream fspb.GitReadFsClient, opts Options) *Cache {
+	if opts.MaxBytes == 0 {
+		opts.MaxBytes = defaultMaxBytes
+	}
+	if opts.WatchBackoff == 0 {
+		opts.WatchBackoff = defaultWatchBackoff
+	}
+	if opts.WatchMaxBackoff == 0 {
+		opts.WatchMaxBackoff = defaultWatchMaxBackoff
+	}
+	c := &Cache{
+		upstream: upstream,
+		opts:     opts,
+		objects:  newLRU(opts.MaxBytes),
+		repos:    map[string]*repoState{},
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	return c
+}
+
+// Close stops following upstream branches, and ends WatchBranches streams.
+func (c *Cache) Close() {
+	c.cancel()
+}
+
+func (c *Cache) GetFile(ctx context.Context, req *fspb.GetFileRequest) (*fspb.GetFileResponse, error) {
+	res, err := c.get(ctx, req.Commit, key("file", req.Repo, req.View, req.Commit, req.Path), func(ctx context.Context) (proto.Message, error) {
+		return c.upstream.GetFile(ctx, req)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.(*fspb.GetFileResponse), nil
+}
+
+func (c *Cache) GetAttributes(ctx context.Context, req *fspb.GetAttributesRequest) (*fspb.GetAttributesResponse, error) {
+	res, err := c.get(ctx, req.Commit, key("attributes", req.Repo, req.View, req.Commit, req.Path), func(ctx context.Context) (proto.Message, error) {
+		return c.upstream.GetAttributes(ctx, req)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.(*fspb.GetAttributesResponse), nil
+}
+
+func (c *Cache) ListDir(ctx context.Context, req *fspb.ListDirRequest) (*fspb.ListDirResponse, error) {
+	res, err := c.get(ctx, req.Commit, key("dir", req.Repo, req.View, req.Commit, req.Path), func(ctx context.Context) (proto.Message, error) {
+		return c.upstream.ListDir(ctx, req)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.(*fspb.ListDirResponse), nil
+}
+
+// GetCommit caches commits by hash, with or without their diffs.
+func (c *Cache) GetCommit(ctx context.Context, req *fspb.GetCommitRequest) (*fspb.GetCommitResponse, error) {
+	res, err := c.get(ctx, req.Commit, key("commit", req.Repo, req.Commit, fmt.Sprint(req.IncludeDiff)), func(ctx context.Context) (proto.Message, error) {
+		return c.upstream.GetCommit(ctx, req)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.(*fspb.GetCommitResponse), nil
+}
+
+// ListBranches serves the branches last sent by the upstream. If the watch of
+// the upstream's branches is down, it asks the upstream instead, and falls
+// back to the last branches it saw if that fails too.
+func (c *Cache) ListBranches(ctx context.Context, req *fspb.ListBranchesRequest) (*fspb.ListBranchesResponse, error) {
+	rs := c.repo(req.Repo)
+	branches, synced, _ := rs.snapshot()
+	if synced {
+		return branches, nil
+	}
+	res, err := c.upstream.ListBranches(ctx, req)
+	if err != nil {
+		if branches != nil {
+			glog.Warningf("ListBranches: serving stale branches of repo %q: %v", req.Repo, err)
+			return branches, nil
+		}
+		return nil, err
+	}
+	return res, nil
+}
+
+// ListCommits serves the upstream's commits, which are cached for each view
+// until its branches change.
+func (c *Cache) ListCommits(ctx context.Context, req *fspb.ListCommitsRequest) (*fspb.ListCommitsResponse, error) {
+	rs := c.repo(req.Repo)
+	if res, ok := rs.cachedCommits(req.View); ok {
+		return res, nil
+	}
+	_, synced, version := rs.snapshot()
+	res, err := c.upstream.ListCommits(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if synced {
+		rs.setCommits(req.View, res, version)
+	}
+	return res, nil
+}
+
+// ListTags serves the upstream's tags, which aren't cached since they aren't
+// followed.
+func (c *Cache) ListTags(ctx context.Context, req *fspb.ListTagsRequest) (*fspb.ListTagsResponse, error) {
+	return c.upstream.ListTags(ctx, req)
+}
+
+// ListRepos serves the upstream's repos.
+func (c *Cache) ListRepos(ctx context.Context, req *fspb.ListReposRequest) (*fspb.ListReposResponse, error) {
+	return c.upstream.ListRepos(ctx, req)
+}
+
+// GetFetchStatus reports the upstream's fetches from origin.
+func (c *Cache) GetFetchStatus(ctx context.Context, req *fspb.GetFetchStatusRequest) (*fspb.GetFetchStatusResponse, error) {
+	return c.upstream.GetFetchStatus(ctx, req)
+}
+
+// WatchBranches streams the branches that the upstream sends, so that caches
+// can be chained.
+func (c *Cache) WatchBranches(req *fspb.WatchBranchesRequest, stream fspb.GitReadFs_WatchBranchesServer) error {
+	rs := c.repo(req.Repo)
+	var lastVersion int
+	for {
+		updated := rs.updatedChan()
+		if err := rs.notFound(); err != nil {
+			return err
+		}
+		branches, _, version := rs.snapshot()
+		if branches != nil && version != lastVersion {
+			if err := stream.Send(branches); err != nil {
+				return err
+			}
+			lastVersion = version
+		}
+
+		select {
+		case <-updated:
+		case <-stream.Context().Done():
+			return status.FromContextError(stream.Context().Err()).Err()
+		case <-c.ctx.Done():
+			return status.Errorf(codes.Unavailable, "cache is shutting down")
+		}
+	}
+}
+
+// get returns the cached response for key if there is one. Otherwise it
+// calls fill, and caches the result if commit is a full hash. Concurrent
+// misses of the same key share one call to fill, which runs until it is done
+// or fillTimeout passes even if the request that started it is cancelled, so
+// that it doesn't fail the others.
+func (c *Cache) get(ctx context.Context, commit string, key string, fill func(ctx context.Context) (proto.Message, error)) (proto.Message, error) {
+	if !fullHash.MatchString(commit) {
+		return fill(ctx)
+	}
+	if res, ok := c.objects.get(key); ok {
+		return res, nil
+	}
+	res, err := c.fills.Do(ctx, key, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(c.ctx, fillTimeout)
+		defer cancel()
+		res, err := fill(ctx)
+		if err != nil {
+			return nil, err
+		}
+		c.objects.add(key, res)
+		return res, nil
+	})
+	if err != nil {
+		if err == ctx.Err() {
+			return nil, status.FromContextError(err).Err()
+		}
+		return nil, err
+	}
+	return res.(proto.Message), nil
+}
+
+func key(method string, fields ...string) string {
+	return method + "\x00" + strings.Join(fields, "\x00")
+}
+
+// repo returns the state of the named repo, and starts following its
+// branches the first time it is read.
+func (c *Cache) repo(name string) *repoState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rs, ok := c.repos[name]
+	if !ok {
+		rs = &repoState{updated: make(chan struct{})}
+		c.repos[name] = rs
+		go c.watch(name, rs)
+	}
+	return rs
+}
+
+// forget drops the state of a repo that the upstream doesn't have, ending
+// its WatchBranches streams with err.
+func (c *Cache) forget(name string, rs *repoState, err error) {
+	c.mu.Lock()
+	delete(c.repos, name)
+	c.mu.Unlock()
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.err = err
+	close(rs.updated)
+	rs.updated = make(chan struct{})
+}
+
+// watch follows the upstream's branches of a repo until the cache is closed,
+// starting over with exponential backoff whenever the stream breaks.
+func (c *Cache) watch(name string, rs *repoState) {
+	delay := c.opts.WatchBackoff
+	for {
+		received, err := c.follow(name, rs)
+		rs.setUnsynced()
+		if c.ctx.Err() != nil {
+			return
+		}
+		if status.Code(err) == codes.NotFound {
+			// Forget the repo rather than watching it forever, in case it
+			// was a typo.
+			c.forget(name, rs, err)
+			return
+		}
+		if received {
+			delay = c.opts.WatchBackoff
+		}
+		glog.Errorf("Cache: lost branches of repo %q; retrying in %v: %v", name, delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-c.ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if delay *= 2; delay > c.opts.WatchMaxBackoff {
+			delay = c.opts.WatchMaxBackoff
+		}
+	}
+}
+
+// follow applies the branches from one WatchBranches stream until it breaks,
+// returning whether any were received.
+func (c *Cache) follow(name string, rs *repoState) (bool, error) {
+	stream, err := c.upstream.WatchBranches(c.ctx, &fspb.WatchBranchesRequest{Repo: name})
+	if err != nil {
+		return false, err
+	}
+	received := false
+	for {
+		res, err := stream.Recv()
+		if err != nil {
+			return received, err
+		}
+		received = true
+		rs.setBranches(res)
+		glog.V(1).Infof("Cache: branches of repo %q changed", name)
+	}
+}
+
+// repoState is what the cache knows about the refs of a repo.
+type repoState struct {
+	mu sync.Mutex
+	// branches are the latest branches sent by the upstream, or nil if none
+	// have arrived yet.
+	branches *fspb.ListBranchesResponse
+	// synced is set while the upstream's branch stream is live, so that
+	// branches are current.
+	synced bool
+	// version counts the changes to branches.
+	version int
+	// commits are the commit lists for the current version, keyed by view, if
+	// they're cached.
+	commits map[string]*fspb.ListCommitsResponse
+	// updated is closed and replaced whenever branches change.
+	updated chan struct{}
+	// err is set once the repo turns out not to exist upstream.
+	err error
+}
+
+func (rs *repoState) snapshot() (branches *fspb.ListBranchesResponse, synced bool, version int) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.branches, rs.synced, rs.version
+}
+
+func (rs *repoState) setBranches(branches *fspb.ListBranchesResponse) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.branches = branches
+	rs.synced = true
+	rs.version++
+	rs.commits = nil
+	close(rs.updated)
+	rs.updated = make(chan struct{})
+}
+
+func (rs *repoState) setUnsynced() {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.synced = false
+	rs.commits = nil
+}
+
+func (rs *repoState) updatedChan() <-chan struct{} {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.updated
+}
+
+func (rs *repoState) notFound() error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.err
+}
+
+func (rs *repoState) cachedCommits(view string) (*fspb.ListCommitsResponse, bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	commits, ok := rs.commits[view]
+	return commits, rs.synced && ok
+}
+
+// setCommits caches the commit list of a view, as long as the branches
+// haven't changed since version.
+func (rs *repoState) setCommits(view string, commits *fspb.ListCommitsResponse, version int) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if !rs.synced || rs.version != version {
+		return
+	}
+	if rs.commits == nil {
+		rs.commits = map[string]*fspb.ListCommitsResponse{}
+	}
+	rs.commits[view] = commits
+}
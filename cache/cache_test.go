@@ -0,0 +1,372 @@
+package cache
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	fspb "github.com/minorhacks/funhouse/proto/git_read_fs_proto"
+
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	commitA = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	commitB = "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+)
+
+// fakeUpstream serves a single repo whose files contain their own path and
+// commit, and counts the calls it receives.
+type fakeUpstream struct {
+	mu       sync.Mutex
+	calls    map[string]int
+	branches map[string]string
+	updated  chan struct{}
+}
+
+func (u *fakeUpstream) count(method string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.calls[method]++
+}
+
+func (u *fakeUpstream) callCount(method string) int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.calls[method]
+}
+
+func (u *fakeUpstream) setBranch(name string, commit string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.branches[name] = commit
+	close(u.updated)
+	u.updated = make(chan struct{})
+}
+
+func (u *fakeUpstream) snapshot() (*fspb.ListBranchesResponse, <-chan struct{}) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	res := &fspb.ListBranchesResponse{Branches: map[string]string{}}
+	for name, commit := range u.branches {
+		res.Branches[name] = commit
+	}
+	return res, u.updated
+}
+
+func (u *fakeUpstream) GetFile(ctx context.Context, req *fspb.GetFileRequest) (*fspb.GetFileResponse, error) {
+	u.count("GetFile")
+	if req.Path == "missing" {
+		return nil, status.Errorf(codes.NotFound, "file %q not found", req.Path)
+	}
+	return &fspb.GetFileResponse{Contents: []byte(req.Path + "@" + req.Commit)}, nil
+}
+
+func (u *fakeUpstream) GetAttributes(ctx context.Context, req *fspb.GetAttributesRequest) (*fspb.GetAttributesResponse, error) {
+	u.count("GetAttributes")
+	return &fspb.GetAttributesResponse{Mode: fspb.FileMode_MODE_REGULAR, SizeBytes: uint64(len(req.Path + "@" + req.Commit))}, nil
+}
+
+func (u *fakeUpstream) ListDir(ctx context.Context, req *fspb.ListDirRequest) (*fspb.ListDirResponse, error) {
+	u.count("ListDir")
+	return &fspb.ListDirResponse{Entries: []*fspb.DirEntry{{Name: "README.md", Mode: fspb.FileMode_MODE_REGULAR}}}, nil
+}
+
+func (u *fakeUpstream) ListBranches(ctx context.Context, req *fspb.ListBranchesRequest) (*fspb.ListBranchesResponse, error) {
+	u.count("ListBranches")
+	if req.Repo != "" {
+		return nil, status.Errorf(codes.NotFound, "repo %q not found", req.Repo)
+	}
+	res, _ := u.snapshot()
+	return res, nil
+}
+
+func (u *fakeUpstream) ListCommits(ctx context.Context, req *fspb.ListCommitsRequest) (*fspb.ListCommitsResponse, error) {
+	u.count("ListCommits")
+	branches, _ := u.snapshot()
+	res := &fspb.ListCommitsResponse{}
+	for _, commit := range branches.Branches {
+		res.Commits = append(res.Commits, commit)
+	}
+	sort.Strings(res.Commits)
+	if req.View == "first" {
+		res.Commits = res.Commits[:1]
+	}
+	return res, nil
+}
+
+func (u *fakeUpstream) GetFetchStatus(ctx context.Context, req *fspb.GetFetchStatusRequest) (*fspb.GetFetchStatusResponse, error) {
+	u.count("GetFetchStatus")
+	return &fspb.GetFetchStatusResponse{Status: &fspb.FetchStatus{}}, nil
+}
+
+func (u *fakeUpstream) ListTags(ctx context.Context, req *fspb.ListTagsRequest) (*fspb.ListTagsResponse, error) {
+	u.count("ListTags")
+	return &fspb.ListTagsResponse{Tags: map[string]string{"v1.0": commitA}}, nil
+}
+
+func (u *fakeUpstream) GetCommit(ctx context.Context, req *fspb.GetCommitRequest) (*fspb.GetCommitResponse, error) {
+	u.count("GetCommit")
+	return &fspb.GetCommitResponse{Hash: req.Commit}, nil
+}
+
+func (u *fakeUpstream) ListRepos(ctx context.Context, req *fspb.ListReposRequest) (*fspb.ListReposResponse, error) {
+	u.count("ListRepos")
+	return &fspb.ListReposResponse{Repos: []string{"test"}, DefaultRepo: "test"}, nil
+}
+
+func (u *fakeUpstream) WatchBranches(req *fspb.WatchBranchesRequest, stream fspb.GitReadFs_WatchBranchesServer) error {
+	u.count("WatchBranches")
+	if req.Repo != "" {
+		return status.Errorf(codes.NotFound, "repo %q not found", req.Repo)
+	}
+	for {
+		res, updated := u.snapshot()
+		if err := stream.Send(res); err != nil {
+			return err
+		}
+		select {
+		case <-updated:
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// newTestCache returns a cache whose upstream is a fakeUpstream served over an
+// in-memory connection.
+func newTestCache(t *testing.T, opts Options) (*Cache, *fakeUpstream) {
+	t.Helper()
+	upstream := &fakeUpstream{
+		calls:    map[string]int{},
+		branches: map[string]string{"master": commitA},
+		updated:  make(chan struct{}),
+	}
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	fspb.RegisterGitReadFsServer(server, upstream)
+	go server.Serve(lis)
+
+	conn, err := grpc.Dial("bufconn",
+		grpc.WithInsecure(),
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+			return lis.Dial()
+		}))
+	if err != nil {
+		t.Fatalf("grpc.Dial() got error %v; want no error", err)
+	}
+	c := New(fspb.NewGitReadFsClient(conn), opts)
+	t.Cleanup(func() {
+		c.Close()
+		conn.Close()
+		server.Stop()
+	})
+	return c, upstream
+}
+
+func TestCacheFillsMissesOnce(t *testing.T) {
+	c, upstream := newTestCache(t, Options{})
+	ctx := context.Background()
+
+	testCases := []struct {
+		desc      string
+		commit    string
+		path      string
+		wantCalls int
+		wantErr   bool
+	}{
+		{
+			desc:      "full hash",
+			commit:    commitA,
+			path:      "README.md",
+			wantCalls: 1,
+		},
+		{
+			desc:      "abbreviated hash",
+			commit:    commitA[:7],
+			path:      "README.md",
+			wantCalls: 3,
+		},
+		{
+			desc:      "error",
+			commit:    commitA,
+			path:      "missing",
+			wantCalls: 3,
+			wantErr:   true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			before := upstream.callCount("GetFile")
+			for i := 0; i < 3; i++ {
+				res, err := c.GetFile(ctx, &fspb.GetFileRequest{Commit: tc.commit, Path: tc.path})
+				if tc.wantErr {
+					if status.Code(err) != codes.NotFound {
+						t.Fatalf("GetFile() got error %v; want NotFound", err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("GetFile() got error %v; want no error", err)
+				}
+				if got, want := string(res.Contents), tc.path+"@"+tc.commit; got != want {
+					t.Errorf("GetFile() = %q; want %q", got, want)
+				}
+			}
+			if got := upstream.callCount("GetFile") - before; got != tc.wantCalls {
+				t.Errorf("upstream got %d GetFile calls; want %d", got, tc.wantCalls)
+			}
+		})
+	}
+}
+
+func TestFillOutlivesCancelledCaller(t *testing.T) {
+	c, _ := newTestCache(t, Options{})
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := c.get(ctx, commitA, "key", func(ctx context.Context) (proto.Message, error) {
+			close(started)
+			<-release
+			return &fspb.GetFileResponse{Contents: []byte("contents")}, nil
+		})
+		first <- err
+	}()
+	<-started
+	cancel()
+	if err := <-first; status.Code(err) != codes.Canceled {
+		t.Errorf("get() with cancelled context got error %v; want Canceled", err)
+	}
+
+	// The fill carries on, so a later caller shares it, or finds its result
+	// cached, rather than filling again.
+	close(release)
+	res, err := c.get(context.Background(), commitA, "key", func(ctx context.Context) (proto.Message, error) {
+		t.Errorf("get() filled key again")
+		return nil, status.Errorf(codes.Internal, "filled again")
+	})
+	if err != nil {
+		t.Fatalf("get() got error %v; want no error", err)
+	}
+	if got := string(res.(*fspb.GetFileResponse).GetContents()); got != "contents" {
+		t.Errorf("get() = %q; want %q", got, "contents")
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	// Room for about two files.
+	c, upstream := newTestCache(t, Options{MaxBytes: 250})
+	ctx := context.Background()
+	read := func(path string) {
+		t.Helper()
+		if _, err := c.GetFile(ctx, &fspb.GetFileRequest{Commit: commitA, Path: path}); err != nil {
+			t.Fatalf("GetFile(%q) got error %v; want no error", path, err)
+		}
+	}
+
+	read("a")
+	read("b")
+	read("a")
+	read("c") // Evicts b.
+	before := upstream.callCount("GetFile")
+	read("a")
+	if got := upstream.callCount("GetFile") - before; got != 0 {
+		t.Errorf("recently read file was evicted")
+	}
+	read("b")
+	if got := upstream.callCount("GetFile") - before; got != 1 {
+		t.Errorf("least recently read file wasn't evicted")
+	}
+}
+
+func TestCacheFollowsUpstreamBranches(t *testing.T) {
+	c, upstream := newTestCache(t, Options{})
+	ctx := context.Background()
+
+	waitForBranches := func(want map[string]string) {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			res, err := c.ListBranches(ctx, &fspb.ListBranchesRequest{})
+			if err != nil {
+				t.Fatalf("ListBranches() got error %v; want no error", err)
+			}
+			_, synced, _ := c.repo("").snapshot()
+			if synced && cmp.Equal(res.Branches, want) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("ListBranches() = %v; want %v", res.Branches, want)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	listCommits := func(view string) []string {
+		t.Helper()
+		res, err := c.ListCommits(ctx, &fspb.ListCommitsRequest{View: view})
+		if err != nil {
+			t.Fatalf("ListCommits() got error %v; want no error", err)
+		}
+		return res.Commits
+	}
+
+	waitForBranches(map[string]string{"master": commitA})
+	branchCalls := upstream.callCount("ListBranches")
+	for i := 0; i < 3; i++ {
+		if diff := cmp.Diff([]string{commitA}, listCommits("")); diff != "" {
+			t.Errorf("ListCommits() returned diff (-want +got):\n%s", diff)
+		}
+	}
+	if got := upstream.callCount("ListCommits"); got != 1 {
+		t.Errorf("upstream got %d ListCommits calls; want 1", got)
+	}
+
+	upstream.setBranch("feature", commitB)
+	waitForBranches(map[string]string{"master": commitA, "feature": commitB})
+	for i := 0; i < 3; i++ {
+		if diff := cmp.Diff([]string{commitA, commitB}, listCommits("")); diff != "" {
+			t.Errorf("ListCommits() after branch change returned diff (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff([]string{commitA}, listCommits("first")); diff != "" {
+			t.Errorf("ListCommits() of view returned diff (-want +got):\n%s", diff)
+		}
+	}
+	if got := upstream.callCount("ListCommits"); got != 3 {
+		t.Errorf("upstream got %d ListCommits calls; want 3", got)
+	}
+	if got := upstream.callCount("ListBranches"); got != branchCalls {
+		t.Errorf("upstream got %d more ListBranches calls; want branches from WatchBranches", got-branchCalls)
+	}
+}
+
+func TestCacheForgetsUnknownRepos(t *testing.T) {
+	c, _ := newTestCache(t, Options{})
+	if _, err := c.ListBranches(context.Background(), &fspb.ListBranchesRequest{Repo: "typo"}); status.Code(err) != codes.NotFound {
+		t.Errorf("ListBranches() got error %v; want NotFound", err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		c.mu.Lock()
+		_, ok := c.repos["typo"]
+		c.mu.Unlock()
+		if !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("cache is still watching unknown repo")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
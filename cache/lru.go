@@ -0,0 +1,67 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// lru holds responses up to a total encoded size, evicting the least recently
+// used first.
+type lru struct {
+	mu       sync.Mutex
+	maxBytes int64
+	bytes    int64
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+type lruEntry struct {
+	key   string
+	value proto.Message
+	size  int64
+}
+
+func newLRU(maxBytes int64) *lru {
+	return &lru{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  map[string]*list.Element{},
+	}
+}
+
+func (c *lru) get(key string) (proto.Message, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*lruEntry).value, true
+}
+
+// add caches value under key, unless it is larger than the whole cache.
+func (c *lru) add(key string, value proto.Message) {
+	size := int64(len(key) + proto.Size(value))
+	if size > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.bytes -= e.Value.(*lruEntry).size
+		c.order.Remove(e)
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, value: value, size: size})
+	c.bytes += size
+	for c.bytes > c.maxBytes {
+		e := c.order.Back()
+		entry := e.Value.(*lruEntry)
+		c.order.Remove(e)
+		delete(c.entries, entry.key)
+		c.bytes -= entry.size
+	}
+}
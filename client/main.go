@@ -4,6 +4,7 @@ import (
 	"crypto/tls"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
 	"syscall"
@@ -13,6 +14,7 @@ import (
 	fspb "github.com/minorhacks/funhouse/proto/git_read_fs_proto"
 
 	"github.com/golang/glog"
+	gofuse "github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
 	"github.com/hanwen/go-fuse/fuse/pathfs"
 	"google.golang.org/grpc"
@@ -23,9 +25,21 @@ var (
 	mountPoint = flag.String("mount_point", "", "Location where filesystem should be mounted")
 	serverAddr = flag.String("server_addr", "", "Address of API server")
 	insecure = flag.Bool("insecure", false, "Disables TLS usage")
+	repo = flag.String("repo", "", "Name of the repository to mount; defaults to the server's default repository")
+	view = flag.String("view", "", "Name of a view of the repository, configured on the server, to mount the commits of")
 
 	entryTTL    = flag.Float64("entry_ttl", 1.0, "FUSE entry cache TTL")
 	negativeTTL = flag.Float64("negative_ttl", 1.0, "FUSE negative entry cache TTL")
+	commitTTL   = flag.Float64("commit_ttl", 365*24*60*60, "FUSE entry cache TTL, in seconds, for paths in commits, which never change")
+
+	metadataCacheEntries = flag.Int("metadata_cache_entries", 100000, "Number of attributes and directory listings of paths in commits to keep in memory; 0 disables the cache")
+
+	fileTimes = flag.String("file_times", "commit", "Time that files in a commit are given as their mtime, ctime and atime: the commit's committer time (commit), its author time (author) or the Unix epoch (zero)")
+	uid       = flag.Int("uid", -1, "Owner of every file; defaults to the user that mounts the filesystem")
+	gid       = flag.Int("gid", -1, "Group of every file; defaults to the group of the user that mounts the filesystem")
+
+	traceLog         = flag.String("trace_log", "", "File to append a JSON line to for every file access, with the calling PID")
+	traceManifestDir = flag.String("trace_manifest_dir", "", "Directory to write a manifest of the paths read in each commit to, on SIGUSR1 and at unmount")
 )
 
 func main() {
@@ -38,6 +52,18 @@ func main() {
 }
 
 func app() error {
+	times, err := fuse.ParseFileTimes(*fileTimes)
+	if err != nil {
+		return fmt.Errorf("invalid --file_times: %v", err)
+	}
+	owner := gofuse.CurrentOwner()
+	if *uid >= 0 {
+		owner.Uid = uint32(*uid)
+	}
+	if *gid >= 0 {
+		owner.Gid = uint32(*gid)
+	}
+
 	var options []grpc.DialOption
 	if *insecure {
 		options = append(options, grpc.WithInsecure())
@@ -55,17 +81,50 @@ func app() error {
 
 	fs := &fuse.GitFS{
 		Client: client,
+		Repo:   *repo,
+		View:   *view,
+		Times:  times,
+	}
+	if *metadataCacheEntries > 0 {
+		fs.Cache = fuse.NewMetadataCache(*metadataCacheEntries)
+	}
+	if *traceLog != "" || *traceManifestDir != "" {
+		var log io.Writer
+		if *traceLog != "" {
+			f, err := os.OpenFile(*traceLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+			if err != nil {
+				return fmt.Errorf("failed to open trace log: %v", err)
+			}
+			defer f.Close()
+			log = f
+		}
+		fs.Tracer = fuse.NewTracer(log)
 	}
 	pathNodeFs := pathfs.NewPathNodeFs(fs, &pathfs.PathNodeFsOptions{})
-	mountState, _, err := nodefs.MountRoot(*mountPoint, pathNodeFs.Root(), &nodefs.Options{
+	mountState, connector, err := nodefs.MountRoot(*mountPoint, pathNodeFs.Root(), &nodefs.Options{
 		EntryTimeout:    time.Duration(*entryTTL * float64(time.Second)),
 		AttrTimeout:     time.Duration(*entryTTL * float64(time.Second)),
 		NegativeTimeout: time.Duration(*negativeTTL * float64(time.Second)),
 		PortableInodes:  false,
+		Owner:           owner,
 	})
 	if err != nil {
 		return fmt.Errorf("failed to mount: %v", err)
 	}
+	// The kernel's TTLs are set per mount, so commits is mounted on its own
+	// to keep what it learns about them for much longer than about branches.
+	// Negative entries keep the short TTL, since a path can be missing only
+	// because the server hasn't fetched its commit yet.
+	commitsNodeFs := pathfs.NewPathNodeFs(pathfs.NewPrefixFileSystem(fs, "/commits"), &pathfs.PathNodeFsOptions{})
+	if status := connector.Mount(pathNodeFs.Root().Inode(), "commits", commitsNodeFs.Root(), &nodefs.Options{
+		EntryTimeout:    time.Duration(*commitTTL * float64(time.Second)),
+		AttrTimeout:     time.Duration(*commitTTL * float64(time.Second)),
+		NegativeTimeout: time.Duration(*negativeTTL * float64(time.Second)),
+		Owner:           owner,
+	}); !status.Ok() {
+		mountState.Unmount()
+		return fmt.Errorf("failed to mount commits: %v", status)
+	}
 
 	sigChan := make(chan os.Signal)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
@@ -85,6 +144,26 @@ func app() error {
 		}
 	}()
 
+	if *traceManifestDir != "" {
+		dumpChan := make(chan os.Signal, 1)
+		signal.Notify(dumpChan, syscall.SIGUSR1)
+		defer signal.Stop(dumpChan)
+		go func() {
+			for range dumpChan {
+				if err := fs.Tracer.WriteManifests(*traceManifestDir); err != nil {
+					glog.Errorf("Failed to write manifests: %v", err)
+				} else {
+					glog.Infof("Wrote manifests to %q", *traceManifestDir)
+				}
+			}
+		}()
+	}
+
 	mountState.Serve()
+	if *traceManifestDir != "" {
+		if err := fs.Tracer.WriteManifests(*traceManifestDir); err != nil {
+			return fmt.Errorf("failed to write manifests: %v", err)
+		}
+	}
 	return nil
 }
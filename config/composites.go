@@ -0,0 +1,79 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/minorhacks/funhouse/service"
+)
+
+// Composite describes a synthetic repo that mounts branches of several of the
+// configured repos at paths of its own, so that they can be mounted and built
+// as one workspace.
+type Composite struct {
+	Name    string            `yaml:"name"`
+	Members []CompositeMember `yaml:"members"`
+}
+
+// CompositeMember mounts a branch of a configured repo in a composite.
+type CompositeMember struct {
+	Repo string `yaml:"repo"`
+	Path string `yaml:"path"`
+	// Branch is the branch that the composite follows; the repo's default
+	// branch if unset.
+	Branch string `yaml:"branch"`
+	// View, if set, is one of the repo's views, which the composite shows in
+	// place of the repo's own tree.
+	View string `yaml:"view"`
+}
+
+// validate checks a composite against the config's repos, keyed by name.
+func (c Composite) validate(repos map[string]Repo) error {
+	if err := service.ValidateComposite(c.Name, c.members()); err != nil {
+		return err
+	}
+	if _, ok := repos[c.Name]; ok {
+		return fmt.Errorf("composite %q has the name of a repo", c.Name)
+	}
+	for i, m := range c.Members {
+		repo, ok := repos[m.Repo]
+		if !ok {
+			return fmt.Errorf("composite %q: members[%d]: repo %q isn't listed in repos", c.Name, i, m.Repo)
+		}
+		if m.View != "" && !hasView(repo, m.View) {
+			return fmt.Errorf("composite %q: members[%d]: repo %q has no view %q", c.Name, i, m.Repo, m.View)
+		}
+	}
+	return nil
+}
+
+func hasView(r Repo, name string) bool {
+	for _, v := range r.Views {
+		if v.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// CompositeMembers returns the members of each composite, keyed by name, for
+// service.SetComposites.
+func (c *Config) CompositeMembers() map[string][]service.CompositeMember {
+	composites := map[string][]service.CompositeMember{}
+	for _, comp := range c.Composites {
+		composites[comp.Name] = comp.members()
+	}
+	return composites
+}
+
+func (c Composite) members() []service.CompositeMember {
+	var members []service.CompositeMember
+	for _, m := range c.Members {
+		members = append(members, service.CompositeMember{
+			Path:   m.Path,
+			Repo:   m.Repo,
+			Branch: m.Branch,
+			View:   m.View,
+		})
+	}
+	return members
+}
@@ -0,0 +1,335 @@
+// Package config loads the server's configuration file, which lists the repos
+// to mirror along with their credentials and other settings.
+//
+// The file is YAML, or JSON, which is read as YAML. For example:
+//
+//	base_path: /var/lib/funhouse
+//	admin_token: {file: /etc/funhouse/admin_token}
+//	webhook_secrets:
+//	  github: {env: GITHUB_WEBHOOK_SECRET}
+//	repos:
+//	- name: funhouse
+//	  url: https://github.com/minorhacks/funhouse
+//	  poll_interval: 5m
+//	- name: private
+//	  url: git@github.com:minorhacks/private.git
+//	  partial_clone: true
+//	  credentials:
+//	    ssh_key: {file: /etc/funhouse/id_ed25519}
+//	  webhook_secret: {file: /etc/funhouse/private_webhook_secret}
+//	  views:
+//	  - name: public
+//	    transforms:
+//	    - exclude: [internal, "*.pem"]
+//	    - move: {from: docs, to: documentation}
+//	    - add_file: {path: NOTICE, contents: "Mirrored by funhouse.\n"}
+//	    - replace: {paths: ["*.go"], pattern: 'corp\.example\.com', with: example.com}
+//	  - name: payments
+//	    transforms:
+//	    - subdirectory: {path: services/payments, only_touching_commits: true}
+//	  - name: contractors
+//	    transforms:
+//	    - redact:
+//	      - {name: credentials, paths: [secrets, "*.pem"]}
+//	      - {name: aws-key, pattern: 'AKIA[0-9A-Z]{16}'}
+//	composites:
+//	- name: workspace
+//	  members:
+//	  - {repo: funhouse, path: funhouse}
+//	  - {repo: private, path: libs/private, branch: main, view: payments}
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/minorhacks/funhouse/service"
+
+	"gopkg.in/yaml.v2"
+)
+
+// webhookProviders are the providers that the server accepts webhooks from.
+var webhookProviders = map[string]bool{
+	"github":    true,
+	"gitlab":    true,
+	"gitea":     true,
+	"bitbucket": true,
+}
+
+// Config describes a server. Fields that are left unset fall back to the
+// server's flags.
+type Config struct {
+	// BasePath is the directory that repos are cloned into.
+	BasePath string `yaml:"base_path"`
+	GRPCPort int    `yaml:"grpc_port"`
+	HTTPPort int    `yaml:"http_port"`
+	// AdminToken, if set, enables the MirrorAdmin service for callers that
+	// present it.
+	AdminToken service.Secret `yaml:"admin_token"`
+	// WebhookSecrets are the secrets that webhooks from each provider must be
+	// signed with, keyed by provider name, unless the repo has its own.
+	WebhookSecrets map[string]service.Secret `yaml:"webhook_secrets"`
+	Repos          []Repo                    `yaml:"repos"`
+	// Composites are synthetic repos made of branches of Repos.
+	Composites []Composite `yaml:"composites"`
+}
+
+// Repo describes a repo to mirror.
+type Repo struct {
+	Name         string      `yaml:"name"`
+	URL          string      `yaml:"url"`
+	Credentials  Credentials `yaml:"credentials"`
+	PartialClone bool        `yaml:"partial_clone"`
+	// PollInterval overrides the server's poll interval for the repo if it
+	// is set.
+	PollInterval time.Duration `yaml:"poll_interval"`
+	// WebhookSecret, if set, replaces the provider's webhook secret for the
+	// repo. Its webhooks must then be delivered to /hook/<provider>/<name>.
+	WebhookSecret service.Secret `yaml:"webhook_secret"`
+	Views         []View         `yaml:"views"`
+	// RequireView makes the repo readable only through one of Views; see
+	// service.RepoOptions.
+	RequireView bool `yaml:"require_view"`
+}
+
+// Credentials authenticate a repo's clones and fetches, as described by
+// service.Credentials.
+type Credentials struct {
+	Username         string         `yaml:"username"`
+	Password         service.Secret `yaml:"password"`
+	Token            service.Secret `yaml:"token"`
+	SSHKey           service.Secret `yaml:"ssh_key"`
+	SSHKeyPassphrase service.Secret `yaml:"ssh_key_passphrase"`
+	KnownHostsFile   string         `yaml:"known_hosts_file"`
+}
+
+// Load reads and validates the config file at path.
+func Load(path string) (*Config, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %v", err)
+	}
+	c, err := Parse(contents)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config %q: %v", path, err)
+	}
+	return c, nil
+}
+
+// Parse parses and validates a YAML or JSON config. Unknown fields are
+// rejected, so that a misspelt setting isn't silently ignored.
+func Parse(contents []byte) (*Config, error) {
+	c := &Config{}
+	if err := yaml.UnmarshalStrict(contents, c); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Validate returns an error describing the first problem with the config.
+func (c *Config) Validate() error {
+	if len(c.Repos) == 0 && !c.AdminToken.IsSet() {
+		return fmt.Errorf("no repos, and no admin_token to add them with")
+	}
+	for field, port := range map[string]int{"grpc_port": c.GRPCPort, "http_port": c.HTTPPort} {
+		if port < 0 || port > 65535 {
+			return fmt.Errorf("%s %d is out of range", field, port)
+		}
+	}
+	if err := checkSecret("admin_token", c.AdminToken); err != nil {
+		return err
+	}
+	for provider, secret := range c.WebhookSecrets {
+		if !webhookProviders[provider] {
+			return fmt.Errorf("webhook_secrets: unknown provider %q", provider)
+		}
+		if err := checkSecret("webhook_secrets."+provider, secret); err != nil {
+			return err
+		}
+	}
+
+	repos := map[string]Repo{}
+	for i, repo := range c.Repos {
+		if err := repo.validate(); err != nil {
+			return fmt.Errorf("repos[%d]: %v", i, err)
+		}
+		if _, ok := repos[repo.Name]; ok {
+			return fmt.Errorf("repos[%d]: repo %q is listed more than once", i, repo.Name)
+		}
+		repos[repo.Name] = repo
+	}
+	composites := map[string]bool{}
+	for i, comp := range c.Composites {
+		if err := comp.validate(repos); err != nil {
+			return fmt.Errorf("composites[%d]: %v", i, err)
+		}
+		if composites[comp.Name] {
+			return fmt.Errorf("composites[%d]: composite %q is listed more than once", i, comp.Name)
+		}
+		composites[comp.Name] = true
+	}
+	return nil
+}
+
+func (r Repo) validate() error {
+	if err := service.ValidateRepoName(r.Name); err != nil {
+		return err
+	}
+	if r.URL == "" {
+		return fmt.Errorf("repo %q has no url", r.Name)
+	}
+	if r.PollInterval < 0 {
+		return fmt.Errorf("repo %q has negative poll_interval %v", r.Name, r.PollInterval)
+	}
+	if err := checkSecret("webhook_secret", r.WebhookSecret); err != nil {
+		return fmt.Errorf("repo %q: %v", r.Name, err)
+	}
+	if _, err := viewTransformers(r.Views); err != nil {
+		return fmt.Errorf("repo %q: %v", r.Name, err)
+	}
+
+	creds := r.Credentials
+	secrets := map[string]service.Secret{
+		"password":           creds.Password,
+		"token":              creds.Token,
+		"ssh_key":            creds.SSHKey,
+		"ssh_key_passphrase": creds.SSHKeyPassphrase,
+	}
+	for field, secret := range secrets {
+		if err := checkSecret("credentials."+field, secret); err != nil {
+			return fmt.Errorf("repo %q: %v", r.Name, err)
+		}
+	}
+	methods := 0
+	for _, secret := range []service.Secret{creds.Password, creds.Token, creds.SSHKey} {
+		if secret.IsSet() {
+			methods++
+		}
+	}
+	if methods > 1 {
+		return fmt.Errorf("repo %q: at most one of credentials.password, credentials.token and credentials.ssh_key may be set", r.Name)
+	}
+	if creds.SSHKeyPassphrase.IsSet() && !creds.SSHKey.IsSet() {
+		return fmt.Errorf("repo %q: credentials.ssh_key_passphrase is set without credentials.ssh_key", r.Name)
+	}
+	return nil
+}
+
+// checkSecret returns an error if a secret has more than one source.
+func checkSecret(field string, s service.Secret) error {
+	sources := 0
+	for _, source := range []string{s.Value, s.File, s.Env} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return fmt.Errorf("%s: at most one of value, file and env may be set", field)
+	}
+	return nil
+}
+
+// Options returns the options to mirror the repo with. Its webhook secret is
+// read now, whereas its credentials are read before each clone and fetch.
+func (r Repo) Options() (service.RepoOptions, error) {
+	webhookSecret, err := r.WebhookSecret.Read()
+	if err != nil {
+		return service.RepoOptions{}, fmt.Errorf("repo %q: failed to read webhook_secret: %v", r.Name, err)
+	}
+	views, err := viewTransformers(r.Views)
+	if err != nil {
+		return service.RepoOptions{}, fmt.Errorf("repo %q: %v", r.Name, err)
+	}
+	return service.RepoOptions{
+		Credentials: service.Credentials{
+			Username:         r.Credentials.Username,
+			Password:         r.Credentials.Password,
+			Token:            r.Credentials.Token,
+			SSHKey:           r.Credentials.SSHKey,
+			SSHKeyPassphrase: r.Credentials.SSHKeyPassphrase,
+			KnownHostsFile:   r.Credentials.KnownHostsFile,
+		},
+		PartialClone:  r.PartialClone,
+		PollInterval:  r.PollInterval,
+		WebhookSecret: webhookSecret,
+		Views:         views,
+		RequireView:   r.RequireView,
+	}, nil
+}
+
+// CheckReload returns an error if the server can't switch from c to next
+// without a restart: if next changes a server setting, or changes the URL or
+// clone mode of a repo rather than removing it and adding a new one.
+func (c *Config) CheckReload(next *Config) error {
+	var changed []string
+	if next.BasePath != c.BasePath {
+		changed = append(changed, "base_path")
+	}
+	if next.GRPCPort != c.GRPCPort {
+		changed = append(changed, "grpc_port")
+	}
+	if next.HTTPPort != c.HTTPPort {
+		changed = append(changed, "http_port")
+	}
+	if next.AdminToken != c.AdminToken {
+		changed = append(changed, "admin_token")
+	}
+	if !sameSecrets(next.WebhookSecrets, c.WebhookSecrets) {
+		changed = append(changed, "webhook_secrets")
+	}
+	if len(changed) > 0 {
+		return fmt.Errorf("changes to %v only take effect on restart", changed)
+	}
+
+	repos := map[string]Repo{}
+	for _, repo := range c.Repos {
+		repos[repo.Name] = repo
+	}
+	for _, repo := range next.Repos {
+		old, ok := repos[repo.Name]
+		if !ok {
+			continue
+		}
+		if repo.URL != old.URL || repo.PartialClone != old.PartialClone {
+			return fmt.Errorf("repo %q changes url or partial_clone; give it a new name instead", repo.Name)
+		}
+	}
+	return nil
+}
+
+func sameSecrets(a, b map[string]service.Secret) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || v != w {
+			return false
+		}
+	}
+	return true
+}
+
+// Diff returns the repos in next that aren't in c, and the repos in c that
+// aren't in next.
+func (c *Config) Diff(next *Config) (added []Repo, removed []Repo) {
+	return missing(next.Repos, c.Repos), missing(c.Repos, next.Repos)
+}
+
+// missing returns the repos in a that aren't in b.
+func missing(a, b []Repo) []Repo {
+	names := map[string]bool{}
+	for _, repo := range b {
+		names[repo.Name] = true
+	}
+	var repos []Repo
+	for _, repo := range a {
+		if !names[repo.Name] {
+			repos = append(repos, repo)
+		}
+	}
+	return repos
+}
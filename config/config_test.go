@@ -0,0 +1,411 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/minorhacks/funhouse/service"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParse(t *testing.T) {
+	want := &Config{
+		BasePath:       "/var/lib/funhouse",
+		GRPCPort:       9090,
+		AdminToken:     service.Secret{File: "/etc/funhouse/admin_token"},
+		WebhookSecrets: map[string]service.Secret{"github": {Env: "GITHUB_WEBHOOK_SECRET"}},
+		Repos: []Repo{
+			{
+				Name:         "funhouse",
+				URL:          "https://github.com/minorhacks/funhouse",
+				PollInterval: 5 * time.Minute,
+			},
+			{
+				Name:         "private",
+				URL:          "git@github.com:minorhacks/private.git",
+				PartialClone: true,
+				Credentials: Credentials{
+					SSHKey:           service.Secret{File: "/etc/funhouse/id_ed25519"},
+					SSHKeyPassphrase: service.Secret{Env: "SSH_PASSPHRASE"},
+				},
+				WebhookSecret: service.Secret{Value: "hunter2"},
+			},
+		},
+	}
+
+	testCases := []struct {
+		desc     string
+		contents string
+	}{
+		{
+			desc: "yaml",
+			contents: `
+base_path: /var/lib/funhouse
+grpc_port: 9090
+admin_token: {file: /etc/funhouse/admin_token}
+webhook_secrets:
+  github: {env: GITHUB_WEBHOOK_SECRET}
+repos:
+- name: funhouse
+  url: https://github.com/minorhacks/funhouse
+  poll_interval: 5m
+- name: private
+  url: git@github.com:minorhacks/private.git
+  partial_clone: true
+  credentials:
+    ssh_key: {file: /etc/funhouse/id_ed25519}
+    ssh_key_passphrase: {env: SSH_PASSPHRASE}
+  webhook_secret: {value: hunter2}
+`,
+		},
+		{
+			desc: "json",
+			contents: `{
+  "base_path": "/var/lib/funhouse",
+  "grpc_port": 9090,
+  "admin_token": {"file": "/etc/funhouse/admin_token"},
+  "webhook_secrets": {"github": {"env": "GITHUB_WEBHOOK_SECRET"}},
+  "repos": [
+    {"name": "funhouse", "url": "https://github.com/minorhacks/funhouse", "poll_interval": "5m"},
+    {
+      "name": "private",
+      "url": "git@github.com:minorhacks/private.git",
+      "partial_clone": true,
+      "credentials": {
+        "ssh_key": {"file": "/etc/funhouse/id_ed25519"},
+        "ssh_key_passphrase": {"env": "SSH_PASSPHRASE"}
+      },
+      "webhook_secret": {"value": "hunter2"}
+    }
+  ]
+}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			got, err := Parse([]byte(tc.contents))
+			if err != nil {
+				t.Fatalf("Parse() got error %v; want no error", err)
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("Parse() returned diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		contents string
+		wantErr  string
+	}{
+		{
+			desc:     "empty",
+			contents: ``,
+			wantErr:  "no repos",
+		},
+		{
+			desc:     "unknown field",
+			contents: `{repos: [{name: a, url: u, poll_intervl: 5m}]}`,
+			wantErr:  "poll_intervl",
+		},
+		{
+			desc:     "bad duration",
+			contents: `{repos: [{name: a, url: u, poll_interval: often}]}`,
+			wantErr:  "often",
+		},
+		{
+			desc:     "invalid name",
+			contents: `{repos: [{name: ../a, url: u}]}`,
+			wantErr:  "invalid repo name",
+		},
+		{
+			desc:     "duplicate name",
+			contents: `{repos: [{name: a, url: u}, {name: a, url: v}]}`,
+			wantErr:  "more than once",
+		},
+		{
+			desc:     "missing url",
+			contents: `{repos: [{name: a}]}`,
+			wantErr:  "no url",
+		},
+		{
+			desc:     "port out of range",
+			contents: `{http_port: 70000, repos: [{name: a, url: u}]}`,
+			wantErr:  "http_port",
+		},
+		{
+			desc:     "unknown webhook provider",
+			contents: `{webhook_secrets: {gitcafe: {value: s}}, repos: [{name: a, url: u}]}`,
+			wantErr:  "gitcafe",
+		},
+		{
+			desc:     "secret with two sources",
+			contents: `{repos: [{name: a, url: u, credentials: {token: {value: t, env: T}}}]}`,
+			wantErr:  "credentials.token",
+		},
+		{
+			desc:     "two auth methods",
+			contents: `{repos: [{name: a, url: u, credentials: {token: {value: t}, ssh_key: {file: k}}}]}`,
+			wantErr:  "at most one of credentials",
+		},
+		{
+			desc:     "passphrase without key",
+			contents: `{repos: [{name: a, url: u, credentials: {ssh_key_passphrase: {env: P}}}]}`,
+			wantErr:  "without credentials.ssh_key",
+		},
+		{
+			desc:     "invalid view name",
+			contents: `{repos: [{name: a, url: u, views: [{name: "a/b"}]}]}`,
+			wantErr:  "invalid view name",
+		},
+		{
+			desc:     "duplicate view",
+			contents: `{repos: [{name: a, url: u, views: [{name: v}, {name: v}]}]}`,
+			wantErr:  `view "v" is listed more than once`,
+		},
+		{
+			desc:     "two steps in one transform",
+			contents: `{repos: [{name: a, url: u, views: [{name: v, transforms: [{exclude: [x], move: {from: x, to: y}}]}]}]}`,
+			wantErr:  "transforms[0]: exactly one of",
+		},
+		{
+			desc:     "bad exclude pattern",
+			contents: `{repos: [{name: a, url: u, views: [{name: v, transforms: [{exclude: ["[x"]}]}]}]}`,
+			wantErr:  "invalid path pattern",
+		},
+		{
+			desc:     "bad replace pattern",
+			contents: `{repos: [{name: a, url: u, views: [{name: v, transforms: [{replace: {pattern: "(x"}}]}]}]}`,
+			wantErr:  "replace: error parsing regexp",
+		},
+		{
+			desc:     "move of root",
+			contents: `{repos: [{name: a, url: u, views: [{name: v, transforms: [{move: {from: /, to: x}}]}]}]}`,
+			wantErr:  "root",
+		},
+		{
+			desc:     "subdirectory of root",
+			contents: `{repos: [{name: a, url: u, views: [{name: v, transforms: [{subdirectory: {path: /}}]}]}]}`,
+			wantErr:  "subdirectory",
+		},
+		{
+			desc:     "commit filter after another transform",
+			contents: `{repos: [{name: a, url: u, views: [{name: v, transforms: [{exclude: [x]}, {subdirectory: {path: s, only_touching_commits: true}}]}]}]}`,
+			wantErr:  "transforms[1]: only the first transform",
+		},
+		{
+			desc:     "redact before another transform",
+			contents: `{repos: [{name: a, url: u, views: [{name: v, transforms: [{redact: [{name: r, paths: [x]}]}, {exclude: [y]}]}]}]}`,
+			wantErr:  "transforms[0]: only the last transform can redact",
+		},
+		{
+			desc:     "bad redact pattern",
+			contents: `{repos: [{name: a, url: u, views: [{name: v, transforms: [{redact: [{name: r, pattern: "(x"}]}]}]}]}`,
+			wantErr:  `redact: "r": error parsing regexp`,
+		},
+		{
+			desc:     "empty redaction",
+			contents: `{repos: [{name: a, url: u, views: [{name: v, transforms: [{redact: [{name: r}]}]}]}]}`,
+			wantErr:  "neither paths nor a pattern",
+		},
+		{
+			desc:     "composite of unlisted repo",
+			contents: `{repos: [{name: a, url: u}], composites: [{name: w, members: [{repo: b, path: b}]}]}`,
+			wantErr:  `composites[0]: composite "w": members[0]: repo "b" isn't listed`,
+		},
+		{
+			desc:     "composite of unknown view",
+			contents: `{repos: [{name: a, url: u}], composites: [{name: w, members: [{repo: a, path: a, view: v}]}]}`,
+			wantErr:  `repo "a" has no view "v"`,
+		},
+		{
+			desc:     "composite with the name of a repo",
+			contents: `{repos: [{name: a, url: u}], composites: [{name: a, members: [{repo: a, path: a}]}]}`,
+			wantErr:  "has the name of a repo",
+		},
+		{
+			desc:     "composite at the root",
+			contents: `{repos: [{name: a, url: u}], composites: [{name: w, members: [{repo: a, path: /}]}]}`,
+			wantErr:  "root",
+		},
+		{
+			desc:     "duplicate composite",
+			contents: `{repos: [{name: a, url: u}], composites: [{name: w, members: [{repo: a, path: a}]}, {name: w, members: [{repo: a, path: a}]}]}`,
+			wantErr:  "listed more than once",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			_, err := Parse([]byte(tc.contents))
+			if err == nil {
+				t.Fatalf("Parse() got no error; want error containing %q", tc.wantErr)
+			}
+			if !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("Parse() got error %v; want error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestViews(t *testing.T) {
+	c, err := Parse([]byte(`
+repos:
+- name: a
+  url: u
+  views:
+  - name: public
+    transforms:
+    - exclude: [internal]
+    - move: {from: docs, to: documentation}
+    - add_file: {path: NOTICE, contents: hello}
+    - replace: {paths: ["*.go"], pattern: 'corp\.example\.com', with: example.com}
+    - export_attributes: true
+    - checkout_attributes: true
+  - name: everything
+  - name: payments
+    transforms:
+    - subdirectory: {path: services/payments, only_touching_commits: true}
+    - exclude: ["*.pem"]
+  - name: contractors
+    transforms:
+    - redact:
+      - {name: credentials, paths: [secrets, "*.pem"]}
+      - {name: aws-key, pattern: 'AKIA[0-9A-Z]{16}'}
+`))
+	if err != nil {
+		t.Fatalf("Parse() got error %v; want no error", err)
+	}
+	opts, err := c.Repos[0].Options()
+	if err != nil {
+		t.Fatalf("Options() got error %v; want no error", err)
+	}
+	if got, want := len(opts.Views["public"]), 6; got != want {
+		t.Errorf("Options() returned %d transformers for view %q; want %d", got, "public", want)
+	}
+	if transformers, ok := opts.Views["everything"]; !ok || len(transformers) != 0 {
+		t.Errorf("Options() returned transformers %v for view %q; want none", transformers, "everything")
+	}
+	payments := opts.Views["payments"]
+	if got, want := len(payments), 3; got != want {
+		t.Fatalf("Options() returned %d transformers for view %q; want %d", got, "payments", want)
+	}
+	if _, ok := payments[0].(service.CommitFilter); !ok {
+		t.Errorf("Options() returned transformers for view %q that don't filter commits; want the first to", "payments")
+	}
+	if got, want := len(opts.Views["contractors"]), 1; got != want {
+		t.Errorf("Options() returned %d transformers for view %q; want %d", got, "contractors", want)
+	}
+}
+
+func TestCompositeMembers(t *testing.T) {
+	c, err := Parse([]byte(`
+repos:
+- name: a
+  url: u
+  views:
+  - name: public
+- name: b
+  url: u
+composites:
+- name: workspace
+  members:
+  - {repo: a, path: a, view: public}
+  - {repo: b, path: libs/b, branch: main}
+`))
+	if err != nil {
+		t.Fatalf("Parse() got error %v; want no error", err)
+	}
+	want := map[string][]service.CompositeMember{
+		"workspace": {
+			{Path: "a", Repo: "a", View: "public"},
+			{Path: "libs/b", Repo: "b", Branch: "main"},
+		},
+	}
+	if diff := cmp.Diff(want, c.CompositeMembers()); diff != "" {
+		t.Errorf("CompositeMembers() returned diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestReload(t *testing.T) {
+	cur := &Config{
+		BasePath: "/data",
+		Repos: []Repo{
+			{Name: "kept", URL: "https://example.com/kept"},
+			{Name: "removed", URL: "https://example.com/removed"},
+		},
+	}
+
+	testCases := []struct {
+		desc        string
+		next        *Config
+		wantErr     bool
+		wantAdded   []string
+		wantRemoved []string
+	}{
+		{
+			desc: "repos added and removed",
+			next: &Config{
+				BasePath: "/data",
+				Repos: []Repo{
+					{Name: "kept", URL: "https://example.com/kept", PollInterval: time.Minute},
+					{Name: "added", URL: "https://example.com/added"},
+				},
+			},
+			wantAdded:   []string{"added"},
+			wantRemoved: []string{"removed"},
+		},
+		{
+			desc: "server setting changed",
+			next: &Config{
+				BasePath: "/elsewhere",
+				Repos:    cur.Repos,
+			},
+			wantErr: true,
+		},
+		{
+			desc: "repo url changed",
+			next: &Config{
+				BasePath: "/data",
+				Repos:    []Repo{{Name: "kept", URL: "https://example.com/moved"}},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			err := cur.CheckReload(tc.next)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("CheckReload() got no error; want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CheckReload() got error %v; want no error", err)
+			}
+
+			added, removed := cur.Diff(tc.next)
+			if diff := cmp.Diff(tc.wantAdded, repoNames(added)); diff != "" {
+				t.Errorf("Diff() added repos diff (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.wantRemoved, repoNames(removed)); diff != "" {
+				t.Errorf("Diff() removed repos diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func repoNames(repos []Repo) []string {
+	var names []string
+	for _, repo := range repos {
+		names = append(names, repo.Name)
+	}
+	return names
+}
@@ -0,0 +1,198 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/minorhacks/funhouse/service"
+)
+
+// View describes a distorted view of a repo, which clients name along with
+// the repo. Its transforms are applied in order.
+type View struct {
+	Name       string      `yaml:"name"`
+	Transforms []Transform `yaml:"transforms"`
+}
+
+// Transform is a step of a view. Exactly one of its fields must be set.
+type Transform struct {
+	// Exclude hides the files and directories that match any of its path
+	// patterns. A pattern without a slash matches names at any depth.
+	Exclude []string `yaml:"exclude"`
+	// Move moves a file or directory.
+	Move *Move `yaml:"move"`
+	// AddFile adds a file, replacing whatever is at its path.
+	AddFile *AddFile `yaml:"add_file"`
+	// Replace replaces the matches of a regular expression in files.
+	Replace *Replace `yaml:"replace"`
+	// Subdirectory makes a directory the root of the view.
+	Subdirectory *Subdirectory `yaml:"subdirectory"`
+	// ExportAttributes applies the export-ignore and export-subst attributes
+	// of .gitattributes files, as git archive does.
+	ExportAttributes bool `yaml:"export_attributes"`
+	// CheckoutAttributes applies the text, eol and ident attributes of
+	// .gitattributes files, so that files have the contents that git checkout
+	// would give them on Linux.
+	CheckoutAttributes bool `yaml:"checkout_attributes"`
+	// Redact hides paths and replaces secrets in files with placeholders, for
+	// views that are shared outside. It must be the view's last transform.
+	Redact []Redaction `yaml:"redact"`
+}
+
+type Move struct {
+	From string `yaml:"from"`
+	To   string `yaml:"to"`
+}
+
+type AddFile struct {
+	Path     string `yaml:"path"`
+	Contents string `yaml:"contents"`
+}
+
+type Replace struct {
+	// Paths are patterns of the files to rewrite, as for Exclude; every file
+	// is rewritten if there are none.
+	Paths []string `yaml:"paths"`
+	// Pattern is an RE2 regular expression.
+	Pattern string `yaml:"pattern"`
+	// With replaces each match, and may refer to submatches as $1 or ${name}.
+	With string `yaml:"with"`
+}
+
+// Redaction is a rule of a redact transform. At least one of Paths and
+// Pattern must be set.
+type Redaction struct {
+	// Name identifies the rule, and appears in the placeholders of its
+	// matches as "[REDACTED:<name>]".
+	Name string `yaml:"name"`
+	// Paths are patterns of paths to hide, as for Exclude.
+	Paths []string `yaml:"paths"`
+	// Pattern is an RE2 regular expression that matches secrets.
+	Pattern string `yaml:"pattern"`
+}
+
+type Subdirectory struct {
+	Path string `yaml:"path"`
+	// OnlyTouchingCommits lists only the commits that change the directory
+	// in the view, much like git subtree split but without rewriting them.
+	// The subdirectory must be the view's first transform, since commits are
+	// checked against the repo's own tree.
+	OnlyTouchingCommits bool `yaml:"only_touching_commits"`
+}
+
+// transformers returns the service transformers that apply the view.
+func (v View) transformers() ([]service.Transformer, error) {
+	var transformers []service.Transformer
+	for i, t := range v.Transforms {
+		if i > 0 && t.Subdirectory != nil && t.Subdirectory.OnlyTouchingCommits {
+			return nil, fmt.Errorf("view %q: transforms[%d]: only the first transform can be a subdirectory with only_touching_commits", v.Name, i)
+		}
+		if i < len(v.Transforms)-1 && t.Redact != nil {
+			return nil, fmt.Errorf("view %q: transforms[%d]: only the last transform can redact", v.Name, i)
+		}
+		ts, err := t.transformers()
+		if err != nil {
+			return nil, fmt.Errorf("view %q: transforms[%d]: %v", v.Name, i, err)
+		}
+		transformers = append(transformers, ts...)
+	}
+	return transformers, nil
+}
+
+func (t Transform) transformers() ([]service.Transformer, error) {
+	set := 0
+	for _, isSet := range []bool{t.Exclude != nil, t.Move != nil, t.AddFile != nil, t.Replace != nil, t.Subdirectory != nil, t.ExportAttributes, t.CheckoutAttributes, t.Redact != nil} {
+		if isSet {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, fmt.Errorf("exactly one of exclude, move, add_file, replace, subdirectory, export_attributes, checkout_attributes and redact must be set")
+	}
+
+	var transformer service.Transformer
+	var err error
+	switch {
+	case t.Exclude != nil:
+		transformer, err = service.ExcludePaths(t.Exclude...)
+	case t.Move != nil:
+		transformer, err = service.MovePath(t.Move.From, t.Move.To)
+	case t.AddFile != nil:
+		transformer, err = service.AddFile(t.AddFile.Path, []byte(t.AddFile.Contents))
+	case t.Replace != nil:
+		re, reErr := regexp.Compile(t.Replace.Pattern)
+		if reErr != nil {
+			return nil, fmt.Errorf("replace: %v", reErr)
+		}
+		transformer, err = service.ReplaceInFiles(t.Replace.Paths, re, t.Replace.With)
+	case t.ExportAttributes:
+		transformer = service.ExportAttributes()
+	case t.CheckoutAttributes:
+		transformer = service.CheckoutAttributes()
+	case t.Redact != nil:
+		transformer, err = redact(t.Redact)
+	default:
+		return t.Subdirectory.transformers()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []service.Transformer{transformer}, nil
+}
+
+func redact(rules []Redaction) (service.Transformer, error) {
+	var redactions []service.Redaction
+	for _, r := range rules {
+		redaction := service.Redaction{Name: r.Name, Paths: r.Paths}
+		if r.Pattern != "" {
+			re, err := regexp.Compile(r.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("redact: %q: %v", r.Name, err)
+			}
+			redaction.Pattern = re
+		}
+		redactions = append(redactions, redaction)
+	}
+	transformer, err := service.Redact(redactions)
+	if err != nil {
+		return nil, fmt.Errorf("redact: %v", err)
+	}
+	return transformer, nil
+}
+
+func (d *Subdirectory) transformers() ([]service.Transformer, error) {
+	root, err := service.SubdirectoryRoot(d.Path)
+	if err != nil {
+		return nil, fmt.Errorf("subdirectory: %v", err)
+	}
+	if !d.OnlyTouchingCommits {
+		return []service.Transformer{root}, nil
+	}
+	filter, err := service.OnlyCommitsTouching(d.Path)
+	if err != nil {
+		return nil, fmt.Errorf("subdirectory: %v", err)
+	}
+	return []service.Transformer{filter, root}, nil
+}
+
+// viewTransformers returns the transformers of each of views, keyed by name.
+func viewTransformers(views []View) (map[string][]service.Transformer, error) {
+	if len(views) == 0 {
+		return nil, nil
+	}
+	byName := map[string][]service.Transformer{}
+	for _, v := range views {
+		if err := service.ValidateViewName(v.Name); err != nil {
+			return nil, err
+		}
+		if _, ok := byName[v.Name]; ok {
+			return nil, fmt.Errorf("view %q is listed more than once", v.Name)
+		}
+		transformers, err := v.transformers()
+		if err != nil {
+			return nil, err
+		}
+		byName[v.Name] = transformers
+	}
+	return byName, nil
+}
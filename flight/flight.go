@@ -0,0 +1,70 @@
+// Package flight coalesces concurrent calls that would do the same work, such
+// as fetching the same object, into a single call whose result they share.
+package flight
+
+import (
+	"context"
+	"sync"
+)
+
+// Group coalesces calls by key. The zero Group is ready to use.
+type Group struct {
+	mu       sync.Mutex
+	inflight map[string]*Call
+}
+
+// Call is a call in flight, shared by every caller of Start with its key.
+type Call struct {
+	done chan struct{}
+	res  interface{}
+	err  error
+}
+
+// Done returns a channel that is closed once the call has returned.
+func (c *Call) Done() <-chan struct{} {
+	return c.done
+}
+
+// Result returns what the call returned. It must only be called once Done is
+// closed.
+func (c *Call) Result() (interface{}, error) {
+	return c.res, c.err
+}
+
+// Start starts fn in the background, unless a call with the same key is
+// already in flight, and returns the call. Once fn returns, a later Start
+// with the same key starts a new call.
+func (g *Group) Start(key string, fn func() (interface{}, error)) *Call {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if c, ok := g.inflight[key]; ok {
+		return c
+	}
+	if g.inflight == nil {
+		g.inflight = map[string]*Call{}
+	}
+	c := &Call{done: make(chan struct{})}
+	g.inflight[key] = c
+	go func() {
+		c.res, c.err = fn()
+		g.mu.Lock()
+		delete(g.inflight, key)
+		g.mu.Unlock()
+		close(c.done)
+	}()
+	return c
+}
+
+// Do starts fn like Start, and waits for the call to return its result. If
+// ctx is done first, Do returns ctx.Err() without waiting, and the call
+// carries on for the other callers. fn should stop on its own, e.g. after a
+// timeout, since no caller can cancel it.
+func (g *Group) Do(ctx context.Context, key string, fn func() (interface{}, error)) (interface{}, error) {
+	c := g.Start(key, fn)
+	select {
+	case <-c.Done():
+		return c.Result()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
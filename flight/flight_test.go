@@ -0,0 +1,90 @@
+package flight
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestStartCoalesces(t *testing.T) {
+	var g Group
+	errCall := errors.New("call failed")
+	release := make(chan struct{})
+	var mu sync.Mutex
+	calls := 0
+	fn := func() (interface{}, error) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		<-release
+		return "result", errCall
+	}
+
+	var started []*Call
+	for i := 0; i < 5; i++ {
+		started = append(started, g.Start("key", fn))
+	}
+	close(release)
+	for _, c := range started {
+		<-c.Done()
+		if res, err := c.Result(); res != "result" || err != errCall {
+			t.Errorf("Result() = %v, %v; want %q, %v", res, err, "result", errCall)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("fn called %d times; want 1", calls)
+	}
+
+	// A call that has returned isn't shared with later callers.
+	c := g.Start("key", func() (interface{}, error) { return "again", nil })
+	<-c.Done()
+	if res, _ := c.Result(); res != "again" {
+		t.Errorf("Result() of a later call = %v; want %q", res, "again")
+	}
+}
+
+func TestStartKeysAreSeparate(t *testing.T) {
+	var g Group
+	release := make(chan struct{})
+	a := g.Start("a", func() (interface{}, error) {
+		<-release
+		return "a", nil
+	})
+	b := g.Start("b", func() (interface{}, error) { return "b", nil })
+	// b returns while a is still in flight.
+	<-b.Done()
+	if res, _ := b.Result(); res != "b" {
+		t.Errorf("Result() of b = %v; want %q", res, "b")
+	}
+	close(release)
+	<-a.Done()
+	if res, _ := a.Result(); res != "a" {
+		t.Errorf("Result() of a = %v; want %q", res, "a")
+	}
+}
+
+func TestDoOutlivesCancelledCaller(t *testing.T) {
+	var g Group
+	release := make(chan struct{})
+	fn := func() (interface{}, error) {
+		<-release
+		return "result", nil
+	}
+	// Another caller shares the call, and waits for it to return.
+	c := g.Start("key", fn)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := g.Do(ctx, "key", fn); err != context.Canceled {
+		t.Errorf("Do() with cancelled context got error %v; want %v", err, context.Canceled)
+	}
+	close(release)
+	<-c.Done()
+	if res, err := c.Result(); res != "result" || err != nil {
+		t.Errorf("Result() = %v, %v; want %q, no error", res, err, "result")
+	}
+	if res, err := g.Do(context.Background(), "key", fn); res != "result" || err != nil {
+		t.Errorf("Do() = %v, %v; want %q, no error", res, err, "result")
+	}
+}
@@ -0,0 +1,152 @@
+package fuse
+
+import (
+	"container/list"
+	"context"
+	"regexp"
+	"sync"
+
+	fspb "github.com/minorhacks/funhouse/proto/git_read_fs_proto"
+
+	"google.golang.org/grpc/codes"
+	grpcstat "google.golang.org/grpc/status"
+)
+
+// fullHashPattern matches the commit names whose paths can be cached, since
+// what they refer to never changes.
+var fullHashPattern = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// MetadataCache holds the attributes and directory listings of paths in
+// commits, and which paths don't exist, so that looking at the same commit
+// again doesn't call the server. It holds up to a number of entries, evicting
+// the least recently used first. Like the server's caching tier, it assumes
+// that the view the mount reads through doesn't change while it's mounted.
+type MetadataCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	order      *list.List
+	entries    map[string]*list.Element
+}
+
+type metadataEntry struct {
+	key string
+	// value is a *fspb.GetAttributesResponse, a []*fspb.DirEntry, or the
+	// error of a path that doesn't exist.
+	value interface{}
+}
+
+// NewMetadataCache returns a MetadataCache that holds up to maxEntries
+// entries.
+func NewMetadataCache(maxEntries int) *MetadataCache {
+	return &MetadataCache{
+		maxEntries: maxEntries,
+		order:      list.New(),
+		entries:    map[string]*list.Element{},
+	}
+}
+
+func (c *MetadataCache) get(key string) (interface{}, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*metadataEntry).value, true
+}
+
+func (c *MetadataCache) add(key string, value interface{}) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.order.Remove(e)
+	}
+	c.entries[key] = c.order.PushFront(&metadataEntry{key: key, value: value})
+	for c.order.Len() > c.maxEntries {
+		e := c.order.Back()
+		c.order.Remove(e)
+		delete(c.entries, e.Value.(*metadataEntry).key)
+	}
+}
+
+func cacheKey(kind string, commit string, p string) string {
+	return kind + "\x00" + commit + "\x00" + p
+}
+
+// cacheable reports whether the paths of commit are cached.
+func (f *GitFS) cacheable(commit string) bool {
+	return f.Cache != nil && fullHashPattern.MatchString(commit)
+}
+
+// getAttributes returns the attributes of the file or directory at p in
+// commit, from the cache if it can.
+func (f *GitFS) getAttributes(ctx context.Context, commit string, p string) (*fspb.GetAttributesResponse, error) {
+	key := cacheKey("attributes", commit, p)
+	if v, ok := f.Cache.get(key); ok {
+		if err, ok := v.(error); ok {
+			return nil, err
+		}
+		return v.(*fspb.GetAttributesResponse), nil
+	}
+	res, err := f.Client.GetAttributes(ctx, &fspb.GetAttributesRequest{
+		Repo:   f.Repo,
+		View:   f.View,
+		Commit: commit,
+		Path:   p,
+	})
+	if f.cacheable(commit) {
+		switch {
+		case err == nil:
+			f.Cache.add(key, res)
+		case f.missing(ctx, commit, p, err):
+			f.Cache.add(key, err)
+		}
+	}
+	return res, err
+}
+
+// listDir returns the entries of the directory at p in commit, from the
+// cache if it can.
+func (f *GitFS) listDir(ctx context.Context, commit string, p string) ([]*fspb.DirEntry, error) {
+	key := cacheKey("dir", commit, p)
+	if v, ok := f.Cache.get(key); ok {
+		if err, ok := v.(error); ok {
+			return nil, err
+		}
+		return v.([]*fspb.DirEntry), nil
+	}
+	res, err := f.Client.ListDir(ctx, &fspb.ListDirRequest{
+		Repo:   f.Repo,
+		View:   f.View,
+		Commit: commit,
+		Path:   p,
+	})
+	if err != nil {
+		if f.cacheable(commit) && f.missing(ctx, commit, p, err) {
+			f.Cache.add(key, err)
+		}
+		return nil, err
+	}
+	if f.cacheable(commit) {
+		f.Cache.add(key, res.Entries)
+	}
+	return res.Entries, nil
+}
+
+// missing reports whether err says that p doesn't exist in commit for good.
+// The server also answers NotFound for commits that it hasn't fetched yet,
+// so the commit's root must be found before the path is taken to be missing.
+func (f *GitFS) missing(ctx context.Context, commit string, p string, err error) bool {
+	if grpcstat.Code(err) != codes.NotFound || p == "/" {
+		return false
+	}
+	_, rootErr := f.getAttributes(ctx, commit, "/")
+	return rootErr == nil
+}
@@ -0,0 +1,86 @@
+package fuse
+
+import (
+	"testing"
+
+	fspb "github.com/minorhacks/funhouse/proto/git_read_fs_proto"
+
+	gofuse "github.com/hanwen/go-fuse/fuse"
+)
+
+func testFiles() map[string]*fspb.GetAttributesResponse {
+	return map[string]*fspb.GetAttributesResponse{
+		"/":            testAttrs(fspb.FileMode_MODE_DIR, 0),
+		"/src":         testAttrs(fspb.FileMode_MODE_DIR, 0),
+		"/src/main.go": testAttrs(fspb.FileMode_MODE_REGULAR, 13),
+	}
+}
+
+func TestMetadataCacheSavesCalls(t *testing.T) {
+	client := newFakeClient(map[string]map[string]*fspb.GetAttributesResponse{testCommit: testFiles()})
+	f := &GitFS{Client: client, Cache: NewMetadataCache(100)}
+	dir := "commits/" + testCommit + "/src"
+
+	for i := 0; i < 3; i++ {
+		if _, st := f.GetAttr(dir+"/main.go", nil); st != gofuse.OK {
+			t.Fatalf("GetAttr() got status %v; want OK", st)
+		}
+		entries, st := f.OpenDir(dir, nil)
+		if st != gofuse.OK {
+			t.Fatalf("OpenDir() got status %v; want OK", st)
+		}
+		if len(entries) != 1 || entries[0].Name != "main.go" {
+			t.Errorf("OpenDir() = %v; want only main.go", entries)
+		}
+		// The root is looked up once to be sure that a path is missing
+		// from the commit, rather than the commit not being fetched yet.
+		if _, st := f.GetAttr(dir+"/missing.go", nil); st != gofuse.ENOENT {
+			t.Errorf("GetAttr() of missing file got status %v; want %v", st, gofuse.ENOENT)
+		}
+	}
+	for rpc, want := range map[string]int{"GetAttributes": 3, "ListDir": 1} {
+		if got := client.callCount(rpc); got != want {
+			t.Errorf("%s was called %d times; want %d", rpc, got, want)
+		}
+	}
+}
+
+func TestMetadataCacheWaitsForUnfetchedCommits(t *testing.T) {
+	client := newFakeClient(map[string]map[string]*fspb.GetAttributesResponse{})
+	f := &GitFS{Client: client, Cache: NewMetadataCache(100)}
+	file := "commits/" + testCommit + "/src/main.go"
+
+	if _, st := f.GetAttr(file, nil); st != gofuse.ENOENT {
+		t.Fatalf("GetAttr() before the server fetched the commit got status %v; want %v", st, gofuse.ENOENT)
+	}
+	if _, st := f.OpenDir("commits/"+testCommit+"/src", nil); st == gofuse.OK {
+		t.Fatalf("OpenDir() before the server fetched the commit got status OK; want error")
+	}
+	client.mu.Lock()
+	client.files[testCommit] = testFiles()
+	client.mu.Unlock()
+
+	if _, st := f.GetAttr(file, nil); st != gofuse.OK {
+		t.Errorf("GetAttr() after the server fetched the commit got status %v; want OK", st)
+	}
+	if _, st := f.OpenDir("commits/"+testCommit+"/src", nil); st != gofuse.OK {
+		t.Errorf("OpenDir() after the server fetched the commit got status %v; want OK", st)
+	}
+	if _, st := f.GetAttr("commits/"+testCommit, nil); st != gofuse.OK {
+		t.Errorf("GetAttr() of commit after the server fetched it got status %v; want OK", st)
+	}
+}
+
+func TestMetadataCacheEvicts(t *testing.T) {
+	client := newFakeClient(map[string]map[string]*fspb.GetAttributesResponse{testCommit: testFiles()})
+	f := &GitFS{Client: client, Cache: NewMetadataCache(2)}
+	for _, p := range []string{"/", "/src", "/src/main.go", "/"} {
+		if _, st := f.GetAttr("commits/"+testCommit+p, nil); st != gofuse.OK {
+			t.Fatalf("GetAttr(%q) got status %v; want OK", p, st)
+		}
+	}
+	// The root was evicted by the time it was looked up again.
+	if got, want := client.callCount("GetAttributes"), 4; got != want {
+		t.Errorf("GetAttributes was called %d times; want %d", got, want)
+	}
+}
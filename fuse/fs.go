@@ -23,6 +23,22 @@ var commitHashPattern = regexp.MustCompile(`[0-9a-f]{40}`)
 type GitFS struct {
 	ServerAddr string
 	Client     fspb.GitReadFsClient
+	// Repo names the repo to mount; if empty, the server's default repo is
+	// used.
+	Repo string
+	// View names a view of the repo, configured on the server, that the
+	// files of commits are read through; if empty, they are read as they are.
+	View string
+	// Tracer, if set, records every GetAttr, OpenDir, Readlink and Open.
+	Tracer *Tracer
+	// Times chooses the times given to the files of commits. Directories
+	// that the mount makes up, such as commits itself, have the time it was
+	// mounted.
+	Times FileTimes
+	// Cache, if set, keeps the attributes and listings of paths in commits.
+	Cache *MetadataCache
+
+	mounted time.Time
 }
 
 func (f *GitFS) String() string {
@@ -36,6 +52,7 @@ func (f *GitFS) SetDebug(debug bool) {
 func (f *GitFS) GetAttr(name string, ctx *gofuse.Context) (ret *gofuse.Attr, status gofuse.Status) {
 	glog.V(1).Infof("GetAttr(name=%q) called", name)
 	defer func() {
+		f.Tracer.record("GetAttr", name, status, ctx)
 		if status != gofuse.OK {
 			glog.Errorf("GetAttr(name=%q) failed: %v", name, status)
 		}
@@ -45,35 +62,17 @@ func (f *GitFS) GetAttr(name string, ctx *gofuse.Context) (ret *gofuse.Attr, sta
 	// Simulate top-level dirs
 	switch {
 	case len(path) == 0:
-		return &gofuse.Attr{
-			Mode: syscall.S_IFDIR,
-		}, gofuse.OK
+		return f.syntheticAttr(syscall.S_IFDIR | 0o555), gofuse.OK
 	case len(path) == 1 && path[0] == "commits":
-		return &gofuse.Attr{
-			Mode: syscall.S_IFDIR,
-		}, gofuse.OK
+		return f.syntheticAttr(syscall.S_IFDIR | 0o555), gofuse.OK
 	case len(path) == 1 && path[0] == "branches":
-		return &gofuse.Attr{
-			Mode: syscall.S_IFDIR,
-		}, gofuse.OK
-	case len(path) == 2 && path[0] == "commits":
-		// The right thing to do here is to query and see which paths are
-		// present, to avoid optimistically returning directories where none
-		// exist. This is important because GetAttr is called when programs are
-		// checking for file existence of files that don't necessarily exist.
-		//
-		// For now, just make sure path[1] looks like a commit hash; it's
-		// unlikely that false positives will be reported since that means that
-		// programs are checking for the existence of fabricated hashes.
-		if !commitHashPattern.MatchString(path[1]) {
-			return nil, gofuse.ENOENT
-		}
-		return &gofuse.Attr{
-			Mode: syscall.S_IFDIR,
-		}, gofuse.OK
+		return f.syntheticAttr(syscall.S_IFDIR | 0o555), gofuse.OK
+	case len(path) == 2 && path[0] == "commits" && !commitHashPattern.MatchString(path[1]):
+		// Don't ask the server about names that can't be commits.
+		return nil, gofuse.ENOENT
 	case len(path) == 2 && path[0] == "branches":
 		// Get the list of branches
-		res, err := f.Client.ListBranches(context.TODO(), &fspb.ListBranchesRequest{})
+		res, err := f.Client.ListBranches(context.TODO(), &fspb.ListBranchesRequest{Repo: f.Repo})
 		if err != nil {
 			glog.Errorf("GetAttributes(Path=%q) returned error: %v", name, err)
 			return nil, errnoFromCode(grpcstat.Convert(err))
@@ -84,33 +83,53 @@ func (f *GitFS) GetAttr(name string, ctx *gofuse.Context) (ret *gofuse.Attr, sta
 			return nil, gofuse.ENOENT
 		}
 		// Return a symlink to the branch's commit
-		return &gofuse.Attr{
-			Mode: syscall.S_IFLNK,
-		}, gofuse.OK
+		return f.syntheticAttr(syscall.S_IFLNK | 0o777), gofuse.OK
 	case len(path) >= 2 && path[0] == "commits":
-		// Assume path[1] is the commit hash
+		// Assume path[1] is the commit hash. The commit's own directory is
+		// its root, which has the commit's time like everything in it.
 		var filePath string
 		if len(path) == 2 {
 			filePath = "/"
 		} else {
 			filePath = "/" + strings.Join(path[2:], "/")
 		}
-		res, err := f.Client.GetAttributes(context.TODO(), &fspb.GetAttributesRequest{
-			Commit: path[1],
-			Path:   filePath,
-		})
+		res, err := f.getAttributes(context.TODO(), path[1], filePath)
 		if err != nil {
 			glog.Errorf("GetAttributes(Commit=%q, Path=%q) returned error: %v", path[1], filePath, err)
 			return nil, errnoFromCode(grpcstat.Convert(err))
 		}
-		return &gofuse.Attr{
-			Mode: toSyscallMode(res.Mode),
-			Size: res.SizeBytes,
-		}, gofuse.OK
+		return f.commitAttr(res), gofuse.OK
 	}
 	return nil, gofuse.ENOENT
 }
 
+// commitAttr returns the attributes of a file or directory in a commit.
+func (f *GitFS) commitAttr(res *fspb.GetAttributesResponse) *gofuse.Attr {
+	attr := &gofuse.Attr{
+		Mode: toSyscallMode(res.Mode),
+		Size: res.SizeBytes,
+	}
+	setSizes(attr)
+	switch {
+	case f.Times == CommitTimes && res.CommitTime != nil:
+		setTime(attr, res.CommitTime.AsTime())
+	case f.Times == AuthorTimes && res.AuthorTime != nil:
+		setTime(attr, res.AuthorTime.AsTime())
+	}
+	return attr
+}
+
+// syntheticAttr returns the attributes of a directory or symlink that the
+// mount makes up.
+func (f *GitFS) syntheticAttr(mode uint32) *gofuse.Attr {
+	attr := &gofuse.Attr{Mode: mode}
+	setSizes(attr)
+	if f.Times != ZeroTimes {
+		setTime(attr, f.mounted)
+	}
+	return attr
+}
+
 func (f *GitFS) Chmod(name string, mode uint32, ctx *gofuse.Context) gofuse.Status {
 	return gofuse.EROFS
 }
@@ -196,6 +215,7 @@ func (f *GitFS) SetXAttr(name string, attr string, data []byte, flags int, ctx *
 
 func (f *GitFS) OnMount(nodeFs *pathfs.PathNodeFs) {
 	glog.V(1).Infof("OnMount() called")
+	f.mounted = time.Now()
 }
 
 func (f *GitFS) OnUnmount() {
@@ -205,6 +225,7 @@ func (f *GitFS) OnUnmount() {
 func (f *GitFS) Open(name string, flags uint32, ctx *gofuse.Context) (file nodefs.File, status gofuse.Status) {
 	glog.V(1).Infof("Open(name=%q, flags=%#x) called", name, flags)
 	defer func() {
+		f.Tracer.record("Open", name, status, ctx)
 		if status != gofuse.OK {
 			glog.Errorf("Open(name=%q, flags=%#x) failed: %v", name, flags, status)
 		}
@@ -222,6 +243,8 @@ func (f *GitFS) Open(name string, flags uint32, ctx *gofuse.Context) (file nodef
 	}
 
 	res, err := f.Client.GetFile(context.TODO(), &fspb.GetFileRequest{
+		Repo:   f.Repo,
+		View:   f.View,
 		Commit: path[1],
 		Path:   strings.Join(path[2:], "/"),
 	})
@@ -239,6 +262,7 @@ func (f *GitFS) Create(name string, flags uint32, mode uint32, ctx *gofuse.Conte
 func (f *GitFS) OpenDir(name string, ctx *gofuse.Context) (dirs []gofuse.DirEntry, status gofuse.Status) {
 	glog.V(1).Infof("OpenDir(name=%q) called", name)
 	defer func() {
+		f.Tracer.record("OpenDir", name, status, ctx)
 		if status != gofuse.OK {
 			glog.Errorf("OpenDir(name=%q) failed: %v", name, status)
 		}
@@ -259,7 +283,7 @@ func (f *GitFS) OpenDir(name string, ctx *gofuse.Context) (dirs []gofuse.DirEntr
 			},
 		}, gofuse.OK
 	case len(path) == 1 && path[0] == "commits":
-		res, err := f.Client.ListCommits(context.TODO(), &fspb.ListCommitsRequest{})
+		res, err := f.Client.ListCommits(context.TODO(), &fspb.ListCommitsRequest{Repo: f.Repo, View: f.View})
 		if err != nil {
 			glog.Errorf("ListCommits() returned error: %v", err)
 			return nil, gofuse.EIO
@@ -272,7 +296,7 @@ func (f *GitFS) OpenDir(name string, ctx *gofuse.Context) (dirs []gofuse.DirEntr
 		}
 		return dirs, gofuse.OK
 	case len(path) == 1 && path[0] == "branches":
-		res, err := f.Client.ListBranches(context.TODO(), &fspb.ListBranchesRequest{})
+		res, err := f.Client.ListBranches(context.TODO(), &fspb.ListBranchesRequest{Repo: f.Repo})
 		if err != nil {
 			glog.Errorf("OpenDir(Path=%q) returned error: %v", name, err)
 			return nil, errnoFromCode(grpcstat.Convert(err))
@@ -292,15 +316,12 @@ func (f *GitFS) OpenDir(name string, ctx *gofuse.Context) (dirs []gofuse.DirEntr
 		} else {
 			filePath = "/" + strings.Join(path[2:], "/")
 		}
-		res, err := f.Client.ListDir(context.TODO(), &fspb.ListDirRequest{
-			Commit: path[1],
-			Path:   filePath,
-		})
+		entries, err := f.listDir(context.TODO(), path[1], filePath)
 		if err != nil {
 			glog.Errorf("ListDir(Commit=%q, Path=%q) returned error: %v", path[1], filePath, err)
 			return nil, gofuse.EIO
 		}
-		for _, entry := range res.Entries {
+		for _, entry := range entries {
 			dirs = append(dirs, gofuse.DirEntry{
 				Name: entry.Name,
 				Mode: toSyscallMode(entry.Mode),
@@ -320,6 +341,7 @@ func (f *GitFS) Readlink(name string, ctx *gofuse.Context) (link string, status
 	// TODO: implement
 	glog.V(1).Infof("Readlink(name=%q) called", name)
 	defer func() {
+		f.Tracer.record("Readlink", name, status, ctx)
 		if status != gofuse.OK {
 			glog.Errorf("Readlink(name=%q) failed: %v", name, status)
 		}
@@ -329,7 +351,7 @@ func (f *GitFS) Readlink(name string, ctx *gofuse.Context) (link string, status
 
 	switch {
 	case len(path) == 2 && path[0] == "branches":
-		res, err := f.Client.ListBranches(context.TODO(), &fspb.ListBranchesRequest{})
+		res, err := f.Client.ListBranches(context.TODO(), &fspb.ListBranchesRequest{Repo: f.Repo})
 		if err != nil {
 			glog.Errorf("Readlink(Path=%q) returned error: %v", name, err)
 			return "", errnoFromCode(grpcstat.Convert(err))
@@ -0,0 +1,172 @@
+package fuse
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	fspb "github.com/minorhacks/funhouse/proto/git_read_fs_proto"
+
+	"github.com/google/go-cmp/cmp"
+	gofuse "github.com/hanwen/go-fuse/fuse"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const testCommit = "0802d5e6cee084a8f867c5406e46a3fca556bf4e"
+
+// fakeClient serves the attributes and listings of the commits in files,
+// keyed by commit and then by path, counting the calls made to it.
+type fakeClient struct {
+	fspb.GitReadFsClient
+
+	mu sync.Mutex
+	// files can be changed under mu, e.g. to fetch a commit.
+	files map[string]map[string]*fspb.GetAttributesResponse
+	calls map[string]int
+}
+
+func newFakeClient(files map[string]map[string]*fspb.GetAttributesResponse) *fakeClient {
+	return &fakeClient{files: files, calls: map[string]int{}}
+}
+
+// lookup returns the attributes of p in commit, counting a call to rpc.
+func (c *fakeClient) lookup(rpc string, commit string, p string) (*fspb.GetAttributesResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls[rpc]++
+	files, ok := c.files[commit]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "commit %q not found", commit)
+	}
+	res, ok := files[p]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "%q not found at commit %q", p, commit)
+	}
+	return res, nil
+}
+
+func (c *fakeClient) GetAttributes(ctx context.Context, req *fspb.GetAttributesRequest, opts ...grpc.CallOption) (*fspb.GetAttributesResponse, error) {
+	return c.lookup("GetAttributes", req.Commit, req.Path)
+}
+
+func (c *fakeClient) ListDir(ctx context.Context, req *fspb.ListDirRequest, opts ...grpc.CallOption) (*fspb.ListDirResponse, error) {
+	res, err := c.lookup("ListDir", req.Commit, req.Path)
+	if err != nil {
+		return nil, err
+	}
+	if res.Mode != fspb.FileMode_MODE_DIR {
+		return nil, status.Errorf(codes.FailedPrecondition, "%q isn't a directory", req.Path)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dir := strings.TrimSuffix(req.Path, "/") + "/"
+	var entries []*fspb.DirEntry
+	for p, attrs := range c.files[req.Commit] {
+		if p != "/" && strings.HasPrefix(p, dir) && !strings.Contains(p[len(dir):], "/") {
+			entries = append(entries, &fspb.DirEntry{Name: p[len(dir):], Mode: attrs.Mode})
+		}
+	}
+	return &fspb.ListDirResponse{Entries: entries}, nil
+}
+
+// callCount returns the number of calls made to rpc.
+func (c *fakeClient) callCount(rpc string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.calls[rpc]
+}
+
+var (
+	testAuthorTime = time.Date(2021, 9, 18, 12, 0, 0, 0, time.UTC)
+	testCommitTime = time.Date(2021, 9, 19, 8, 30, 0, 0, time.UTC)
+)
+
+// testAttrs returns the attributes of a file or directory of testCommit.
+func testAttrs(mode fspb.FileMode, size uint64) *fspb.GetAttributesResponse {
+	return &fspb.GetAttributesResponse{
+		Mode:       mode,
+		SizeBytes:  size,
+		AuthorTime: timestamppb.New(testAuthorTime),
+		CommitTime: timestamppb.New(testCommitTime),
+	}
+}
+
+func TestCommitAttr(t *testing.T) {
+	testCases := []struct {
+		desc  string
+		times FileTimes
+		res   *fspb.GetAttributesResponse
+		want  *gofuse.Attr
+	}{
+		{
+			desc:  "file with commit times",
+			times: CommitTimes,
+			res:   testAttrs(fspb.FileMode_MODE_REGULAR, 1000),
+			want:  withTime(&gofuse.Attr{Mode: syscall.S_IFREG | 0o444, Size: 1000, Blocks: 2, Blksize: blockSize, Nlink: 1}, testCommitTime),
+		},
+		{
+			desc:  "executable with author times",
+			times: AuthorTimes,
+			res:   testAttrs(fspb.FileMode_MODE_EXECUTABLE, 512),
+			want:  withTime(&gofuse.Attr{Mode: syscall.S_IFREG | 0o555, Size: 512, Blocks: 1, Blksize: blockSize, Nlink: 1}, testAuthorTime),
+		},
+		{
+			desc:  "directory with zero times",
+			times: ZeroTimes,
+			res:   testAttrs(fspb.FileMode_MODE_DIR, 0),
+			want:  &gofuse.Attr{Mode: syscall.S_IFDIR | 0o555, Blksize: blockSize, Nlink: 2},
+		},
+		{
+			desc:  "commit times missing from the server",
+			times: CommitTimes,
+			res:   &fspb.GetAttributesResponse{Mode: fspb.FileMode_MODE_SYMLINK, SizeBytes: 10},
+			want:  &gofuse.Attr{Mode: syscall.S_IFLNK | 0o555, Size: 10, Blocks: 1, Blksize: blockSize, Nlink: 1},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			f := &GitFS{Times: tc.times}
+			if diff := cmp.Diff(tc.want, f.commitAttr(tc.res)); diff != "" {
+				t.Errorf("commitAttr() returned diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func withTime(attr *gofuse.Attr, t time.Time) *gofuse.Attr {
+	attr.SetTimes(&t, &t, &t)
+	return attr
+}
+
+func TestGetAttrCommitDir(t *testing.T) {
+	client := newFakeClient(map[string]map[string]*fspb.GetAttributesResponse{
+		testCommit: {"/": testAttrs(fspb.FileMode_MODE_DIR, 0)},
+	})
+	f := &GitFS{Client: client}
+
+	attr, st := f.GetAttr("commits/"+testCommit, nil)
+	if st != gofuse.OK {
+		t.Fatalf("GetAttr() of commit got status %v; want OK", st)
+	}
+	want := withTime(&gofuse.Attr{Mode: syscall.S_IFDIR | 0o555, Blksize: blockSize, Nlink: 2}, testCommitTime)
+	if diff := cmp.Diff(want, attr); diff != "" {
+		t.Errorf("GetAttr() of commit returned diff (-want +got):\n%s", diff)
+	}
+
+	if _, st := f.GetAttr("commits/"+strings.Repeat("f", 40), nil); st != gofuse.ENOENT {
+		t.Errorf("GetAttr() of unknown commit got status %v; want %v", st, gofuse.ENOENT)
+	}
+	calls := client.callCount("GetAttributes")
+	if _, st := f.GetAttr("commits/HEAD", nil); st != gofuse.ENOENT {
+		t.Errorf("GetAttr() of non-hash got status %v; want %v", st, gofuse.ENOENT)
+	}
+	if got := client.callCount("GetAttributes"); got != calls {
+		t.Errorf("GetAttr() of non-hash made %d GetAttributes calls; want none", got-calls)
+	}
+}
@@ -0,0 +1,179 @@
+package fuse
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	gofuse "github.com/hanwen/go-fuse/fuse"
+)
+
+// Access is a filesystem operation recorded by a Tracer.
+type Access struct {
+	Time time.Time `json:"time"`
+	// Op is the GitFS method that served the access: GetAttr, OpenDir,
+	// Readlink or Open.
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	// Status is the operation's result, e.g. "OK" or "2=no such file or
+	// directory".
+	Status string `json:"status"`
+	// PID is the process that made the access.
+	PID uint32 `json:"pid"`
+}
+
+// Manifest lists the paths in a commit's tree that were accessed, so that a
+// build's inputs can be checked or listed.
+type Manifest struct {
+	Commit string `json:"commit"`
+	// Paths were found, in the order of their names. Directories are
+	// included, as listing one makes a build depend on what is in it.
+	Paths []ManifestPath `json:"paths"`
+	// Missing were looked up but don't exist, which also makes a build
+	// depend on them.
+	Missing []string `json:"missing"`
+}
+
+// ManifestPath is a path in a Manifest, and how it was accessed.
+type ManifestPath struct {
+	Path string   `json:"path"`
+	Ops  []string `json:"ops"`
+}
+
+// Tracer records the accesses made to a GitFS. It is safe for concurrent use.
+type Tracer struct {
+	mu sync.Mutex
+	// log, if not nil, is written an Access as a JSON line for every access.
+	log io.Writer
+	// commits holds the accesses to each commit's tree, keyed by commit and
+	// then by path within it.
+	commits map[string]map[string]*pathAccesses
+}
+
+// pathAccesses records how a path in a commit was accessed.
+type pathAccesses struct {
+	ops     map[string]bool
+	found   bool
+	missing bool
+}
+
+// NewTracer returns a Tracer that writes every access to log, if it isn't
+// nil, and keeps the accesses to each commit for manifests.
+func NewTracer(log io.Writer) *Tracer {
+	return &Tracer{log: log, commits: map[string]map[string]*pathAccesses{}}
+}
+
+// record records an access to the file or directory at name in the mount.
+func (t *Tracer) record(op string, name string, status gofuse.Status, ctx *gofuse.Context) {
+	if t == nil {
+		return
+	}
+	a := Access{Time: time.Now(), Op: op, Path: "/" + strings.TrimPrefix(name, "/"), Status: status.String()}
+	if ctx != nil {
+		a.PID = ctx.Pid
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.log != nil {
+		line, err := json.Marshal(a)
+		if err == nil {
+			_, err = t.log.Write(append(line, '\n'))
+		}
+		if err != nil {
+			glog.Errorf("Failed to write access to trace log: %v", err)
+		}
+	}
+
+	path := strings.FieldsFunc(name, func(c rune) bool { return c == '/' })
+	if len(path) < 2 || path[0] != "commits" || !commitHashPattern.MatchString(path[1]) {
+		return
+	}
+	accesses, ok := t.commits[path[1]]
+	if !ok {
+		accesses = map[string]*pathAccesses{}
+		t.commits[path[1]] = accesses
+	}
+	p := "/" + strings.Join(path[2:], "/")
+	pa, ok := accesses[p]
+	if !ok {
+		pa = &pathAccesses{ops: map[string]bool{}}
+		accesses[p] = pa
+	}
+	pa.ops[op] = true
+	switch status {
+	case gofuse.OK:
+		pa.found = true
+	case gofuse.ENOENT:
+		pa.missing = true
+	}
+}
+
+// Manifests returns a manifest of each commit whose tree was accessed, in the
+// order of their hashes.
+func (t *Tracer) Manifests() []*Manifest {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var manifests []*Manifest
+	for commit, accesses := range t.commits {
+		m := &Manifest{Commit: commit, Paths: []ManifestPath{}, Missing: []string{}}
+		for p, pa := range accesses {
+			if pa.found {
+				var ops []string
+				for op := range pa.ops {
+					ops = append(ops, op)
+				}
+				sort.Strings(ops)
+				m.Paths = append(m.Paths, ManifestPath{Path: p, Ops: ops})
+			} else if pa.missing {
+				m.Missing = append(m.Missing, p)
+			}
+		}
+		sort.Slice(m.Paths, func(i, j int) bool { return m.Paths[i].Path < m.Paths[j].Path })
+		sort.Strings(m.Missing)
+		manifests = append(manifests, m)
+	}
+	sort.Slice(manifests, func(i, j int) bool { return manifests[i].Commit < manifests[j].Commit })
+	return manifests
+}
+
+// WriteManifests writes each commit's manifest to <commit>.json in dir,
+// replacing any manifest written before, so that it can be called whenever a
+// caller wants an up-to-date set.
+func (t *Tracer) WriteManifests(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create manifest dir: %v", err)
+	}
+	for _, m := range t.Manifests() {
+		contents, err := json.MarshalIndent(m, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to encode manifest of commit %q: %v", m.Commit, err)
+		}
+		// Manifests are written to a temporary file and renamed so that
+		// readers never see half of one.
+		tmp, err := ioutil.TempFile(dir, m.Commit+".*.tmp")
+		if err != nil {
+			return fmt.Errorf("failed to write manifest of commit %q: %v", m.Commit, err)
+		}
+		_, err = tmp.Write(append(contents, '\n'))
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), filepath.Join(dir, m.Commit+".json"))
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+			return fmt.Errorf("failed to write manifest of commit %q: %v", m.Commit, err)
+		}
+	}
+	return nil
+}
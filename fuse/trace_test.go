@@ -0,0 +1,207 @@
+package fuse
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	gofuse "github.com/hanwen/go-fuse/fuse"
+)
+
+const (
+	traceCommitA = "0802d5e6cee084a8f867c5406e46a3fca556bf4e"
+	traceCommitB = "1f0c7e5b4c2d8e3a9b6f7a0d1e2c3b4a5f6e7d8c"
+)
+
+type traceAccess struct {
+	op     string
+	name   string
+	status gofuse.Status
+}
+
+func TestTracerManifests(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		accesses []traceAccess
+		want     []*Manifest
+	}{
+		{
+			desc: "found paths are listed once with their ops in order",
+			accesses: []traceAccess{
+				{op: "Open", name: "commits/" + traceCommitA + "/src/main.go", status: gofuse.OK},
+				{op: "GetAttr", name: "commits/" + traceCommitA + "/src/main.go", status: gofuse.OK},
+				{op: "GetAttr", name: "commits/" + traceCommitA + "/src/main.go", status: gofuse.OK},
+				{op: "OpenDir", name: "commits/" + traceCommitA + "/src", status: gofuse.OK},
+				{op: "OpenDir", name: "commits/" + traceCommitA, status: gofuse.OK},
+			},
+			want: []*Manifest{{
+				Commit: traceCommitA,
+				Paths: []ManifestPath{
+					{Path: "/", Ops: []string{"OpenDir"}},
+					{Path: "/src", Ops: []string{"OpenDir"}},
+					{Path: "/src/main.go", Ops: []string{"GetAttr", "Open"}},
+				},
+				Missing: []string{},
+			}},
+		},
+		{
+			desc: "missing paths are listed apart from found ones",
+			accesses: []traceAccess{
+				{op: "GetAttr", name: "commits/" + traceCommitA + "/go.work", status: gofuse.ENOENT},
+				{op: "GetAttr", name: "commits/" + traceCommitA + "/BUILD", status: gofuse.ENOENT},
+				{op: "GetAttr", name: "commits/" + traceCommitA + "/BUILD", status: gofuse.ENOENT},
+				{op: "GetAttr", name: "commits/" + traceCommitA + "/go.mod", status: gofuse.OK},
+			},
+			want: []*Manifest{{
+				Commit:  traceCommitA,
+				Paths:   []ManifestPath{{Path: "/go.mod", Ops: []string{"GetAttr"}}},
+				Missing: []string{"/BUILD", "/go.work"},
+			}},
+		},
+		{
+			desc: "a path found after it was missing is found",
+			accesses: []traceAccess{
+				{op: "GetAttr", name: "commits/" + traceCommitA + "/README.md", status: gofuse.ENOENT},
+				{op: "Open", name: "commits/" + traceCommitA + "/README.md", status: gofuse.OK},
+			},
+			want: []*Manifest{{
+				Commit:  traceCommitA,
+				Paths:   []ManifestPath{{Path: "/README.md", Ops: []string{"GetAttr", "Open"}}},
+				Missing: []string{},
+			}},
+		},
+		{
+			desc: "paths that failed otherwise are left out",
+			accesses: []traceAccess{
+				{op: "Open", name: "commits/" + traceCommitA + "/README.md", status: gofuse.EIO},
+			},
+			want: []*Manifest{{Commit: traceCommitA, Paths: []ManifestPath{}, Missing: []string{}}},
+		},
+		{
+			desc: "commits are in the order of their hashes",
+			accesses: []traceAccess{
+				{op: "Open", name: "commits/" + traceCommitB + "/b.txt", status: gofuse.OK},
+				{op: "Open", name: "commits/" + traceCommitA + "/a.txt", status: gofuse.OK},
+			},
+			want: []*Manifest{
+				{Commit: traceCommitA, Paths: []ManifestPath{{Path: "/a.txt", Ops: []string{"Open"}}}, Missing: []string{}},
+				{Commit: traceCommitB, Paths: []ManifestPath{{Path: "/b.txt", Ops: []string{"Open"}}}, Missing: []string{}},
+			},
+		},
+		{
+			desc: "paths outside commits are left out",
+			accesses: []traceAccess{
+				{op: "GetAttr", name: "", status: gofuse.OK},
+				{op: "OpenDir", name: "commits", status: gofuse.OK},
+				{op: "Readlink", name: "branches/master", status: gofuse.OK},
+				{op: "GetAttr", name: "commits/0802d5e", status: gofuse.ENOENT},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			tracer := NewTracer(nil)
+			for _, a := range tc.accesses {
+				tracer.record(a.op, a.name, a.status, nil)
+			}
+			if diff := cmp.Diff(tc.want, tracer.Manifests()); diff != "" {
+				t.Errorf("Manifests() returned diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestTracerLog(t *testing.T) {
+	var log bytes.Buffer
+	tracer := NewTracer(&log)
+	tracer.record("GetAttr", "commits/"+traceCommitA+"/go.mod", gofuse.OK, &gofuse.Context{Pid: 42})
+	tracer.record("GetAttr", "branches/master", gofuse.ENOENT, nil)
+
+	var got []Access
+	for _, line := range strings.Split(strings.TrimSuffix(log.String(), "\n"), "\n") {
+		var a Access
+		if err := json.Unmarshal([]byte(line), &a); err != nil {
+			t.Fatalf("trace log line %q isn't an Access: %v", line, err)
+		}
+		got = append(got, a)
+	}
+	want := []Access{
+		{Op: "GetAttr", Path: "/commits/" + traceCommitA + "/go.mod", Status: gofuse.OK.String(), PID: 42},
+		{Op: "GetAttr", Path: "/branches/master", Status: gofuse.ENOENT.String()},
+	}
+	if diff := cmp.Diff(want, got, cmp.Comparer(func(a, b Access) bool {
+		return a.Op == b.Op && a.Path == b.Path && a.Status == b.Status && a.PID == b.PID
+	})); diff != "" {
+		t.Errorf("trace log returned diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestWriteManifests(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "manifests")
+	tracer := NewTracer(nil)
+	tracer.record("Open", "commits/"+traceCommitA+"/a.txt", gofuse.OK, nil)
+	if err := tracer.WriteManifests(dir); err != nil {
+		t.Fatalf("WriteManifests() got error %v; want no error", err)
+	}
+	// A later call replaces the manifest with an up-to-date one.
+	tracer.record("Open", "commits/"+traceCommitA+"/b.txt", gofuse.OK, nil)
+	if err := tracer.WriteManifests(dir); err != nil {
+		t.Fatalf("WriteManifests() got error %v; want no error", err)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir() got error %v; want no error", err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	if diff := cmp.Diff([]string{traceCommitA + ".json"}, names); diff != "" {
+		t.Errorf("manifest dir returned diff (-want +got):\n%s", diff)
+	}
+	contents, err := ioutil.ReadFile(filepath.Join(dir, traceCommitA+".json"))
+	if err != nil {
+		t.Fatalf("ReadFile() got error %v; want no error", err)
+	}
+	var got Manifest
+	if err := json.Unmarshal(contents, &got); err != nil {
+		t.Fatalf("manifest %q isn't a Manifest: %v", contents, err)
+	}
+	want := Manifest{
+		Commit: traceCommitA,
+		Paths: []ManifestPath{
+			{Path: "/a.txt", Ops: []string{"Open"}},
+			{Path: "/b.txt", Ops: []string{"Open"}},
+		},
+		Missing: []string{},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("manifest returned diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestWriteManifestsCleansUpOnError(t *testing.T) {
+	dir := t.TempDir()
+	// A manifest can't replace a directory that isn't empty.
+	if err := os.MkdirAll(filepath.Join(dir, traceCommitA+".json", "x"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	tracer := NewTracer(nil)
+	tracer.record("Open", "commits/"+traceCommitA+"/a.txt", gofuse.OK, nil)
+	if err := tracer.WriteManifests(dir); err == nil {
+		t.Errorf("WriteManifests() got no error; want error")
+	}
+	tmps, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tmps) > 0 {
+		t.Errorf("WriteManifests() left temporary files %v; want none", tmps)
+	}
+}
@@ -3,8 +3,11 @@ package fuse
 import (
 	"fmt"
 	"syscall"
+	"time"
 
 	fspb "github.com/minorhacks/funhouse/proto/git_read_fs_proto"
+
+	gofuse "github.com/hanwen/go-fuse/fuse"
 )
 
 func toSyscallMode(m fspb.FileMode) uint32 {
@@ -21,3 +24,52 @@ func toSyscallMode(m fspb.FileMode) uint32 {
 		panic(fmt.Sprintf("Unhandled filemode: %v", m))
 	}
 }
+
+// FileTimes chooses which of a commit's times the files in it are given as
+// their mtime, ctime and atime.
+type FileTimes int
+
+const (
+	// CommitTimes gives files the commit's committer time.
+	CommitTimes FileTimes = iota
+	// AuthorTimes gives files the commit's author time.
+	AuthorTimes
+	// ZeroTimes gives files the Unix epoch, as the mount once did.
+	ZeroTimes
+)
+
+// ParseFileTimes parses "commit", "author" or "zero" as FileTimes.
+func ParseFileTimes(s string) (FileTimes, error) {
+	switch s {
+	case "commit":
+		return CommitTimes, nil
+	case "author":
+		return AuthorTimes, nil
+	case "zero":
+		return ZeroTimes, nil
+	}
+	return 0, fmt.Errorf("unknown file times %q; want commit, author or zero", s)
+}
+
+// blockSize is the preferred I/O size reported for every file.
+const blockSize = 4096
+
+// setSizes fills in the attribute fields that follow from the mode and size.
+func setSizes(attr *gofuse.Attr) {
+	attr.Nlink = 1
+	if attr.IsDir() {
+		// Subdirectories aren't counted, which tools such as find accept
+		// for filesystems that can't cheaply count them.
+		attr.Nlink = 2
+	}
+	attr.Blksize = blockSize
+	attr.Blocks = (attr.Size + 511) / 512
+}
+
+// setTime sets the mtime, ctime and atime of attr to t, unless t is zero.
+func setTime(attr *gofuse.Attr, t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	attr.SetTimes(&t, &t, &t)
+}
@@ -0,0 +1,52 @@
+package fuse
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	gofuse "github.com/hanwen/go-fuse/fuse"
+)
+
+func TestSetSizes(t *testing.T) {
+	testCases := []struct {
+		desc string
+		attr gofuse.Attr
+		want gofuse.Attr
+	}{
+		{
+			desc: "empty file",
+			attr: gofuse.Attr{Mode: syscall.S_IFREG | 0o444},
+			want: gofuse.Attr{Mode: syscall.S_IFREG | 0o444, Nlink: 1, Blksize: blockSize},
+		},
+		{
+			desc: "file of exactly one block",
+			attr: gofuse.Attr{Mode: syscall.S_IFREG | 0o444, Size: 512},
+			want: gofuse.Attr{Mode: syscall.S_IFREG | 0o444, Size: 512, Nlink: 1, Blksize: blockSize, Blocks: 1},
+		},
+		{
+			desc: "file spilling into another block",
+			attr: gofuse.Attr{Mode: syscall.S_IFREG | 0o555, Size: 513},
+			want: gofuse.Attr{Mode: syscall.S_IFREG | 0o555, Size: 513, Nlink: 1, Blksize: blockSize, Blocks: 2},
+		},
+		{
+			desc: "directory",
+			attr: gofuse.Attr{Mode: syscall.S_IFDIR | 0o555},
+			want: gofuse.Attr{Mode: syscall.S_IFDIR | 0o555, Nlink: 2, Blksize: blockSize},
+		},
+		{
+			desc: "symlink",
+			attr: gofuse.Attr{Mode: syscall.S_IFLNK | 0o777, Size: 40},
+			want: gofuse.Attr{Mode: syscall.S_IFLNK | 0o777, Size: 40, Nlink: 1, Blksize: blockSize, Blocks: 1},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			attr := tc.attr
+			setSizes(&attr)
+			if diff := cmp.Diff(tc.want, attr); diff != "" {
+				t.Errorf("setSizes() returned diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,327 @@
+// Package gateway serves the GitReadFs API as JSON over HTTP, for scripts and
+// browsers that can't easily make gRPC calls.
+//
+// Each RPC has a GET endpoint under /api/v1, and the optional repo field of
+// every request is given by the repo query parameter, as is the view of the
+// files at a commit by the view parameter. Responses are the RPC's
+// response message encoded with protojson, except that file contents are
+// served raw. Errors are JSON objects with the gRPC code and message, and an
+// HTTP status mapped from the code. The JSON schema of each endpoint's
+// response is served under /api/v1/schemas, and linked from its responses.
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	fspb "github.com/minorhacks/funhouse/proto/git_read_fs_proto"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// maxWatch is how long a branch watch streams before the client has to
+// reconnect. It is kept under the HTTP server's write timeout, and stops the
+// stream from holding up a graceful shutdown.
+const maxWatch = 10 * time.Second
+
+var marshalOptions = protojson.MarshalOptions{
+	UseProtoNames:   true,
+	EmitUnpopulated: true,
+}
+
+// Gateway translates HTTP requests into calls to a GitReadFs server.
+type Gateway struct {
+	server fspb.GitReadFsServer
+}
+
+// Register adds the gateway's endpoints for server to router.
+func Register(router *mux.Router, server fspb.GitReadFsServer) {
+	g := &Gateway{server: server}
+	for _, e := range endpoints {
+		router.HandleFunc(e.Path, g.handler(e)).Methods("GET")
+		// Paths can be left off to mean the root of the commit's tree.
+		if e.optionalPath {
+			router.HandleFunc(e.Path[:len(e.Path)-len("/{path:.*}")], g.handler(e)).Methods("GET")
+		}
+	}
+	router.HandleFunc("/api/v1/schemas", serveSchemaIndex).Methods("GET")
+	router.HandleFunc("/api/v1/schemas/{name}", serveSchema).Methods("GET")
+}
+
+func (g *Gateway) handler(e *endpoint) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"describedby\"", schemaPath(e.Name)))
+		e.serve(g.server, w, r)
+	}
+}
+
+// params holds the parts of a request that become RPC request fields.
+type params struct {
+	repo   string
+	view   string
+	commit string
+	path   string
+}
+
+func requestParams(r *http.Request) params {
+	vars := mux.Vars(r)
+	return params{
+		repo:   r.URL.Query().Get("repo"),
+		view:   r.URL.Query().Get("view"),
+		commit: vars["commit"],
+		path:   "/" + vars["path"],
+	}
+}
+
+// endpoint is the HTTP form of a GitReadFs RPC.
+type endpoint struct {
+	// Name identifies the endpoint's schema.
+	Name        string `json:"name"`
+	Path        string `json:"path"`
+	Description string `json:"description"`
+	// response is the RPC's response message, which describes the JSON
+	// response, or nil if the response is raw.
+	response proto.Message
+	// optionalPath is set if the path at the end of Path may be left off.
+	optionalPath bool
+	serve        func(server fspb.GitReadFsServer, w http.ResponseWriter, r *http.Request)
+}
+
+var endpoints = []*endpoint{
+	{
+		Name:        "list_branches",
+		Path:        "/api/v1/branches",
+		Description: "The repo's branches, mapped to the commit hash of each.",
+		response:    &fspb.ListBranchesResponse{},
+		serve: func(server fspb.GitReadFsServer, w http.ResponseWriter, r *http.Request) {
+			p := requestParams(r)
+			res, err := server.ListBranches(r.Context(), &fspb.ListBranchesRequest{Repo: p.repo})
+			writeResponse(w, res, err)
+		},
+	},
+	{
+		Name: "watch_branches",
+		Path: "/api/v1/branches/watch",
+		Description: "A stream of the repo's branches, as newline-delimited JSON objects: first as they are, and " +
+			"then each time they change. The stream ends after " + maxWatch.String() + ", after which the client should reconnect.",
+		response: &fspb.ListBranchesResponse{},
+		serve: func(server fspb.GitReadFsServer, w http.ResponseWriter, r *http.Request) {
+			p := requestParams(r)
+			ctx, cancel := context.WithTimeout(r.Context(), maxWatch)
+			defer cancel()
+			stream := &watchBranchesStream{ctx: ctx, w: w}
+			err := server.WatchBranches(&fspb.WatchBranchesRequest{Repo: p.repo}, stream)
+			if !stream.started {
+				// Nothing was sent, so the status code is still free to
+				// describe the error.
+				writeError(w, err)
+			}
+		},
+	},
+	{
+		Name:        "list_tags",
+		Path:        "/api/v1/tags",
+		Description: "The repo's tags, mapped to the hash of the commit each points to.",
+		response:    &fspb.ListTagsResponse{},
+		serve: func(server fspb.GitReadFsServer, w http.ResponseWriter, r *http.Request) {
+			p := requestParams(r)
+			res, err := server.ListTags(r.Context(), &fspb.ListTagsRequest{Repo: p.repo})
+			writeResponse(w, res, err)
+		},
+	},
+	{
+		Name:        "list_commits",
+		Path:        "/api/v1/commits",
+		Description: "The hashes of the commits reachable from the repo's branches.",
+		response:    &fspb.ListCommitsResponse{},
+		serve: func(server fspb.GitReadFsServer, w http.ResponseWriter, r *http.Request) {
+			p := requestParams(r)
+			res, err := server.ListCommits(r.Context(), &fspb.ListCommitsRequest{Repo: p.repo, View: p.view})
+			writeResponse(w, res, err)
+		},
+	},
+	{
+		Name: "get_commit",
+		Path: "/api/v1/commits/{commit}",
+		Description: "The author, committer, parents and message of a commit, and with ?diff=true the changes " +
+			"it made to its first parent.",
+		response: &fspb.GetCommitResponse{},
+		serve: func(server fspb.GitReadFsServer, w http.ResponseWriter, r *http.Request) {
+			p := requestParams(r)
+			res, err := server.GetCommit(r.Context(), &fspb.GetCommitRequest{
+				Repo:        p.repo,
+				Commit:      p.commit,
+				IncludeDiff: r.URL.Query().Get("diff") == "true",
+			})
+			writeResponse(w, res, err)
+		},
+	},
+	{
+		Name:         "list_dir",
+		Path:         "/api/v1/commits/{commit}/tree/{path:.*}",
+		Description:  "The entries of a directory at a commit.",
+		response:     &fspb.ListDirResponse{},
+		optionalPath: true,
+		serve: func(server fspb.GitReadFsServer, w http.ResponseWriter, r *http.Request) {
+			p := requestParams(r)
+			res, err := server.ListDir(r.Context(), &fspb.ListDirRequest{Repo: p.repo, View: p.view, Commit: p.commit, Path: p.path})
+			writeResponse(w, res, err)
+		},
+	},
+	{
+		Name:        "get_file",
+		Path:        "/api/v1/commits/{commit}/blob/{path:.+}",
+		Description: "The raw contents of a file at a commit.",
+		serve: func(server fspb.GitReadFsServer, w http.ResponseWriter, r *http.Request) {
+			p := requestParams(r)
+			res, err := server.GetFile(r.Context(), &fspb.GetFileRequest{Repo: p.repo, View: p.view, Commit: p.commit, Path: p.path})
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write(res.Contents)
+		},
+	},
+	{
+		Name:         "get_attributes",
+		Path:         "/api/v1/commits/{commit}/attributes/{path:.*}",
+		Description:  "The mode and size of a file or directory at a commit, and the times of the commit.",
+		response:     &fspb.GetAttributesResponse{},
+		optionalPath: true,
+		serve: func(server fspb.GitReadFsServer, w http.ResponseWriter, r *http.Request) {
+			p := requestParams(r)
+			res, err := server.GetAttributes(r.Context(), &fspb.GetAttributesRequest{Repo: p.repo, View: p.view, Commit: p.commit, Path: p.path})
+			writeResponse(w, res, err)
+		},
+	},
+	{
+		Name:        "list_repos",
+		Path:        "/api/v1/repos",
+		Description: "The names of the repos that the server mirrors, and which is the default.",
+		response:    &fspb.ListReposResponse{},
+		serve: func(server fspb.GitReadFsServer, w http.ResponseWriter, r *http.Request) {
+			res, err := server.ListRepos(r.Context(), &fspb.ListReposRequest{})
+			writeResponse(w, res, err)
+		},
+	},
+	{
+		Name:        "get_fetch_status",
+		Path:        "/api/v1/fetch_status",
+		Description: "The outcome of the server's recent fetches of the repo from origin.",
+		response:    &fspb.GetFetchStatusResponse{},
+		serve: func(server fspb.GitReadFsServer, w http.ResponseWriter, r *http.Request) {
+			p := requestParams(r)
+			res, err := server.GetFetchStatus(r.Context(), &fspb.GetFetchStatusRequest{Repo: p.repo})
+			writeResponse(w, res, err)
+		},
+	},
+}
+
+// watchBranchesStream sends WatchBranches responses to an HTTP client, one
+// JSON object per line.
+type watchBranchesStream struct {
+	grpc.ServerStream
+	ctx     context.Context
+	w       http.ResponseWriter
+	started bool
+}
+
+func (s *watchBranchesStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *watchBranchesStream) Send(res *fspb.ListBranchesResponse) error {
+	line, err := marshalOptions.Marshal(res)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to encode response: %v", err)
+	}
+	if !s.started {
+		s.w.Header().Set("Content-Type", "application/x-ndjson")
+		s.started = true
+	}
+	if _, err := s.w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// writeResponse writes res as JSON, or err if it isn't nil.
+func writeResponse(w http.ResponseWriter, res proto.Message, err error) {
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	body, err := marshalOptions.Marshal(res)
+	if err != nil {
+		writeError(w, status.Errorf(codes.Internal, "failed to encode response: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(body, '\n'))
+}
+
+// writeError writes a gRPC status error as a JSON object, with the HTTP status
+// that best matches its code.
+func writeError(w http.ResponseWriter, err error) {
+	st := status.Convert(err)
+	code := HTTPStatus(st.Code())
+	if code >= http.StatusInternalServerError {
+		glog.Errorf("Gateway: %v", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(errorResponse{Code: st.Code().String(), Message: st.Message()}); err != nil {
+		glog.Errorf("Gateway: failed to write error response: %v", err)
+	}
+}
+
+// errorResponse is the body of an error response.
+type errorResponse struct {
+	// Code is the name of the gRPC code, such as "NotFound".
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// HTTPStatus maps a gRPC code to an HTTP status, as grpc-gateway does.
+func HTTPStatus(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		// nginx's "client closed request".
+		return 499
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
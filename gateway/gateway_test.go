@@ -0,0 +1,394 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	fspb "github.com/minorhacks/funhouse/proto/git_read_fs_proto"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const commitA = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+
+// fakeServer serves a repo named "repo", holding a single commit with a
+// README.md file and an empty src directory.
+type fakeServer struct{}
+
+func checkRepo(repo string) error {
+	switch repo {
+	case "repo":
+		return nil
+	case "down":
+		return status.Errorf(codes.Unavailable, "repo %q is still cloning", repo)
+	default:
+		return status.Errorf(codes.NotFound, "repo %q not found", repo)
+	}
+}
+
+func checkPath(commit string, path string) error {
+	if commit != commitA {
+		return status.Errorf(codes.NotFound, "commit %q not found", commit)
+	}
+	switch path {
+	case "/", "/README.md", "/src":
+		return nil
+	default:
+		return status.Errorf(codes.NotFound, "path %q not found", path)
+	}
+}
+
+func (fakeServer) GetFile(ctx context.Context, req *fspb.GetFileRequest) (*fspb.GetFileResponse, error) {
+	if err := checkRepo(req.Repo); err != nil {
+		return nil, err
+	}
+	if err := checkPath(req.Commit, req.Path); err != nil {
+		return nil, err
+	}
+	if req.Path != "/README.md" {
+		return nil, status.Errorf(codes.InvalidArgument, "path %q is a directory", req.Path)
+	}
+	return &fspb.GetFileResponse{Contents: []byte("\x00hello\n")}, nil
+}
+
+func (fakeServer) GetAttributes(ctx context.Context, req *fspb.GetAttributesRequest) (*fspb.GetAttributesResponse, error) {
+	if err := checkRepo(req.Repo); err != nil {
+		return nil, err
+	}
+	if err := checkPath(req.Commit, req.Path); err != nil {
+		return nil, err
+	}
+	if req.Path == "/README.md" {
+		return &fspb.GetAttributesResponse{Mode: fspb.FileMode_MODE_REGULAR, SizeBytes: 7}, nil
+	}
+	return &fspb.GetAttributesResponse{Mode: fspb.FileMode_MODE_DIR}, nil
+}
+
+func (fakeServer) ListCommits(ctx context.Context, req *fspb.ListCommitsRequest) (*fspb.ListCommitsResponse, error) {
+	if err := checkRepo(req.Repo); err != nil {
+		return nil, err
+	}
+	return &fspb.ListCommitsResponse{Commits: []string{commitA}}, nil
+}
+
+func (fakeServer) ListDir(ctx context.Context, req *fspb.ListDirRequest) (*fspb.ListDirResponse, error) {
+	if err := checkRepo(req.Repo); err != nil {
+		return nil, err
+	}
+	if err := checkPath(req.Commit, req.Path); err != nil {
+		return nil, err
+	}
+	if req.Path != "/" {
+		return &fspb.ListDirResponse{}, nil
+	}
+	// The docs view hides everything but the README.
+	if req.View == "docs" {
+		return &fspb.ListDirResponse{Entries: []*fspb.DirEntry{{Name: "README.md", Mode: fspb.FileMode_MODE_REGULAR}}}, nil
+	}
+	return &fspb.ListDirResponse{Entries: []*fspb.DirEntry{
+		{Name: "README.md", Mode: fspb.FileMode_MODE_REGULAR},
+		{Name: "src", Mode: fspb.FileMode_MODE_DIR},
+	}}, nil
+}
+
+func (fakeServer) ListBranches(ctx context.Context, req *fspb.ListBranchesRequest) (*fspb.ListBranchesResponse, error) {
+	if err := checkRepo(req.Repo); err != nil {
+		return nil, err
+	}
+	return &fspb.ListBranchesResponse{Branches: map[string]string{"master": commitA}}, nil
+}
+
+func (fakeServer) GetFetchStatus(ctx context.Context, req *fspb.GetFetchStatusRequest) (*fspb.GetFetchStatusResponse, error) {
+	if err := checkRepo(req.Repo); err != nil {
+		return nil, err
+	}
+	return &fspb.GetFetchStatusResponse{Status: &fspb.FetchStatus{LastError: "exit status 128"}}, nil
+}
+
+func (fakeServer) ListTags(ctx context.Context, req *fspb.ListTagsRequest) (*fspb.ListTagsResponse, error) {
+	if err := checkRepo(req.Repo); err != nil {
+		return nil, err
+	}
+	return &fspb.ListTagsResponse{Tags: map[string]string{"v1.0": commitA}}, nil
+}
+
+func (fakeServer) GetCommit(ctx context.Context, req *fspb.GetCommitRequest) (*fspb.GetCommitResponse, error) {
+	if err := checkRepo(req.Repo); err != nil {
+		return nil, err
+	}
+	if err := checkPath(req.Commit, "/"); err != nil {
+		return nil, err
+	}
+	res := &fspb.GetCommitResponse{Hash: commitA, Message: "Add README\n"}
+	if req.IncludeDiff {
+		res.Diff = []*fspb.FileDiff{{ToPath: "README.md", Patch: "+hello\n"}}
+	}
+	return res, nil
+}
+
+func (fakeServer) ListRepos(ctx context.Context, req *fspb.ListReposRequest) (*fspb.ListReposResponse, error) {
+	return &fspb.ListReposResponse{Repos: []string{"down", "repo"}, DefaultRepo: "repo"}, nil
+}
+
+func (fakeServer) WatchBranches(req *fspb.WatchBranchesRequest, stream fspb.GitReadFs_WatchBranchesServer) error {
+	if err := checkRepo(req.Repo); err != nil {
+		return err
+	}
+	for _, commit := range []string{commitA, "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"} {
+		if err := stream.Send(&fspb.ListBranchesResponse{Branches: map[string]string{"master": commit}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	router := mux.NewRouter()
+	Register(router, fakeServer{})
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestEndpoints(t *testing.T) {
+	server := newTestServer(t)
+
+	testCases := []struct {
+		desc            string
+		path            string
+		wantStatus      int
+		wantContentType string
+		wantBody        string
+	}{
+		{
+			desc:            "list branches",
+			path:            "/api/v1/branches?repo=repo",
+			wantStatus:      http.StatusOK,
+			wantContentType: "application/json",
+			wantBody:        `{"branches":{"master":"` + commitA + `"}}`,
+		},
+		{
+			desc:            "list tags",
+			path:            "/api/v1/tags?repo=repo",
+			wantStatus:      http.StatusOK,
+			wantContentType: "application/json",
+			wantBody:        `{"tags":{"v1.0":"` + commitA + `"}}`,
+		},
+		{
+			desc:            "list repos",
+			path:            "/api/v1/repos",
+			wantStatus:      http.StatusOK,
+			wantContentType: "application/json",
+			wantBody:        `{"repos":["down","repo"],"default_repo":"repo"}`,
+		},
+		{
+			desc:            "commit",
+			path:            "/api/v1/commits/" + commitA + "?repo=repo",
+			wantStatus:      http.StatusOK,
+			wantContentType: "application/json",
+			wantBody:        `{"hash":"` + commitA + `","parent_hashes":[],"author":null,"committer":null,"message":"Add README\n","diff":[]}`,
+		},
+		{
+			desc:            "commit with diff",
+			path:            "/api/v1/commits/" + commitA + "?repo=repo&diff=true",
+			wantStatus:      http.StatusOK,
+			wantContentType: "application/json",
+			wantBody: `{"hash":"` + commitA + `","parent_hashes":[],"author":null,"committer":null,"message":"Add README\n",` +
+				`"diff":[{"from_path":"","to_path":"README.md","binary":false,"patch":"+hello\n"}]}`,
+		},
+		{
+			desc:            "list root dir",
+			path:            "/api/v1/commits/" + commitA + "/tree?repo=repo",
+			wantStatus:      http.StatusOK,
+			wantContentType: "application/json",
+			wantBody:        `{"entries":[{"name":"README.md","mode":"MODE_REGULAR"},{"name":"src","mode":"MODE_DIR"}]}`,
+		},
+		{
+			desc:            "list root dir of view",
+			path:            "/api/v1/commits/" + commitA + "/tree?repo=repo&view=docs",
+			wantStatus:      http.StatusOK,
+			wantContentType: "application/json",
+			wantBody:        `{"entries":[{"name":"README.md","mode":"MODE_REGULAR"}]}`,
+		},
+		{
+			desc:            "list empty dir",
+			path:            "/api/v1/commits/" + commitA + "/tree/src?repo=repo",
+			wantStatus:      http.StatusOK,
+			wantContentType: "application/json",
+			wantBody:        `{"entries":[]}`,
+		},
+		{
+			desc:            "raw file",
+			path:            "/api/v1/commits/" + commitA + "/blob/README.md?repo=repo",
+			wantStatus:      http.StatusOK,
+			wantContentType: "application/octet-stream",
+			wantBody:        "\x00hello\n",
+		},
+		{
+			desc:            "attributes with 64-bit size",
+			path:            "/api/v1/commits/" + commitA + "/attributes/README.md?repo=repo",
+			wantStatus:      http.StatusOK,
+			wantContentType: "application/json",
+			wantBody:        `{"mode":"MODE_REGULAR","size_bytes":"7","commit_time":null,"author_time":null}`,
+		},
+		{
+			desc:            "fetch status",
+			path:            "/api/v1/fetch_status?repo=repo",
+			wantStatus:      http.StatusOK,
+			wantContentType: "application/json",
+			wantBody:        `{"status":{"last_fetch_time":null,"last_success_time":null,"last_error":"exit status 128","consecutive_failures":0,"next_poll_time":null}}`,
+		},
+		{
+			desc:            "stream",
+			path:            "/api/v1/branches/watch?repo=repo",
+			wantStatus:      http.StatusOK,
+			wantContentType: "application/x-ndjson",
+			wantBody: `{"branches":{"master":"` + commitA + `"}}` + "\n" +
+				`{"branches":{"master":"bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"}}` + "\n",
+		},
+		{
+			desc:            "missing file",
+			path:            "/api/v1/commits/" + commitA + "/blob/missing?repo=repo",
+			wantStatus:      http.StatusNotFound,
+			wantContentType: "application/json",
+			wantBody:        `{"code":"NotFound","message":"path \"/missing\" not found"}`,
+		},
+		{
+			desc:            "invalid argument",
+			path:            "/api/v1/commits/" + commitA + "/blob/src?repo=repo",
+			wantStatus:      http.StatusBadRequest,
+			wantContentType: "application/json",
+			wantBody:        `{"code":"InvalidArgument","message":"path \"/src\" is a directory"}`,
+		},
+		{
+			desc:            "unavailable",
+			path:            "/api/v1/commits?repo=down",
+			wantStatus:      http.StatusServiceUnavailable,
+			wantContentType: "application/json",
+			wantBody:        `{"code":"Unavailable","message":"repo \"down\" is still cloning"}`,
+		},
+		{
+			desc:            "stream error",
+			path:            "/api/v1/branches/watch?repo=typo",
+			wantStatus:      http.StatusNotFound,
+			wantContentType: "application/json",
+			wantBody:        `{"code":"NotFound","message":"repo \"typo\" not found"}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			res, err := http.Get(server.URL + tc.path)
+			if err != nil {
+				t.Fatalf("http.Get() got error %v; want no error", err)
+			}
+			defer res.Body.Close()
+			body, err := ioutil.ReadAll(res.Body)
+			if err != nil {
+				t.Fatalf("ReadAll() got error %v; want no error", err)
+			}
+			if res.StatusCode != tc.wantStatus {
+				t.Errorf("GET %s got status %d; want %d", tc.path, res.StatusCode, tc.wantStatus)
+			}
+			if got := res.Header.Get("Content-Type"); got != tc.wantContentType {
+				t.Errorf("GET %s got Content-Type %q; want %q", tc.path, got, tc.wantContentType)
+			}
+			if tc.wantContentType == "application/octet-stream" {
+				if got := string(body); got != tc.wantBody {
+					t.Errorf("GET %s = %q; want %q", tc.path, got, tc.wantBody)
+				}
+				return
+			}
+			// Compare decoded JSON, one value per line, since protojson's
+			// whitespace is deliberately unstable.
+			if diff := cmp.Diff(decodeLines(t, tc.wantBody), decodeLines(t, string(body))); diff != "" {
+				t.Errorf("GET %s returned diff (-want +got):\n%s", tc.path, diff)
+			}
+		})
+	}
+}
+
+func decodeLines(t *testing.T, body string) []interface{} {
+	t.Helper()
+	var values []interface{}
+	for _, line := range strings.Split(strings.TrimSuffix(body, "\n"), "\n") {
+		var v interface{}
+		if err := json.Unmarshal([]byte(line), &v); err != nil {
+			t.Fatalf("invalid JSON %q: %v", line, err)
+		}
+		values = append(values, v)
+	}
+	return values
+}
+
+func TestSchemas(t *testing.T) {
+	server := newTestServer(t)
+
+	getJSON := func(path string) map[string]interface{} {
+		t.Helper()
+		res, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("http.Get() got error %v; want no error", err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s got status %d; want %d", path, res.StatusCode, http.StatusOK)
+		}
+		var v map[string]interface{}
+		if err := json.NewDecoder(res.Body).Decode(&v); err != nil {
+			t.Fatalf("GET %s returned invalid JSON: %v", path, err)
+		}
+		return v
+	}
+
+	index := getJSON("/api/v1/schemas")
+	entries := index["endpoints"].([]interface{})
+	if got, want := len(entries), len(endpoints); got != want {
+		t.Errorf("schema index lists %d endpoints; want %d", got, want)
+	}
+	for _, e := range entries {
+		schemaURL := e.(map[string]interface{})["schema"].(string)
+		if s := getJSON(schemaURL); s["$id"] != schemaURL {
+			t.Errorf("schema at %s has $id %v", schemaURL, s["$id"])
+		}
+	}
+	getJSON(index["error_schema"].(string))
+
+	res, err := http.Get(server.URL + "/api/v1/commits/" + commitA + "/attributes/README.md?repo=repo")
+	if err != nil {
+		t.Fatalf("http.Get() got error %v; want no error", err)
+	}
+	res.Body.Close()
+	if got, want := res.Header.Get("Link"), `</api/v1/schemas/get_attributes>; rel="describedby"`; got != want {
+		t.Errorf("response got Link %q; want %q", got, want)
+	}
+
+	attributes := getJSON("/api/v1/schemas/get_attributes")
+	want := map[string]interface{}{
+		"mode": map[string]interface{}{
+			"type": "string",
+			"enum": []interface{}{"MODE_UNKNOWN", "MODE_EMPTY", "MODE_DIR", "MODE_REGULAR", "MODE_EXECUTABLE", "MODE_SYMLINK", "MODE_SUBMODULE"},
+		},
+		"size_bytes": map[string]interface{}{"type": "string", "pattern": "^-?[0-9]+$"},
+		"commit_time": map[string]interface{}{"anyOf": []interface{}{
+			map[string]interface{}{"type": "string", "format": "date-time"},
+			map[string]interface{}{"type": "null"},
+		}},
+		"author_time": map[string]interface{}{"anyOf": []interface{}{
+			map[string]interface{}{"type": "string", "format": "date-time"},
+			map[string]interface{}{"type": "null"},
+		}},
+	}
+	if diff := cmp.Diff(want, attributes["properties"]); diff != "" {
+		t.Errorf("get_attributes schema returned diff (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,159 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+const (
+	schemaDialect = "https://json-schema.org/draft/2020-12/schema"
+	// errorSchema names the schema of error responses.
+	errorSchema = "error"
+)
+
+// schema is a JSON schema document.
+type schema map[string]interface{}
+
+func schemaPath(name string) string {
+	return "/api/v1/schemas/" + name
+}
+
+// serveSchemaIndex lists the endpoints, and where to find their schemas.
+func serveSchemaIndex(w http.ResponseWriter, r *http.Request) {
+	type entry struct {
+		*endpoint
+		Schema string `json:"schema"`
+	}
+	index := struct {
+		Endpoints   []entry `json:"endpoints"`
+		ErrorSchema string  `json:"error_schema"`
+	}{
+		ErrorSchema: schemaPath(errorSchema),
+	}
+	for _, e := range endpoints {
+		index.Endpoints = append(index.Endpoints, entry{endpoint: e, Schema: schemaPath(e.Name)})
+	}
+	writeJSON(w, index)
+}
+
+// serveSchema serves the JSON schema of an endpoint's response.
+func serveSchema(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if name == errorSchema {
+		writeJSON(w, schema{
+			"$schema":     schemaDialect,
+			"$id":         schemaPath(errorSchema),
+			"title":       errorSchema,
+			"description": "The body of every error response.",
+			"type":        "object",
+			"properties": schema{
+				"code":    schema{"type": "string", "description": "Name of the gRPC status code, such as \"NotFound\"."},
+				"message": schema{"type": "string"},
+			},
+			"required": []string{"code", "message"},
+		})
+		return
+	}
+	for _, e := range endpoints {
+		if e.Name == name {
+			writeJSON(w, endpointSchema(e))
+			return
+		}
+	}
+	http.Error(w, "no schema named "+name, http.StatusNotFound)
+}
+
+// endpointSchema describes the response of an endpoint.
+func endpointSchema(e *endpoint) schema {
+	s := schema{
+		"type":             "string",
+		"contentMediaType": "application/octet-stream",
+	}
+	if e.response != nil {
+		s = messageSchema(e.response.ProtoReflect().Descriptor())
+	}
+	s["$schema"] = schemaDialect
+	s["$id"] = schemaPath(e.Name)
+	s["title"] = e.Name
+	s["description"] = e.Description
+	return s
+}
+
+// messageSchema describes the protojson encoding of a message, with proto
+// field names and unset fields included.
+func messageSchema(md protoreflect.MessageDescriptor) schema {
+	if md.FullName() == "google.protobuf.Timestamp" {
+		return schema{"type": "string", "format": "date-time"}
+	}
+	properties := schema{}
+	var required []string
+	fields := md.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		properties[string(fd.Name())] = fieldSchema(fd)
+		required = append(required, string(fd.Name()))
+	}
+	return schema{
+		"type":                 "object",
+		"properties":           properties,
+		"required":             required,
+		"additionalProperties": false,
+	}
+}
+
+func fieldSchema(fd protoreflect.FieldDescriptor) schema {
+	switch {
+	case fd.IsMap():
+		return schema{"type": "object", "additionalProperties": valueSchema(fd.MapValue())}
+	case fd.IsList():
+		return schema{"type": "array", "items": valueSchema(fd)}
+	case fd.Message() != nil:
+		// Unset message fields are encoded as null.
+		return schema{"anyOf": []schema{valueSchema(fd), {"type": "null"}}}
+	default:
+		return valueSchema(fd)
+	}
+}
+
+// valueSchema describes a single value of a field, ignoring whether the field
+// is repeated.
+func valueSchema(fd protoreflect.FieldDescriptor) schema {
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		return schema{"type": "boolean"}
+	case protoreflect.StringKind:
+		return schema{"type": "string"}
+	case protoreflect.BytesKind:
+		return schema{"type": "string", "contentEncoding": "base64"}
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		return schema{"type": "integer"}
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind,
+		protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		// protojson encodes 64-bit integers as strings, since JavaScript
+		// numbers can't hold them exactly.
+		return schema{"type": "string", "pattern": "^-?[0-9]+$"}
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		return schema{"type": "number"}
+	case protoreflect.EnumKind:
+		var names []string
+		values := fd.Enum().Values()
+		for i := 0; i < values.Len(); i++ {
+			names = append(names, string(values.Get(i).Name()))
+		}
+		return schema{"type": "string", "enum": names}
+	default:
+		return messageSchema(fd.Message())
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		glog.Errorf("Gateway: failed to write JSON response: %v", err)
+	}
+}
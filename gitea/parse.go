@@ -0,0 +1,71 @@
+package gitea
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/minorhacks/funhouse/webhook"
+)
+
+// ParsePush parses a Gitea push or delete webhook. If secret is set, the
+// request must carry a matching X-Gitea-Signature header.
+func ParsePush(r *http.Request, secret string) (*webhook.PushEvent, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body: %v", err)
+	}
+	if err := webhook.CheckSignature(body, r.Header.Get("X-Gitea-Signature"), secret); err != nil {
+		return nil, err
+	}
+
+	switch event := r.Header.Get("X-Gitea-Event"); event {
+	case "push":
+		var payload PushPayload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return nil, fmt.Errorf("failed to decode payload: %v", err)
+		}
+		ev := &webhook.PushEvent{
+			DeliveryID: r.Header.Get("X-Gitea-Delivery"),
+			Updates: []webhook.RefUpdate{{
+				Ref:    payload.Ref,
+				Before: payload.Before,
+				After:  payload.After,
+			}},
+		}
+		if payload.Repository != nil {
+			ev.Repository = payload.Repository.FullName
+		}
+		return ev, nil
+
+	case "delete":
+		var payload DeletePayload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return nil, fmt.Errorf("failed to decode payload: %v", err)
+		}
+		var ref string
+		switch payload.RefType {
+		case "branch":
+			ref = "refs/heads/" + payload.Ref
+		case "tag":
+			ref = "refs/tags/" + payload.Ref
+		default:
+			return nil, fmt.Errorf("%w: delete of ref_type %q", webhook.ErrUnsupportedEvent, payload.RefType)
+		}
+		ev := &webhook.PushEvent{
+			DeliveryID: r.Header.Get("X-Gitea-Delivery"),
+			Updates: []webhook.RefUpdate{{
+				Ref:   ref,
+				After: webhook.ZeroHash,
+			}},
+		}
+		if payload.Repository != nil {
+			ev.Repository = payload.Repository.FullName
+		}
+		return ev, nil
+
+	default:
+		return nil, fmt.Errorf("%w: %q", webhook.ErrUnsupportedEvent, event)
+	}
+}
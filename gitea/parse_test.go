@@ -0,0 +1,86 @@
+package gitea
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/minorhacks/funhouse/webhook"
+	"github.com/minorhacks/funhouse/webhook/webhooktest"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParsePush(t *testing.T) {
+	const secret = "hunter2"
+
+	testCases := []struct {
+		desc       string
+		filename   string
+		event      string
+		signSecret string
+		want       *webhook.PushEvent
+		wantErr    error
+	}{
+		{
+			desc:       "branch push",
+			filename:   "gitea/testdata/push_response.json",
+			event:      "push",
+			signSecret: secret,
+			want: &webhook.PushEvent{
+				Repository: "minorhacks/advent_2020",
+				Updates: []webhook.RefUpdate{{
+					Ref:    "refs/heads/master",
+					Before: "0802d5e6cee084a8f867c5406e46a3fca556bf4e",
+					After:  "89b269b3c313d05c182e5ff829727f2b5132c2e5",
+				}},
+			},
+		},
+		{
+			desc:       "branch delete",
+			filename:   "gitea/testdata/delete_response.json",
+			event:      "delete",
+			signSecret: secret,
+			want: &webhook.PushEvent{
+				Repository: "minorhacks/advent_2020",
+				Updates: []webhook.RefUpdate{{
+					Ref:   "refs/heads/feature",
+					After: webhook.ZeroHash,
+				}},
+			},
+		},
+		{
+			desc:       "bad signature",
+			filename:   "gitea/testdata/push_response.json",
+			event:      "push",
+			signSecret: "wrong",
+			wantErr:    webhook.ErrUnauthorized,
+		},
+		{
+			desc:       "unsupported event",
+			filename:   "gitea/testdata/push_response.json",
+			event:      "issues",
+			signSecret: secret,
+			wantErr:    webhook.ErrUnsupportedEvent,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			body := webhooktest.ReadFile(t, tc.filename)
+			req := httptest.NewRequest("POST", "/hook/gitea", bytes.NewReader(body))
+			req.Header.Set("X-Gitea-Event", tc.event)
+			req.Header.Set("X-Gitea-Signature", hex.EncodeToString(webhook.Sign(body, tc.signSecret)))
+
+			got, err := ParsePush(req, secret)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("ParsePush() got error %v; want %v", err, tc.wantErr)
+			}
+			if diff := cmp.Diff(got, tc.want); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
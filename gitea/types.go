@@ -0,0 +1,23 @@
+package gitea
+
+// PushPayload is the body of Gitea's "push" event.
+type PushPayload struct {
+	Ref        string      `json:"ref"`
+	Before     string      `json:"before"`
+	After      string      `json:"after"`
+	Repository *Repository `json:"repository"`
+}
+
+// DeletePayload is the body of Gitea's "delete" event, sent when a branch or
+// tag is deleted.
+type DeletePayload struct {
+	// Ref is the short name of the branch or tag.
+	Ref string `json:"ref"`
+	// RefType is either "branch" or "tag".
+	RefType    string      `json:"ref_type"`
+	Repository *Repository `json:"repository"`
+}
+
+type Repository struct {
+	FullName string `json:"full_name"`
+}
@@ -0,0 +1,50 @@
+package github
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/minorhacks/funhouse/webhook"
+)
+
+// ParsePush parses a GitHub push webhook. If secret is set, the request must
+// carry a matching X-Hub-Signature-256 header.
+func ParsePush(r *http.Request, secret string) (*webhook.PushEvent, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body: %v", err)
+	}
+	if err := webhook.CheckSignature(body, r.Header.Get("X-Hub-Signature-256"), secret); err != nil {
+		return nil, err
+	}
+
+	switch event := r.Header.Get("X-GitHub-Event"); event {
+	case "", "push":
+	case "ping":
+		return nil, webhook.ErrPing
+	default:
+		return nil, fmt.Errorf("%w: %q", webhook.ErrUnsupportedEvent, event)
+	}
+
+	var payload PushPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("failed to decode payload: %v", err)
+	}
+	ev := &webhook.PushEvent{
+		DeliveryID: r.Header.Get("X-GitHub-Delivery"),
+		Updates: []webhook.RefUpdate{{
+			Ref:    payload.Ref,
+			Before: payload.Before,
+			After:  payload.After,
+		}},
+	}
+	if payload.Repository != nil {
+		ev.Repository = payload.Repository.FullName
+	}
+	if payload.Deleted {
+		ev.Updates[0].After = webhook.ZeroHash
+	}
+	return ev, nil
+}
@@ -0,0 +1,96 @@
+package github
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/minorhacks/funhouse/webhook"
+	"github.com/minorhacks/funhouse/webhook/webhooktest"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParsePush(t *testing.T) {
+	body := webhooktest.ReadFile(t, "github/testdata/push_response.json")
+	const secret = "hunter2"
+
+	testCases := []struct {
+		desc      string
+		event     string
+		signature string
+		want      *webhook.PushEvent
+		wantErr   error
+	}{
+		{
+			desc:      "signed push",
+			event:     "push",
+			signature: "sha256=" + hex.EncodeToString(webhook.Sign(body, secret)),
+			want: &webhook.PushEvent{
+				Repository: "minorhacks/advent_2020",
+				Updates: []webhook.RefUpdate{{
+					Ref:    "refs/heads/master",
+					Before: "0802d5e6cee084a8f867c5406e46a3fca556bf4e",
+					After:  "89b269b3c313d05c182e5ff829727f2b5132c2e5",
+				}},
+			},
+		},
+		{
+			desc:      "bad signature",
+			event:     "push",
+			signature: "sha256=" + hex.EncodeToString(webhook.Sign(body, "wrong")),
+			wantErr:   webhook.ErrUnauthorized,
+		},
+		{
+			desc:    "missing signature",
+			event:   "push",
+			wantErr: webhook.ErrUnauthorized,
+		},
+		{
+			desc:      "ping",
+			event:     "ping",
+			signature: "sha256=" + hex.EncodeToString(webhook.Sign(body, secret)),
+			wantErr:   webhook.ErrPing,
+		},
+		{
+			desc:      "unsupported event",
+			event:     "issues",
+			signature: "sha256=" + hex.EncodeToString(webhook.Sign(body, secret)),
+			wantErr:   webhook.ErrUnsupportedEvent,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/hook/github", bytes.NewReader(body))
+			req.Header.Set("X-GitHub-Event", tc.event)
+			if tc.signature != "" {
+				req.Header.Set("X-Hub-Signature-256", tc.signature)
+			}
+
+			got, err := ParsePush(req, secret)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("ParsePush() got error %v; want %v", err, tc.wantErr)
+			}
+			if diff := cmp.Diff(got, tc.want); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestParsePushDeleted(t *testing.T) {
+	body := webhooktest.ReadFile(t, "github/testdata/push_delete_response.json")
+	req := httptest.NewRequest("POST", "/hook/github", bytes.NewReader(body))
+	req.Header.Set("X-GitHub-Event", "push")
+
+	got, err := ParsePush(req, "")
+	if err != nil {
+		t.Fatalf("ParsePush() got error %v; want no error", err)
+	}
+	if len(got.Updates) != 1 || !got.Updates[0].Deleted() {
+		t.Errorf("ParsePush() got updates %+v; want a single deletion", got.Updates)
+	}
+}
@@ -4,6 +4,9 @@ type PushPayload struct {
 	Ref        string      `json:"ref"`
 	Before     string      `json:"before"`
 	After      string      `json:"after"`
+	Created    bool        `json:"created"`
+	Deleted    bool        `json:"deleted"`
+	Forced     bool        `json:"forced"`
 	Repository *Repository `json:"repository"`
 }
 
@@ -2,44 +2,72 @@ package github
 
 import (
 	"encoding/json"
-  "io/ioutil"
 	"testing"
 
+	"github.com/minorhacks/funhouse/webhook/webhooktest"
+
 	"github.com/google/go-cmp/cmp"
-  "github.com/bazelbuild/rules_go/go/tools/bazel"
 )
 
-func mustReadFile(t *testing.T, filename string) []byte {
-  t.Helper()
-  f, err := bazel.Runfile(filename)
-  if err != nil {
-    t.Fatalf("can't get runfile %q: %v", filename, err)
-  }
-  contents, err := ioutil.ReadFile(f)
-  if err != nil {
-    t.Fatal(err)
-  }
-  return contents
-}
-
 func TestUnmarshal(t *testing.T) {
-  example := mustReadFile(t, "github/testdata/push_response.json")
-
-	want := PushPayload{
-		Ref:    "refs/heads/master",
-		Before: "0802d5e6cee084a8f867c5406e46a3fca556bf4e",
-		After:  "89b269b3c313d05c182e5ff829727f2b5132c2e5",
-		Repository: &Repository{
-			FullName: "minorhacks/advent_2020",
+	testCases := []struct {
+		desc     string
+		filename string
+		want     PushPayload
+	}{
+		{
+			desc:     "branch update",
+			filename: "github/testdata/push_response.json",
+			want: PushPayload{
+				Ref:    "refs/heads/master",
+				Before: "0802d5e6cee084a8f867c5406e46a3fca556bf4e",
+				After:  "89b269b3c313d05c182e5ff829727f2b5132c2e5",
+				Forced: true,
+				Repository: &Repository{
+					FullName: "minorhacks/advent_2020",
+				},
+			},
+		},
+		{
+			desc:     "branch deletion",
+			filename: "github/testdata/push_delete_response.json",
+			want: PushPayload{
+				Ref:     "refs/heads/feature",
+				Before:  "89b269b3c313d05c182e5ff829727f2b5132c2e5",
+				After:   "0000000000000000000000000000000000000000",
+				Deleted: true,
+				Repository: &Repository{
+					FullName: "minorhacks/advent_2020",
+				},
+			},
+		},
+		{
+			desc:     "tag creation",
+			filename: "github/testdata/push_tag_response.json",
+			want: PushPayload{
+				Ref:     "refs/tags/v1.0",
+				Before:  "0000000000000000000000000000000000000000",
+				After:   "89b269b3c313d05c182e5ff829727f2b5132c2e5",
+				Created: true,
+				Repository: &Repository{
+					FullName: "minorhacks/advent_2020",
+				},
+			},
 		},
 	}
 
-	got := PushPayload{}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			example := webhooktest.ReadFile(t, tc.filename)
 
-	if err := json.Unmarshal([]byte(example), &got); err != nil {
-		t.Fatalf("json.Unmarshal got error %v; want no error", err)
-	}
-	if diff := cmp.Diff(got, want); diff != "" {
-		t.Error(diff)
+			got := PushPayload{}
+
+			if err := json.Unmarshal([]byte(example), &got); err != nil {
+				t.Fatalf("json.Unmarshal got error %v; want no error", err)
+			}
+			if diff := cmp.Diff(got, tc.want); diff != "" {
+				t.Error(diff)
+			}
+		})
 	}
 }
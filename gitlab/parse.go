@@ -0,0 +1,50 @@
+package gitlab
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/minorhacks/funhouse/webhook"
+)
+
+// ParsePush parses a GitLab push or tag push webhook. If secret is set, the
+// request must carry it in the X-Gitlab-Token header.
+func ParsePush(r *http.Request, secret string) (*webhook.PushEvent, error) {
+	if err := webhook.CheckToken(r.Header.Get("X-Gitlab-Token"), secret); err != nil {
+		return nil, err
+	}
+
+	switch event := r.Header.Get("X-Gitlab-Event"); event {
+	case "Push Hook", "Tag Push Hook", "System Hook":
+	default:
+		return nil, fmt.Errorf("%w: %q", webhook.ErrUnsupportedEvent, event)
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body: %v", err)
+	}
+	var payload PushPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("failed to decode payload: %v", err)
+	}
+	// System hooks deliver many kinds of events under the same header.
+	if payload.ObjectKind != "push" && payload.ObjectKind != "tag_push" {
+		return nil, fmt.Errorf("%w: object_kind %q", webhook.ErrUnsupportedEvent, payload.ObjectKind)
+	}
+
+	ev := &webhook.PushEvent{
+		DeliveryID: r.Header.Get("X-Gitlab-Event-UUID"),
+		Updates: []webhook.RefUpdate{{
+			Ref:    payload.Ref,
+			Before: payload.Before,
+			After:  payload.After,
+		}},
+	}
+	if payload.Project != nil {
+		ev.Repository = payload.Project.PathWithNamespace
+	}
+	return ev, nil
+}
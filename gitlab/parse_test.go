@@ -0,0 +1,85 @@
+package gitlab
+
+import (
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/minorhacks/funhouse/webhook"
+	"github.com/minorhacks/funhouse/webhook/webhooktest"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParsePush(t *testing.T) {
+	const token = "hunter2"
+
+	testCases := []struct {
+		desc     string
+		filename string
+		event    string
+		token    string
+		want     *webhook.PushEvent
+		wantErr  error
+	}{
+		{
+			desc:     "branch push",
+			filename: "gitlab/testdata/push_response.json",
+			event:    "Push Hook",
+			token:    token,
+			want: &webhook.PushEvent{
+				Repository: "minorhacks/advent_2020",
+				Updates: []webhook.RefUpdate{{
+					Ref:    "refs/heads/master",
+					Before: "0802d5e6cee084a8f867c5406e46a3fca556bf4e",
+					After:  "89b269b3c313d05c182e5ff829727f2b5132c2e5",
+				}},
+			},
+		},
+		{
+			desc:     "tag push",
+			filename: "gitlab/testdata/tag_push_response.json",
+			event:    "Tag Push Hook",
+			token:    token,
+			want: &webhook.PushEvent{
+				Repository: "minorhacks/advent_2020",
+				Updates: []webhook.RefUpdate{{
+					Ref:    "refs/tags/v1.0",
+					Before: "0000000000000000000000000000000000000000",
+					After:  "89b269b3c313d05c182e5ff829727f2b5132c2e5",
+				}},
+			},
+		},
+		{
+			desc:     "wrong token",
+			filename: "gitlab/testdata/push_response.json",
+			event:    "Push Hook",
+			token:    "wrong",
+			wantErr:  webhook.ErrUnauthorized,
+		},
+		{
+			desc:     "unsupported event",
+			filename: "gitlab/testdata/push_response.json",
+			event:    "Issue Hook",
+			token:    token,
+			wantErr:  webhook.ErrUnsupportedEvent,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/hook/gitlab", bytes.NewReader(webhooktest.ReadFile(t, tc.filename)))
+			req.Header.Set("X-Gitlab-Event", tc.event)
+			req.Header.Set("X-Gitlab-Token", tc.token)
+
+			got, err := ParsePush(req, token)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("ParsePush() got error %v; want %v", err, tc.wantErr)
+			}
+			if diff := cmp.Diff(got, tc.want); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
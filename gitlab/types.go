@@ -0,0 +1,14 @@
+package gitlab
+
+// PushPayload is the body of GitLab's "Push Hook" and "Tag Push Hook" events.
+type PushPayload struct {
+	ObjectKind string   `json:"object_kind"`
+	Ref        string   `json:"ref"`
+	Before     string   `json:"before"`
+	After      string   `json:"after"`
+	Project    *Project `json:"project"`
+}
+
+type Project struct {
+	PathWithNamespace string `json:"path_with_namespace"`
+}
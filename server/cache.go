@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/minorhacks/funhouse/cache"
+	fspb "github.com/minorhacks/funhouse/proto/git_read_fs_proto"
+
+	"github.com/golang/glog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/reflection"
+)
+
+// serveCache serves GitReadFs from a cache of --upstream_addr until SIGTERM.
+func serveCache() error {
+	var options []grpc.DialOption
+	if *upstreamInsecure {
+		options = append(options, grpc.WithInsecure())
+	} else {
+		options = append(options, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{})))
+	}
+	upstream, err := grpc.Dial(*upstreamAddr, options...)
+	if err != nil {
+		return fmt.Errorf("failed to dial %q: %v", *upstreamAddr, err)
+	}
+	defer upstream.Close()
+	c := cache.New(fspb.NewGitReadFsClient(upstream), cache.Options{MaxBytes: *cacheMaxBytes})
+
+	addr := net.JoinHostPort("", strconv.FormatInt(int64(*grpcPort), 10))
+	conn, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %q: %v", addr, err)
+	}
+	grpcServer := grpc.NewServer()
+	fspb.RegisterGitReadFsServer(grpcServer, c)
+	reflection.Register(grpcServer)
+	grpcErr := make(chan error, 1)
+	go func() {
+		glog.Infof("Caching %s; listening on %s", *upstreamAddr, addr)
+		grpcErr <- grpcServer.Serve(conn)
+	}()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+	select {
+	case err := <-grpcErr:
+		return fmt.Errorf("gRPC server failed: %v", err)
+	case sig := <-sigs:
+		glog.Infof("Received %v; shutting down", sig)
+	}
+	signal.Stop(sigs)
+
+	// End WatchBranches streams, which would otherwise hold up GracefulStop.
+	c.Close()
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(*shutdownTimeout):
+		grpcServer.Stop()
+		return fmt.Errorf("unclean shutdown: in-flight RPCs cancelled after --shutdown_timeout")
+	}
+	glog.Infof("Shut down cleanly")
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/minorhacks/funhouse/config"
+	"github.com/minorhacks/funhouse/service"
+
+	"github.com/golang/glog"
+)
+
+// applyServerConfig overrides the server flags with the settings in cfg.
+func applyServerConfig(cfg *config.Config) error {
+	if cfg.BasePath != "" {
+		*basePath = cfg.BasePath
+	}
+	if cfg.GRPCPort != 0 {
+		*grpcPort = cfg.GRPCPort
+	}
+	if cfg.HTTPPort != 0 {
+		*httpPort = cfg.HTTPPort
+	}
+	if cfg.AdminToken.IsSet() {
+		token, err := cfg.AdminToken.Read()
+		if err != nil {
+			return fmt.Errorf("failed to read admin_token: %v", err)
+		}
+		*adminToken = token
+	}
+	webhookSecrets := map[string]*string{
+		"github":    githubWebhookSecret,
+		"gitlab":    gitlabWebhookToken,
+		"gitea":     giteaWebhookSecret,
+		"bitbucket": bitbucketWebhookSecret,
+	}
+	for provider, secret := range cfg.WebhookSecrets {
+		value, err := secret.Read()
+		if err != nil {
+			return fmt.Errorf("failed to read webhook_secrets.%s: %v", provider, err)
+		}
+		*webhookSecrets[provider] = value
+	}
+	return nil
+}
+
+// reloadConfig makes s serve the config file at path, where cur is the config
+// it serves now, and returns the new config. Repos missing from the new config
+// are removed, keeping their data so that adding them back is quick; repos
+// that s doesn't serve are cloned in the background, so that a reload retries
+// those that failed to clone before; and the rest have their settings
+// updated. If the new config is invalid, or changes settings that need a
+// restart, s is left as it was. If its composites can't be applied, the
+// reload fails, but repos may have been removed already.
+func reloadConfig(s *service.Service, cur *config.Config, path string) (*config.Config, error) {
+	next, err := config.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := cur.CheckReload(next); err != nil {
+		return nil, err
+	}
+	opts := map[string]service.RepoOptions{}
+	for _, repo := range next.Repos {
+		if opts[repo.Name], err = repo.Options(); err != nil {
+			return nil, err
+		}
+	}
+
+	_, removed := cur.Diff(next)
+	for _, repo := range removed {
+		if err := s.RemoveRepo(repo.Name, true /* keepData */); err != nil {
+			glog.Errorf("Config: failed to remove repo %q: %v", repo.Name, err)
+			continue
+		}
+		glog.Infof("Config: removed repo %q", repo.Name)
+	}
+	// Composites are replaced before repos are added, so that an added repo
+	// can take the name of a removed composite.
+	if err := s.SetComposites(next.CompositeMembers()); err != nil {
+		return nil, fmt.Errorf("failed to update composites: %v", err)
+	}
+	for _, repo := range next.Repos {
+		if s.HasRepo(repo.Name) {
+			if err := s.UpdateRepo(repo.Name, repo.URL, opts[repo.Name]); err != nil {
+				glog.Errorf("Config: failed to update repo %q: %v", repo.Name, err)
+			}
+			continue
+		}
+		go func(repo config.Repo) {
+			if err := s.AddRepo(repo.Name, repo.URL, opts[repo.Name]); err != nil {
+				glog.Errorf("Config: failed to add repo %q; it is retried on the next reload: %v", repo.Name, err)
+				return
+			}
+			glog.Infof("Config: added repo %q", repo.Name)
+		}(repo)
+	}
+	glog.Infof("Config: reloaded %q", path)
+	return next, nil
+}
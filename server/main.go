@@ -1,16 +1,28 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/minorhacks/funhouse/bitbucket"
+	"github.com/minorhacks/funhouse/config"
+	"github.com/minorhacks/funhouse/gateway"
+	"github.com/minorhacks/funhouse/gitea"
+	"github.com/minorhacks/funhouse/github"
+	"github.com/minorhacks/funhouse/gitlab"
 	fspb "github.com/minorhacks/funhouse/proto/git_read_fs_proto"
+	mapb "github.com/minorhacks/funhouse/proto/mirror_admin_proto"
 	"github.com/minorhacks/funhouse/service"
+	"github.com/minorhacks/funhouse/web"
 
 	"github.com/golang/glog"
 	"google.golang.org/grpc"
@@ -19,10 +31,40 @@ import (
 )
 
 var (
-	grpcPort = flag.Int("grpc_port", 8080, "Port of gRPC service")
-	httpPort = flag.Int("http_port", 8081, "Port of HTTP service")
-	basePath = flag.String("base_path", "/tmp/funhouse", "Path to store cloned repository data")
-	repoURL  = flag.String("repo_url", "", "Clone and serve a single repository at this URL")
+	configPath           = flag.String("config", "", "YAML or JSON file listing the repos to serve and their settings, which override the flags below; reloaded on SIGHUP")
+	grpcPort             = flag.Int("grpc_port", 8080, "Port of gRPC service")
+	httpPort             = flag.Int("http_port", 8081, "Port of HTTP service")
+	basePath             = flag.String("base_path", "/tmp/funhouse", "Path to store cloned repository data")
+	repoURL              = flag.String("repo_url", "", "If set, clone and serve the repository at this URL at startup")
+	repoName             = flag.String("repo_name", "", "Name of the repository given by --repo_url; defaults to the last path element of the URL")
+	repoUsername         = flag.String("repo_username", "", "Username for cloning --repo_url over HTTPS, or SSH user")
+	repoPasswordFile     = flag.String("repo_password_file", "", "File containing the password or access token for cloning --repo_url over HTTPS")
+	repoPasswordEnv      = flag.String("repo_password_env", "", "Environment variable containing the password or access token for cloning --repo_url over HTTPS")
+	repoSSHKeyFile       = flag.String("repo_ssh_key_file", "", "File containing the SSH private key for cloning --repo_url")
+	repoSSHPassphraseEnv = flag.String("repo_ssh_key_passphrase_env", "", "Environment variable containing the passphrase of --repo_ssh_key_file")
+	repoKnownHostsFile   = flag.String("repo_known_hosts_file", "", "known_hosts file to check SSH host keys against; defaults to the user's known_hosts")
+	partialClone         = flag.Bool("partial_clone", false, "Clone --repo_url without blobs, and fetch each blob from origin when it is first read; requires the git CLI")
+	adminToken           = flag.String("admin_token", "", "If set, serve the MirrorAdmin service to callers presenting this bearer token")
+
+	pollInterval   = flag.Duration("poll_interval", 10*time.Minute, "How often to fetch all refs from origin in case a webhook was missed; 0 disables polling")
+	pollJitter     = flag.Float64("poll_jitter", 0.1, "Fraction by which each poll interval is randomly lengthened or shortened")
+	pollMaxBackoff = flag.Duration("poll_max_backoff", time.Hour, "Maximum interval between polls of a repo whose fetches are failing")
+
+	maintenanceInterval        = flag.Duration("maintenance_interval", time.Hour, "How often to check whether repos need repacking; 0 disables maintenance")
+	maintenanceMaxPacks        = flag.Int("maintenance_max_packs", 20, "Repack a repo once it has more than this many packfiles")
+	maintenanceMaxLooseObjects = flag.Int("maintenance_max_loose_objects", 1000, "Repack a repo once it has more than this many loose objects")
+	maintenancePruneGrace      = flag.Duration("maintenance_prune_grace", 24*time.Hour, "Minimum age of unreachable objects before they are pruned")
+
+	upstreamAddr     = flag.String("upstream_addr", "", "If set, serve a cache of the GitReadFs server at this address instead of cloning repos")
+	upstreamInsecure = flag.Bool("upstream_insecure", false, "Connect to --upstream_addr without TLS")
+	cacheMaxBytes    = flag.Int64("cache_max_bytes", 1<<30, "Maximum total size of the responses cached from --upstream_addr")
+
+	shutdownTimeout = flag.Duration("shutdown_timeout", 30*time.Second, "How long to wait on SIGTERM for queued fetches and in-flight requests to finish before cancelling them")
+
+	githubWebhookSecret    = flag.String("github_webhook_secret", "", "If set, GitHub webhooks must be signed with this secret")
+	gitlabWebhookToken     = flag.String("gitlab_webhook_token", "", "If set, GitLab webhooks must carry this secret token")
+	giteaWebhookSecret     = flag.String("gitea_webhook_secret", "", "If set, Gitea webhooks must be signed with this secret")
+	bitbucketWebhookSecret = flag.String("bitbucket_webhook_secret", "", "If set, Bitbucket Server webhooks must be signed with this secret")
 )
 
 func main() {
@@ -34,15 +76,67 @@ func main() {
 }
 
 func app() error {
-	var s *service.Service
-	var err error
-	if *repoURL == "" {
-		return fmt.Errorf("--repo_url must be set")
-	} else {
-		s, err = service.New(*basePath, *repoURL)
+	pollOpts := service.PollOptions{
+		Interval:   *pollInterval,
+		Jitter:     *pollJitter,
+		MaxBackoff: *pollMaxBackoff,
 	}
-	if err != nil {
-		return fmt.Errorf("failed to create service: %v", err)
+	if err := pollOpts.Validate(); err != nil {
+		return fmt.Errorf("invalid --poll_interval, --poll_jitter or --poll_max_backoff: %v", err)
+	}
+	if *upstreamAddr != "" {
+		if *configPath != "" || *repoURL != "" || *adminToken != "" {
+			return fmt.Errorf("--upstream_addr can't be used with --config, --repo_url or --admin_token")
+		}
+		return serveCache()
+	}
+
+	var cfg *config.Config
+	if *configPath != "" {
+		if *repoURL != "" {
+			return fmt.Errorf("--repo_url can't be used with --config")
+		}
+		var err error
+		cfg, err = config.Load(*configPath)
+		if err != nil {
+			return err
+		}
+		if err := applyServerConfig(cfg); err != nil {
+			return err
+		}
+	} else if *repoURL == "" && *adminToken == "" {
+		return fmt.Errorf("--config, --repo_url or --admin_token must be set")
+	}
+	s := service.New(*basePath)
+	if cfg != nil {
+		for _, repo := range cfg.Repos {
+			opts, err := repo.Options()
+			if err != nil {
+				return err
+			}
+			if err := s.AddRepo(repo.Name, repo.URL, opts); err != nil {
+				return fmt.Errorf("failed to create service: %v", err)
+			}
+		}
+		if err := s.SetComposites(cfg.CompositeMembers()); err != nil {
+			return fmt.Errorf("failed to create service: %v", err)
+		}
+	}
+	if *repoURL != "" {
+		name := *repoName
+		if name == "" {
+			name = defaultRepoName(*repoURL)
+		}
+		creds := service.Credentials{
+			Username:         *repoUsername,
+			Password:         service.Secret{File: *repoPasswordFile, Env: *repoPasswordEnv},
+			SSHKey:           service.Secret{File: *repoSSHKeyFile},
+			SSHKeyPassphrase: service.Secret{Env: *repoSSHPassphraseEnv},
+			KnownHostsFile:   *repoKnownHostsFile,
+		}
+		if err := s.AddRepo(name, *repoURL, service.RepoOptions{Credentials: creds, PartialClone: *partialClone}); err != nil {
+			return fmt.Errorf("failed to create service: %v", err)
+		}
 	}
 
 	addr := net.JoinHostPort("", strconv.FormatInt(int64(*grpcPort), 10))
@@ -52,22 +146,155 @@ func app() error {
 	}
 	grpcServer := grpc.NewServer([]grpc.ServerOption{}...)
 	fspb.RegisterGitReadFsServer(grpcServer, s)
+	if *adminToken != "" {
+		mapb.RegisterMirrorAdminServer(grpcServer, &service.Admin{Service: s, Token: *adminToken})
+	}
 	reflection.Register(grpcServer)
 
 	httpAddr := net.JoinHostPort("", strconv.FormatInt(int64(*httpPort), 10))
 	router := mux.NewRouter()
-	router.HandleFunc("/push", s.PushHook).Methods("POST")
+	githubHook := s.WebhookHandler(github.ParsePush, *githubWebhookSecret)
+	router.HandleFunc("/push", githubHook).Methods("POST")
+	hooks := map[string]http.HandlerFunc{
+		"github":    githubHook,
+		"gitlab":    s.WebhookHandler(gitlab.ParsePush, *gitlabWebhookToken),
+		"gitea":     s.WebhookHandler(gitea.ParsePush, *giteaWebhookSecret),
+		"bitbucket": s.WebhookHandler(bitbucket.ParsePush, *bitbucketWebhookSecret),
+	}
+	for provider, hook := range hooks {
+		router.HandleFunc("/hook/"+provider, hook).Methods("POST")
+		router.HandleFunc("/hook/"+provider+"/{repo}", hook).Methods("POST")
+	}
+	router.HandleFunc("/hook/jobs/{delivery_id}", s.FetchJobHandler).Methods("GET")
+	router.HandleFunc("/status", s.StatusPage).Methods("GET")
+	router.HandleFunc("/raw/{ref_path:.+}", s.RawHandler).Methods("GET", "HEAD")
+	router.HandleFunc("/git/{repo}/info/refs", s.GitInfoRefs).Methods("GET")
+	router.HandleFunc("/git/{repo}/git-upload-pack", s.GitUploadPack).Methods("POST")
+	gateway.Register(router, s)
+	web.Register(router, s)
 	httpServer := &http.Server{
-		Handler: router,
-		Addr: httpAddr,
-		WriteTimeout: 15*time.Second,
-		ReadTimeout: 15*time.Second,
+		// Clones take as long as the repo takes to send, so /git/ is left
+		// out of the write timeout.
+		Handler:     withWriteTimeout(router, 15*time.Second, "/git/"),
+		Addr:        httpAddr,
+		ReadTimeout: 15 * time.Second,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connKey{}, c)
+		},
 	}
+	httpErr := make(chan error, 1)
 	go func() {
 		glog.Infof("HTTP server listening on %s", httpAddr)
-		glog.Fatal(httpServer.ListenAndServe())
+		httpErr <- httpServer.ListenAndServe()
+	}()
+
+	go s.Poll(context.Background(), pollOpts)
+	go s.Maintain(context.Background(), service.MaintenanceOptions{
+		Interval:        *maintenanceInterval,
+		MaxPacks:        *maintenanceMaxPacks,
+		MaxLooseObjects: *maintenanceMaxLooseObjects,
+		PruneGrace:      *maintenancePruneGrace,
+	})
+
+	grpcErr := make(chan error, 1)
+	go func() {
+		glog.Infof("Listening on %s", addr)
+		grpcErr <- grpcServer.Serve(conn)
 	}()
 
-	glog.Infof("Listening on %s", addr)
-	return grpcServer.Serve(conn)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt, syscall.SIGHUP)
+	for {
+		select {
+		case err := <-httpErr:
+			return fmt.Errorf("HTTP server failed: %v", err)
+		case err := <-grpcErr:
+			return fmt.Errorf("gRPC server failed: %v", err)
+		case sig := <-sigs:
+			if sig != syscall.SIGHUP {
+				glog.Infof("Received %v; shutting down", sig)
+				signal.Stop(sigs)
+				return shutdown(httpServer, grpcServer, s)
+			}
+			if cfg == nil {
+				glog.Warningf("Received SIGHUP without --config; nothing to reload")
+				continue
+			}
+			next, err := reloadConfig(s, cfg, *configPath)
+			if err != nil {
+				glog.Errorf("Failed to reload config; still serving the previous one: %v", err)
+				continue
+			}
+			cfg = next
+		}
+	}
+}
+
+// shutdown stops the servers within --shutdown_timeout. Webhooks stop first,
+// then queued and in-flight fetches finish while reads are still served, and
+// finally in-flight RPCs finish. The HTTP server finishes its requests while
+// fetches do, since a /git/ response has no write timeout and may take until
+// the deadline.
+func shutdown(httpServer *http.Server, grpcServer *grpc.Server, s *service.Service) error {
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+
+	httpErr := make(chan error, 1)
+	go func() {
+		httpErr <- httpServer.Shutdown(ctx)
+	}()
+	serviceErr := s.Shutdown(ctx)
+	var errs []string
+	if err := <-httpErr; err != nil {
+		errs = append(errs, fmt.Sprintf("HTTP server: %v", err))
+	}
+	if serviceErr != nil {
+		errs = append(errs, fmt.Sprintf("service: %v", serviceErr))
+	}
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		grpcServer.Stop()
+		errs = append(errs, "gRPC server: in-flight RPCs cancelled after --shutdown_timeout")
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("unclean shutdown: %s", strings.Join(errs, "; "))
+	}
+	glog.Infof("Shut down cleanly")
+	return nil
+}
+
+// connKey is the context key of the connection that a request arrived on.
+type connKey struct{}
+
+// withWriteTimeout gives each response d to be written, like
+// http.Server.WriteTimeout, except for responses to paths under noTimeout.
+func withWriteTimeout(h http.Handler, d time.Duration, noTimeout string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if conn, ok := r.Context().Value(connKey{}).(net.Conn); ok {
+			// The deadline is set for every request, since a kept-alive
+			// connection keeps the one of the request before.
+			var deadline time.Time
+			if !strings.HasPrefix(r.URL.Path, noTimeout) {
+				deadline = time.Now().Add(d)
+			}
+			conn.SetWriteDeadline(deadline)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// defaultRepoName derives a repo name from the last element of its URL, e.g.
+// "funhouse" from "https://github.com/minorhacks/funhouse.git".
+func defaultRepoName(url string) string {
+	url = strings.TrimSuffix(strings.TrimRight(url, "/"), ".git")
+	if i := strings.LastIndexAny(url, "/:"); i >= 0 {
+		url = url[i+1:]
+	}
+	return url
 }
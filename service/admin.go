@@ -0,0 +1,211 @@
+package service
+
+import (
+	"context"
+	"crypto/subtle"
+	"strings"
+
+	mapb "github.com/minorhacks/funhouse/proto/mirror_admin_proto"
+
+	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Admin implements the MirrorAdmin service, which adds and removes the repos
+// that a Service mirrors at runtime. Every call must carry Token as a bearer
+// token.
+type Admin struct {
+	Service *Service
+	Token   string
+}
+
+func (a *Admin) AddRepo(ctx context.Context, req *mapb.AddRepoRequest) (*mapb.RepoStatus, error) {
+	if err := a.authorize(ctx); err != nil {
+		return nil, err
+	}
+	if a.Service.shuttingDown() {
+		return nil, status.Errorf(codes.Unavailable, "server is shutting down")
+	}
+	if a.Service.HasRepo(req.Name) {
+		return nil, status.Errorf(codes.AlreadyExists, "repo %q already exists", req.Name)
+	}
+	if _, ok := a.Service.lookupComposite(req.Name); ok {
+		return nil, status.Errorf(codes.AlreadyExists, "repo %q has the name of a composite", req.Name)
+	}
+	r, err := a.Service.addRepo(req.Name, req.Url, RepoOptions{
+		Credentials:  credentialsFromProto(req.Credentials),
+		PartialClone: req.PartialClone,
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	// Cloning can take much longer than a request should, so report progress
+	// through GetRepoStatus instead.
+	go func() {
+		if err := r.clone(); err != nil {
+			glog.Errorf("AddRepo: failed to clone repo %q: %v", req.Name, err)
+		}
+	}()
+	return a.Service.repoStatus(r), nil
+}
+
+func (a *Admin) RemoveRepo(ctx context.Context, req *mapb.RemoveRepoRequest) (*mapb.RemoveRepoResponse, error) {
+	if err := a.authorize(ctx); err != nil {
+		return nil, err
+	}
+	if _, ok := a.Service.lookupRepo(req.Name); !ok || req.Name == "" {
+		return nil, status.Errorf(codes.NotFound, "repo %q not found", req.Name)
+	}
+	if err := a.Service.RemoveRepo(req.Name, req.KeepData); err != nil {
+		return nil, status.Errorf(codes.Internal, "%v", err)
+	}
+	return &mapb.RemoveRepoResponse{}, nil
+}
+
+func (a *Admin) ListRepos(ctx context.Context, req *mapb.ListReposRequest) (*mapb.ListReposResponse, error) {
+	if err := a.authorize(ctx); err != nil {
+		return nil, err
+	}
+	res := &mapb.ListReposResponse{}
+	for _, r := range a.Service.allRepos() {
+		res.Repos = append(res.Repos, a.Service.repoStatus(r))
+	}
+	return res, nil
+}
+
+func (a *Admin) FetchNow(ctx context.Context, req *mapb.FetchNowRequest) (*mapb.RepoStatus, error) {
+	if err := a.authorize(ctx); err != nil {
+		return nil, err
+	}
+	r, err := a.adminRepo(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.fetchAll(ctx); err != nil {
+		return nil, status.Errorf(codes.Unavailable, "%v", err)
+	}
+	return a.Service.repoStatus(r), nil
+}
+
+func (a *Admin) GetRepoStatus(ctx context.Context, req *mapb.GetRepoStatusRequest) (*mapb.RepoStatus, error) {
+	if err := a.authorize(ctx); err != nil {
+		return nil, err
+	}
+	r, err := a.adminRepo(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	return a.Service.repoStatus(r), nil
+}
+
+// adminRepo returns the named repo. Unlike the read RPCs, admin RPCs always
+// name the repo they act on.
+func (a *Admin) adminRepo(name string) (*Repo, error) {
+	r, ok := a.Service.lookupRepo(name)
+	if !ok || name == "" {
+		return nil, status.Errorf(codes.NotFound, "repo %q not found", name)
+	}
+	return r, nil
+}
+
+// authorize checks that the request carries the admin token.
+func (a *Admin) authorize(ctx context.Context) error {
+	if a.Token == "" {
+		return status.Errorf(codes.PermissionDenied, "admin RPCs are disabled")
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return status.Errorf(codes.Unauthenticated, "missing authorization header")
+	}
+	token := strings.TrimPrefix(values[0], "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) != 1 {
+		return status.Errorf(codes.PermissionDenied, "invalid admin token")
+	}
+	return nil
+}
+
+// repoStatus summarizes the state of a repo for MirrorAdmin.
+func (s *Service) repoStatus(r *Repo) *mapb.RepoStatus {
+	s.mu.RLock()
+	isDefault := s.defaultRepo == r.path
+	s.mu.RUnlock()
+
+	r.statusMu.Lock()
+	res := &mapb.RepoStatus{
+		Name:        r.path,
+		Url:         r.url,
+		Default:     isDefault,
+		CloneState:  r.cloneState.proto(),
+		FetchStatus: r.status.proto(),
+	}
+	if r.cloneErr != nil {
+		res.CloneError = r.cloneErr.Error()
+	}
+	if !r.maintStatus.lastRun.IsZero() {
+		res.LastMaintenanceTime = timestamppb.New(r.maintStatus.lastRun)
+	}
+	if r.maintStatus.lastErr != nil {
+		res.LastMaintenanceError = r.maintStatus.lastErr.Error()
+	}
+	r.statusMu.Unlock()
+
+	if res.CloneState != mapb.CloneState_CLONE_STATE_READY {
+		return res
+	}
+	if size, err := r.sizeOnDisk(); err != nil {
+		glog.Errorf("RepoStatus: %v", err)
+	} else {
+		res.SizeBytes = size
+	}
+	if count, err := r.refCount(); err != nil {
+		glog.Errorf("RepoStatus: %v", err)
+	} else {
+		res.RefCount = uint32(count)
+	}
+	if stats, err := r.storageStats(); err != nil {
+		glog.Errorf("RepoStatus: %v", err)
+	} else {
+		res.PackCount = uint32(stats.packs)
+		res.LooseObjectCount = uint32(stats.looseObjects)
+	}
+	return res
+}
+
+func credentialsFromProto(c *mapb.Credentials) Credentials {
+	if c == nil {
+		return Credentials{}
+	}
+	return Credentials{
+		Username:         c.Username,
+		Password:         secretFromProto(c.Password),
+		Token:            secretFromProto(c.Token),
+		SSHKey:           secretFromProto(c.SshKey),
+		SSHKeyPassphrase: secretFromProto(c.SshKeyPassphrase),
+		KnownHostsFile:   c.KnownHostsFile,
+	}
+}
+
+// secretFromProto only takes secrets by value. Unlike the config file, which
+// is trusted to name files and environment variables on the server, an admin
+// could otherwise read them by adding a repo whose URL points at a server of
+// their own.
+func secretFromProto(s *mapb.Secret) Secret {
+	return Secret{Value: s.GetValue()}
+}
+
+func (c cloneState) proto() mapb.CloneState {
+	switch c {
+	case cloneStateCloning:
+		return mapb.CloneState_CLONE_STATE_CLONING
+	case cloneStateReady:
+		return mapb.CloneState_CLONE_STATE_READY
+	case cloneStateFailed:
+		return mapb.CloneState_CLONE_STATE_FAILED
+	default:
+		return mapb.CloneState_CLONE_STATE_UNKNOWN
+	}
+}
@@ -0,0 +1,175 @@
+package service
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	fspb "github.com/minorhacks/funhouse/proto/git_read_fs_proto"
+	mapb "github.com/minorhacks/funhouse/proto/mirror_admin_proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func adminContext(token string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+token))
+}
+
+// waitForClone waits for a repo added through MirrorAdmin to finish cloning.
+func waitForClone(t *testing.T, a *Admin, name string) *mapb.RepoStatus {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		res, err := a.GetRepoStatus(adminContext(a.Token), &mapb.GetRepoStatusRequest{Name: name})
+		if err != nil {
+			t.Fatalf("GetRepoStatus() got error %v; want no error", err)
+		}
+		if res.CloneState != mapb.CloneState_CLONE_STATE_CLONING {
+			return res
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("repo %q still cloning after 10s", name)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAdminAuthorization(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		token    string
+		ctx      context.Context
+		wantCode codes.Code
+	}{
+		{
+			desc:     "valid token",
+			token:    "hunter2",
+			ctx:      adminContext("hunter2"),
+			wantCode: codes.OK,
+		},
+		{
+			desc:     "missing token",
+			token:    "hunter2",
+			ctx:      context.Background(),
+			wantCode: codes.Unauthenticated,
+		},
+		{
+			desc:     "wrong token",
+			token:    "hunter2",
+			ctx:      adminContext("hunter3"),
+			wantCode: codes.PermissionDenied,
+		},
+		{
+			desc:     "admin disabled",
+			token:    "",
+			ctx:      adminContext(""),
+			wantCode: codes.PermissionDenied,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			a := &Admin{Service: New(t.TempDir()), Token: tc.token}
+			_, err := a.ListRepos(tc.ctx, &mapb.ListReposRequest{})
+			if got := status.Code(err); got != tc.wantCode {
+				t.Errorf("ListRepos() got code %v; want %v", got, tc.wantCode)
+			}
+		})
+	}
+}
+
+func TestAdminRepoLifecycle(t *testing.T) {
+	origin := newTestOrigin(t)
+	origin.commit(map[string]string{"README.md": "v1"})
+	a := &Admin{Service: New(t.TempDir()), Token: "hunter2"}
+	ctx := adminContext(a.Token)
+
+	if _, err := a.AddRepo(ctx, &mapb.AddRepoRequest{Name: "test", Url: origin.url()}); err != nil {
+		t.Fatalf("AddRepo() got error %v; want no error", err)
+	}
+	if _, err := a.AddRepo(ctx, &mapb.AddRepoRequest{Name: "test", Url: origin.url()}); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("AddRepo() of duplicate repo got error %v; want AlreadyExists", err)
+	}
+	if err := a.Service.SetComposites(map[string][]CompositeMember{"both": {{Path: "test", Repo: "test"}}}); err != nil {
+		t.Fatalf("SetComposites() got error %v; want no error", err)
+	}
+	if _, err := a.AddRepo(ctx, &mapb.AddRepoRequest{Name: "both", Url: origin.url()}); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("AddRepo() with the name of a composite got error %v; want AlreadyExists", err)
+	}
+	got := waitForClone(t, a, "test")
+	if got.CloneState != mapb.CloneState_CLONE_STATE_READY {
+		t.Fatalf("repo finished cloning in state %v; want READY: %s", got.CloneState, got.CloneError)
+	}
+	if !got.Default {
+		t.Errorf("first repo added is not the default repo")
+	}
+	if got.SizeBytes == 0 {
+		t.Errorf("RepoStatus.SizeBytes = 0; want nonzero")
+	}
+	if got.RefCount == 0 {
+		t.Errorf("RepoStatus.RefCount = 0; want nonzero")
+	}
+
+	head := origin.commit(map[string]string{"README.md": "v2"})
+	got, err := a.FetchNow(ctx, &mapb.FetchNowRequest{Name: "test"})
+	if err != nil {
+		t.Fatalf("FetchNow() got error %v; want no error", err)
+	}
+	if got.FetchStatus.GetLastSuccessTime() == nil {
+		t.Errorf("RepoStatus.FetchStatus has no last success time after FetchNow")
+	}
+	if branch := mustListBranches(t, a.Service)["master"]; branch != head.String() {
+		t.Errorf("branch master = %q after FetchNow; want %q", branch, head)
+	}
+
+	list, err := a.ListRepos(ctx, &mapb.ListReposRequest{})
+	if err != nil {
+		t.Fatalf("ListRepos() got error %v; want no error", err)
+	}
+	if len(list.Repos) != 1 || list.Repos[0].Name != "test" {
+		t.Errorf("ListRepos() = %v; want only repo \"test\"", list.Repos)
+	}
+
+	dir := testRepo(t, a.Service).fullPath()
+	if _, err := a.RemoveRepo(ctx, &mapb.RemoveRepoRequest{Name: "test"}); err != nil {
+		t.Fatalf("RemoveRepo() got error %v; want no error", err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("repo data still exists at %q after RemoveRepo", dir)
+	}
+	if _, err := a.GetRepoStatus(ctx, &mapb.GetRepoStatusRequest{Name: "test"}); status.Code(err) != codes.NotFound {
+		t.Errorf("GetRepoStatus() of removed repo got error %v; want NotFound", err)
+	}
+}
+
+func TestAdminAddRepoFailure(t *testing.T) {
+	a := &Admin{Service: New(t.TempDir()), Token: "hunter2"}
+	ctx := adminContext(a.Token)
+
+	if _, err := a.AddRepo(ctx, &mapb.AddRepoRequest{Name: "../escape", Url: "/nonexistent"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("AddRepo() with invalid name got error %v; want InvalidArgument", err)
+	}
+	if _, err := a.AddRepo(ctx, &mapb.AddRepoRequest{Name: "missing", Url: t.TempDir()}); err != nil {
+		t.Fatalf("AddRepo() got error %v; want no error", err)
+	}
+	got := waitForClone(t, a, "missing")
+	if got.CloneState != mapb.CloneState_CLONE_STATE_FAILED || got.CloneError == "" {
+		t.Errorf("repo finished cloning in state %v with error %q; want FAILED with an error", got.CloneState, got.CloneError)
+	}
+	if _, err := a.Service.ListBranches(context.Background(), &fspb.ListBranchesRequest{Repo: "missing"}); status.Code(err) != codes.Unavailable {
+		t.Errorf("ListBranches() of failed repo got error %v; want Unavailable", err)
+	}
+
+	origin := newTestOrigin(t)
+	origin.commit(map[string]string{"README.md": "v1"})
+	if _, err := a.AddRepo(ctx, &mapb.AddRepoRequest{Name: "missing", Url: origin.url()}); err != nil {
+		t.Fatalf("AddRepo() of failed repo got error %v; want no error", err)
+	}
+	t.Cleanup(func() { a.Service.RemoveRepo("missing", false /* keepData */) })
+	if got := waitForClone(t, a, "missing"); got.CloneState != mapb.CloneState_CLONE_STATE_READY {
+		t.Errorf("repo added again finished cloning in state %v; want READY: %s", got.CloneState, got.CloneError)
+	}
+}
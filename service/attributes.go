@@ -0,0 +1,354 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	gitplumbing "github.com/go-git/go-git/v5/plumbing"
+	gitattributes "github.com/go-git/go-git/v5/plumbing/format/gitattributes"
+	gitobject "github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// gitAttributes looks up the .gitattributes of paths in a tree, as git does
+// when it reads them from a tree rather than a worktree. Each directory's file
+// is read once. Like a Tree, it is only used by one request.
+type gitAttributes struct {
+	tree Tree
+	dirs map[string][]gitattributes.MatchAttribute
+}
+
+func newGitAttributes(tree Tree) *gitAttributes {
+	return &gitAttributes{tree: tree, dirs: map[string][]gitattributes.MatchAttribute{}}
+}
+
+// lookup returns the named attributes of the file or directory at p. Names
+// that no pattern mentions are left out.
+func (a *gitAttributes) lookup(ctx context.Context, p string, names ...string) (map[string]gitattributes.Attribute, error) {
+	if p == "" {
+		return nil, nil
+	}
+	// Files deeper in the tree take priority, so they come last.
+	var stack []gitattributes.MatchAttribute
+	dir := ""
+	for _, elem := range strings.Split(p, "/") {
+		attrs, err := a.dir(ctx, dir)
+		if err != nil {
+			return nil, err
+		}
+		stack = append(stack, attrs...)
+		dir = path.Join(dir, elem)
+	}
+	results, _ := gitattributes.NewMatcher(stack).Match(strings.Split(p, "/"), names)
+	return results, nil
+}
+
+// dir returns the attributes in the .gitattributes file of a directory.
+func (a *gitAttributes) dir(ctx context.Context, dir string) ([]gitattributes.MatchAttribute, error) {
+	if attrs, ok := a.dirs[dir]; ok {
+		return attrs, nil
+	}
+	contents, err := a.tree.ReadFile(ctx, path.Join(dir, ".gitattributes"))
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, errNotFile) {
+		a.dirs[dir] = nil
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var domain []string
+	if dir != "" {
+		domain = strings.Split(dir, "/")
+	}
+	var attrs []gitattributes.MatchAttribute
+	for _, line := range strings.Split(string(contents), "\n") {
+		// As in git, a line that can't be parsed is skipped rather than
+		// spoiling the rest of the file. Macros can only be defined at the
+		// root.
+		attr, err := gitattributes.ParseAttributesLine(line, domain, dir == "")
+		if err != nil || attr.Name == "" {
+			continue
+		}
+		attrs = append(attrs, attr)
+	}
+	a.dirs[dir] = attrs
+	return attrs, nil
+}
+
+// isSet returns a predicate that reports whether a path has the named
+// attribute set in a tree.
+func (a *gitAttributes) isSet(name string) pathPredicate {
+	return func(ctx context.Context, p string) (bool, error) {
+		attrs, err := a.lookup(ctx, p, name)
+		if err != nil {
+			return false, err
+		}
+		attr, ok := attrs[name]
+		return ok && attr.IsSet(), nil
+	}
+}
+
+// ExportAttributes makes trees look like git archive's output: paths with the
+// export-ignore attribute are hidden, and $Format:...$ placeholders in files
+// with the export-subst attribute are expanded, as by git log --format, for
+// the commit. Attributes are read from the .gitattributes files in the tree
+// that the transformer is given.
+func ExportAttributes() Transformer {
+	return TransformerFunc(func(ctx context.Context, commit *gitobject.Commit, tree Tree) (Tree, error) {
+		attrs := newGitAttributes(tree)
+		ignore := attrs.isSet("export-ignore")
+		exported := &filterTree{
+			Tree: tree,
+			keep: func(ctx context.Context, p string) (bool, error) {
+				ignored, err := ignore(ctx, p)
+				return !ignored, err
+			},
+		}
+		return &rewriteTree{
+			Tree:   exported,
+			commit: commit,
+			match:  attrs.isSet("export-subst"),
+			rewrite: func(ctx context.Context, commit *gitobject.Commit, p string, contents []byte) ([]byte, error) {
+				return substFormats(contents, commit), nil
+			},
+		}, nil
+	})
+}
+
+// CheckoutAttributes makes the contents of files what git checkout would
+// write on Linux, with git's default config: the text, eol and ident
+// attributes of .gitattributes files are applied as they are on checkout.
+// Since core.eol is LF on Linux, line endings only change in text files with
+// eol=crlf. Filter drivers and working-tree-encoding aren't applied.
+func CheckoutAttributes() Transformer {
+	return TransformerFunc(func(ctx context.Context, commit *gitobject.Commit, tree Tree) (Tree, error) {
+		attrs := newGitAttributes(tree)
+		return &rewriteTree{
+			Tree:   tree,
+			commit: commit,
+			match: func(ctx context.Context, p string) (bool, error) {
+				conv, err := attrs.checkoutConversion(ctx, p)
+				return conv.ident || conv.eol != eolNone, err
+			},
+			rewrite: func(ctx context.Context, commit *gitobject.Commit, p string, contents []byte) ([]byte, error) {
+				conv, err := attrs.checkoutConversion(ctx, p)
+				if err != nil {
+					return nil, err
+				}
+				return conv.apply(contents), nil
+			},
+		}, nil
+	})
+}
+
+// eolConversion is how checkout changes the line endings of a file.
+type eolConversion int
+
+const (
+	eolNone eolConversion = iota
+	// eolCRLF converts every LF to CRLF.
+	eolCRLF
+	// eolAutoCRLF converts every LF to CRLF if the file looks like text and
+	// has no CRs yet.
+	eolAutoCRLF
+)
+
+// checkoutConversion is how checkout changes the contents of a file.
+type checkoutConversion struct {
+	eol   eolConversion
+	ident bool
+}
+
+// checkoutConversion works out how checkout changes the file at p, as
+// convert.c in git does.
+func (a *gitAttributes) checkoutConversion(ctx context.Context, p string) (checkoutConversion, error) {
+	attrs, err := a.lookup(ctx, p, "text", "crlf", "eol", "ident")
+	if err != nil {
+		return checkoutConversion{}, err
+	}
+	conv := checkoutConversion{}
+	if ident, ok := attrs["ident"]; ok && ident.IsSet() {
+		conv.ident = true
+	}
+	text, ok := attrs["text"]
+	if !ok || text.IsUnspecified() {
+		// crlf is text's name in old versions of git.
+		text, ok = attrs["crlf"]
+	}
+	eol, hasEOL := attrs["eol"]
+	if !hasEOL || !eol.IsValueSet() || eol.Value() != "crlf" {
+		// eol=lf, and core.eol's native LF, leave files as they are.
+		return conv, nil
+	}
+	switch {
+	case !ok || text.IsUnspecified() || text.IsSet():
+		// Setting eol makes a file text unless it says otherwise.
+		conv.eol = eolCRLF
+	case text.IsValueSet() && text.Value() == "auto":
+		conv.eol = eolAutoCRLF
+	}
+	return conv, nil
+}
+
+var identPattern = regexp.MustCompile(`\$Id(:[^$\n]*)?\$`)
+
+// apply changes the contents of a file as checkout would.
+func (conv checkoutConversion) apply(contents []byte) []byte {
+	if conv.ident {
+		// $Id$ names the blob as it is stored.
+		id := []byte("$Id: " + gitplumbing.ComputeHash(gitplumbing.BlobObject, contents).String() + " $")
+		contents = identPattern.ReplaceAllLiteral(contents, id)
+	}
+	switch conv.eol {
+	case eolAutoCRLF:
+		if bytes.IndexByte(contents, '\r') >= 0 || looksBinary(contents) {
+			return contents
+		}
+		fallthrough
+	case eolCRLF:
+		var b bytes.Buffer
+		for i, c := range contents {
+			if c == '\n' && (i == 0 || contents[i-1] != '\r') {
+				b.WriteByte('\r')
+			}
+			b.WriteByte(c)
+		}
+		return b.Bytes()
+	}
+	return contents
+}
+
+// looksBinary reports whether git would take contents to be binary: if they
+// have a NUL, or a lot of control characters.
+func looksBinary(contents []byte) bool {
+	printable, nonprintable := 0, 0
+	for i, c := range contents {
+		switch {
+		case c == 0:
+			return true
+		case c == '\n' || c == '\r' || c == '\b' || c == '\t' || c == '\033' || c == '\014':
+			printable++
+		case c == '\032' && i == len(contents)-1:
+			// DOS's end-of-file marker.
+		case c < 32 || c == 127:
+			nonprintable++
+		default:
+			printable++
+		}
+	}
+	return printable>>7 < nonprintable
+}
+
+var formatPattern = regexp.MustCompile(`\$Format:([^$]*)\$`)
+
+// substFormats expands the $Format:...$ placeholders in contents.
+func substFormats(contents []byte, commit *gitobject.Commit) []byte {
+	return formatPattern.ReplaceAllFunc(contents, func(m []byte) []byte {
+		return []byte(formatCommit(string(formatPattern.FindSubmatch(m)[1]), commit))
+	})
+}
+
+// abbrevLength is the length of abbreviated hashes, which is git's minimum.
+const abbrevLength = 7
+
+// gitDateLayouts are the layouts of the date placeholders of git log
+// --format, keyed by the placeholder's last letter.
+var gitDateLayouts = map[byte]string{
+	'd': "Mon Jan 2 15:04:05 2006 -0700",
+	'D': "Mon, 2 Jan 2006 15:04:05 -0700",
+	'i': "2006-01-02 15:04:05 -0700",
+	'I': "2006-01-02T15:04:05-07:00",
+}
+
+// formatCommit expands the placeholders of git log --format in format for
+// commit. Placeholders that need more than the commit, such as ref names, are
+// left as they are, as are unknown ones.
+func formatCommit(format string, commit *gitobject.Commit) string {
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i+1 == len(format) {
+			b.WriteByte(format[i])
+			continue
+		}
+		if s, n, ok := formatPlaceholder(format[i+1:], commit); ok {
+			b.WriteString(s)
+			i += n
+			continue
+		}
+		b.WriteByte(format[i])
+	}
+	return b.String()
+}
+
+// formatPlaceholder expands the placeholder at the start of p, which follows
+// a %, and returns how many bytes it took up.
+func formatPlaceholder(p string, commit *gitobject.Commit) (string, int, bool) {
+	switch p[0] {
+	case '%':
+		return "%", 1, true
+	case 'n':
+		return "\n", 1, true
+	case 'H':
+		return commit.Hash.String(), 1, true
+	case 'h':
+		return commit.Hash.String()[:abbrevLength], 1, true
+	case 'T':
+		return commit.TreeHash.String(), 1, true
+	case 't':
+		return commit.TreeHash.String()[:abbrevLength], 1, true
+	case 'P', 'p':
+		var parents []string
+		for _, h := range commit.ParentHashes {
+			hash := h.String()
+			if p[0] == 'p' {
+				hash = hash[:abbrevLength]
+			}
+			parents = append(parents, hash)
+		}
+		return strings.Join(parents, " "), 1, true
+	case 's':
+		subject, _ := splitMessage(commit.Message)
+		return subject, 1, true
+	case 'b':
+		_, body := splitMessage(commit.Message)
+		return body, 1, true
+	case 'B':
+		return commit.Message, 1, true
+	case 'a', 'c':
+		if len(p) < 2 {
+			return "", 0, false
+		}
+		sig := commit.Author
+		if p[0] == 'c' {
+			sig = commit.Committer
+		}
+		switch p[1] {
+		case 'n':
+			return sig.Name, 2, true
+		case 'e':
+			return sig.Email, 2, true
+		case 't':
+			return strconv.FormatInt(sig.When.Unix(), 10), 2, true
+		}
+		if layout, ok := gitDateLayouts[p[1]]; ok {
+			return sig.When.Format(layout), 2, true
+		}
+	}
+	return "", 0, false
+}
+
+// splitMessage splits a commit message into its subject, the first
+// paragraph joined into one line, and its body, the rest.
+func splitMessage(msg string) (subject string, body string) {
+	msg = strings.TrimLeft(msg, "\n")
+	para := msg
+	if i := strings.Index(msg, "\n\n"); i >= 0 {
+		para, body = msg[:i], strings.TrimLeft(msg[i:], "\n")
+	}
+	return strings.ReplaceAll(strings.TrimRight(para, "\n"), "\n", " "), body
+}
@@ -0,0 +1,193 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	fspb "github.com/minorhacks/funhouse/proto/git_read_fs_proto"
+
+	gitplumbing "github.com/go-git/go-git/v5/plumbing"
+	gitobject "github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/testing/protocmp"
+)
+
+func TestExportAttributes(t *testing.T) {
+	origin := newTestOrigin(t)
+	head := origin.commit(map[string]string{
+		".gitattributes":      "internal export-ignore\n*.pem export-ignore\nVERSION export-subst\n",
+		"README.md":           "$Format:%H$\n",
+		"VERSION":             "$Format:%h$ by $Format:%an <%ae>$ on $Format:%ad$\n",
+		"docs/.gitattributes": "draft.md export-ignore\n",
+		"docs/draft.md":       "TODO\n",
+		"docs/guide.md":       "Guide\n",
+		"internal/secret.txt": "hunter2\n",
+		"src/VERSION":         "$Format:%s$\n",
+		"src/server.pem":      "KEY\n",
+	})
+	s := newTestService(t, origin)
+	if err := s.UpdateRepo("test", origin.url(), RepoOptions{Views: map[string][]Transformer{"export": {ExportAttributes()}}}); err != nil {
+		t.Fatalf("UpdateRepo() got error %v; want no error", err)
+	}
+	ctx := context.Background()
+
+	dirTestCases := []struct {
+		path        string
+		wantEntries []*fspb.DirEntry
+	}{
+		{
+			path: "/",
+			wantEntries: []*fspb.DirEntry{
+				{Name: ".gitattributes", Mode: fspb.FileMode_MODE_REGULAR},
+				{Name: "README.md", Mode: fspb.FileMode_MODE_REGULAR},
+				{Name: "VERSION", Mode: fspb.FileMode_MODE_REGULAR},
+				{Name: "docs", Mode: fspb.FileMode_MODE_DIR},
+				{Name: "src", Mode: fspb.FileMode_MODE_DIR},
+			},
+		},
+		{
+			path: "/docs",
+			wantEntries: []*fspb.DirEntry{
+				{Name: ".gitattributes", Mode: fspb.FileMode_MODE_REGULAR},
+				{Name: "guide.md", Mode: fspb.FileMode_MODE_REGULAR},
+			},
+		},
+		{
+			path:        "/src",
+			wantEntries: []*fspb.DirEntry{{Name: "VERSION", Mode: fspb.FileMode_MODE_REGULAR}},
+		},
+	}
+	for _, tc := range dirTestCases {
+		res, err := s.ListDir(ctx, &fspb.ListDirRequest{Commit: head.String(), Path: tc.path, View: "export"})
+		if err != nil {
+			t.Fatalf("ListDir(%q) got error %v; want no error", tc.path, err)
+		}
+		if diff := cmp.Diff(tc.wantEntries, res.Entries, protocmp.Transform()); diff != "" {
+			t.Errorf("ListDir(%q) returned diff (-want +got):\n%s", tc.path, diff)
+		}
+	}
+
+	fileTestCases := []struct {
+		path         string
+		wantContents string
+		wantCode     codes.Code
+	}{
+		{
+			path:         "/VERSION",
+			wantContents: head.String()[:7] + " by Funhouse Test <test@example.com> on Sat Sep 18 12:00:00 2021 +0000\n",
+		},
+		{
+			path:         "/src/VERSION",
+			wantContents: "test commit\n",
+		},
+		{
+			path:         "/README.md",
+			wantContents: "$Format:%H$\n",
+		},
+		{path: "/internal/secret.txt", wantCode: codes.NotFound},
+		{path: "/internal", wantCode: codes.NotFound},
+		{path: "/src/server.pem", wantCode: codes.NotFound},
+		{path: "/docs/draft.md", wantCode: codes.NotFound},
+	}
+	for _, tc := range fileTestCases {
+		attrs, err := s.GetAttributes(ctx, &fspb.GetAttributesRequest{Commit: head.String(), Path: tc.path, View: "export"})
+		if got := status.Code(err); got != tc.wantCode {
+			t.Errorf("GetAttributes(%q) got code %v (error %v); want %v", tc.path, got, err, tc.wantCode)
+			continue
+		}
+		if tc.wantCode != codes.OK {
+			continue
+		}
+		file, err := s.GetFile(ctx, &fspb.GetFileRequest{Commit: head.String(), Path: tc.path, View: "export"})
+		if err != nil {
+			t.Fatalf("GetFile(%q) got error %v; want no error", tc.path, err)
+		}
+		if got := string(file.Contents); got != tc.wantContents {
+			t.Errorf("GetFile(%q) = %q; want %q", tc.path, got, tc.wantContents)
+		}
+		if got, want := attrs.SizeBytes, uint64(len(tc.wantContents)); got != want {
+			t.Errorf("GetAttributes(%q).SizeBytes = %d; want %d", tc.path, got, want)
+		}
+	}
+}
+
+func TestFormatCommit(t *testing.T) {
+	when := time.Date(2021, 9, 18, 12, 30, 0, 0, time.FixedZone("", -4*60*60))
+	commit := &gitobject.Commit{
+		Hash:      gitplumbing.NewHash("0123456789abcdef0123456789abcdef01234567"),
+		TreeHash:  gitplumbing.NewHash("89abcdef0123456789abcdef0123456789abcdef"),
+		Author:    gitobject.Signature{Name: "Author", Email: "author@example.com", When: when},
+		Committer: gitobject.Signature{Name: "Committer", Email: "committer@example.com", When: when.Add(time.Hour)},
+		Message:   "Fix the\nthing\n\nIt was broken.\n",
+		ParentHashes: []gitplumbing.Hash{
+			gitplumbing.NewHash("1111111111111111111111111111111111111111"),
+			gitplumbing.NewHash("2222222222222222222222222222222222222222"),
+		},
+	}
+	for format, want := range map[string]string{
+		"%H":         "0123456789abcdef0123456789abcdef01234567",
+		"%h %t":      "0123456 89abcde",
+		"%p":         "1111111 2222222",
+		"%s":         "Fix the thing",
+		"%b":         "It was broken.\n",
+		"%cn <%ce>":  "Committer <committer@example.com>",
+		"%ai":        "2021-09-18 12:30:00 -0400",
+		"%cI":        "2021-09-18T13:30:00-04:00",
+		"%aD":        "Sat, 18 Sep 2021 12:30:00 -0400",
+		"%at":        "1631982600",
+		"100%% %n":   "100% \n",
+		"%d %x %a %": "%d %x %a %",
+	} {
+		if got := formatCommit(format, commit); got != want {
+			t.Errorf("formatCommit(%q) = %q; want %q", format, got, want)
+		}
+	}
+}
+
+func TestCheckoutAttributes(t *testing.T) {
+	origin := newTestOrigin(t)
+	head := origin.commit(map[string]string{
+		".gitattributes": "*.bat eol=crlf\n*.txt text=auto eol=crlf\n*.go ident\n*.sh text eol=lf\nraw.bat -text\n",
+		"run.bat":        "@echo off\necho hi\n",
+		"raw.bat":        "a\nb\n",
+		"notes.txt":      "one\ntwo\n",
+		"dos.txt":        "one\r\ntwo\n",
+		"data.txt":       "\x00\x01\n",
+		"main.go":        "// $Id$\npackage main\n",
+		"run.sh":         "echo hi\n",
+	})
+	s := newTestService(t, origin)
+	if err := s.UpdateRepo("test", origin.url(), RepoOptions{Views: map[string][]Transformer{"checkout": {CheckoutAttributes()}}}); err != nil {
+		t.Fatalf("UpdateRepo() got error %v; want no error", err)
+	}
+	ctx := context.Background()
+
+	mainID := gitplumbing.ComputeHash(gitplumbing.BlobObject, []byte("// $Id$\npackage main\n")).String()
+	for p, want := range map[string]string{
+		"/run.bat":   "@echo off\r\necho hi\r\n",
+		"/raw.bat":   "a\nb\n",
+		"/notes.txt": "one\r\ntwo\r\n",
+		"/dos.txt":   "one\r\ntwo\n",
+		"/data.txt":  "\x00\x01\n",
+		"/main.go":   "// $Id: " + mainID + " $\npackage main\n",
+		"/run.sh":    "echo hi\n",
+	} {
+		file, err := s.GetFile(ctx, &fspb.GetFileRequest{Commit: head.String(), Path: p, View: "checkout"})
+		if err != nil {
+			t.Fatalf("GetFile(%q) got error %v; want no error", p, err)
+		}
+		if got := string(file.Contents); got != want {
+			t.Errorf("GetFile(%q) = %q; want %q", p, got, want)
+		}
+		attrs, err := s.GetAttributes(ctx, &fspb.GetAttributesRequest{Commit: head.String(), Path: p, View: "checkout"})
+		if err != nil {
+			t.Fatalf("GetAttributes(%q) got error %v; want no error", p, err)
+		}
+		if got, want := attrs.SizeBytes, uint64(len(want)); got != want {
+			t.Errorf("GetAttributes(%q).SizeBytes = %d; want %d", p, got, want)
+		}
+	}
+}
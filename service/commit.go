@@ -0,0 +1,138 @@
+package service
+
+import (
+	"bytes"
+	"context"
+
+	fspb "github.com/minorhacks/funhouse/proto/git_read_fs_proto"
+
+	gitplumbing "github.com/go-git/go-git/v5/plumbing"
+	gitdiff "github.com/go-git/go-git/v5/plumbing/format/diff"
+	gitobject "github.com/go-git/go-git/v5/plumbing/object"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func (s *Service) GetCommit(ctx context.Context, req *fspb.GetCommitRequest) (*fspb.GetCommitResponse, error) {
+	if c, ok := s.lookupComposite(req.Repo); ok {
+		return s.getCompositeCommit(ctx, c, req.Commit)
+	}
+	repo, err := s.readerFor(req.Repo)
+	if err != nil {
+		return nil, err
+	}
+	defer repo.release()
+	commit, err := repo.git.CommitObject(gitplumbing.NewHash(req.Commit))
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "commit %q not found in repo: %v", req.Commit, err)
+	}
+
+	res := &fspb.GetCommitResponse{
+		Hash:      commit.Hash.String(),
+		Author:    signatureProto(commit.Author),
+		Committer: signatureProto(commit.Committer),
+		Message:   commit.Message,
+	}
+	for _, parent := range commit.ParentHashes {
+		res.ParentHashes = append(res.ParentHashes, parent.String())
+	}
+	if req.IncludeDiff {
+		// Diffs are of the repo's own trees, which no view has distorted.
+		if repo.viewRequired() {
+			return nil, viewRequired(repo.path)
+		}
+		res.Diff, err = repo.diff(ctx, commit)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// diff returns the changes that a commit made to the files of its first
+// parent.
+func (rd *repoReader) diff(ctx context.Context, commit *gitobject.Commit) ([]*fspb.FileDiff, error) {
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "can't get tree for commit %q: %v", commit.Hash, err)
+	}
+	var parentTree *gitobject.Tree
+	if commit.NumParents() > 0 {
+		parent, err := commit.Parent(0)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "can't get parent of commit %q: %v", commit.Hash, err)
+		}
+		parentTree, err = parent.Tree()
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "can't get tree for commit %q: %v", parent.Hash, err)
+		}
+	}
+
+	opts := gitobject.DefaultDiffTreeOptions
+	if rd.partial {
+		// Detecting renames compares the contents of every added and
+		// deleted file, which would fetch blobs that aren't needed.
+		opts = nil
+	}
+	changes, err := gitobject.DiffTreeWithOptions(ctx, parentTree, tree, opts)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "can't diff commit %q: %v", commit.Hash, err)
+	}
+	for _, change := range changes {
+		for _, entry := range []gitobject.ChangeEntry{change.From, change.To} {
+			if entry.Name == "" || !entry.TreeEntry.Mode.IsFile() {
+				continue
+			}
+			// Fetches the blob first if this is a partial clone.
+			if _, err := rd.blobSize(ctx, entry.TreeEntry.Hash); err != nil {
+				return nil, status.Errorf(codes.Unavailable, "can't get blob for file %q: %v", entry.Name, err)
+			}
+		}
+	}
+	patch, err := changes.PatchContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "can't diff commit %q: %v", commit.Hash, err)
+	}
+
+	var res []*fspb.FileDiff
+	for _, fp := range patch.FilePatches() {
+		d := &fspb.FileDiff{Binary: fp.IsBinary()}
+		from, to := fp.Files()
+		if from != nil {
+			d.FromPath = from.Path()
+		}
+		if to != nil {
+			d.ToPath = to.Path()
+		}
+		var buf bytes.Buffer
+		if err := gitdiff.NewUnifiedEncoder(&buf, gitdiff.DefaultContextLines).Encode(filePatch{fp}); err != nil {
+			return nil, status.Errorf(codes.Internal, "can't encode diff of commit %q: %v", commit.Hash, err)
+		}
+		d.Patch = buf.String()
+		res = append(res, d)
+	}
+	return res, nil
+}
+
+// filePatch is a patch of a single file, so that each file's diff can be
+// encoded on its own.
+type filePatch struct {
+	gitdiff.FilePatch
+}
+
+func (p filePatch) FilePatches() []gitdiff.FilePatch {
+	return []gitdiff.FilePatch{p.FilePatch}
+}
+
+func (p filePatch) Message() string {
+	return ""
+}
+
+func signatureProto(sig gitobject.Signature) *fspb.Signature {
+	return &fspb.Signature{
+		Name:  sig.Name,
+		Email: sig.Email,
+		Time:  timestamppb.New(sig.When),
+	}
+}
@@ -0,0 +1,127 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	fspb "github.com/minorhacks/funhouse/proto/git_read_fs_proto"
+
+	git "github.com/go-git/go-git/v5"
+	gitobject "github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestGetCommit(t *testing.T) {
+	origin := newTestOrigin(t)
+	first := origin.commit(map[string]string{"README.md": "v1\n", "LICENSE": "MIT\n"})
+	second := origin.commit(map[string]string{"README.md": "v2\n"})
+	s := newTestService(t, origin)
+	ctx := context.Background()
+
+	testCases := []struct {
+		desc        string
+		commit      string
+		wantParents []string
+		// wantDiff maps each changed file to lines its patch must contain.
+		wantDiff map[string][]string
+	}{
+		{
+			desc:     "root commit",
+			commit:   first.String(),
+			wantDiff: map[string][]string{"LICENSE": {"+MIT"}, "README.md": {"+v1"}},
+		},
+		{
+			desc:        "child commit",
+			commit:      second.String(),
+			wantParents: []string{first.String()},
+			wantDiff:    map[string][]string{"README.md": {"-v1", "+v2"}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			res, err := s.GetCommit(ctx, &fspb.GetCommitRequest{Commit: tc.commit, IncludeDiff: true})
+			if err != nil {
+				t.Fatalf("GetCommit() got error %v; want no error", err)
+			}
+			if res.Hash != tc.commit {
+				t.Errorf("GetCommit() returned hash %q; want %q", res.Hash, tc.commit)
+			}
+			if diff := cmp.Diff(tc.wantParents, res.ParentHashes); diff != "" {
+				t.Errorf("GetCommit() returned parents diff (-want +got):\n%s", diff)
+			}
+			if got, want := res.Author.Email, "test@example.com"; got != want {
+				t.Errorf("GetCommit() returned author %q; want %q", got, want)
+			}
+			if got, want := res.Message, "test commit"; got != want {
+				t.Errorf("GetCommit() returned message %q; want %q", got, want)
+			}
+			if got, want := len(res.Diff), len(tc.wantDiff); got != want {
+				t.Fatalf("GetCommit() returned %d changed files; want %d: %v", got, want, res.Diff)
+			}
+			for _, d := range res.Diff {
+				wantLines, ok := tc.wantDiff[d.ToPath]
+				if !ok {
+					t.Errorf("GetCommit() returned unexpected change to %q", d.ToPath)
+					continue
+				}
+				for _, line := range wantLines {
+					if !strings.Contains(d.Patch, "\n"+line+"\n") {
+						t.Errorf("patch of %q is missing line %q:\n%s", d.ToPath, line, d.Patch)
+					}
+				}
+			}
+		})
+	}
+
+	res, err := s.GetCommit(ctx, &fspb.GetCommitRequest{Commit: second.String()})
+	if err != nil {
+		t.Fatalf("GetCommit() got error %v; want no error", err)
+	}
+	if res.Diff != nil {
+		t.Errorf("GetCommit() without include_diff returned diff %v", res.Diff)
+	}
+}
+
+func TestListTags(t *testing.T) {
+	origin := newTestOrigin(t)
+	head := origin.commit(map[string]string{"README.md": "v1"})
+	if _, err := origin.repo.CreateTag("lightweight", head, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := origin.repo.CreateTag("annotated", head, &git.CreateTagOptions{
+		Message: "annotated",
+		Tagger:  &gitobject.Signature{Name: "Funhouse Test", Email: "test@example.com"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestService(t, origin)
+
+	res, err := s.ListTags(context.Background(), &fspb.ListTagsRequest{})
+	if err != nil {
+		t.Fatalf("ListTags() got error %v; want no error", err)
+	}
+	want := map[string]string{"lightweight": head.String(), "annotated": head.String()}
+	if diff := cmp.Diff(want, res.Tags); diff != "" {
+		t.Errorf("ListTags() returned diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestListRepos(t *testing.T) {
+	origin := newTestOrigin(t)
+	origin.commit(map[string]string{"README.md": "v1"})
+	s := newTestService(t, origin)
+	if err := s.AddRepo("another", origin.url(), RepoOptions{}); err != nil {
+		t.Fatalf("AddRepo() got error %v; want no error", err)
+	}
+
+	res, err := s.ListRepos(context.Background(), &fspb.ListReposRequest{})
+	if err != nil {
+		t.Fatalf("ListRepos() got error %v; want no error", err)
+	}
+	want := &fspb.ListReposResponse{Repos: []string{"another", "test"}, DefaultRepo: "test"}
+	if diff := cmp.Diff(want.Repos, res.Repos); diff != "" || res.DefaultRepo != want.DefaultRepo {
+		t.Errorf("ListRepos() = %v; want %v", res, want)
+	}
+}
@@ -0,0 +1,559 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	fspb "github.com/minorhacks/funhouse/proto/git_read_fs_proto"
+
+	gitplumbing "github.com/go-git/go-git/v5/plumbing"
+	gitobject "github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Composites
+//
+// A composite is a synthetic repo whose tree mounts the trees of branches of
+// other mirrored repos at paths of its own, so that several repos can be
+// browsed, mounted and built as one workspace. It is served under its own
+// name wherever the GitReadFs API takes a repo.
+//
+// Each commit of a composite is a tuple of its members' commits, and its hash
+// is the SHA-1 of that tuple, so that the same tuple always has the same hash.
+// The service records a commit whenever it sees the members' branches at a
+// new tuple, with the previous head as its parent, and keeps the commits it
+// has recorded under BasePath so that their hashes still work after a
+// restart.
+
+// compositeBranch is the name of a composite's only branch.
+const compositeBranch = "main"
+
+// compositesDir is the directory under BasePath that keeps the commits of
+// composites. Repo names can't start with a dot, so it can't clash with one.
+const compositesDir = ".composites"
+
+// CompositeMember mounts a branch of a mirrored repo in a composite.
+type CompositeMember struct {
+	// Path is where the member's tree appears in the composite.
+	Path string
+	Repo string
+	// Branch is the branch of Repo that the composite follows, or Repo's
+	// HEAD if it is empty.
+	Branch string
+	// View, if set, is the view of Repo that the composite shows.
+	View string
+}
+
+type composite struct {
+	name string
+	// file keeps the composite's commits, one JSON object per line.
+	file string
+
+	mu      sync.Mutex
+	members []CompositeMember
+	commits map[string]*compositeCommit
+	// order lists the commits in the order they were recorded.
+	order []*compositeCommit
+	head  *compositeCommit
+	// removed is closed when the composite stops being served.
+	removed chan struct{}
+}
+
+// compositeCommit is a commit of a composite.
+type compositeCommit struct {
+	Hash    string         `json:"hash"`
+	Parent  string         `json:"parent,omitempty"`
+	Members []memberCommit `json:"members"`
+}
+
+// memberCommit is the commit of one member in a composite commit.
+type memberCommit struct {
+	Path   string `json:"path"`
+	Repo   string `json:"repo"`
+	View   string `json:"view,omitempty"`
+	Commit string `json:"commit"`
+}
+
+// compositeHash returns the hash of a composite commit with members, which
+// must be sorted by path.
+func compositeHash(members []memberCommit) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "funhouse composite\n")
+	for _, m := range members {
+		fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\n", m.Path, m.Repo, m.View, m.Commit)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// SetComposites replaces the composites that the service serves with
+// composites, keyed by name. Composite names can't be used by repos, but a
+// composite's member repos needn't be served yet; reads of the composite fail
+// until they are.
+func (s *Service) SetComposites(composites map[string][]CompositeMember) error {
+	for name, members := range composites {
+		if err := ValidateComposite(name, members); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return fmt.Errorf("service is shutting down")
+	}
+	for name := range composites {
+		if _, ok := s.repos[name]; ok {
+			return fmt.Errorf("composite %q has the name of a repo", name)
+		}
+	}
+	next := map[string]*composite{}
+	for name, members := range composites {
+		c, ok := s.composites[name]
+		if !ok {
+			var err error
+			if c, err = loadComposite(name, filepath.Join(s.BasePath, compositesDir, name+".json")); err != nil {
+				return err
+			}
+		}
+		c.setMembers(members)
+		next[name] = c
+	}
+	for name, c := range s.composites {
+		if _, ok := next[name]; !ok {
+			close(c.removed)
+		}
+	}
+	s.composites = next
+	return nil
+}
+
+// ValidateComposite returns an error if a composite can't have name and
+// members.
+func ValidateComposite(name string, members []CompositeMember) error {
+	if err := ValidateRepoName(name); err != nil {
+		return fmt.Errorf("composite: %v", err)
+	}
+	if len(members) == 0 {
+		return fmt.Errorf("composite %q has no members", name)
+	}
+	paths := map[string]bool{}
+	for _, m := range members {
+		p := treePath(m.Path)
+		if p == "" {
+			return fmt.Errorf("composite %q: member repo %q can't be mounted at the root", name, m.Repo)
+		}
+		if paths[p] {
+			return fmt.Errorf("composite %q: more than one member is mounted at %q", name, p)
+		}
+		paths[p] = true
+		if err := ValidateRepoName(m.Repo); err != nil {
+			return fmt.Errorf("composite %q: %v", name, err)
+		}
+		if m.View != "" {
+			if err := ValidateViewName(m.View); err != nil {
+				return fmt.Errorf("composite %q: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// lookupComposite returns the named composite.
+func (s *Service) lookupComposite(name string) (*composite, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c, ok := s.composites[name]
+	return c, ok
+}
+
+// allComposites returns the composites sorted by name.
+func (s *Service) allComposites() []*composite {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var composites []*composite
+	for _, c := range s.composites {
+		composites = append(composites, c)
+	}
+	sort.Slice(composites, func(i, j int) bool { return composites[i].name < composites[j].name })
+	return composites
+}
+
+// loadComposite returns a composite with the commits recorded in file, if it
+// exists.
+func loadComposite(name string, file string) (*composite, error) {
+	c := &composite{
+		name:    name,
+		file:    file,
+		commits: map[string]*compositeCommit{},
+		removed: make(chan struct{}),
+	}
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("composite %q: failed to read commits: %v", name, err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		cc := &compositeCommit{}
+		if err := json.Unmarshal(scanner.Bytes(), cc); err != nil {
+			return nil, fmt.Errorf("composite %q: malformed commit in %q: %v", name, file, err)
+		}
+		c.add(cc)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("composite %q: failed to read commits: %v", name, err)
+	}
+	return c, nil
+}
+
+func (c *composite) setMembers(members []CompositeMember) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.members = members
+}
+
+// add makes cc the head, recording it unless it has been seen before. It must
+// be called with c.mu held, or before c is shared.
+func (c *composite) add(cc *compositeCommit) (isNew bool) {
+	if old, ok := c.commits[cc.Hash]; ok {
+		c.head = old
+		return false
+	}
+	c.commits[cc.Hash] = cc
+	c.order = append(c.order, cc)
+	c.head = cc
+	return true
+}
+
+// record makes the commit with members the head, recording it if it is new.
+func (c *composite) record(members []memberCommit) *compositeCommit {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cc := &compositeCommit{Hash: compositeHash(members), Members: members}
+	if c.head != nil && c.head.Hash == cc.Hash {
+		return c.head
+	}
+	if c.head != nil {
+		cc.Parent = c.head.Hash
+	}
+	if !c.add(cc) {
+		return c.head
+	}
+	// A commit that can't be kept still works until the server restarts.
+	if err := appendJSONLine(c.file, cc); err != nil {
+		glog.Errorf("Composite %q: failed to keep commit %s: %v", c.name, cc.Hash, err)
+	}
+	return cc
+}
+
+func appendJSONLine(file string, v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// commit returns the recorded commit with hash.
+func (c *composite) commit(hash string) (*compositeCommit, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cc, ok := c.commits[hash]
+	return cc, ok
+}
+
+// allCommits returns the recorded commits.
+func (c *composite) allCommits() []*compositeCommit {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*compositeCommit(nil), c.order...)
+}
+
+func (c *composite) currentMembers() []CompositeMember {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.members
+}
+
+// compositeHead records and returns the composite's commit for the current heads of
+// its members' branches.
+func (s *Service) compositeHead(c *composite) (*compositeCommit, error) {
+	var members []memberCommit
+	for _, m := range c.currentMembers() {
+		rd, err := s.compositeReader(c, m.Repo)
+		if err != nil {
+			return nil, err
+		}
+		var ref *gitplumbing.Reference
+		branch := m.Branch
+		if branch == "" {
+			branch = "HEAD"
+			ref, err = rd.git.Head()
+		} else {
+			ref, err = rd.git.Reference(gitplumbing.NewBranchReferenceName(branch), true)
+		}
+		rd.release()
+		if err != nil {
+			return nil, status.Errorf(codes.FailedPrecondition, "composite %q: can't find %s of repo %q: %v", c.name, branch, m.Repo, err)
+		}
+		members = append(members, memberCommit{Path: treePath(m.Path), Repo: m.Repo, View: m.View, Commit: ref.Hash().String()})
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Path < members[j].Path })
+	return c.record(members), nil
+}
+
+// compositeReader returns a reader of a member repo of a composite.
+func (s *Service) compositeReader(c *composite, repo string) (*repoReader, error) {
+	rd, err := s.readerFor(repo)
+	if err != nil {
+		return nil, status.Errorf(status.Code(err), "composite %q: member %v", c.name, status.Convert(err).Message())
+	}
+	return rd, nil
+}
+
+// compositeTree returns the tree of a composite commit, and a commit that
+// describes it. The composite has no views of its own. release must be called
+// once the tree is no longer used.
+func (s *Service) compositeTree(ctx context.Context, c *composite, hash string, view string) (Tree, *gitobject.Commit, func(), error) {
+	if view != "" {
+		return nil, nil, nil, status.Errorf(codes.NotFound, "view %q not found in composite %q", view, c.name)
+	}
+	cc, ok := c.commit(hash)
+	if !ok {
+		return nil, nil, nil, status.Errorf(codes.NotFound, "commit %q not found in composite %q", hash, c.name)
+	}
+
+	// Readers are taken in order of repo name, and only once per repo, so
+	// that composites that share repos can't deadlock with a fetch that is
+	// waiting to publish.
+	readers := map[string]*repoReader{}
+	release := func() {
+		for _, rd := range readers {
+			rd.release()
+		}
+	}
+	var repos []string
+	for _, m := range cc.Members {
+		repos = append(repos, m.Repo)
+	}
+	sort.Strings(repos)
+	for _, repo := range repos {
+		if _, ok := readers[repo]; ok {
+			continue
+		}
+		rd, err := s.compositeReader(c, repo)
+		if err != nil {
+			release()
+			return nil, nil, nil, err
+		}
+		readers[repo] = rd
+	}
+
+	tree := &mountTree{base: emptyTree{}, mounts: map[string]Tree{}}
+	commit := &gitobject.Commit{
+		Hash:      gitplumbing.NewHash(cc.Hash),
+		Author:    gitobject.Signature{Name: "funhouse"},
+		Committer: gitobject.Signature{Name: "funhouse"},
+	}
+	if cc.Parent != "" {
+		commit.ParentHashes = []gitplumbing.Hash{gitplumbing.NewHash(cc.Parent)}
+	}
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "Composite %s of:\n\n", c.name)
+	for _, m := range cc.Members {
+		memberTree, memberCommit, err := readers[m.Repo].tree(ctx, m.Commit, m.View)
+		if err != nil {
+			release()
+			return nil, nil, nil, status.Errorf(status.Code(err), "composite %q: member %q: %v", c.name, m.Path, status.Convert(err).Message())
+		}
+		tree.mounts[m.Path] = memberTree
+		// The composite changed when its newest member did.
+		if memberCommit.Author.When.After(commit.Author.When) {
+			commit.Author.When = memberCommit.Author.When
+		}
+		if memberCommit.Committer.When.After(commit.Committer.When) {
+			commit.Committer.When = memberCommit.Committer.When
+		}
+		fmt.Fprintf(&msg, "%s: %s %s\n", m.Path, m.Repo, m.Commit)
+	}
+	commit.Message = msg.String()
+	return tree, commit, release, nil
+}
+
+// treeFor returns the tree of a commit in the repo or composite that a
+// request names, as the named view shows it, along with the commit. release
+// must be called once the tree is no longer used.
+func (s *Service) treeFor(ctx context.Context, repo string, hash string, view string) (Tree, *gitobject.Commit, func(), error) {
+	if c, ok := s.lookupComposite(repo); ok {
+		return s.compositeTree(ctx, c, hash, view)
+	}
+	rd, err := s.readerFor(repo)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	tree, commit, err := rd.tree(ctx, hash, view)
+	if err != nil {
+		rd.release()
+		return nil, nil, nil, err
+	}
+	return tree, commit, rd.release, nil
+}
+
+// listCompositeCommits lists the commits of a composite, recording the
+// current one first.
+func (s *Service) listCompositeCommits(c *composite, view string) (*fspb.ListCommitsResponse, error) {
+	if view != "" {
+		return nil, status.Errorf(codes.NotFound, "view %q not found in composite %q", view, c.name)
+	}
+	if _, err := s.compositeHead(c); err != nil {
+		return nil, err
+	}
+	res := &fspb.ListCommitsResponse{}
+	for _, cc := range c.allCommits() {
+		res.Commits = append(res.Commits, cc.Hash)
+	}
+	return res, nil
+}
+
+func (s *Service) compositeBranches(c *composite) (*fspb.ListBranchesResponse, error) {
+	head, err := s.compositeHead(c)
+	if err != nil {
+		return nil, err
+	}
+	return &fspb.ListBranchesResponse{Branches: map[string]string{compositeBranch: head.Hash}}, nil
+}
+
+// watchCompositeBranches calls send with the composite's branch whenever a
+// fetch of one of its members moves it.
+func (s *Service) watchCompositeBranches(ctx context.Context, c *composite, send func(*fspb.ListBranchesResponse) error) error {
+	var last map[string]string
+	for {
+		cases := []reflect.SelectCase{
+			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(c.removed)},
+		}
+		for _, m := range c.currentMembers() {
+			if r, ok := s.lookupRepo(m.Repo); ok {
+				cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(r.refsUpdatedChan())})
+			}
+		}
+		res, err := s.compositeBranches(c)
+		if err != nil {
+			return err
+		}
+		if !sameBranches(res.Branches, last) {
+			if err := send(res); err != nil {
+				return err
+			}
+			last = res.Branches
+		}
+
+		switch chosen, _, _ := reflect.Select(cases); chosen {
+		case 0:
+			return status.FromContextError(ctx.Err()).Err()
+		case 1:
+			return status.Errorf(codes.Unavailable, "composite %q is no longer served", c.name)
+		}
+	}
+}
+
+// compositeFetchStatus describes the freshness of a composite as that of its
+// stalest member.
+func (s *Service) compositeFetchStatus(c *composite) (*fspb.GetFetchStatusResponse, error) {
+	var combined fetchStatus
+	for i, m := range c.currentMembers() {
+		r, ok := s.lookupRepo(m.Repo)
+		if !ok {
+			return nil, status.Errorf(codes.Unavailable, "composite %q: member repo %q not found", c.name, m.Repo)
+		}
+		st := r.lastFetchStatus()
+		if i == 0 || st.lastFetch.Before(combined.lastFetch) {
+			combined.lastFetch = st.lastFetch
+		}
+		if i == 0 || st.lastSuccess.Before(combined.lastSuccess) {
+			combined.lastSuccess = st.lastSuccess
+		}
+		if !st.nextPoll.IsZero() && (combined.nextPoll.IsZero() || st.nextPoll.Before(combined.nextPoll)) {
+			combined.nextPoll = st.nextPoll
+		}
+		if st.failures > combined.failures {
+			combined.failures = st.failures
+		}
+		if st.lastErr != nil && combined.lastErr == nil {
+			combined.lastErr = fmt.Errorf("repo %q: %v", m.Repo, st.lastErr)
+		}
+	}
+	return &fspb.GetFetchStatusResponse{Status: combined.proto()}, nil
+}
+
+// getCompositeCommit describes a composite commit. Composite commits have no
+// diffs.
+func (s *Service) getCompositeCommit(ctx context.Context, c *composite, hash string) (*fspb.GetCommitResponse, error) {
+	_, commit, release, err := s.compositeTree(ctx, c, hash, "")
+	if err != nil {
+		return nil, err
+	}
+	release()
+	res := &fspb.GetCommitResponse{
+		Hash:      commit.Hash.String(),
+		Author:    signatureProto(commit.Author),
+		Committer: signatureProto(commit.Committer),
+		Message:   commit.Message,
+	}
+	for _, parent := range commit.ParentHashes {
+		res.ParentHashes = append(res.ParentHashes, parent.String())
+	}
+	return res, nil
+}
+
+// emptyTree is a tree with nothing but its root directory.
+type emptyTree struct{}
+
+func (emptyTree) Stat(ctx context.Context, p string) (TreeEntry, error) {
+	if p != "" {
+		return TreeEntry{}, notFound("stat", p)
+	}
+	return TreeEntry{Mode: fspb.FileMode_MODE_DIR}, nil
+}
+
+func (emptyTree) ReadDir(ctx context.Context, p string) ([]TreeEntry, error) {
+	if p != "" {
+		return nil, notFound("readdir", p)
+	}
+	return nil, nil
+}
+
+func (emptyTree) ReadFile(ctx context.Context, p string) ([]byte, error) {
+	if p != "" {
+		return nil, notFound("read", p)
+	}
+	return nil, &fs.PathError{Op: "read", Path: p, Err: errNotFile}
+}
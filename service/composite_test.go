@@ -0,0 +1,181 @@
+package service
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	fspb "github.com/minorhacks/funhouse/proto/git_read_fs_proto"
+
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/testing/protocmp"
+)
+
+func TestComposite(t *testing.T) {
+	originA := newTestOrigin(t)
+	originA.commit(map[string]string{"README.md": "A\n"})
+	originB := newTestOrigin(t)
+	originB.commit(map[string]string{"lib.go": "package b // v1\n"})
+	s := newTestService(t, originA)
+	if err := s.AddRepo("b", originB.url(), RepoOptions{}); err != nil {
+		t.Fatalf("AddRepo() got error %v; want no error", err)
+	}
+	composites := map[string][]CompositeMember{
+		"workspace": {
+			{Path: "a", Repo: "test"},
+			{Path: "/libs/b/", Repo: "b", Branch: "master"},
+		},
+	}
+	if err := s.SetComposites(composites); err != nil {
+		t.Fatalf("SetComposites() got error %v; want no error", err)
+	}
+	ctx := context.Background()
+
+	head := func(s *Service) string {
+		t.Helper()
+		res, err := s.ListBranches(ctx, &fspb.ListBranchesRequest{Repo: "workspace"})
+		if err != nil {
+			t.Fatalf("ListBranches() got error %v; want no error", err)
+		}
+		if len(res.Branches) != 1 || res.Branches[compositeBranch] == "" {
+			t.Fatalf("ListBranches() = %v; want only branch %q", res.Branches, compositeBranch)
+		}
+		return res.Branches[compositeBranch]
+	}
+	readFile := func(s *Service, commit string, p string) string {
+		t.Helper()
+		res, err := s.GetFile(ctx, &fspb.GetFileRequest{Repo: "workspace", Commit: commit, Path: p})
+		if err != nil {
+			t.Fatalf("GetFile(%q) got error %v; want no error", p, err)
+		}
+		return string(res.Contents)
+	}
+
+	first := head(s)
+	if got := head(s); got != first {
+		t.Errorf("ListBranches() second time got head %q; want %q since no member changed", got, first)
+	}
+	res, err := s.ListDir(ctx, &fspb.ListDirRequest{Repo: "workspace", Commit: first, Path: "/"})
+	if err != nil {
+		t.Fatalf("ListDir() got error %v; want no error", err)
+	}
+	want := []*fspb.DirEntry{
+		{Name: "a", Mode: fspb.FileMode_MODE_DIR},
+		{Name: "libs", Mode: fspb.FileMode_MODE_DIR},
+	}
+	if diff := cmp.Diff(want, res.Entries, protocmp.Transform()); diff != "" {
+		t.Errorf("ListDir() returned diff (-want +got):\n%s", diff)
+	}
+	if got, want := readFile(s, first, "/a/README.md"), "A\n"; got != want {
+		t.Errorf("GetFile() = %q; want %q", got, want)
+	}
+	if got, want := readFile(s, first, "/libs/b/lib.go"), "package b // v1\n"; got != want {
+		t.Errorf("GetFile() = %q; want %q", got, want)
+	}
+
+	originB.commit(map[string]string{"lib.go": "package b // v2\n"})
+	b, _ := s.lookupRepo("b")
+	if err := b.fetchAll(ctx); err != nil {
+		t.Fatalf("fetchAll() got error %v; want no error", err)
+	}
+	second := head(s)
+	if second == first {
+		t.Fatalf("ListBranches() after fetch got head %q; want a new commit", second)
+	}
+	if got, want := readFile(s, second, "/libs/b/lib.go"), "package b // v2\n"; got != want {
+		t.Errorf("GetFile() at new commit = %q; want %q", got, want)
+	}
+	if got, want := readFile(s, first, "/libs/b/lib.go"), "package b // v1\n"; got != want {
+		t.Errorf("GetFile() at old commit = %q; want %q", got, want)
+	}
+	commit, err := s.GetCommit(ctx, &fspb.GetCommitRequest{Repo: "workspace", Commit: second})
+	if err != nil {
+		t.Fatalf("GetCommit() got error %v; want no error", err)
+	}
+	if diff := cmp.Diff([]string{first}, commit.ParentHashes); diff != "" {
+		t.Errorf("GetCommit().ParentHashes returned diff (-want +got):\n%s", diff)
+	}
+	commits, err := s.ListCommits(ctx, &fspb.ListCommitsRequest{Repo: "workspace"})
+	if err != nil {
+		t.Fatalf("ListCommits() got error %v; want no error", err)
+	}
+	if diff := cmp.Diff([]string{first, second}, commits.Commits); diff != "" {
+		t.Errorf("ListCommits() returned diff (-want +got):\n%s", diff)
+	}
+	repos, err := s.ListRepos(ctx, &fspb.ListReposRequest{})
+	if err != nil {
+		t.Fatalf("ListRepos() got error %v; want no error", err)
+	}
+	if diff := cmp.Diff([]string{"b", "test", "workspace"}, repos.Repos); diff != "" {
+		t.Errorf("ListRepos() returned diff (-want +got):\n%s", diff)
+	}
+
+	for _, tc := range []struct {
+		desc string
+		req  *fspb.ListDirRequest
+	}{
+		{desc: "unknown commit", req: &fspb.ListDirRequest{Repo: "workspace", Commit: "0123456789012345678901234567890123456789", Path: "/"}},
+		{desc: "view", req: &fspb.ListDirRequest{Repo: "workspace", Commit: first, Path: "/", View: "public"}},
+		{desc: "path outside the members", req: &fspb.ListDirRequest{Repo: "workspace", Commit: first, Path: "/c"}},
+	} {
+		if _, err := s.ListDir(ctx, tc.req); status.Code(err) != codes.NotFound {
+			t.Errorf("ListDir() of %s got error %v; want code %v", tc.desc, err, codes.NotFound)
+		}
+	}
+
+	// A new server on the same data still knows the old commit.
+	restarted := New(s.BasePath)
+	t.Cleanup(func() {
+		for _, r := range restarted.allRepos() {
+			r.close(false /* deleteData */)
+		}
+	})
+	for name, url := range map[string]string{"test": originA.url(), "b": originB.url()} {
+		if err := restarted.AddRepo(name, url, RepoOptions{}); err != nil {
+			t.Fatalf("AddRepo() got error %v; want no error", err)
+		}
+	}
+	if err := restarted.SetComposites(composites); err != nil {
+		t.Fatalf("SetComposites() got error %v; want no error", err)
+	}
+	if got, want := readFile(restarted, first, "/libs/b/lib.go"), "package b // v1\n"; got != want {
+		t.Errorf("GetFile() at old commit after restart = %q; want %q", got, want)
+	}
+	commits, err = restarted.ListCommits(ctx, &fspb.ListCommitsRequest{Repo: "workspace"})
+	if err != nil {
+		t.Fatalf("ListCommits() after restart got error %v; want no error", err)
+	}
+	sort.Strings(commits.Commits)
+	wantCommits := []string{first, second}
+	sort.Strings(wantCommits)
+	if diff := cmp.Diff(wantCommits, commits.Commits); diff != "" {
+		t.Errorf("ListCommits() after restart returned diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestCompositeNames(t *testing.T) {
+	origin := newTestOrigin(t)
+	origin.commit(map[string]string{"README.md": "hello\n"})
+	s := newTestService(t, origin)
+	members := []CompositeMember{{Path: "a", Repo: "test"}}
+	if err := s.SetComposites(map[string][]CompositeMember{"test": members}); err == nil {
+		t.Errorf("SetComposites() with the name of a repo got no error; want error")
+	}
+	if err := s.SetComposites(map[string][]CompositeMember{"workspace": members}); err != nil {
+		t.Fatalf("SetComposites() got error %v; want no error", err)
+	}
+	if _, err := s.addRepo("workspace", "https://example.com/workspace", RepoOptions{}); err == nil {
+		t.Errorf("addRepo() with the name of a composite got no error; want error")
+	}
+	for desc, members := range map[string][]CompositeMember{
+		"no members":         nil,
+		"member at the root": {{Path: "/", Repo: "test"}},
+		"shared path":        {{Path: "a", Repo: "test"}, {Path: "a/", Repo: "test", Branch: "dev"}},
+	} {
+		if err := s.SetComposites(map[string][]CompositeMember{"other": members}); err == nil {
+			t.Errorf("SetComposites() with %s got no error; want error", desc)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package service
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+)
+
+// Secret is a credential that is given directly, or read from a file or an
+// environment variable. Files and variables are re-read before every clone
+// and fetch, so that rotated credentials are picked up without a restart.
+type Secret struct {
+	Value string
+	File  string
+	Env   string
+}
+
+// IsSet returns whether the secret has a source.
+func (s Secret) IsSet() bool {
+	return s.Value != "" || s.File != "" || s.Env != ""
+}
+
+// Read returns the secret's current value, or "" if it has no source.
+func (s Secret) Read() (string, error) {
+	switch {
+	case s.Value != "":
+		return s.Value, nil
+	case s.File != "":
+		contents, err := ioutil.ReadFile(s.File)
+		if err != nil {
+			return "", fmt.Errorf("failed to read secret: %v", err)
+		}
+		// Editors and `echo` usually leave a trailing newline, which is never
+		// part of a password or token.
+		return strings.TrimRight(string(contents), "\r\n"), nil
+	case s.Env != "":
+		v, ok := os.LookupEnv(s.Env)
+		if !ok {
+			return "", fmt.Errorf("environment variable %q is not set", s.Env)
+		}
+		return v, nil
+	default:
+		return "", nil
+	}
+}
+
+// Credentials authenticate a repo's clones and fetches. At most one of
+// Password, Token and SSHKey should be set; the zero value means anonymous
+// access.
+type Credentials struct {
+	// Username for HTTPS basic auth, or the SSH user (default "git").
+	Username string
+	// Password for HTTPS basic auth. For GitHub, this can be a personal
+	// access token.
+	Password Secret
+	// Token is sent as an HTTPS bearer token.
+	Token Secret
+	// SSHKey is a PEM-encoded SSH private key, optionally protected by
+	// SSHKeyPassphrase.
+	SSHKey           Secret
+	SSHKeyPassphrase Secret
+	// KnownHostsFile lists the host keys that SSH servers are checked against.
+	// If empty, $SSH_KNOWN_HOSTS or the user's known_hosts files are used.
+	KnownHostsFile string
+}
+
+// authMethod returns the go-git auth method for the credentials, or nil if no
+// credentials are set.
+func (c Credentials) authMethod() (transport.AuthMethod, error) {
+	switch {
+	case c.SSHKey.IsSet():
+		key, err := c.SSHKey.Read()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get SSH key: %v", err)
+		}
+		passphrase, err := c.SSHKeyPassphrase.Read()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get SSH key passphrase: %v", err)
+		}
+		user := c.Username
+		if user == "" {
+			user = gitssh.DefaultUsername
+		}
+		auth, err := gitssh.NewPublicKeys(user, []byte(key), passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse SSH key: %v", err)
+		}
+		var knownHosts []string
+		if c.KnownHostsFile != "" {
+			knownHosts = append(knownHosts, c.KnownHostsFile)
+		}
+		auth.HostKeyCallback, err = gitssh.NewKnownHostsCallback(knownHosts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load known hosts: %v", err)
+		}
+		return auth, nil
+	case c.Token.IsSet():
+		token, err := c.Token.Read()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get token: %v", err)
+		}
+		return &githttp.TokenAuth{Token: token}, nil
+	case c.Password.IsSet():
+		password, err := c.Password.Read()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get password: %v", err)
+		}
+		user := c.Username
+		if user == "" {
+			// GitHub ignores the username when the password is a token,
+			// but requires one to be present.
+			user = "x-access-token"
+		}
+		return &githttp.BasicAuth{Username: user, Password: password}, nil
+	default:
+		return nil, nil
+	}
+}
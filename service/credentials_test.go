@@ -0,0 +1,225 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	fspb "github.com/minorhacks/funhouse/proto/git_read_fs_proto"
+
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitserver "github.com/go-git/go-git/v5/plumbing/transport/server"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+)
+
+// newTestHTTPOrigin serves an origin over the git smart HTTP protocol,
+// requiring basic auth with the given username and password.
+func newTestHTTPOrigin(t *testing.T, o *testOrigin, username string, password string) *httptest.Server {
+	t.Helper()
+	ep, err := transport.NewEndpoint(o.url())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := gitserver.NewServer(gitserver.DefaultLoader)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); !ok || u != username || p != password {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		sess, err := srv.NewUploadPackSession(ep, nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer sess.Close()
+
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/info/refs":
+			refs, err := sess.AdvertisedReferencesContext(r.Context())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			refs.Prefix = [][]byte{[]byte("# service=git-upload-pack"), pktline.Flush}
+			w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+			refs.Encode(w)
+		case r.Method == "POST" && r.URL.Path == "/git-upload-pack":
+			req := packp.NewUploadPackRequest()
+			if err := req.Decode(r.Body); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			res, err := sess.UploadPack(r.Context(), req)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+			res.Encode(w)
+		default:
+			http.NotFound(w, r)
+		}
+	}
+	s := httptest.NewServer(http.HandlerFunc(handler))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestSecretRead(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(file, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("FUNHOUSE_TEST_SECRET", "from-env")
+	defer os.Unsetenv("FUNHOUSE_TEST_SECRET")
+
+	testCases := []struct {
+		desc    string
+		secret  Secret
+		want    string
+		wantErr bool
+	}{
+		{desc: "unset", secret: Secret{}, want: ""},
+		{desc: "value", secret: Secret{Value: "literal"}, want: "literal"},
+		{desc: "file", secret: Secret{File: file}, want: "from-file"},
+		{desc: "env", secret: Secret{Env: "FUNHOUSE_TEST_SECRET"}, want: "from-env"},
+		{desc: "missing file", secret: Secret{File: file + ".missing"}, wantErr: true},
+		{desc: "missing env", secret: Secret{Env: "FUNHOUSE_TEST_UNSET"}, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			got, err := tc.secret.Read()
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("Read() got no error; want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Read() got error %v; want no error", err)
+			}
+			if got != tc.want {
+				t.Errorf("Read() = %q; want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCredentialsAuthMethod(t *testing.T) {
+	dir := t.TempDir()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	knownHosts := filepath.Join(dir, "known_hosts")
+	if err := ioutil.WriteFile(knownHosts, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("anonymous", func(t *testing.T) {
+		auth, err := Credentials{}.authMethod()
+		if err != nil || auth != nil {
+			t.Errorf("authMethod() = %v, %v; want nil, nil", auth, err)
+		}
+	})
+	t.Run("password", func(t *testing.T) {
+		auth, err := Credentials{Password: Secret{Value: "ghp_token"}}.authMethod()
+		if err != nil {
+			t.Fatalf("authMethod() got error %v; want no error", err)
+		}
+		basic, ok := auth.(*githttp.BasicAuth)
+		if !ok || basic.Username != "x-access-token" || basic.Password != "ghp_token" {
+			t.Errorf("authMethod() = %v; want basic auth for x-access-token", auth)
+		}
+	})
+	t.Run("token", func(t *testing.T) {
+		auth, err := Credentials{Token: Secret{Value: "tok"}}.authMethod()
+		if err != nil {
+			t.Fatalf("authMethod() got error %v; want no error", err)
+		}
+		if bearer, ok := auth.(*githttp.TokenAuth); !ok || bearer.Token != "tok" {
+			t.Errorf("authMethod() = %v; want bearer token auth", auth)
+		}
+	})
+	t.Run("ssh key", func(t *testing.T) {
+		auth, err := Credentials{
+			SSHKey:         Secret{Value: string(keyPEM)},
+			KnownHostsFile: knownHosts,
+		}.authMethod()
+		if err != nil {
+			t.Fatalf("authMethod() got error %v; want no error", err)
+		}
+		keys, ok := auth.(*gitssh.PublicKeys)
+		if !ok || keys.User != "git" || keys.HostKeyCallback == nil {
+			t.Errorf("authMethod() = %v; want public key auth as git with host key checking", auth)
+		}
+	})
+	t.Run("missing known hosts", func(t *testing.T) {
+		_, err := Credentials{
+			SSHKey:         Secret{Value: string(keyPEM)},
+			KnownHostsFile: filepath.Join(dir, "missing"),
+		}.authMethod()
+		if err == nil {
+			t.Errorf("authMethod() got no error; want error")
+		}
+	})
+	t.Run("bad key", func(t *testing.T) {
+		_, err := Credentials{
+			SSHKey:         Secret{Value: "not a key"},
+			KnownHostsFile: knownHosts,
+		}.authMethod()
+		if err == nil {
+			t.Errorf("authMethod() got no error; want error")
+		}
+	})
+}
+
+func TestAddRepoWithBasicAuth(t *testing.T) {
+	origin := newTestOrigin(t)
+	origin.commit(map[string]string{"README.md": "v1"})
+	srv := newTestHTTPOrigin(t, origin, "mirror", "s3cret")
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	if err := ioutil.WriteFile(passwordFile, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := New(t.TempDir())
+	if err := s.AddRepo("anonymous", srv.URL, RepoOptions{}); err == nil {
+		t.Errorf("AddRepo() without credentials got no error; want error")
+	}
+	if _, ok := s.lookupRepo("anonymous"); ok {
+		t.Errorf("repo %q is still served after it failed to clone", "anonymous")
+	}
+	creds := Credentials{Username: "mirror", Password: Secret{File: passwordFile}}
+	if err := s.AddRepo("private", srv.URL, RepoOptions{Credentials: creds}); err != nil {
+		t.Fatalf("AddRepo() got error %v; want no error", err)
+	}
+	r, _ := s.lookupRepo("private")
+	defer r.close(false /* deleteData */)
+
+	head := origin.commit(map[string]string{"README.md": "v2"})
+	if err := r.fetchAll(context.Background()); err != nil {
+		t.Fatalf("fetchAll() got error %v; want no error", err)
+	}
+	res, err := s.ListBranches(context.Background(), &fspb.ListBranchesRequest{Repo: "private"})
+	if err != nil {
+		t.Fatalf("ListBranches() got error %v; want no error", err)
+	}
+	if got, want := res.Branches["master"], head.String(); got != want {
+		t.Errorf("branch master = %q; want %q", got, want)
+	}
+}
@@ -0,0 +1,504 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	gitplumbing "github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/idxfile"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/revlist"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/go-git/go-git/v5/storage/filesystem/dotgit"
+	"github.com/golang/glog"
+)
+
+// MaintenanceOptions configures the background maintenance that keeps repos'
+// object storage compact.
+type MaintenanceOptions struct {
+	// Interval is the time between checks of each repo's storage.
+	// Maintenance is disabled if it is zero.
+	Interval time.Duration
+	// A repo is repacked once it has more than MaxPacks packfiles or more
+	// than MaxLooseObjects loose objects.
+	MaxPacks        int
+	MaxLooseObjects int
+	// PruneGrace is how old an unreachable object must be before it is
+	// deleted, so that objects written by an in-progress write aren't pruned
+	// before a ref points at them.
+	PruneGrace time.Duration
+}
+
+// storageStats describes a repo's object storage.
+type storageStats struct {
+	packs        int
+	looseObjects int
+}
+
+// maintenanceStatus records the outcome of a repo's last maintenance run.
+type maintenanceStatus struct {
+	lastRun  time.Time
+	duration time.Duration
+	lastErr  error
+}
+
+// Maintain checks the storage of each repo, including repos added later,
+// every opts.Interval until ctx is cancelled, and repacks and prunes repos
+// whose packfiles or loose objects have piled up.
+func (s *Service) Maintain(ctx context.Context, opts MaintenanceOptions) {
+	if opts.Interval <= 0 {
+		return
+	}
+	s.mu.Lock()
+	s.maintCtx = ctx
+	s.maintOpts = opts
+	for _, r := range s.repos {
+		go maintainRepo(ctx, r, opts)
+	}
+	s.mu.Unlock()
+	<-ctx.Done()
+}
+
+// maintainRepo maintains r until ctx is cancelled or r is removed.
+func maintainRepo(ctx context.Context, r *Repo, opts MaintenanceOptions) {
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := r.ready(); err != nil {
+			glog.V(1).Infof("Maintenance: skipping: %v", err)
+			continue
+		}
+		stats, err := r.storageStats()
+		if err != nil {
+			glog.Errorf("Maintenance: %v", err)
+			continue
+		}
+		if stats.packs <= opts.MaxPacks && stats.looseObjects <= opts.MaxLooseObjects {
+			continue
+		}
+		glog.Infof("Maintenance: repacking repo %q with %d packs and %d loose objects", r.path, stats.packs, stats.looseObjects)
+		if err := r.maintain(ctx, opts.PruneGrace); err != nil {
+			glog.Errorf("Maintenance: %v", err)
+		}
+	}
+}
+
+// storageStats counts the repo's packfiles and loose objects.
+func (r *Repo) storageStats() (storageStats, error) {
+	var stats storageStats
+	objects := filepath.Join(r.fullPath(), "objects")
+	dirs, err := ioutil.ReadDir(objects)
+	if err != nil {
+		return stats, fmt.Errorf("failed to read objects of repo %q: %v", r.path, err)
+	}
+	for _, dir := range dirs {
+		switch {
+		case dir.Name() == "pack":
+			packs, err := filepath.Glob(filepath.Join(objects, "pack", "pack-*.pack"))
+			if err != nil {
+				return stats, fmt.Errorf("failed to list packs of repo %q: %v", r.path, err)
+			}
+			stats.packs = len(packs)
+		case dir.IsDir() && len(dir.Name()) == 2:
+			files, err := ioutil.ReadDir(filepath.Join(objects, dir.Name()))
+			if err != nil {
+				return stats, fmt.Errorf("failed to read objects of repo %q: %v", r.path, err)
+			}
+			stats.looseObjects += len(files)
+		}
+	}
+	return stats, nil
+}
+
+// maintain repacks every object reachable from the repo's refs into a single
+// packfile, and deletes the old packfiles and loose objects, except for
+// unreachable objects younger than grace.
+func (r *Repo) maintain(ctx context.Context, grace time.Duration) error {
+	ctx, done, err := r.beginWrite(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	start := time.Now()
+	if r.partial {
+		err = r.maintainPartial(ctx, grace)
+	} else {
+		err = r.repack(grace)
+	}
+	r.statusMu.Lock()
+	r.maintStatus = maintenanceStatus{
+		lastRun:  start,
+		duration: time.Since(start),
+		lastErr:  err,
+	}
+	r.statusMu.Unlock()
+	return err
+}
+
+// repack writes the new packfile to a staging directory without holding r.mu,
+// so reads carry on, and r.mu is only held to move it into place and delete
+// the old files. It must be called with r.writeMu held, so that no packfile is
+// added while the old ones are being replaced.
+func (r *Repo) repack(grace time.Duration) error {
+	dir, err := r.newStagingDir()
+	if err != nil {
+		return err
+	}
+	expire := time.Now().Add(-grace)
+	packed, oldPacks, err := r.writePack(dir, expire)
+	if err != nil {
+		os.RemoveAll(dir)
+		return fmt.Errorf("failed to repack repo %q: %v", r.path, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.publishObjects(dir); err != nil {
+		return err
+	}
+	return r.deleteRepacked(packed, oldPacks, expire)
+}
+
+// writePack writes a packfile of all objects reachable from the repo's refs to
+// the staging directory dir, returning the objects it contains and the
+// packfiles that it replaces. Unreachable objects in packfiles written after
+// expire are staged as loose objects. It must be called with r.writeMu held.
+func (r *Repo) writePack(dir string, expire time.Time) (packed map[gitplumbing.Hash]bool, oldPacks []gitplumbing.Hash, err error) {
+	objects, err := openStorage(r.fullPath())
+	if err != nil {
+		return nil, nil, err
+	}
+	defer objects.Close()
+	staging, err := initStorage(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer staging.Close()
+	oldPacks, err = objects.ObjectPacks()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	refs, err := objects.IterReferences()
+	if err != nil {
+		return nil, nil, err
+	}
+	var tips []gitplumbing.Hash
+	err = refs.ForEach(func(ref *gitplumbing.Reference) error {
+		if ref.Type() == gitplumbing.HashReference {
+			tips = append(tips, ref.Hash())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	objs, err := revlist.Objects(objects, tips, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	w, err := staging.PackfileWriter()
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg, err := objects.Config()
+	if err != nil {
+		w.Close()
+		return nil, nil, err
+	}
+	if _, err := packfile.NewEncoder(w, objects, false /* useRefDeltas */).Encode(objs, cfg.Pack.Window); err != nil {
+		w.Close()
+		return nil, nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, nil, err
+	}
+	// Repacking unchanged objects writes a packfile with the same name as
+	// the one that it replaces, which must be kept.
+	newPacks, err := staging.ObjectPacks()
+	if err != nil {
+		return nil, nil, err
+	}
+	oldPacks = withoutHashes(oldPacks, newPacks)
+
+	packed = make(map[gitplumbing.Hash]bool, len(objs))
+	for _, h := range objs {
+		packed[h] = true
+	}
+	if err := r.loosenUnreachable(objects, staging, dir, oldPacks, packed, expire); err != nil {
+		return nil, nil, err
+	}
+	return packed, oldPacks, nil
+}
+
+// loosenUnreachable stages the objects of packfiles written after expire that
+// aren't in packed as loose objects, with the packfile's modification time,
+// like `git repack -A`. Deleting the packfiles then doesn't prune objects
+// that an in-progress write may still need; they are pruned once they are
+// older than expire like any other loose object.
+func (r *Repo) loosenUnreachable(objects *filesystem.Storage, staging *filesystem.Storage, dir string, packs []gitplumbing.Hash, packed map[gitplumbing.Hash]bool, expire time.Time) error {
+	dg := dotgit.New(objects.Filesystem())
+	for _, pack := range packs {
+		info, err := os.Stat(filepath.Join(r.fullPath(), "objects", "pack", "pack-"+pack.String()+".pack"))
+		if err != nil {
+			return err
+		}
+		mtime := info.ModTime()
+		if mtime.Before(expire) {
+			continue
+		}
+
+		idxFile, err := dg.ObjectPackIdx(pack)
+		if err != nil {
+			return err
+		}
+		idx := idxfile.NewMemoryIndex()
+		err = idxfile.NewDecoder(idxFile).Decode(idx)
+		idxFile.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read index of pack %s: %v", pack, err)
+		}
+		entries, err := idx.Entries()
+		if err != nil {
+			return err
+		}
+		for {
+			e, err := entries.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				entries.Close()
+				return err
+			}
+			if packed[e.Hash] {
+				continue
+			}
+			if _, err := objects.LooseObjectTime(e.Hash); err == nil {
+				// Already loose, with an age of its own.
+				continue
+			}
+			obj, err := objects.EncodedObject(gitplumbing.AnyObject, e.Hash)
+			if err != nil {
+				entries.Close()
+				return err
+			}
+			if _, err := staging.SetEncodedObject(obj); err != nil {
+				entries.Close()
+				return err
+			}
+			h := e.Hash.String()
+			if err := os.Chtimes(filepath.Join(dir, "objects", h[:2], h[2:]), mtime, mtime); err != nil {
+				entries.Close()
+				return err
+			}
+		}
+		entries.Close()
+	}
+	return nil
+}
+
+// withoutHashes returns the hashes in hs that aren't in remove.
+func withoutHashes(hs []gitplumbing.Hash, remove []gitplumbing.Hash) []gitplumbing.Hash {
+	var res []gitplumbing.Hash
+	for _, h := range hs {
+		keep := true
+		for _, r := range remove {
+			if h == r {
+				keep = false
+			}
+		}
+		if keep {
+			res = append(res, h)
+		}
+	}
+	return res
+}
+
+// deleteRepacked deletes the packfiles replaced by a repack, and loose objects
+// that are either in the new packfile or unreachable and older than expire.
+// It must be called with r.mu held for writing.
+func (r *Repo) deleteRepacked(packed map[gitplumbing.Hash]bool, oldPacks []gitplumbing.Hash, expire time.Time) error {
+	pos, ok := r.repo.Storer.(storer.PackedObjectStorer)
+	if !ok {
+		return fmt.Errorf("storer for repo %q doesn't support packfiles", r.path)
+	}
+	defer r.reindex()
+	for _, h := range oldPacks {
+		if err := pos.DeleteOldObjectPackAndIndex(h, time.Time{}); err != nil {
+			return fmt.Errorf("failed to delete old pack %s of repo %q: %v", h, r.path, err)
+		}
+	}
+
+	los, ok := r.repo.Storer.(storer.LooseObjectStorer)
+	if !ok {
+		return nil
+	}
+	var stale []gitplumbing.Hash
+	err := los.ForEachObjectHash(func(h gitplumbing.Hash) error {
+		if packed[h] {
+			stale = append(stale, h)
+			return nil
+		}
+		t, err := los.LooseObjectTime(h)
+		if err != nil {
+			return err
+		}
+		if t.Before(expire) {
+			stale = append(stale, h)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list loose objects of repo %q: %v", r.path, err)
+	}
+	for _, h := range stale {
+		if err := los.DeleteLooseObject(h); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete loose object %s of repo %q: %v", h, r.path, err)
+		}
+	}
+	glog.Infof("Maintenance: repacked repo %q, replacing %d packs and %d loose objects", r.path, len(oldPacks), len(stale))
+	return nil
+}
+
+// maintainPartial repacks a partial clone with the git CLI, since go-git can't
+// walk objects whose blobs are missing. git deletes the files that it
+// replaces, so it works on a staging copy of the repo's objects made of hard
+// links, without holding r.mu, so reads carry on. r.mu is only held to swap
+// the result into place. It must be called with r.writeMu held, so that no
+// fetch adds objects meanwhile.
+func (r *Repo) maintainPartial(ctx context.Context, grace time.Duration) error {
+	dir, err := r.newStagingDir()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	staged := filepath.Join(dir, "objects")
+	linked, err := linkObjects(filepath.Join(r.fullPath(), "objects"), staged)
+	if err != nil {
+		return fmt.Errorf("failed to repack repo %q: %v", r.path, err)
+	}
+	if err := r.packFetchedBlobs(ctx, staged); err != nil {
+		return fmt.Errorf("failed to repack repo %q: %v", r.path, err)
+	}
+	// These are the steps of git gc that replace packfiles and prune
+	// objects. Its others rewrite refs, which readers may be reading.
+	expire := fmt.Sprintf("%d.seconds.ago", int64(grace/time.Second))
+	for _, args := range [][]string{
+		{"repack", "-d", "-l", "-A", "-n", "--unpack-unreachable=" + expire},
+		{"prune", "--exclude-promisor-objects", "--expire=" + expire},
+	} {
+		cmd, cleanup, err := gitCommand(ctx, r.fullPath(), Credentials{}, args...)
+		if err != nil {
+			return err
+		}
+		cmd.Env = append(cmd.Env, "GIT_OBJECT_DIRECTORY="+staged)
+		err = runCommand(cmd)
+		cleanup()
+		if err != nil {
+			return fmt.Errorf("failed to repack repo %q: %v", r.path, err)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	defer r.reindex()
+	return r.swapObjects(staged, linked)
+}
+
+// linkObjects hard links the packfiles and loose objects in the object
+// directory src into dst, returning their paths relative to it.
+func linkObjects(src string, dst string) (map[string]bool, error) {
+	linked := map[string]bool{}
+	err := forEachObjectFile(src, func(rel string) error {
+		if err := os.MkdirAll(filepath.Join(dst, filepath.Dir(rel)), 0o755); err != nil {
+			return err
+		}
+		linked[rel] = true
+		return os.Link(filepath.Join(src, rel), filepath.Join(dst, rel))
+	})
+	return linked, err
+}
+
+// swapObjects replaces the repo's objects that were linked into the object
+// directory staged with what is there now, keeping objects added to the repo
+// since, such as blobs fetched on demand. It must be called with r.mu held for
+// writing.
+func (r *Repo) swapObjects(staged string, linked map[string]bool) error {
+	kept := map[string]bool{}
+	err := forEachObjectFile(staged, func(rel string) error {
+		kept[rel] = true
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read repacked objects of repo %q: %v", r.path, err)
+	}
+	if err := r.moveObjects(staged); err != nil {
+		return err
+	}
+	objects := filepath.Join(r.fullPath(), "objects")
+	removed := 0
+	for rel := range linked {
+		if kept[rel] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(objects, rel)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete repacked object file %s of repo %q: %v", rel, r.path, err)
+		}
+		removed++
+	}
+	glog.Infof("Maintenance: repacked repo %q, replacing %d files", r.path, removed)
+	return nil
+}
+
+// packFetchedBlobs packs the loose blobs fetched on demand into a promisor
+// packfile in the object directory objects. git never packs loose objects
+// that promisor objects refer to, so they would otherwise pile up.
+func (r *Repo) packFetchedBlobs(ctx context.Context, objects string) error {
+	var hashes bytes.Buffer
+	err := forEachObjectFile(objects, func(rel string) error {
+		if dir, file := filepath.Split(rel); dir != "pack/" {
+			fmt.Fprintln(&hashes, strings.TrimSuffix(dir, "/")+file)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if hashes.Len() == 0 {
+		return nil
+	}
+	packDir := filepath.Join(objects, "pack")
+	cmd, cleanup, err := gitCommand(ctx, r.fullPath(), Credentials{}, "pack-objects", "--quiet", filepath.Join(packDir, "pack"))
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	var name bytes.Buffer
+	cmd.Env = append(cmd.Env, "GIT_OBJECT_DIRECTORY="+objects)
+	cmd.Stdin = &hashes
+	cmd.Stdout = &name
+	if err := runCommand(cmd); err != nil {
+		return err
+	}
+	promisor := filepath.Join(packDir, "pack-"+strings.TrimSpace(name.String())+".promisor")
+	return ioutil.WriteFile(promisor, nil, 0o644)
+}
@@ -0,0 +1,262 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	fspb "github.com/minorhacks/funhouse/proto/git_read_fs_proto"
+
+	gitplumbing "github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// storeLooseBlob writes a blob that no commit refers to as a loose object,
+// with the given modification time.
+func storeLooseBlob(t *testing.T, r *Repo, contents string, mtime time.Time) gitplumbing.Hash {
+	t.Helper()
+	obj := r.repo.Storer.NewEncodedObject()
+	obj.SetType(gitplumbing.BlobObject)
+	w, err := obj.Writer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(contents)); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	hash, err := r.repo.Storer.SetEncodedObject(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(r.fullPath(), "objects", hash.String()[:2], hash.String()[2:])
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+// storePackedBlob writes a blob that no commit refers to in a packfile of its
+// own, with the given modification time.
+func storePackedBlob(t *testing.T, r *Repo, contents string, mtime time.Time) gitplumbing.Hash {
+	t.Helper()
+	mem := memory.NewStorage()
+	obj := mem.NewEncodedObject()
+	obj.SetType(gitplumbing.BlobObject)
+	w, err := obj.Writer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(contents)); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	hash, err := mem.SetEncodedObject(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pw, err := r.repo.Storer.(storer.PackfileWriter).PackfileWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pack, err := packfile.NewEncoder(pw, mem, false /* useRefDeltas */).Encode([]gitplumbing.Hash{hash}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(r.fullPath(), "objects", "pack", "pack-"+pack.String()+".pack")
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func mustStorageStats(t *testing.T, r *Repo) storageStats {
+	t.Helper()
+	stats, err := r.storageStats()
+	if err != nil {
+		t.Fatalf("storageStats() got error %v; want no error", err)
+	}
+	return stats
+}
+
+func TestMaintainRepacksAndPrunes(t *testing.T) {
+	origin := newTestOrigin(t)
+	commits := []gitplumbing.Hash{origin.commit(map[string]string{"README.md": "v1"})}
+	s := newTestService(t, origin)
+	r := testRepo(t, s)
+	// Each fetch adds a packfile.
+	for _, contents := range []string{"v2", "v3", "v4"} {
+		commits = append(commits, origin.commit(map[string]string{"README.md": contents}))
+		if err := r.fetchAll(context.Background()); err != nil {
+			t.Fatalf("fetchAll() got error %v; want no error", err)
+		}
+	}
+	old := storeLooseBlob(t, r, "unreachable and old", time.Now().Add(-2*time.Hour))
+	recent := storeLooseBlob(t, r, "unreachable and recent", time.Now())
+	oldPacked := storePackedBlob(t, r, "unreachable, packed and old", time.Now().Add(-2*time.Hour))
+	recentPacked := storePackedBlob(t, r, "unreachable, packed and recent", time.Now())
+
+	if stats := mustStorageStats(t, r); stats.packs < 4 || stats.looseObjects != 2 {
+		t.Fatalf("before maintenance, repo has %d packs and %d loose objects; want at least 4 and 2", stats.packs, stats.looseObjects)
+	}
+	if err := r.maintain(context.Background(), time.Hour); err != nil {
+		t.Fatalf("maintain() got error %v; want no error", err)
+	}
+	// The recent packed object is kept as a loose object.
+	if stats := mustStorageStats(t, r); stats.packs != 1 || stats.looseObjects != 2 {
+		t.Errorf("after maintenance, repo has %d packs and %d loose objects; want 1 and 2", stats.packs, stats.looseObjects)
+	}
+	for _, h := range []gitplumbing.Hash{old, oldPacked} {
+		if err := r.repo.Storer.HasEncodedObject(h); err == nil {
+			t.Errorf("old unreachable object %s was not pruned", h)
+		}
+	}
+	for _, h := range []gitplumbing.Hash{recent, recentPacked} {
+		if err := r.repo.Storer.HasEncodedObject(h); err != nil {
+			t.Errorf("recent unreachable object %s was pruned: %v", h, err)
+		}
+	}
+	// It is pruned once it has aged like any loose object.
+	if err := r.maintain(context.Background(), 0); err != nil {
+		t.Fatalf("maintain() got error %v; want no error", err)
+	}
+	if err := r.repo.Storer.HasEncodedObject(recentPacked); err == nil {
+		t.Errorf("unreachable object %s was not pruned after its grace period", recentPacked)
+	}
+
+	for i, commit := range commits {
+		res, err := s.GetFile(context.Background(), &fspb.GetFileRequest{Commit: commit.String(), Path: "README.md"})
+		if err != nil {
+			t.Fatalf("GetFile() at commit %d got error %v after maintenance; want no error", i, err)
+		}
+		if got, want := string(res.Contents), []string{"v1", "v2", "v3", "v4"}[i]; got != want {
+			t.Errorf("GetFile() at commit %d = %q; want %q", i, got, want)
+		}
+	}
+
+	st := s.repoStatus(r)
+	if st.LastMaintenanceTime == nil || st.LastMaintenanceError != "" {
+		t.Errorf("RepoStatus has last maintenance %v with error %q; want a successful run", st.LastMaintenanceTime, st.LastMaintenanceError)
+	}
+	if st.PackCount != 1 {
+		t.Errorf("RepoStatus.PackCount = %d; want 1", st.PackCount)
+	}
+}
+
+func TestMaintainPartialClone(t *testing.T) {
+	origin := newTestOrigin(t)
+	head := origin.commit(map[string]string{"README.md": "v1", "unread.txt": "never read"})
+	s := newPartialTestService(t, origin)
+	r := testRepo(t, s)
+	req := &fspb.GetFileRequest{Commit: head.String(), Path: "README.md"}
+	if _, err := s.GetFile(context.Background(), req); err != nil {
+		t.Fatalf("GetFile() got error %v; want no error", err)
+	}
+
+	if err := r.maintain(context.Background(), time.Hour); err != nil {
+		t.Fatalf("maintain() got error %v; want no error", err)
+	}
+	if stats := mustStorageStats(t, r); stats.looseObjects != 0 {
+		t.Errorf("after maintenance, repo has %d loose objects; want 0", stats.looseObjects)
+	}
+	res, err := s.GetFile(context.Background(), req)
+	if err != nil {
+		t.Fatalf("GetFile() got error %v after maintenance; want no error", err)
+	}
+	if got, want := string(res.Contents), "v1"; got != want {
+		t.Errorf("GetFile() = %q; want %q", got, want)
+	}
+	unread := gitplumbing.ComputeHash(gitplumbing.BlobObject, []byte("never read"))
+	if err := r.repo.Storer.HasEncodedObject(unread); err == nil {
+		t.Errorf("maintenance fetched blob for unread.txt")
+	}
+}
+
+func TestMaintainPartialCloneServesReads(t *testing.T) {
+	origin := newTestOrigin(t)
+	head := origin.commit(map[string]string{"README.md": "v1"})
+	s := newPartialTestService(t, origin)
+	r := testRepo(t, s)
+	req := &fspb.GetFileRequest{Commit: head.String(), Path: "README.md"}
+	if _, err := s.GetFile(context.Background(), req); err != nil {
+		t.Fatalf("GetFile() got error %v; want no error", err)
+	}
+
+	// Put a git in front of the real one that holds repack until the test
+	// releases it.
+	realGit, err := exec.LookPath("git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin := t.TempDir()
+	started := filepath.Join(bin, "started")
+	release := filepath.Join(bin, "release")
+	script := fmt.Sprintf(`#!/bin/sh
+if [ "$1" = repack ]; then
+	touch %q
+	while [ ! -e %q ]; do sleep 0.01; done
+fi
+exec %q "$@"
+`, started, release, realGit)
+	if err := ioutil.WriteFile(filepath.Join(bin, "git"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+path)
+	t.Cleanup(func() { os.Setenv("PATH", path) })
+	releaseRepack := func() {
+		if err := ioutil.WriteFile(release, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer releaseRepack()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- r.maintain(context.Background(), time.Hour)
+	}()
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(started); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("maintain() didn't run git repack")
+		}
+	}
+
+	read := make(chan error, 1)
+	go func() {
+		_, err := s.GetFile(context.Background(), req)
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		if err != nil {
+			t.Errorf("GetFile() during maintenance got error %v; want no error", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("GetFile() didn't finish while git repack was running")
+	}
+
+	releaseRepack()
+	if err := <-done; err != nil {
+		t.Fatalf("maintain() got error %v; want no error", err)
+	}
+	if stats := mustStorageStats(t, r); stats.looseObjects != 0 {
+		t.Errorf("after maintenance, repo has %d loose objects; want 0", stats.looseObjects)
+	}
+	if _, err := s.GetFile(context.Background(), req); err != nil {
+		t.Errorf("GetFile() after maintenance got error %v; want no error", err)
+	}
+}
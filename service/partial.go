@@ -0,0 +1,347 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	gitplumbing "github.com/go-git/go-git/v5/plumbing"
+	gitobject "github.com/go-git/go-git/v5/plumbing/object"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/golang/glog"
+	"google.golang.org/grpc/status"
+)
+
+// Partial clones are made and updated with the git CLI, since go-git can't
+// request a filtered packfile. Everything else still reads the repo through
+// go-git, which sees blobs that were never fetched as missing objects.
+
+// blobFilter is the partial clone filter, which omits every blob.
+const blobFilter = "blob:none"
+
+// partialClone makes a bare clone of url in dir that has every commit and
+// tree, but no blobs.
+func partialClone(ctx context.Context, dir string, url string, creds Credentials) error {
+	return runGit(ctx, "", creds, "clone", "--bare", "--filter="+blobFilter, "--", url, dir)
+}
+
+// isPartialClone returns whether r was cloned with a filter.
+func isPartialClone(r *Repo) bool {
+	cfg, err := r.repo.Config()
+	if err != nil {
+		return false
+	}
+	// Older versions of git name the promisor remote in extensions.partialClone,
+	// newer ones mark the remote itself.
+	if cfg.Raw.Section("extensions").Option("partialClone") != "" {
+		return true
+	}
+	return cfg.Raw.Section("remote").Subsection(git.DefaultRemoteName).Option("promisor") == "true"
+}
+
+// gitFetch runs `git fetch` for a partial clone, which keeps omitting blobs,
+// and returns the refs that it fetched. It fetches into a repo in the staging
+// directory dir that borrows the partial clone's objects, so that neither
+// its refs nor its packfiles change underneath readers. It must be called
+// with r.writeMu held.
+func (r *Repo) gitFetch(ctx context.Context, dir string, specs []gitconfig.RefSpec) (map[gitplumbing.ReferenceName]gitplumbing.Hash, error) {
+	if err := runGit(ctx, "", Credentials{}, "init", "--bare", "--quiet", dir); err != nil {
+		return nil, err
+	}
+	// The staging repo fetches from the same promisor remote.
+	config, err := ioutil.ReadFile(filepath.Join(r.fullPath(), "config"))
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "config"), config, 0o644); err != nil {
+		return nil, err
+	}
+	// git tells origin about the commits that the partial clone has from
+	// the refs of its alternates.
+	alternates := filepath.Join(dir, "objects", "info", "alternates")
+	if err := ioutil.WriteFile(alternates, []byte(filepath.Join(r.fullPath(), "objects")+"\n"), 0o644); err != nil {
+		return nil, err
+	}
+
+	args := []string{"fetch", "--no-tags", "--force", "--filter=" + blobFilter, git.DefaultRemoteName}
+	for _, spec := range specs {
+		args = append(args, spec.String())
+	}
+	if err := runGit(ctx, dir, r.credentials(), args...); err != nil {
+		return nil, err
+	}
+
+	staged, err := openStorage(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer staged.Close()
+	refs, err := staged.IterReferences()
+	if err != nil {
+		return nil, err
+	}
+	updates := map[gitplumbing.ReferenceName]gitplumbing.Hash{}
+	err = refs.ForEach(func(ref *gitplumbing.Reference) error {
+		if ref.Type() == gitplumbing.HashReference {
+			updates[ref.Name()] = ref.Hash()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return updates, nil
+}
+
+// blob returns the blob with the given hash. In a partial clone, a blob that
+// hasn't been fetched yet is fetched from origin and stored locally first.
+func (rd *repoReader) blob(ctx context.Context, hash gitplumbing.Hash) (*gitobject.Blob, error) {
+	b, err := gitobject.GetBlob(rd.git.Storer, hash)
+	if err != gitplumbing.ErrObjectNotFound || !rd.partial {
+		return b, err
+	}
+	if err := rd.fetchMissingBlob(ctx, hash); err != nil {
+		return nil, err
+	}
+	return gitobject.GetBlob(rd.git.Storer, hash)
+}
+
+// objectSizer is implemented by storers that can read an object's size
+// without its contents, as go-git's filesystem storage does.
+type objectSizer interface {
+	EncodedObjectSize(hash gitplumbing.Hash) (int64, error)
+}
+
+// blobSize returns the size of the blob with the given hash, reading only
+// the object's header where the storer allows. In a partial clone, a blob
+// that hasn't been fetched yet is fetched first: origin can't tell a blob's
+// size without sending it, and the file is likely to be read next anyway.
+func (rd *repoReader) blobSize(ctx context.Context, hash gitplumbing.Hash) (int64, error) {
+	sizer, ok := rd.git.Storer.(objectSizer)
+	if !ok {
+		b, err := rd.blob(ctx, hash)
+		if err != nil {
+			return 0, err
+		}
+		return b.Size, nil
+	}
+	size, err := sizer.EncodedObjectSize(hash)
+	if err != gitplumbing.ErrObjectNotFound || !rd.partial {
+		return size, err
+	}
+	if err := rd.fetchMissingBlob(ctx, hash); err != nil {
+		return 0, err
+	}
+	return sizer.EncodedObjectSize(hash)
+}
+
+// blobFetchTimeout bounds a blob fetch shared by concurrent reads, which
+// doesn't stop when the read that started it is cancelled.
+const blobFetchTimeout = 5 * time.Minute
+
+// fetchMissingBlob fetches a blob that a partial clone doesn't have. Other
+// readers find it once it is stored, since go-git looks for loose objects on
+// disk. The fetch runs until the repo is closed or blobFetchTimeout passes,
+// even if ctx is done first, so that other readers waiting for it get the
+// blob.
+func (rd *repoReader) fetchMissingBlob(ctx context.Context, hash gitplumbing.Hash) error {
+	_, err := rd.blobs.Do(ctx, hash.String(), func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(rd.ctx, blobFetchTimeout)
+		defer cancel()
+		return nil, rd.fetchBlob(ctx, hash)
+	})
+	if err != nil && err == ctx.Err() {
+		return status.FromContextError(err).Err()
+	}
+	return err
+}
+
+// fetchBlob fetches a missing blob from origin, and stores it in the repo as
+// a loose object so that go-git can find it without rescanning packfiles.
+func (r *Repo) fetchBlob(ctx context.Context, hash gitplumbing.Hash) error {
+	glog.Infof("Fetching blob %s for repo %q from origin", hash, r.path)
+	// cat-file fetches the blob from the promisor remote, since it isn't
+	// present locally. The packfile that it fetches is written to a staging
+	// directory, since go-git would find it in the repo before it was
+	// indexed, and is then unpacked there by git itself, so that the blob is
+	// stored once and never held in memory. Only finished loose objects are
+	// moved into the repo: go-git lists the files that git is still writing
+	// as objects that it then can't read.
+	dir, err := r.newStagingDir()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	staged := filepath.Join(dir, "objects")
+	env := []string{
+		"GIT_OBJECT_DIRECTORY=" + staged,
+		"GIT_ALTERNATE_OBJECT_DIRECTORIES=" + filepath.Join(r.fullPath(), "objects"),
+	}
+	cmd, cleanup, err := gitCommand(ctx, r.fullPath(), r.credentials(), "cat-file", "-t", hash.String())
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	cmd.Env = append(cmd.Env, env...)
+	if err := runCommand(cmd); err != nil {
+		return fmt.Errorf("failed to fetch blob %s for repo %q: %v", hash, r.path, err)
+	}
+
+	// The fetched packfile is moved out of the staging object directory
+	// first, or git would find the blob there and not unpack it.
+	fetched := filepath.Join(dir, "fetched")
+	if err := os.Rename(filepath.Join(staged, "pack"), fetched); err != nil {
+		return fmt.Errorf("failed to store blob %s for repo %q: %v", hash, r.path, err)
+	}
+	packs, err := filepath.Glob(filepath.Join(fetched, "*.pack"))
+	if err != nil {
+		return fmt.Errorf("failed to store blob %s for repo %q: %v", hash, r.path, err)
+	}
+	if len(packs) == 0 {
+		return fmt.Errorf("fetching blob %s for repo %q returned no packfile", hash, r.path)
+	}
+	for _, pack := range packs {
+		if err := r.unpackObjects(ctx, pack, env); err != nil {
+			return fmt.Errorf("failed to store blob %s for repo %q: %v", hash, r.path, err)
+		}
+	}
+	return r.moveObjects(staged)
+}
+
+// unpackObjects stores the objects in a packfile as loose objects, in the
+// object directory given by env.
+func (r *Repo) unpackObjects(ctx context.Context, pack string, env []string) error {
+	f, err := os.Open(pack)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	cmd, cleanup, err := gitCommand(ctx, r.fullPath(), Credentials{}, "unpack-objects", "-q")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	cmd.Env = append(cmd.Env, env...)
+	cmd.Stdin = f
+	return runCommand(cmd)
+}
+
+// runGit runs the git CLI in dir, authenticating with creds.
+func runGit(ctx context.Context, dir string, creds Credentials, args ...string) error {
+	cmd, cleanup, err := gitCommand(ctx, dir, creds, args...)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	return runCommand(cmd)
+}
+
+func runCommand(cmd *exec.Cmd) error {
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed: %v: %s", strings.Join(cmd.Args[:2], " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// gitCommand returns a git command that authenticates with creds. Secrets are
+// passed through the environment or private files rather than arguments, which
+// other users can see. cleanup removes any such files once the command is done.
+func gitCommand(ctx context.Context, dir string, creds Credentials, args ...string) (cmd *exec.Cmd, cleanup func(), err error) {
+	cleanup = func() {}
+	env := append(os.Environ(),
+		// Never block on a credential or passphrase prompt.
+		"GIT_TERMINAL_PROMPT=0",
+		"GIT_SSH_VARIANT=ssh",
+	)
+	// Repacking is left to maintenance, which holds r.mu for writing while it
+	// swaps in packfiles, since go-git may be reading the ones they replace.
+	config := [][2]string{
+		{"gc.auto", "0"},
+		{"maintenance.auto", "false"},
+	}
+
+	switch {
+	case creds.SSHKey.IsSet():
+		if creds.SSHKeyPassphrase.IsSet() {
+			return nil, cleanup, fmt.Errorf("passphrase-protected SSH keys are not supported for partial clones")
+		}
+		keyFile := creds.SSHKey.File
+		if keyFile == "" {
+			key, err := creds.SSHKey.Read()
+			if err != nil {
+				return nil, cleanup, fmt.Errorf("failed to get SSH key: %v", err)
+			}
+			f, err := ioutil.TempFile("", "funhouse-ssh-key")
+			if err != nil {
+				return nil, cleanup, fmt.Errorf("failed to write SSH key: %v", err)
+			}
+			cleanup = func() { os.Remove(f.Name()) }
+			_, err = f.WriteString(key)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				cleanup()
+				return nil, func() {}, fmt.Errorf("failed to write SSH key: %v", err)
+			}
+			keyFile = f.Name()
+		}
+		ssh := []string{"ssh", "-i", shellQuote(keyFile), "-o", "IdentitiesOnly=yes", "-o", "StrictHostKeyChecking=yes"}
+		if creds.KnownHostsFile != "" {
+			ssh = append(ssh, "-o", shellQuote("UserKnownHostsFile="+creds.KnownHostsFile))
+		}
+		if creds.Username != "" {
+			ssh = append(ssh, "-l", shellQuote(creds.Username))
+		}
+		env = append(env, "GIT_SSH_COMMAND="+strings.Join(ssh, " "))
+	case creds.Token.IsSet() || creds.Password.IsSet():
+		header, err := httpAuthHeader(creds)
+		if err != nil {
+			return nil, cleanup, err
+		}
+		config = append(config, [2]string{"http.extraHeader", header})
+	}
+
+	env = append(env, fmt.Sprintf("GIT_CONFIG_COUNT=%d", len(config)))
+	for i, kv := range config {
+		env = append(env, fmt.Sprintf("GIT_CONFIG_KEY_%d=%s", i, kv[0]), fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", i, kv[1]))
+	}
+
+	cmd = exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Env = env
+	return cmd, cleanup, nil
+}
+
+// httpAuthHeader returns the Authorization header that go-git would send for
+// creds.
+func httpAuthHeader(creds Credentials) (string, error) {
+	auth, err := creds.authMethod()
+	if err != nil {
+		return "", err
+	}
+	switch auth := auth.(type) {
+	case *githttp.TokenAuth:
+		return "Authorization: Bearer " + auth.Token, nil
+	case *githttp.BasicAuth:
+		return "Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(auth.Username+":"+auth.Password)), nil
+	default:
+		return "", fmt.Errorf("unsupported credentials for HTTP: %T", auth)
+	}
+}
+
+// shellQuote quotes s for GIT_SSH_COMMAND, which git runs with the shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,145 @@
+package service
+
+import (
+	"context"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	fspb "github.com/minorhacks/funhouse/proto/git_read_fs_proto"
+
+	gitplumbing "github.com/go-git/go-git/v5/plumbing"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// newPartialTestService returns a Service that mirrors origin with a partial
+// clone, made by the git CLI.
+func newPartialTestService(t *testing.T, o *testOrigin) *Service {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("partial clones need the git CLI")
+	}
+	cfg, err := o.repo.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Raw.Section("uploadpack").SetOption("allowFilter", "true")
+	cfg.Raw.Section("uploadpack").SetOption("allowAnySHA1InWant", "true")
+	if err := o.repo.SetConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	s := New(t.TempDir())
+	// The git CLI only filters clones from local repos given as file:// URLs.
+	if err := s.AddRepo("test", "file://"+o.url(), RepoOptions{PartialClone: true}); err != nil {
+		t.Fatalf("AddRepo() got error %v; want no error", err)
+	}
+	t.Cleanup(func() {
+		testRepo(t, s).close(false /* deleteData */)
+	})
+	return s
+}
+
+func TestPartialCloneFetchesBlobsOnDemand(t *testing.T) {
+	origin := newTestOrigin(t)
+	head := origin.commit(map[string]string{
+		"README.md":       "v1",
+		"assets/logo.png": "not really a png",
+		"docs/unread.txt": "never read",
+	})
+	s := newPartialTestService(t, origin)
+	r := testRepo(t, s)
+	if !r.partial {
+		t.Fatalf("repo is not a partial clone")
+	}
+
+	readme := gitplumbing.ComputeHash(gitplumbing.BlobObject, []byte("v1"))
+	if err := r.repo.Storer.HasEncodedObject(readme); err == nil {
+		t.Fatalf("blob for README.md was cloned; want it fetched on demand")
+	}
+
+	res, err := s.GetFile(context.Background(), &fspb.GetFileRequest{Commit: head.String(), Path: "README.md"})
+	if err != nil {
+		t.Fatalf("GetFile() got error %v; want no error", err)
+	}
+	if got, want := string(res.Contents), "v1"; got != want {
+		t.Errorf("GetFile() = %q; want %q", got, want)
+	}
+	if err := r.repo.Storer.HasEncodedObject(readme); err != nil {
+		t.Errorf("blob for README.md not stored after GetFile: %v", err)
+	}
+
+	before, err := r.storageStats()
+	if err != nil {
+		t.Fatalf("storageStats() got error %v; want no error", err)
+	}
+	attrs, err := s.GetAttributes(context.Background(), &fspb.GetAttributesRequest{Commit: head.String(), Path: "assets/logo.png"})
+	if err != nil {
+		t.Fatalf("GetAttributes() got error %v; want no error", err)
+	}
+	if got, want := attrs.SizeBytes, uint64(len("not really a png")); got != want {
+		t.Errorf("GetAttributes().SizeBytes = %d; want %d", got, want)
+	}
+	// The fetched blob is stored once, as a loose object.
+	after, err := r.storageStats()
+	if err != nil {
+		t.Fatalf("storageStats() got error %v; want no error", err)
+	}
+	if after.packs != before.packs || after.looseObjects != before.looseObjects+1 {
+		t.Errorf("storage after fetching a blob = %+v; want %+v with one more loose object", after, before)
+	}
+	if staging, _ := filepath.Glob(filepath.Join(r.fullPath(), stagingPrefix+"*")); len(staging) != 0 {
+		t.Errorf("staging directories %v left behind after fetching a blob", staging)
+	}
+	unread := gitplumbing.ComputeHash(gitplumbing.BlobObject, []byte("never read"))
+	if err := r.repo.Storer.HasEncodedObject(unread); err == nil {
+		t.Errorf("blob for docs/unread.txt was fetched without being read")
+	}
+
+	// Fetches after the clone keep omitting blobs.
+	next := origin.commit(map[string]string{"README.md": "v2"})
+	if err := r.fetchAll(context.Background()); err != nil {
+		t.Fatalf("fetchAll() got error %v; want no error", err)
+	}
+	if got, want := mustListBranches(t, s)["master"], next.String(); got != want {
+		t.Errorf("branch master = %q; want %q", got, want)
+	}
+	res, err = s.GetFile(context.Background(), &fspb.GetFileRequest{Commit: next.String(), Path: "README.md"})
+	if err != nil {
+		t.Fatalf("GetFile() got error %v; want no error", err)
+	}
+	if got, want := string(res.Contents), "v2"; got != want {
+		t.Errorf("GetFile() = %q; want %q", got, want)
+	}
+}
+
+func TestBlobFetchOutlivesCancelledReader(t *testing.T) {
+	origin := newTestOrigin(t)
+	head := origin.commit(map[string]string{"README.md": "v1"})
+	s := newPartialTestService(t, origin)
+	r := testRepo(t, s)
+	readme := gitplumbing.ComputeHash(gitplumbing.BlobObject, []byte("v1"))
+
+	rd, err := r.reader()
+	if err != nil {
+		t.Fatalf("reader() got error %v; want no error", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = rd.fetchMissingBlob(ctx, readme)
+	rd.release()
+	if status.Code(err) != codes.Canceled {
+		t.Errorf("fetchMissingBlob() with cancelled context got error %v; want Canceled", err)
+	}
+
+	// The fetch carries on, so a later read shares it or finds the blob
+	// stored.
+	res, err := s.GetFile(context.Background(), &fspb.GetFileRequest{Commit: head.String(), Path: "README.md"})
+	if err != nil {
+		t.Fatalf("GetFile() got error %v; want no error", err)
+	}
+	if got, want := string(res.Contents), "v1"; got != want {
+		t.Errorf("GetFile() = %q; want %q", got, want)
+	}
+}
@@ -0,0 +1,153 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// PollOptions configures the background fetcher that refreshes repos in case
+// a webhook was missed.
+type PollOptions struct {
+	// Interval is the time between fetches of a healthy repo, unless the repo
+	// has its own RepoOptions.PollInterval. Polling is disabled for repos
+	// whose interval is zero.
+	Interval time.Duration
+	// Jitter is the fraction of the delay, in [0, 1), by which each delay is
+	// randomly lengthened or shortened so that repos don't fetch in lockstep.
+	Jitter float64
+	// MaxBackoff caps the delay between fetches of a repo whose fetches are
+	// failing. The delay doubles with each consecutive failure.
+	MaxBackoff time.Duration
+}
+
+// Validate checks that the options can be polled with.
+func (o PollOptions) Validate() error {
+	if o.Interval < 0 {
+		return fmt.Errorf("poll interval %v is negative", o.Interval)
+	}
+	if o.MaxBackoff < 0 {
+		return fmt.Errorf("poll max backoff %v is negative", o.MaxBackoff)
+	}
+	// A jitter of 1 or more can make delays zero or negative, so that the
+	// poller would spin.
+	if o.Jitter < 0 || o.Jitter >= 1 {
+		return fmt.Errorf("poll jitter %v is not in [0, 1)", o.Jitter)
+	}
+	return nil
+}
+
+// Poll fetches all refs of each repo, including repos added later, every
+// poll interval until ctx is cancelled. Polls take the same lock as
+// webhook-triggered fetches, so the two never run concurrently against a repo.
+func (s *Service) Poll(ctx context.Context, opts PollOptions) {
+	s.mu.Lock()
+	s.pollCtx = ctx
+	s.pollOpts = opts
+	for _, r := range s.repos {
+		s.startPolling(r)
+	}
+	s.mu.Unlock()
+	<-ctx.Done()
+}
+
+// startPolling starts polling r once Poll has been called, stopping any
+// poller it already has. It must be called with s.mu held.
+func (s *Service) startPolling(r *Repo) {
+	if r.pollStop != nil {
+		r.stopPolling(r.pollStop)
+		r.pollStop = nil
+	}
+	if s.pollCtx == nil {
+		return
+	}
+	opts := s.pollOpts
+	r.optsMu.Lock()
+	if r.pollInterval != 0 {
+		opts.Interval = r.pollInterval
+	}
+	r.optsMu.Unlock()
+	if opts.Interval <= 0 {
+		return
+	}
+	r.pollStop = make(chan struct{})
+	go pollRepo(s.pollCtx, r.pollStop, r, opts)
+}
+
+// pollRepo polls r until ctx is cancelled, stop is closed or r is removed.
+func pollRepo(ctx context.Context, stop <-chan struct{}, r *Repo, opts PollOptions) {
+	for {
+		delay := pollDelay(opts, r.lastFetchStatus().failures, rand.Float64())
+		if !r.scheduleNextPoll(stop, time.Now().Add(delay)) {
+			return
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			r.setNextPoll(time.Time{})
+			return
+		case <-r.ctx.Done():
+			timer.Stop()
+			return
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if err := r.ready(); err != nil {
+			glog.V(1).Infof("Poll: skipping: %v", err)
+			continue
+		}
+		if err := r.fetchAll(ctx); err != nil {
+			glog.Errorf("Poll: %v", err)
+			continue
+		}
+		glog.V(1).Infof("Poll: fetched all refs for repo %q", r.url)
+	}
+}
+
+// stopPolling stops the poller that was started with stop, clearing the time
+// of its next poll.
+func (r *Repo) stopPolling(stop chan struct{}) {
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+	close(stop)
+	r.status.nextPoll = time.Time{}
+}
+
+// scheduleNextPoll records the time of the next poll, unless the poller was
+// stopped. It returns whether the poller should carry on.
+func (r *Repo) scheduleNextPoll(stop <-chan struct{}, t time.Time) bool {
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+	select {
+	case <-stop:
+		return false
+	default:
+	}
+	r.status.nextPoll = t
+	return true
+}
+
+// pollDelay returns how long to wait before the next poll of a repo whose
+// last failures fetches have failed. rnd is a random number in [0, 1) used to
+// apply jitter.
+func pollDelay(opts PollOptions, failures int, rnd float64) time.Duration {
+	delay := opts.Interval
+	maxDelay := opts.MaxBackoff
+	if maxDelay < opts.Interval {
+		maxDelay = opts.Interval
+	}
+	for i := 0; i < failures && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay + time.Duration(float64(delay)*opts.Jitter*(2*rnd-1))
+}
@@ -0,0 +1,197 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	fspb "github.com/minorhacks/funhouse/proto/git_read_fs_proto"
+
+	gitconfig "github.com/go-git/go-git/v5/config"
+	gitplumbing "github.com/go-git/go-git/v5/plumbing"
+)
+
+func TestPollDelay(t *testing.T) {
+	opts := PollOptions{
+		Interval:   time.Minute,
+		Jitter:     0.5,
+		MaxBackoff: 5 * time.Minute,
+	}
+
+	testCases := []struct {
+		desc     string
+		failures int
+		rnd      float64
+		want     time.Duration
+	}{
+		{
+			desc: "healthy without jitter",
+			rnd:  0.5,
+			want: time.Minute,
+		},
+		{
+			desc: "healthy with maximum negative jitter",
+			rnd:  0,
+			want: 30 * time.Second,
+		},
+		{
+			desc:     "backs off after failures",
+			failures: 2,
+			rnd:      0.5,
+			want:     4 * time.Minute,
+		},
+		{
+			desc:     "backoff is capped",
+			failures: 10,
+			rnd:      0.5,
+			want:     5 * time.Minute,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			if got := pollDelay(opts, tc.failures, tc.rnd); got != tc.want {
+				t.Errorf("pollDelay(failures=%d, rnd=%v) = %v; want %v", tc.failures, tc.rnd, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPollOptionsValidate(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		opts    PollOptions
+		wantErr bool
+	}{
+		{desc: "defaults", opts: PollOptions{Interval: 10 * time.Minute, Jitter: 0.1, MaxBackoff: time.Hour}},
+		{desc: "polling disabled", opts: PollOptions{}},
+		{desc: "jitter of 1", opts: PollOptions{Interval: time.Minute, Jitter: 1}, wantErr: true},
+		{desc: "jitter above 1", opts: PollOptions{Interval: time.Minute, Jitter: 1.5}, wantErr: true},
+		{desc: "negative jitter", opts: PollOptions{Interval: time.Minute, Jitter: -0.1}, wantErr: true},
+		{desc: "negative interval", opts: PollOptions{Interval: -time.Minute}, wantErr: true},
+		{desc: "negative max backoff", opts: PollOptions{Interval: time.Minute, MaxBackoff: -time.Minute}, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			err := tc.opts.Validate()
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Errorf("Validate() got error %v; want error: %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestFetchAllMirrorsOrigin(t *testing.T) {
+	origin := newTestOrigin(t)
+	first := origin.commit(map[string]string{"README.md": "v1"})
+	s := newTestService(t, origin)
+	feature := gitplumbing.NewBranchReferenceName("feature")
+	if err := testRepo(t, s).repo.Storer.SetReference(gitplumbing.NewHashReference(feature, first)); err != nil {
+		t.Fatal(err)
+	}
+	head := origin.commit(map[string]string{"README.md": "v2"})
+
+	if err := testRepo(t, s).fetchAll(context.Background()); err != nil {
+		t.Fatalf("fetchAll() got error %v; want no error", err)
+	}
+
+	branches := mustListBranches(t, s)
+	if got, want := branches["master"], head.String(); got != want {
+		t.Errorf("branch master = %q; want %q", got, want)
+	}
+	if _, ok := branches["feature"]; ok {
+		t.Errorf("branch feature not pruned after it disappeared from origin")
+	}
+
+	res, err := s.GetFetchStatus(context.Background(), &fspb.GetFetchStatusRequest{})
+	if err != nil {
+		t.Fatalf("GetFetchStatus() got error %v; want no error", err)
+	}
+	if res.Status.LastSuccessTime == nil || res.Status.LastError != "" {
+		t.Errorf("GetFetchStatus() = %v; want a successful fetch", res.Status)
+	}
+}
+
+func TestPollRecordsFailures(t *testing.T) {
+	origin := newTestOrigin(t)
+	origin.commit(map[string]string{"README.md": "v1"})
+	s := newTestService(t, origin)
+	// Point origin somewhere that doesn't exist so that every fetch fails.
+	testRepo(t, s).repo.DeleteRemote("origin")
+	if _, err := testRepo(t, s).repo.CreateRemote(&gitconfig.RemoteConfig{
+		Name: "origin",
+		URLs: []string{origin.url() + "-missing"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Poll(ctx, PollOptions{Interval: time.Millisecond})
+		close(done)
+	}()
+	deadline := time.Now().Add(10 * time.Second)
+	for testRepo(t, s).lastFetchStatus().failures < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("poller did not record repeated failures")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	res, err := s.GetFetchStatus(context.Background(), &fspb.GetFetchStatusRequest{})
+	if err != nil {
+		t.Fatalf("GetFetchStatus() got error %v; want no error", err)
+	}
+	if res.Status.LastError == "" {
+		t.Errorf("GetFetchStatus() = %v; want an error", res.Status)
+	}
+}
+
+func TestUpdateRepoRestartsPolling(t *testing.T) {
+	origin := newTestOrigin(t)
+	origin.commit(map[string]string{"README.md": "v1"})
+	s := newTestService(t, origin)
+	r := testRepo(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		// Polling is disabled except for repos with their own interval.
+		s.Poll(ctx, PollOptions{})
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	if err := s.UpdateRepo("test", origin.url()+"-moved", RepoOptions{}); err == nil {
+		t.Errorf("UpdateRepo() with a new URL got no error; want error")
+	}
+	if err := s.UpdateRepo("test", origin.url(), RepoOptions{PartialClone: true}); err == nil {
+		t.Errorf("UpdateRepo() to a partial clone got no error; want error")
+	}
+	if err := s.UpdateRepo("test", origin.url(), RepoOptions{PollInterval: time.Millisecond}); err != nil {
+		t.Fatalf("UpdateRepo() got error %v; want no error", err)
+	}
+
+	head := origin.commit(map[string]string{"README.md": "v2"})
+	deadline := time.Now().Add(10 * time.Second)
+	for mustListBranches(t, s)["master"] != head.String() {
+		if time.Now().After(deadline) {
+			t.Fatalf("repo was not polled after UpdateRepo()")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := s.UpdateRepo("test", origin.url(), RepoOptions{}); err != nil {
+		t.Fatalf("UpdateRepo() got error %v; want no error", err)
+	}
+	if next := r.lastFetchStatus().nextPoll; !next.IsZero() {
+		t.Errorf("next poll = %v after polling was disabled; want none", next)
+	}
+}
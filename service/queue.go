@@ -0,0 +1,347 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/minorhacks/funhouse/webhook"
+
+	gitplumbing "github.com/go-git/go-git/v5/plumbing"
+	"github.com/golang/glog"
+)
+
+const (
+	// Number of finished jobs whose status is remembered for lookup.
+	jobHistorySize = 1000
+
+	defaultFetchAttempts   = 5
+	defaultFetchBackoff    = time.Second
+	defaultFetchMaxBackoff = time.Minute
+)
+
+// Fetch job states, as reported in FetchJobStatus.State.
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobRetrying  = "retrying"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+// FetchJobStatus describes the progress of the fetches requested by a single
+// webhook delivery.
+type FetchJobStatus struct {
+	DeliveryID string    `json:"delivery_id"`
+	State      string    `json:"state"`
+	Refs       []string  `json:"refs"`
+	Attempts   int       `json:"attempts"`
+	Error      string    `json:"error,omitempty"`
+	Enqueued   time.Time `json:"enqueued"`
+	Finished   time.Time `json:"finished,omitempty"`
+}
+
+// fetchQueue applies ref updates from webhooks to a repo in the background, so
+// that webhook requests return immediately. Updates to a ref that are still
+// waiting to run are coalesced into one fetch of the ref's latest value, and
+// failed fetches are retried with exponential backoff.
+type fetchQueue struct {
+	repo        *Repo
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+
+	mu      sync.Mutex
+	pending map[gitplumbing.ReferenceName]*refTask
+	jobs    map[string]*fetchJob
+	// Delivery IDs in the order they were enqueued, for evicting old jobs.
+	history []string
+	wake    chan struct{}
+	// running is set while a batch is being applied.
+	running bool
+	// batchDone is closed and replaced whenever a batch finishes.
+	batchDone chan struct{}
+}
+
+// refTask is a pending update to a single ref, on behalf of one or more jobs.
+type refTask struct {
+	update   webhook.RefUpdate
+	attempts int
+	jobs     []*fetchJob
+}
+
+type fetchJob struct {
+	status FetchJobStatus
+	// Number of refTasks the job is waiting on.
+	waiting int
+}
+
+func newFetchQueue(r *Repo) *fetchQueue {
+	return &fetchQueue{
+		repo:        r,
+		maxAttempts: defaultFetchAttempts,
+		backoff:     defaultFetchBackoff,
+		maxBackoff:  defaultFetchMaxBackoff,
+		pending:     map[gitplumbing.ReferenceName]*refTask{},
+		jobs:        map[string]*fetchJob{},
+		wake:        make(chan struct{}, 1),
+		batchDone:   make(chan struct{}),
+	}
+}
+
+// enqueue schedules the updates from a webhook delivery, generating a delivery
+// ID if the provider didn't send one.
+func (q *fetchQueue) enqueue(ev *webhook.PushEvent) FetchJobStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	id := ev.DeliveryID
+	if id == "" {
+		id = newDeliveryID()
+	}
+	job := &fetchJob{
+		status: FetchJobStatus{
+			DeliveryID: id,
+			State:      JobQueued,
+			Enqueued:   time.Now(),
+		},
+	}
+	for _, u := range ev.Updates {
+		job.status.Refs = append(job.status.Refs, u.Ref)
+		ref := gitplumbing.ReferenceName(u.Ref)
+		if t, ok := q.pending[ref]; ok {
+			// The earlier update hasn't run yet, so it's enough to fetch
+			// the ref once at its newest value.
+			t.update = u
+			t.jobs = append(t.jobs, job)
+		} else {
+			q.pending[ref] = &refTask{update: u, jobs: []*fetchJob{job}}
+		}
+		job.waiting++
+	}
+	if job.waiting == 0 {
+		job.status.State = JobSucceeded
+		job.status.Finished = job.status.Enqueued
+	}
+
+	if _, ok := q.jobs[id]; !ok {
+		q.history = append(q.history, id)
+	}
+	q.jobs[id] = job
+	for len(q.history) > jobHistorySize {
+		delete(q.jobs, q.history[0])
+		q.history = q.history[1:]
+	}
+
+	q.signal()
+	return job.status
+}
+
+// status returns the status of the job for a delivery, if it is still known.
+func (q *fetchQueue) status(deliveryID string) (FetchJobStatus, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.jobs[deliveryID]
+	if !ok {
+		return FetchJobStatus{}, false
+	}
+	return job.status, true
+}
+
+func (q *fetchQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run processes queued updates until ctx is cancelled.
+func (q *fetchQueue) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		}
+
+		retryAfter := q.runBatch(ctx)
+		if retryAfter == 0 {
+			continue
+		}
+		timer := time.NewTimer(retryAfter)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+			q.signal()
+		}
+	}
+}
+
+// runBatch applies every pending update, returning how long to wait before
+// retrying if any of them failed.
+func (q *fetchQueue) runBatch(ctx context.Context) time.Duration {
+	q.mu.Lock()
+	batch := q.pending
+	q.pending = map[gitplumbing.ReferenceName]*refTask{}
+	var fetch, remove []gitplumbing.ReferenceName
+	for ref, t := range batch {
+		if t.update.Deleted() {
+			remove = append(remove, ref)
+		} else {
+			fetch = append(fetch, ref)
+		}
+		for _, job := range t.jobs {
+			if job.status.State == JobQueued || job.status.State == JobRetrying {
+				job.status.State = JobRunning
+			}
+		}
+	}
+	if len(batch) == 0 {
+		q.mu.Unlock()
+		return 0
+	}
+	q.running = true
+	q.mu.Unlock()
+	sort.Slice(fetch, func(i, j int) bool { return fetch[i] < fetch[j] })
+
+	errs := q.applyBatch(ctx, fetch, remove)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var retryAfter time.Duration
+	for ref, t := range batch {
+		err := errs[ref]
+		t.attempts++
+		for _, job := range t.jobs {
+			if t.attempts > job.status.Attempts {
+				job.status.Attempts = t.attempts
+			}
+		}
+		if err == nil || t.attempts >= q.maxAttempts || ctx.Err() != nil {
+			q.finish(t, err)
+			continue
+		}
+
+		if newer, ok := q.pending[ref]; ok {
+			// A newer update for the ref arrived while this one ran; retrying
+			// the newer one covers both.
+			newer.jobs = append(newer.jobs, t.jobs...)
+		} else {
+			q.pending[ref] = t
+		}
+		for _, job := range t.jobs {
+			if job.status.State == JobRunning {
+				job.status.State = JobRetrying
+			}
+			job.status.Error = err.Error()
+		}
+		if d := q.retryDelay(t.attempts); retryAfter == 0 || d < retryAfter {
+			retryAfter = d
+		}
+	}
+	q.running = false
+	close(q.batchDone)
+	q.batchDone = make(chan struct{})
+	return retryAfter
+}
+
+// applyBatch fetches and removes refs, returning the error of each one that
+// failed. If the batch as a whole fails, each ref is applied on its own, so
+// that one bad ref, such as one that is already gone from origin, doesn't
+// hold back the rest.
+func (q *fetchQueue) applyBatch(ctx context.Context, fetch []gitplumbing.ReferenceName, remove []gitplumbing.ReferenceName) map[gitplumbing.ReferenceName]error {
+	err := q.repo.updateRefs(ctx, fetch, remove)
+	if err == nil {
+		glog.Infof("FetchQueue: fetched %v and deleted %v", fetch, remove)
+		return nil
+	}
+	errs := map[gitplumbing.ReferenceName]error{}
+	if len(fetch)+len(remove) == 1 {
+		glog.Errorf("FetchQueue: %v", err)
+		for _, ref := range append(fetch, remove...) {
+			errs[ref] = err
+		}
+		return errs
+	}
+	glog.Warningf("FetchQueue: batch failed, applying each ref on its own: %v", err)
+	for _, ref := range fetch {
+		if err := q.repo.updateRefs(ctx, []gitplumbing.ReferenceName{ref}, nil); err != nil {
+			glog.Errorf("FetchQueue: %v", err)
+			errs[ref] = err
+		}
+	}
+	for _, ref := range remove {
+		if err := q.repo.updateRefs(ctx, nil, []gitplumbing.ReferenceName{ref}); err != nil {
+			glog.Errorf("FetchQueue: %v", err)
+			errs[ref] = err
+		}
+	}
+	return errs
+}
+
+// drain waits until every queued update has been applied, or has failed for
+// good, or until ctx is done.
+func (q *fetchQueue) drain(ctx context.Context) error {
+	for {
+		q.mu.Lock()
+		n := len(q.pending)
+		busy := n > 0 || q.running
+		batchDone := q.batchDone
+		q.mu.Unlock()
+		if !busy {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d ref updates still queued: %v", n, ctx.Err())
+		case <-batchDone:
+		}
+	}
+}
+
+// finish records the outcome of a task on each job waiting for it.
+func (q *fetchQueue) finish(t *refTask, err error) {
+	now := time.Now()
+	for _, job := range t.jobs {
+		job.waiting--
+		if err != nil {
+			job.status.State = JobFailed
+			job.status.Error = err.Error()
+		}
+		if job.waiting > 0 {
+			continue
+		}
+		if job.status.State != JobFailed {
+			job.status.State = JobSucceeded
+			job.status.Error = ""
+		}
+		job.status.Finished = now
+	}
+}
+
+// retryDelay returns how long to wait before the given attempt is retried.
+func (q *fetchQueue) retryDelay(attempts int) time.Duration {
+	d := q.backoff
+	for i := 1; i < attempts && d < q.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > q.maxBackoff {
+		d = q.maxBackoff
+	}
+	return d
+}
+
+func newDeliveryID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,148 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/minorhacks/funhouse/webhook"
+
+	"github.com/gorilla/mux"
+)
+
+func TestFetchQueueCoalescesUpdates(t *testing.T) {
+	origin := newTestOrigin(t)
+	first := origin.commit(map[string]string{"README.md": "v1"})
+	s := newTestService(t, origin)
+	second := origin.commit(map[string]string{"README.md": "v2"})
+	third := origin.commit(map[string]string{"README.md": "v3"})
+
+	q := newFetchQueue(testRepo(t, s))
+	q.enqueue(&webhook.PushEvent{
+		DeliveryID: "first",
+		Updates:    []webhook.RefUpdate{{Ref: "refs/heads/master", Before: first.String(), After: second.String()}},
+	})
+	q.enqueue(&webhook.PushEvent{
+		DeliveryID: "second",
+		Updates:    []webhook.RefUpdate{{Ref: "refs/heads/master", Before: second.String(), After: third.String()}},
+	})
+	if got, want := len(q.pending), 1; got != want {
+		t.Fatalf("got %d pending ref updates; want %d", got, want)
+	}
+
+	if retry := q.runBatch(context.Background()); retry != 0 {
+		t.Fatalf("runBatch() asked to retry after %v; want success", retry)
+	}
+	for _, id := range []string{"first", "second"} {
+		job, ok := q.status(id)
+		if !ok {
+			t.Fatalf("no job for delivery %q", id)
+		}
+		if job.State != JobSucceeded || job.Attempts != 1 {
+			t.Errorf("job %q = %+v; want succeeded after 1 attempt", id, job)
+		}
+	}
+	if got, want := mustListBranches(t, s)["master"], third.String(); got != want {
+		t.Errorf("branch master = %q; want %q", got, want)
+	}
+}
+
+func TestFetchQueueRetriesThenFails(t *testing.T) {
+	origin := newTestOrigin(t)
+	head := origin.commit(map[string]string{"README.md": "v1"})
+	s := newTestService(t, origin)
+
+	q := newFetchQueue(testRepo(t, s))
+	q.maxAttempts = 2
+	q.backoff = time.Millisecond
+	q.enqueue(&webhook.PushEvent{
+		DeliveryID: "missing",
+		Updates:    []webhook.RefUpdate{{Ref: "refs/heads/missing", After: head.String()}},
+	})
+
+	if retry := q.runBatch(context.Background()); retry != time.Millisecond {
+		t.Errorf("runBatch() asked to retry after %v; want %v", retry, time.Millisecond)
+	}
+	if job, _ := q.status("missing"); job.State != JobRetrying || job.Error == "" {
+		t.Errorf("job after first attempt = %+v; want retrying with an error", job)
+	}
+	if retry := q.runBatch(context.Background()); retry != 0 {
+		t.Errorf("runBatch() asked to retry after %v; want no retry after the last attempt", retry)
+	}
+	if job, _ := q.status("missing"); job.State != JobFailed || job.Attempts != 2 {
+		t.Errorf("job after last attempt = %+v; want failed after 2 attempts", job)
+	}
+}
+
+func TestFetchQueueRefMissingOnOrigin(t *testing.T) {
+	origin := newTestOrigin(t)
+	head := origin.commit(map[string]string{"README.md": "v1"})
+	s := newTestService(t, origin)
+	after := origin.commit(map[string]string{"README.md": "v2"})
+
+	q := newFetchQueue(testRepo(t, s))
+	q.backoff = time.Millisecond
+	q.enqueue(&webhook.PushEvent{
+		DeliveryID: "missing",
+		Updates:    []webhook.RefUpdate{{Ref: "refs/heads/missing", After: head.String()}},
+	})
+	q.enqueue(&webhook.PushEvent{
+		DeliveryID: "master",
+		Updates:    []webhook.RefUpdate{{Ref: "refs/heads/master", Before: head.String(), After: after.String()}},
+	})
+
+	if retry := q.runBatch(context.Background()); retry != time.Millisecond {
+		t.Errorf("runBatch() asked to retry after %v; want %v", retry, time.Millisecond)
+	}
+	if job, _ := q.status("master"); job.State != JobSucceeded || job.Error != "" {
+		t.Errorf("job %q = %+v; want succeeded alongside a ref missing on origin", "master", job)
+	}
+	if job, _ := q.status("missing"); job.State != JobRetrying || job.Error == "" {
+		t.Errorf("job %q = %+v; want retrying with an error", "missing", job)
+	}
+	if got, want := mustListBranches(t, s)["master"], after.String(); got != want {
+		t.Errorf("branch master = %q; want %q", got, want)
+	}
+	if _, ok := q.pending["refs/heads/master"]; ok {
+		t.Errorf("refs/heads/master still pending after it was fetched")
+	}
+}
+
+func TestFetchJobHandler(t *testing.T) {
+	origin := newTestOrigin(t)
+	origin.commit(map[string]string{"README.md": "v1"})
+	s := newTestService(t, origin)
+	testRepo(t, s).queue.enqueue(&webhook.PushEvent{DeliveryID: "known"})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/hook/jobs/{delivery_id}", s.FetchJobHandler)
+
+	testCases := []struct {
+		desc     string
+		path     string
+		wantCode int
+	}{
+		{
+			desc:     "known delivery",
+			path:     "/hook/jobs/known",
+			wantCode: http.StatusOK,
+		},
+		{
+			desc:     "unknown delivery",
+			path:     "/hook/jobs/unknown",
+			wantCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest("GET", tc.path, nil))
+			if rec.Code != tc.wantCode {
+				t.Errorf("GET %s returned status %d; want %d: %s", tc.path, rec.Code, tc.wantCode, rec.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package service
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	gitplumbing "github.com/go-git/go-git/v5/plumbing"
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RawHandler serves the contents of a file at a ref, given by a path of the
+// form {ref}/{path} in the route's ref_path variable. The ref is a branch, a
+// tag or a full commit hash, tried in that order. Branch and tag names may
+// contain slashes, so the shortest prefix of the path that names a ref is
+// used, as raw.githubusercontent.com does. The repo is given by the repo
+// query parameter.
+//
+// The ETag is the hash of the file's blob, so that clients can cheaply check
+// whether a file has changed on a branch, and Range requests are supported.
+func (s *Service) RawHandler(w http.ResponseWriter, r *http.Request) {
+	rd, err := s.readerFor(r.URL.Query().Get("repo"))
+	if err != nil {
+		httpErrorf(w, readerStatus(err), "Raw: %v", status.Convert(err).Message())
+		return
+	}
+	defer rd.release()
+	if rd.viewRequired() {
+		httpErrorf(w, http.StatusForbidden, "Raw: repo %q can only be read through a view", rd.path)
+		return
+	}
+
+	refPath := mux.Vars(r)["ref_path"]
+	ref, hash, filePath, ok := rd.resolveRefPath(refPath)
+	if !ok {
+		httpErrorf(w, http.StatusNotFound, "Raw: no ref in repo %q matches %q", rd.path, refPath)
+		return
+	}
+	commit, err := rd.git.CommitObject(hash)
+	if err != nil {
+		httpErrorf(w, http.StatusNotFound, "Raw: ref %q doesn't point to a commit: %v", ref, err)
+		return
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		httpErrorf(w, http.StatusInternalServerError, "Raw: can't get tree for commit %q: %v", hash, err)
+		return
+	}
+	entry, err := tree.FindEntry(filePath)
+	if err != nil || !entry.Mode.IsFile() {
+		httpErrorf(w, http.StatusNotFound, "Raw: file %q not found at ref %q", filePath, ref)
+		return
+	}
+	blob, err := rd.blob(r.Context(), entry.Hash)
+	if err != nil {
+		httpErrorf(w, http.StatusServiceUnavailable, "Raw: can't get blob for file %q at ref %q: %v", filePath, ref, err)
+		return
+	}
+	rdr, err := blob.Reader()
+	if err != nil {
+		httpErrorf(w, http.StatusInternalServerError, "Raw: can't get reader for file %q at ref %q: %v", filePath, ref, err)
+		return
+	}
+	defer rdr.Close()
+	contents, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		httpErrorf(w, http.StatusInternalServerError, "Raw: error copying from %q at ref %q: %v", filePath, ref, err)
+		return
+	}
+
+	w.Header().Set("ETag", `"`+entry.Hash.String()+`"`)
+	if ref == hash.String() {
+		// Nothing at a commit ever changes.
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	// Files are served with their own Content-Type, so keep any HTML in the
+	// repo from running scripts on this origin.
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	// ServeContent picks the Content-Type from the file's extension, or from
+	// its contents, and handles Range and conditional requests.
+	http.ServeContent(w, r, path.Base(filePath), time.Time{}, bytes.NewReader(contents))
+}
+
+// resolveRefPath splits a path of the form {ref}/{path} at the first ref
+// that exists, returning the ref, the commit it points to and the rest of the
+// path.
+func (rd *repoReader) resolveRefPath(refPath string) (ref string, hash gitplumbing.Hash, filePath string, ok bool) {
+	parts := strings.Split(refPath, "/")
+	for i := 1; i < len(parts); i++ {
+		ref := strings.Join(parts[:i], "/")
+		if hash, ok := rd.resolveRef(ref); ok {
+			return ref, hash, strings.Join(parts[i:], "/"), true
+		}
+	}
+	return "", gitplumbing.ZeroHash, "", false
+}
+
+// resolveRef returns the commit that a branch, tag or commit hash names.
+func (rd *repoReader) resolveRef(ref string) (gitplumbing.Hash, bool) {
+	if r, err := rd.git.Reference(gitplumbing.NewBranchReferenceName(ref), true); err == nil {
+		return r.Hash(), true
+	}
+	if r, err := rd.git.Reference(gitplumbing.NewTagReferenceName(ref), true); err == nil {
+		return rd.peelTag(r.Hash())
+	}
+	if isFullHash(ref) {
+		return gitplumbing.NewHash(ref), true
+	}
+	return gitplumbing.ZeroHash, false
+}
+
+func isFullHash(s string) bool {
+	if len(s) != 40 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil && strings.ToLower(s) == s
+}
+
+// readerStatus maps an error from readerFor to an HTTP status.
+func readerStatus(err error) int {
+	switch status.Code(err) {
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
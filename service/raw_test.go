@@ -0,0 +1,189 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	gitplumbing "github.com/go-git/go-git/v5/plumbing"
+	gitobject "github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/gorilla/mux"
+)
+
+func TestRawHandler(t *testing.T) {
+	origin := newTestOrigin(t)
+	head := origin.commit(map[string]string{
+		"config/app.json": `{"debug": true}`,
+		"LICENSE":         "MIT License\n",
+	})
+	if err := origin.repo.Storer.SetReference(gitplumbing.NewHashReference("refs/heads/feature/raw", head)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := origin.repo.CreateTag("v1.0", head, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := origin.repo.CreateTag("v1.1", head, &git.CreateTagOptions{
+		Message: "annotated",
+		Tagger: &gitobject.Signature{
+			Name:  "Funhouse Test",
+			Email: "test@example.com",
+			When:  time.Date(2021, 9, 18, 12, 0, 0, 0, time.UTC),
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestService(t, origin)
+	// Cloning only creates the default branch.
+	if err := testRepo(t, s).fetchAll(context.Background()); err != nil {
+		t.Fatalf("fetchAll() got error %v; want no error", err)
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/raw/{ref_path:.+}", s.RawHandler).Methods("GET", "HEAD")
+
+	// The hashes of the blobs holding each file.
+	const (
+		configETag  = `"d6276eacf3eba9651458073f3409bb14cd4036da"`
+		licenseETag = `"d1e1072ee5e1d109c15b6fd18756aedc2a401840"`
+	)
+
+	testCases := []struct {
+		desc            string
+		path            string
+		header          http.Header
+		wantCode        int
+		wantBody        string
+		wantContentType string
+		wantCache       string
+		wantETag        string
+	}{
+		{
+			desc:            "branch",
+			path:            "/raw/master/config/app.json",
+			wantCode:        http.StatusOK,
+			wantBody:        `{"debug": true}`,
+			wantContentType: "application/json",
+			wantCache:       "no-cache",
+			wantETag:        configETag,
+		},
+		{
+			desc:            "branch with slash",
+			path:            "/raw/feature/raw/config/app.json",
+			wantCode:        http.StatusOK,
+			wantBody:        `{"debug": true}`,
+			wantContentType: "application/json",
+			wantCache:       "no-cache",
+			wantETag:        configETag,
+		},
+		{
+			desc:            "tag",
+			path:            "/raw/v1.0/config/app.json",
+			wantCode:        http.StatusOK,
+			wantBody:        `{"debug": true}`,
+			wantContentType: "application/json",
+			wantCache:       "no-cache",
+			wantETag:        configETag,
+		},
+		{
+			desc:            "annotated tag",
+			path:            "/raw/v1.1/config/app.json",
+			wantCode:        http.StatusOK,
+			wantBody:        `{"debug": true}`,
+			wantContentType: "application/json",
+			wantCache:       "no-cache",
+			wantETag:        configETag,
+		},
+		{
+			desc:            "hash",
+			path:            "/raw/" + head.String() + "/config/app.json",
+			wantCode:        http.StatusOK,
+			wantBody:        `{"debug": true}`,
+			wantContentType: "application/json",
+			wantCache:       "public, max-age=31536000, immutable",
+			wantETag:        configETag,
+		},
+		{
+			desc:            "sniffed content type",
+			path:            "/raw/master/LICENSE",
+			wantCode:        http.StatusOK,
+			wantBody:        "MIT License\n",
+			wantContentType: "text/plain; charset=utf-8",
+			wantCache:       "no-cache",
+			wantETag:        licenseETag,
+		},
+		{
+			desc:            "range",
+			path:            "/raw/master/config/app.json",
+			header:          http.Header{"Range": {"bytes=1-7"}},
+			wantCode:        http.StatusPartialContent,
+			wantBody:        `"debug"`,
+			wantContentType: "application/json",
+			wantCache:       "no-cache",
+			wantETag:        configETag,
+		},
+		{
+			desc:      "unchanged",
+			path:      "/raw/master/config/app.json",
+			header:    http.Header{"If-None-Match": {configETag}},
+			wantCode:  http.StatusNotModified,
+			wantCache: "no-cache",
+			wantETag:  configETag,
+		},
+		{
+			desc:     "missing file",
+			path:     "/raw/master/config/missing.json",
+			wantCode: http.StatusNotFound,
+		},
+		{
+			desc:     "directory",
+			path:     "/raw/master/config",
+			wantCode: http.StatusNotFound,
+		},
+		{
+			desc:     "missing ref",
+			path:     "/raw/nope/config/app.json",
+			wantCode: http.StatusNotFound,
+		},
+		{
+			desc:     "missing commit",
+			path:     "/raw/0000000000000000000000000000000000000001/config/app.json",
+			wantCode: http.StatusNotFound,
+		},
+		{
+			desc:     "missing repo",
+			path:     "/raw/master/config/app.json?repo=nope",
+			wantCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tc.path, nil)
+			for k, v := range tc.header {
+				req.Header[k] = v
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if rec.Code != tc.wantCode {
+				t.Fatalf("GET %s returned status %d; want %d: %s", tc.path, rec.Code, tc.wantCode, rec.Body)
+			}
+			if rec.Code >= http.StatusBadRequest {
+				return
+			}
+			if got := rec.Body.String(); got != tc.wantBody {
+				t.Errorf("GET %s returned body %q; want %q", tc.path, got, tc.wantBody)
+			}
+			if got := rec.Header().Get("Content-Type"); got != tc.wantContentType {
+				t.Errorf("GET %s returned Content-Type %q; want %q", tc.path, got, tc.wantContentType)
+			}
+			if got := rec.Header().Get("Cache-Control"); got != tc.wantCache {
+				t.Errorf("GET %s returned Cache-Control %q; want %q", tc.path, got, tc.wantCache)
+			}
+			if got := rec.Header().Get("ETag"); got != tc.wantETag {
+				t.Errorf("GET %s returned ETag %s; want %s", tc.path, got, tc.wantETag)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package service
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+// Concurrency
+//
+// go-git's object storage caches pack indexes without synchronization, so a
+// *git.Repository can't be read by several goroutines at once. Each read
+// instead borrows a repo of its own from its Repo's readers, and holds r.mu
+// for reading until it is done.
+//
+// Fetches and maintenance are serialized by r.writeMu. They do their slow work
+// without r.mu, writing new objects to a staging directory and keeping fetched
+// refs aside, since go-git would find packfiles in the repo's object storage
+// before it had indexed them. They take r.mu for writing only to publish
+// their work, by moving the staged objects into place, making readers rescan
+// packfiles and updating refs. A read therefore sees the repo as it was after
+// a single publish, and is only blocked while one is in progress.
+
+// maxIdleReaders is the most readers a repo keeps open between reads. Each has
+// its own object cache.
+const maxIdleReaders = 8
+
+// readerPool holds go-git repos opened on a repo's directory that are not in
+// use by a read.
+type readerPool struct {
+	mu   sync.Mutex
+	idle []*git.Repository
+}
+
+func (p *readerPool) get(path string) (*git.Repository, error) {
+	p.mu.Lock()
+	if n := len(p.idle); n > 0 {
+		gitRepo := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return gitRepo, nil
+	}
+	p.mu.Unlock()
+	return git.PlainOpen(path)
+}
+
+func (p *readerPool) put(gitRepo *git.Repository) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.idle) < maxIdleReaders {
+		p.idle = append(p.idle, gitRepo)
+	}
+}
+
+// reindex makes the idle readers rescan packfiles. Since reads hold r.mu for
+// reading, every reader is idle while r.mu is held for writing.
+func (p *readerPool) reindex() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, gitRepo := range p.idle {
+		reindexStorer(gitRepo.Storer)
+	}
+}
+
+// repoReader is a view of a repo that stays consistent until it is released.
+// It must only be used by one goroutine.
+type repoReader struct {
+	*Repo
+	git *git.Repository
+}
+
+// reader returns a view of the repo for a single read.
+func (r *Repo) reader() (*repoReader, error) {
+	if err := r.ready(); err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	gitRepo, err := r.readers.get(r.fullPath())
+	if err != nil {
+		r.mu.RUnlock()
+		return nil, fmt.Errorf("failed to open repo %q: %v", r.path, err)
+	}
+	return &repoReader{Repo: r, git: gitRepo}, nil
+}
+
+// release returns the reader to its repo, after which it must not be used.
+func (rd *repoReader) release() {
+	rd.readers.put(rd.git)
+	rd.mu.RUnlock()
+}
+
+// reindex makes go-git rescan the repo's packfiles. It must be called with
+// r.mu held for writing.
+func (r *Repo) reindex() {
+	reindexStorer(r.repo.Storer)
+	r.readers.reindex()
+}
+
+func reindexStorer(s storer.Storer) {
+	if s, ok := s.(*filesystem.Storage); ok {
+		s.ObjectStorage.Reindex()
+	}
+}
+
+// stagingPrefix names the staging directories in a repo.
+const stagingPrefix = "staging-"
+
+// newStagingDir returns a directory in the repo whose objects subdirectory
+// takes objects that readers mustn't find yet. It is removed by
+// publishObjects, or by the caller if they are discarded.
+func (r *Repo) newStagingDir() (string, error) {
+	dir, err := ioutil.TempDir(r.fullPath(), stagingPrefix)
+	if err != nil {
+		return "", fmt.Errorf("failed to create staging directory for repo %q: %v", r.path, err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "objects", "pack"), 0o755); err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("failed to create staging directory for repo %q: %v", r.path, err)
+	}
+	return dir, nil
+}
+
+// removeStagingDirs removes staging directories left behind by an earlier
+// process.
+func (r *Repo) removeStagingDirs() {
+	dirs, _ := filepath.Glob(filepath.Join(r.fullPath(), stagingPrefix+"*"))
+	for _, dir := range dirs {
+		os.RemoveAll(dir)
+	}
+}
+
+// publishObjects moves the packfiles and loose objects in a staging directory
+// into the repo's object storage, and removes the directory. It must be called
+// with r.mu held for writing.
+func (r *Repo) publishObjects(dir string) error {
+	defer os.RemoveAll(dir)
+	return r.moveObjects(filepath.Join(dir, "objects"))
+}
+
+// moveObjects moves the packfiles and loose objects in the object directory
+// staged into the repo's object storage. Each file is renamed into place, so
+// loose objects can be moved without r.mu, but readers only find packfiles
+// once the repo is reindexed.
+func (r *Repo) moveObjects(staged string) error {
+	objects := filepath.Join(r.fullPath(), "objects")
+	err := forEachObjectFile(staged, func(rel string) error {
+		if err := os.MkdirAll(filepath.Join(objects, filepath.Dir(rel)), 0o755); err != nil {
+			return err
+		}
+		return os.Rename(filepath.Join(staged, rel), filepath.Join(objects, rel))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish objects for repo %q: %v", r.path, err)
+	}
+	return nil
+}
+
+// forEachObjectFile calls fn with the path, relative to the object directory
+// dir, of each of its packfile, index and loose object files. Files that git
+// hasn't finished writing are skipped.
+func forEachObjectFile(dir string, fn func(rel string) error) error {
+	subdirs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, subdir := range subdirs {
+		name := subdir.Name()
+		if !subdir.IsDir() || (name != "pack" && len(name) != 2) {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if f.IsDir() || strings.HasPrefix(f.Name(), "tmp") {
+				continue
+			}
+			if err := fn(filepath.Join(name, f.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
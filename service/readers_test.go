@@ -0,0 +1,116 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	fspb "github.com/minorhacks/funhouse/proto/git_read_fs_proto"
+
+	gitplumbing "github.com/go-git/go-git/v5/plumbing"
+)
+
+// TestConcurrentReadsAndFetches interleaves reads with fetches and
+// maintenance; run it with -race.
+func TestConcurrentReadsAndFetches(t *testing.T) {
+	testCases := []struct {
+		desc       string
+		newService func(*testing.T, *testOrigin) *Service
+	}{
+		{desc: "full clone", newService: newTestService},
+		{desc: "partial clone", newService: newPartialTestService},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			testConcurrentReadsAndFetches(t, tc.newService)
+		})
+	}
+}
+
+func testConcurrentReadsAndFetches(t *testing.T, newService func(*testing.T, *testOrigin) *Service) {
+	origin := newTestOrigin(t)
+	head := origin.commit(map[string]string{"README.md": "v0"})
+	s := newService(t, origin)
+	r := testRepo(t, s)
+
+	var mu sync.Mutex
+	// The contents of README.md at each commit.
+	readmes := map[string]string{head.String(): "v0"}
+
+	ctx := context.Background()
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	const readers = 4
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				res, err := s.ListBranches(ctx, &fspb.ListBranchesRequest{})
+				if err != nil {
+					t.Errorf("ListBranches() got error %v; want no error", err)
+					return
+				}
+				commit := res.Branches["master"]
+				mu.Lock()
+				want := readmes[commit]
+				mu.Unlock()
+
+				// Every object that a ref points to must be readable as soon
+				// as the ref is.
+				file, err := s.GetFile(ctx, &fspb.GetFileRequest{Commit: commit, Path: "README.md"})
+				if err != nil {
+					t.Errorf("GetFile() at %s got error %v; want no error", commit, err)
+					return
+				}
+				if got := string(file.Contents); got != want {
+					t.Errorf("GetFile() at %s = %q; want %q", commit, got, want)
+				}
+				if _, err := s.GetAttributes(ctx, &fspb.GetAttributesRequest{Commit: commit, Path: "README.md"}); err != nil {
+					t.Errorf("GetAttributes() at %s got error %v; want no error", commit, err)
+				}
+				if _, err := s.ListDir(ctx, &fspb.ListDirRequest{Commit: commit, Path: "/"}); err != nil {
+					t.Errorf("ListDir() at %s got error %v; want no error", commit, err)
+				}
+				if _, err := s.ListCommits(ctx, &fspb.ListCommitsRequest{}); err != nil {
+					t.Errorf("ListCommits() got error %v; want no error", err)
+				}
+			}
+		}()
+	}
+
+	for i := 1; i <= 12; i++ {
+		contents := fmt.Sprintf("v%d", i)
+		head := origin.commit(map[string]string{
+			"README.md":                  contents,
+			fmt.Sprintf("dir/%d.txt", i): contents,
+		})
+		mu.Lock()
+		readmes[head.String()] = contents
+		mu.Unlock()
+
+		var err error
+		switch i % 3 {
+		case 0:
+			err = r.fetchAll(ctx)
+		case 1:
+			err = r.updateRefs(ctx, []gitplumbing.ReferenceName{"refs/heads/master"}, nil)
+		case 2:
+			if err = r.fetchAll(ctx); err == nil {
+				err = r.maintain(ctx, time.Hour)
+			}
+		}
+		if err != nil {
+			t.Errorf("fetch %d got error %v; want no error", i, err)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
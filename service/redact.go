@@ -0,0 +1,109 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	gitobject "github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// A Redaction is a rule of a redacting view. It hides the files that match
+// its paths, and replaces the matches of its pattern in every other file.
+type Redaction struct {
+	// Name identifies the rule in placeholders and on the status page.
+	Name string
+	// Paths are patterns of paths to hide, as for ExcludePaths.
+	Paths []string
+	// Pattern, if set, matches secrets in the contents of files.
+	Pattern *regexp.Regexp
+}
+
+// placeholder is what the rule replaces each of its pattern's matches with.
+func (r Redaction) placeholder() []byte {
+	return []byte("[REDACTED:" + r.Name + "]")
+}
+
+// Redact hides the paths and replaces the secrets described by redactions,
+// in order to share a repo with people who mustn't see all of it. Sizes are
+// those of the redacted contents. It should be the last transformer of its
+// view, so that no later one can put back what it took out.
+func Redact(redactions []Redaction) (Transformer, error) {
+	names := map[string]bool{}
+	var paths []string
+	hasPatterns := false
+	for i, r := range redactions {
+		if r.Name == "" {
+			return nil, fmt.Errorf("redaction %d has no name", i)
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("redaction %q is listed more than once", r.Name)
+		}
+		names[r.Name] = true
+		if len(r.Paths) == 0 && r.Pattern == nil {
+			return nil, fmt.Errorf("redaction %q has neither paths nor a pattern", r.Name)
+		}
+		paths = append(paths, r.Paths...)
+		hasPatterns = hasPatterns || r.Pattern != nil
+	}
+	hidden, err := matchPaths(paths)
+	if err != nil {
+		return nil, err
+	}
+	return &redactor{redactions: redactions, hidden: hidden, hasPatterns: hasPatterns}, nil
+}
+
+// redactor is the Transformer returned by Redact. It keeps its rules so that
+// they can be listed.
+type redactor struct {
+	redactions  []Redaction
+	hidden      func(p string) bool
+	hasPatterns bool
+}
+
+func (r *redactor) Transform(ctx context.Context, commit *gitobject.Commit, tree Tree) (Tree, error) {
+	filtered := &filterTree{Tree: tree, keep: ignoreContext(func(p string) bool { return !r.hidden(p) })}
+	if !r.hasPatterns {
+		// Rewriting reads every file to size it, so don't when nothing would
+		// change.
+		return filtered, nil
+	}
+	return &rewriteTree{
+		Tree:   filtered,
+		commit: commit,
+		match:  ignoreContext(func(string) bool { return true }),
+		rewrite: func(ctx context.Context, commit *gitobject.Commit, p string, contents []byte) ([]byte, error) {
+			for _, rd := range r.redactions {
+				if rd.Pattern != nil {
+					contents = rd.Pattern.ReplaceAllLiteral(contents, rd.placeholder())
+				}
+			}
+			return contents, nil
+		},
+	}, nil
+}
+
+// redactions returns the rules of a view's Redact transformers, in order.
+func redactions(transformers []Transformer) []Redaction {
+	var redactions []Redaction
+	for _, t := range transformers {
+		if r, ok := t.(*redactor); ok {
+			redactions = append(redactions, r.redactions...)
+		}
+	}
+	return redactions
+}
+
+// redactedViews returns the rules of each of the repo's views that redacts
+// anything, keyed by name.
+func (r *Repo) redactedViews() map[string][]Redaction {
+	r.optsMu.Lock()
+	defer r.optsMu.Unlock()
+	views := map[string][]Redaction{}
+	for name, transformers := range r.views {
+		if rs := redactions(transformers); len(rs) > 0 {
+			views[name] = rs
+		}
+	}
+	return views
+}
@@ -3,20 +3,235 @@ package service
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
+
+	"github.com/minorhacks/funhouse/flight"
 
 	git "github.com/go-git/go-git/v5"
 	gitconfig "github.com/go-git/go-git/v5/config"
+	gitplumbing "github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/go-git/go-git/v5/storage/memory"
 	"github.com/golang/glog"
 )
 
 type Repo struct {
-	mu   sync.RWMutex
+	// mu is held for reading by reads, and for writing while a fetch or
+	// maintenance publishes its changes. See readers.go.
+	mu      sync.RWMutex
+	writeMu sync.Mutex
+	readers readerPool
+
 	root string
 	path string
+	url  string
 	repo *git.Repository
+	// partial is set if the repo is a partial clone, whose blobs are fetched
+	// when they are first read.
+	partial bool
+	blobs   flight.Group
+
+	// ctx is cancelled when the repo is removed from its Service, stopping
+	// its background work.
+	ctx    context.Context
+	cancel context.CancelFunc
+	queue  *fetchQueue
+	// pollStop is closed to stop the repo's poller, if it has one. It is
+	// guarded by the Service's mu.
+	pollStop chan struct{}
+
+	// optsMu guards the options that UpdateRepo can change.
+	optsMu sync.Mutex
+	// creds authenticate clones and fetches from url.
+	creds         Credentials
+	pollInterval  time.Duration
+	webhookSecret string
+	views         map[string][]Transformer
+	requireView   bool
+
+	statusMu    sync.Mutex
+	status      fetchStatus
+	cloneState  cloneState
+	cloneErr    error
+	maintStatus maintenanceStatus
+	// closing is set once the repo is shutting down, after which no fetch or
+	// maintenance starts.
+	closing bool
+	// refsUpdated is closed and replaced whenever a fetch publishes refs.
+	refsUpdated chan struct{}
+}
+
+type cloneState int
+
+const (
+	cloneStateCloning cloneState = iota
+	cloneStateReady
+	cloneStateFailed
+)
+
+// fetchStatus records the outcome of recent fetches from origin.
+type fetchStatus struct {
+	lastFetch   time.Time
+	lastSuccess time.Time
+	lastErr     error
+	failures    int
+	nextPoll    time.Time
+}
+
+// newRepo returns a repo that mirrors url into a directory named name under
+// root. It must be initialized with clone before it can serve requests.
+func newRepo(root string, name string, url string, opts RepoOptions) *Repo {
+	r := &Repo{
+		root:        root,
+		path:        name,
+		url:         url,
+		partial:     opts.PartialClone,
+		refsUpdated: make(chan struct{}),
+	}
+	r.setOptions(opts)
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	r.queue = newFetchQueue(r)
+	go r.queue.run(r.ctx)
+	return r
+}
+
+// setOptions replaces the options that can change after the repo is added.
+func (r *Repo) setOptions(opts RepoOptions) {
+	r.optsMu.Lock()
+	defer r.optsMu.Unlock()
+	r.creds = opts.Credentials
+	r.pollInterval = opts.PollInterval
+	r.webhookSecret = opts.WebhookSecret
+	r.views = opts.Views
+	r.requireView = opts.RequireView
+}
+
+// credentials returns the credentials for the next clone or fetch.
+func (r *Repo) credentials() Credentials {
+	r.optsMu.Lock()
+	defer r.optsMu.Unlock()
+	return r.creds
+}
+
+// ownWebhookSecret returns the repo's webhook secret, or "" if it uses the
+// webhook handler's.
+func (r *Repo) ownWebhookSecret() string {
+	r.optsMu.Lock()
+	defer r.optsMu.Unlock()
+	return r.webhookSecret
+}
+
+// view returns the transformers of the named view.
+func (r *Repo) view(name string) ([]Transformer, bool) {
+	r.optsMu.Lock()
+	defer r.optsMu.Unlock()
+	transformers, ok := r.views[name]
+	return transformers, ok
+}
+
+// viewRequired returns whether reads of the repo must name a view.
+func (r *Repo) viewRequired() bool {
+	r.optsMu.Lock()
+	defer r.optsMu.Unlock()
+	return r.requireView
+}
+
+// clone initializes the repo, recording whether it succeeded.
+func (r *Repo) clone() error {
+	err := r.init(r.url)
+
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+	if err != nil {
+		r.cloneState = cloneStateFailed
+		r.cloneErr = err
+		return err
+	}
+	r.cloneState = cloneStateReady
+	return nil
+}
+
+// cloneFailed reports whether the repo failed to clone.
+func (r *Repo) cloneFailed() bool {
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+	return r.cloneState == cloneStateFailed
+}
+
+// ready returns an error if the repo can't serve requests yet.
+func (r *Repo) ready() error {
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+	switch r.cloneState {
+	case cloneStateReady:
+		return nil
+	case cloneStateFailed:
+		return fmt.Errorf("repo %q failed to clone: %v", r.path, r.cloneErr)
+	default:
+		return fmt.Errorf("repo %q is still cloning", r.path)
+	}
+}
+
+// close stops the repo's background work, and deletes its data from disk if
+// deleteData is set.
+func (r *Repo) close(deleteData bool) error {
+	r.cancel()
+	if !deleteData {
+		return nil
+	}
+	// Wait for any in-flight reads and fetches to finish.
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := os.RemoveAll(r.fullPath()); err != nil {
+		return fmt.Errorf("failed to delete data for repo %q: %v", r.path, err)
+	}
+	return nil
+}
+
+// sizeOnDisk returns the total size of the files in the repo's directory.
+func (r *Repo) sizeOnDisk() (uint64, error) {
+	var size uint64
+	err := filepath.Walk(r.fullPath(), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += uint64(info.Size())
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to compute size of repo %q: %v", r.path, err)
+	}
+	return size, nil
+}
+
+// refCount returns the number of refs in the repo.
+func (r *Repo) refCount() (int, error) {
+	rd, err := r.reader()
+	if err != nil {
+		return 0, err
+	}
+	defer rd.release()
+
+	refs, err := rd.git.References()
+	if err != nil {
+		return 0, fmt.Errorf("failed to iterate over refs for repo %q: %v", r.path, err)
+	}
+	count := 0
+	err = refs.ForEach(func(*gitplumbing.Reference) error {
+		count++
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to iterate over refs for repo %q: %v", r.path, err)
+	}
+	return count, nil
 }
 
 func (r *Repo) fullPath() string {
@@ -28,14 +243,33 @@ func (r *Repo) init(url string) error {
 	defer r.mu.Unlock()
 
 	if r.repo == nil {
+		if err := migrateLegacyLayout(r.root, r.path, url); err != nil {
+			return err
+		}
 		var gitRepo *git.Repository
 		var err error
 		if _, statErr := os.Stat(r.fullPath()); os.IsNotExist(statErr) {
 			glog.Infof("Cloning repo %s...", url)
-			gitRepo, err = git.PlainCloneContext(context.TODO(), r.fullPath(), true /* isBare */, &git.CloneOptions{
-				URL: url,
-			})
+			if r.partial {
+				err = partialClone(r.ctx, r.fullPath(), url, r.credentials())
+				if err == nil {
+					gitRepo, err = git.PlainOpen(r.fullPath())
+				}
+			} else {
+				var auth transport.AuthMethod
+				auth, err = r.credentials().authMethod()
+				if err != nil {
+					return fmt.Errorf("failed to get credentials: %v", err)
+				}
+				gitRepo, err = git.PlainCloneContext(r.ctx, r.fullPath(), true /* isBare */, &git.CloneOptions{
+					URL:  url,
+					Auth: auth,
+				})
+			}
 			if err != nil {
+				// Don't leave a partial clone behind to be mistaken for a
+				// complete one next time.
+				os.RemoveAll(r.fullPath())
 				return fmt.Errorf("failed to clone: %v", err)
 			}
 			glog.Infof("Successfully cloned %q to %q", url, r.path)
@@ -47,20 +281,371 @@ func (r *Repo) init(url string) error {
 			glog.Infof("Successfully opened repo at %q", r.path)
 		}
 		r.repo = gitRepo
+		r.removeStagingDirs()
+		// A repo cloned earlier keeps the mode it was cloned with.
+		r.partial = isPartialClone(r)
 	}
 	return nil
 }
 
-func (r *Repo) pull(ref string) error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+// legacyFiles are the files and directories of the bare clone that the server
+// kept directly in its base path before it served more than one repo.
+var legacyFiles = []string{
+	"HEAD", "config", "description", "packed-refs", "shallow", "index",
+	"FETCH_HEAD", "ORIG_HEAD", "objects", "refs", "info", "hooks", "logs",
+}
 
-	err := r.repo.Fetch(&git.FetchOptions{
-		RefSpecs: []gitconfig.RefSpec{gitconfig.RefSpec(fmt.Sprintf("+%s:%s", ref, ref))},
+// migrateLegacyLayout moves a clone of url kept directly in root, as the
+// server did before it served more than one repo, into the directory of the
+// repo named name, so that upgrading doesn't clone it again. The files are
+// moved through a directory that no repo can be named, so that a migration
+// that is interrupted is finished next time.
+func migrateLegacyLayout(root string, name string, url string) error {
+	dest := filepath.Join(root, name)
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		return nil
+	}
+	staging := filepath.Join(root, ".migrating-"+name)
+	if _, err := os.Stat(staging); os.IsNotExist(err) {
+		legacy, err := git.PlainOpen(root)
+		if err != nil {
+			return nil
+		}
+		remote, err := legacy.Remote(git.DefaultRemoteName)
+		if err != nil || len(remote.Config().URLs) == 0 || remote.Config().URLs[0] != url {
+			return nil
+		}
+	}
+
+	glog.Infof("Moving the clone of %q in %q to %q...", url, root, dest)
+	if err := os.MkdirAll(staging, 0o755); err != nil {
+		return fmt.Errorf("failed to migrate repo %q: %v", name, err)
+	}
+	for _, f := range legacyFiles {
+		err := os.Rename(filepath.Join(root, f), filepath.Join(staging, f))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to migrate repo %q: %v", name, err)
+		}
+	}
+	if err := os.Rename(staging, dest); err != nil {
+		return fmt.Errorf("failed to migrate repo %q: %v", name, err)
+	}
+	return nil
+}
+
+// updateRefs fetches the fetch refs from origin in a single round trip,
+// pointing each local ref at the commit of the remote ref with the same name,
+// and deletes the remove refs locally.
+func (r *Repo) updateRefs(ctx context.Context, fetch []gitplumbing.ReferenceName, remove []gitplumbing.ReferenceName) error {
+	ctx, done, err := r.beginWrite(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	var f fetched
+	if len(fetch) > 0 {
+		var specs []gitconfig.RefSpec
+		for _, ref := range fetch {
+			specs = append(specs, gitconfig.RefSpec(fmt.Sprintf("+%s:%s", ref, ref)))
+		}
+		f, err = r.fetchRefs(ctx, specs)
+		if err != nil {
+			err = fmt.Errorf("failed to fetch refs %v for repo %q: %v", fetch, r.path, err)
+			r.recordFetch(err)
+			return err
+		}
+	}
+	err = r.publish(f, remove)
+	if len(fetch) > 0 {
+		r.recordFetch(err)
+	}
+	return err
+}
+
+// fetchAll fetches every branch and tag from origin, and deletes local
+// branches and tags that no longer exist on origin.
+func (r *Repo) fetchAll(ctx context.Context) error {
+	ctx, done, err := r.beginWrite(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	err = r.fetchAllRefs(ctx)
+	r.recordFetch(err)
+	return err
+}
+
+func (r *Repo) fetchAllRefs(ctx context.Context) error {
+	auth, err := r.credentials().authMethod()
+	if err != nil {
+		return fmt.Errorf("failed to get credentials for repo %q: %v", r.path, err)
+	}
+	remote, err := r.repo.Remote(git.DefaultRemoteName)
+	if err != nil {
+		return fmt.Errorf("failed to get remote for repo %q: %v", r.path, err)
+	}
+	remoteRefs, err := remote.ListContext(ctx, &git.ListOptions{Auth: auth})
+	if err != nil {
+		return fmt.Errorf("failed to list remote refs for repo %q: %v", r.path, err)
+	}
+	onRemote := map[gitplumbing.ReferenceName]bool{}
+	for _, ref := range remoteRefs {
+		onRemote[ref.Name()] = true
+	}
+
+	f, err := r.fetchRefs(ctx, []gitconfig.RefSpec{
+		"+refs/heads/*:refs/heads/*",
+		"+refs/tags/*:refs/tags/*",
+	})
+	if err != nil {
+		return fmt.Errorf("failed to fetch all refs for repo %q: %v", r.path, err)
+	}
+
+	localRefs, err := r.repo.References()
+	if err != nil {
+		f.discard()
+		return fmt.Errorf("failed to iterate over refs for repo %q: %v", r.path, err)
+	}
+	var stale []gitplumbing.ReferenceName
+	err = localRefs.ForEach(func(ref *gitplumbing.Reference) error {
+		name := ref.Name()
+		if (name.IsBranch() || name.IsTag()) && !onRemote[name] {
+			glog.Infof("Pruning ref %s from repo %q; it no longer exists on origin", name, r.path)
+			stale = append(stale, name)
+		}
+		return nil
+	})
+	if err != nil {
+		f.discard()
+		return fmt.Errorf("failed to iterate over refs for repo %q: %v", r.path, err)
+	}
+	return r.publish(f, stale)
+}
+
+// beginWrite starts a fetch or maintenance run, once any other has finished.
+// The returned context is also cancelled if the repo is closed, and done must
+// be called when the run is over. It returns an error if the repo is shutting
+// down.
+func (r *Repo) beginWrite(ctx context.Context) (runCtx context.Context, done func(), err error) {
+	if err := r.ready(); err != nil {
+		return nil, nil, err
+	}
+	r.writeMu.Lock()
+	r.statusMu.Lock()
+	closing := r.closing
+	r.statusMu.Unlock()
+	if closing {
+		r.writeMu.Unlock()
+		return nil, nil, fmt.Errorf("repo %q is shutting down", r.path)
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-r.ctx.Done():
+			cancel()
+		case <-runCtx.Done():
+		}
+	}()
+	return runCtx, func() {
+		cancel()
+		r.writeMu.Unlock()
+	}, nil
+}
+
+// fetched is the outcome of a fetch that hasn't been published yet.
+type fetched struct {
+	// stagingDir holds the fetched objects, if any.
+	stagingDir string
+	// updates are the refs that the fetch changed.
+	updates map[gitplumbing.ReferenceName]gitplumbing.Hash
+}
+
+// discard removes the objects of a fetch that won't be published.
+func (f fetched) discard() {
+	if f.stagingDir != "" {
+		os.RemoveAll(f.stagingDir)
+	}
+}
+
+// fetchRefs fetches specs from origin without changing what readers see. It
+// must be called with r.writeMu held.
+func (r *Repo) fetchRefs(ctx context.Context, specs []gitconfig.RefSpec) (fetched, error) {
+	dir, err := r.newStagingDir()
+	if err != nil {
+		return fetched{}, err
+	}
+	f := fetched{stagingDir: dir}
+	if r.partial {
+		f.updates, err = r.gitFetch(ctx, dir, specs)
+	} else {
+		f.updates, err = r.goGitFetch(ctx, dir, specs)
+	}
+	if err != nil {
+		f.discard()
+		return fetched{}, err
+	}
+	return f, nil
+}
+
+// goGitFetch fetches specs from origin with go-git, writing objects to the
+// staging directory dir, and returns the refs that changed.
+func (r *Repo) goGitFetch(ctx context.Context, dir string, specs []gitconfig.RefSpec) (map[gitplumbing.ReferenceName]gitplumbing.Hash, error) {
+	auth, err := r.credentials().authMethod()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get credentials: %v", err)
+	}
+	objects, err := openStorage(r.fullPath())
+	if err != nil {
+		return nil, err
+	}
+	defer objects.Close()
+	staging, err := initStorage(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer staging.Close()
+
+	fs := &fetchStorage{Storage: objects, ReferenceStorage: memory.ReferenceStorage{}, staging: staging}
+	refs, err := objects.IterReferences()
+	if err != nil {
+		return nil, err
+	}
+	before := map[gitplumbing.ReferenceName]gitplumbing.Hash{}
+	err = refs.ForEach(func(ref *gitplumbing.Reference) error {
+		fs.ReferenceStorage[ref.Name()] = ref
+		before[ref.Name()] = ref.Hash()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fetcher, err := git.Open(fs, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = fetcher.FetchContext(ctx, &git.FetchOptions{
+		RefSpecs: specs,
+		Tags:     git.NoTags,
 		Force:    true,
+		Auth:     auth,
 	})
-	if err != nil && err != git.NoErrAlreadyUpToDate {
-		return fmt.Errorf("failed to pull ref %q for repo %q: %v", ref, r.path, err)
+	if err == git.NoErrAlreadyUpToDate {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	updates := map[gitplumbing.ReferenceName]gitplumbing.Hash{}
+	for name, ref := range fs.ReferenceStorage {
+		if ref.Type() != gitplumbing.HashReference {
+			continue
+		}
+		if hash, ok := before[name]; !ok || hash != ref.Hash() {
+			updates[name] = ref.Hash()
+		}
+	}
+	return updates, nil
+}
+
+// fetchStorage reads objects from a repo's object storage but writes fetched
+// packfiles to staging storage, and keeps refs in memory.
+type fetchStorage struct {
+	*filesystem.Storage
+	memory.ReferenceStorage
+	staging *filesystem.Storage
+}
+
+func (s *fetchStorage) PackfileWriter() (io.WriteCloser, error) {
+	return s.staging.PackfileWriter()
+}
+
+// openStorage opens the object storage of the repo in dir, separately from any
+// other user of the repo.
+func openStorage(dir string) (*filesystem.Storage, error) {
+	gitRepo, err := git.PlainOpen(dir)
+	if err != nil {
+		return nil, err
+	}
+	s, ok := gitRepo.Storer.(*filesystem.Storage)
+	if !ok {
+		return nil, fmt.Errorf("unexpected storer %T", gitRepo.Storer)
+	}
+	return s, nil
+}
+
+// initStorage returns storage for objects in the staging directory dir.
+func initStorage(dir string) (*filesystem.Storage, error) {
+	gitRepo, err := git.PlainInit(dir, true /* isBare */)
+	if err != nil {
+		return nil, err
+	}
+	s, ok := gitRepo.Storer.(*filesystem.Storage)
+	if !ok {
+		return nil, fmt.Errorf("unexpected storer %T", gitRepo.Storer)
+	}
+	return s, nil
+}
+
+// publish moves the objects of a fetch into place, making them visible to
+// readers, then points refs at the hashes that it fetched and deletes the
+// remove refs. It must be called with r.writeMu held.
+func (r *Repo) publish(f fetched, remove []gitplumbing.ReferenceName) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if f.stagingDir != "" {
+		if err := r.publishObjects(f.stagingDir); err != nil {
+			return err
+		}
+		r.reindex()
+	}
+	defer r.refsChanged()
+	for name, hash := range f.updates {
+		if ref, err := r.repo.Reference(name, false); err == nil && ref.Hash() == hash {
+			continue
+		}
+		if err := r.repo.Storer.SetReference(gitplumbing.NewHashReference(name, hash)); err != nil {
+			return fmt.Errorf("failed to update ref %q for repo %q: %v", name, r.path, err)
+		}
+	}
+	for _, name := range remove {
+		if err := r.repo.Storer.RemoveReference(name); err != nil {
+			return fmt.Errorf("failed to delete ref %q for repo %q: %v", name, r.path, err)
+		}
 	}
 	return nil
 }
+
+// recordFetch updates the fetch status with the outcome of a fetch.
+func (r *Repo) recordFetch(err error) {
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+
+	now := time.Now()
+	r.status.lastFetch = now
+	r.status.lastErr = err
+	if err != nil {
+		r.status.failures++
+	} else {
+		r.status.lastSuccess = now
+		r.status.failures = 0
+	}
+}
+
+// setNextPoll records when the poller will next fetch the repo.
+func (r *Repo) setNextPoll(t time.Time) {
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+	r.status.nextPoll = t
+}
+
+// lastFetchStatus returns a snapshot of the repo's fetch status.
+func (r *Repo) lastFetchStatus() fetchStatus {
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+	return r.status
+}
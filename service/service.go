@@ -3,117 +3,364 @@ package service
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"net/http"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/minorhacks/funhouse/github"
 	fspb "github.com/minorhacks/funhouse/proto/git_read_fs_proto"
+	"github.com/minorhacks/funhouse/webhook"
 
 	gitplumbing "github.com/go-git/go-git/v5/plumbing"
 	gitfilemode "github.com/go-git/go-git/v5/plumbing/filemode"
 	gitobject "github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/golang/glog"
+	"github.com/gorilla/mux"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
+// repoNamePattern restricts repo names to ones that are safe to use as
+// directory names and URL path segments.
+var repoNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
 type Service struct {
 	BasePath string
-	repo     *Repo
+
+	mu    sync.RWMutex
+	repos map[string]*Repo
+	// composites are served alongside repos, under names of their own. See
+	// composite.go.
+	composites map[string]*composite
+	// defaultRepo serves requests that don't name a repo.
+	defaultRepo string
+	// pollCtx and pollOpts are set once polling has started, so that repos
+	// added later are polled too.
+	pollCtx  context.Context
+	pollOpts PollOptions
+	// Likewise for maintenance.
+	maintCtx  context.Context
+	maintOpts MaintenanceOptions
+	// closing is set by Shutdown.
+	closing bool
 }
 
-func New(basePath string, repoURL string) (*Service, error) {
-	r := &Repo{
-		root: basePath,
-		path: "",
+// New returns a Service that stores repos under basePath. Repos are added with
+// AddRepo.
+func New(basePath string) *Service {
+	return &Service{
+		BasePath: basePath,
+		repos:    map[string]*Repo{},
 	}
-	err := r.init(repoURL)
+}
+
+// RepoOptions configure how a repo is mirrored.
+type RepoOptions struct {
+	// Credentials authenticate the clone and later fetches.
+	Credentials Credentials
+	// PartialClone clones commits and trees only. Blobs are fetched from
+	// origin when they are first read. This requires the git CLI, and a
+	// server that supports partial clone.
+	PartialClone bool
+	// PollInterval overrides PollOptions.Interval for the repo if it is
+	// non-zero.
+	PollInterval time.Duration
+	// WebhookSecret, if set, is the secret that webhooks for the repo must be
+	// signed with in place of the webhook handler's secret. Such webhooks
+	// must be delivered to a route that names the repo.
+	WebhookSecret string
+	// Views are distorted views of the repo, which requests name along with
+	// the repo. Each view's transformers are applied in order.
+	Views map[string][]Transformer
+	// RequireView refuses reads that don't name one of Views, so that a view
+	// such as one that redacts is all that clients can see. Raw files, smart
+	// HTTP and GetCommit diffs can't apply a view, so they are refused too.
+	RequireView bool
+}
+
+// AddRepo clones the repository at url into a directory named name, or opens
+// it if it was cloned previously, and starts serving it. The first repo added
+// becomes the default repo. If the repo can't be cloned or opened, it isn't
+// served.
+func (s *Service) AddRepo(name string, url string, opts RepoOptions) error {
+	r, err := s.addRepo(name, url, opts)
 	if err != nil {
-		return nil, fmt.Errorf("failed to init repo: %v", err)
+		return err
 	}
-	s := &Service{
-		BasePath: basePath,
-		repo:     r,
+	if err := r.clone(); err != nil {
+		s.mu.Lock()
+		s.unregister(r)
+		s.mu.Unlock()
+		r.close(false /* deleteData */)
+		return fmt.Errorf("failed to init repo %q: %v", name, err)
 	}
-	return s, nil
+	return nil
 }
 
-func (s *Service) GetFile(ctx context.Context, req *fspb.GetFileRequest) (*fspb.GetFileResponse, error) {
-	req.Path = strings.TrimPrefix(req.Path, "/")
+// addRepo registers a repo without initializing it.
+func (s *Service) addRepo(name string, url string, opts RepoOptions) (*Repo, error) {
+	if err := ValidateRepoName(name); err != nil {
+		return nil, err
+	}
+	if url == "" {
+		return nil, fmt.Errorf("repo %q has no URL", name)
+	}
+	if err := validateViews(name, opts); err != nil {
+		return nil, err
+	}
 
-	commit, err := s.repo.repo.CommitObject(gitplumbing.NewHash(req.Commit))
-	if err != nil {
-		return nil, status.Errorf(codes.NotFound, "commit %q not found in repo: %v", req.Commit, err)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return nil, fmt.Errorf("service is shutting down")
 	}
-	f, err := commit.File(req.Path)
-	if err != nil {
-		return nil, status.Errorf(codes.NotFound, "file %q not found at commit %q: %v", req.Path, req.Commit, err)
+	if old, ok := s.repos[name]; ok {
+		if !old.cloneFailed() {
+			return nil, fmt.Errorf("repo %q already exists", name)
+		}
+		// A repo that failed to clone is only kept to report why, so it can
+		// be added again, e.g. with the right credentials.
+		old.close(false /* deleteData */)
 	}
-	rdr, err := f.Blob.Reader()
-	if err != nil {
-		return nil, status.Errorf(codes.Internal, "can't get reader for file %q at commit %q: %v", req.Path, req.Commit, err)
+	if _, ok := s.composites[name]; ok {
+		return nil, fmt.Errorf("repo %q has the name of a composite", name)
 	}
-	defer rdr.Close()
+	r := newRepo(s.BasePath, name, url, opts)
+	s.repos[name] = r
+	if s.defaultRepo == "" {
+		s.defaultRepo = name
+	}
+	s.startPolling(r)
+	if s.maintCtx != nil {
+		go maintainRepo(s.maintCtx, r, s.maintOpts)
+	}
+	return r, nil
+}
 
-	res := &fspb.GetFileResponse{}
-	res.Contents, err = ioutil.ReadAll(rdr)
-	if err != nil {
-		return nil, status.Errorf(codes.Internal, "error copying from %q at commit %q: %v", req.Path, req.Commit, err)
+// ValidateRepoName returns an error if name can't be used as a repo name.
+func ValidateRepoName(name string) error {
+	if !repoNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid repo name %q", name)
 	}
-	return res, nil
+	return nil
 }
 
-func (s *Service) GetAttributes(ctx context.Context, req *fspb.GetAttributesRequest) (*fspb.GetAttributesResponse, error) {
-	req.Path = strings.TrimLeft(req.Path, "/")
+// ValidateViewName returns an error if name can't be used as a view name.
+// View names follow the same rules as repo names.
+func ValidateViewName(name string) error {
+	if !repoNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid view name %q", name)
+	}
+	return nil
+}
 
-	commit, err := s.repo.repo.CommitObject(gitplumbing.NewHash(req.Commit))
+func validateViews(repo string, opts RepoOptions) error {
+	if opts.RequireView && len(opts.Views) == 0 {
+		return fmt.Errorf("repo %q requires a view but has none", repo)
+	}
+	for name := range opts.Views {
+		if err := ValidateViewName(name); err != nil {
+			return fmt.Errorf("repo %q: %v", repo, err)
+		}
+	}
+	return nil
+}
+
+// UpdateRepo changes the options of a repo. New credentials are used from the
+// next fetch on, and the repo's poller restarts if its interval changed. The
+// repo's URL and whether it is a partial clone can't change, since its data
+// would no longer match; the repo must be removed and added again instead.
+func (s *Service) UpdateRepo(name string, url string, opts RepoOptions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.repos[name]
+	if !ok {
+		return fmt.Errorf("repo %q not found", name)
+	}
+	if url != r.url {
+		return fmt.Errorf("can't change the URL of repo %q from %q to %q", name, r.url, url)
+	}
+	if opts.PartialClone != r.partial {
+		return fmt.Errorf("can't change whether repo %q is a partial clone", name)
+	}
+	if err := validateViews(name, opts); err != nil {
+		return err
+	}
+	r.optsMu.Lock()
+	restartPolling := opts.PollInterval != r.pollInterval
+	r.optsMu.Unlock()
+	r.setOptions(opts)
+	if restartPolling {
+		s.startPolling(r)
+	}
+	return nil
+}
+
+// RemoveRepo stops serving a repo, deleting its data unless keepData is set.
+// If it was the default repo, the remaining repo whose name sorts first
+// becomes the default.
+func (s *Service) RemoveRepo(name string, keepData bool) error {
+	s.mu.Lock()
+	r, ok := s.repos[name]
+	if ok {
+		s.unregister(r)
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("repo %q not found", name)
+	}
+	return r.close(!keepData)
+}
+
+// HasRepo reports whether a repo named name is served, or is being cloned to
+// be served.
+func (s *Service) HasRepo(name string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	r, ok := s.repos[name]
+	return ok && !r.cloneFailed()
+}
+
+// unregister stops serving r, if it is still served. It must be called with
+// s.mu held for writing.
+func (s *Service) unregister(r *Repo) {
+	if s.repos[r.path] != r {
+		return
+	}
+	delete(s.repos, r.path)
+	if s.defaultRepo == r.path {
+		// The repo named first takes over, so that requests that don't name
+		// a repo keep being served while any repo is.
+		s.defaultRepo = ""
+		for other := range s.repos {
+			if s.defaultRepo == "" || other < s.defaultRepo {
+				s.defaultRepo = other
+			}
+		}
+		if s.defaultRepo != "" {
+			glog.Infof("Repo %q is now the default repo", s.defaultRepo)
+		}
+	}
+}
+
+// allRepos returns the repos sorted by name.
+func (s *Service) allRepos() []*Repo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var repos []*Repo
+	for _, r := range s.repos {
+		repos = append(repos, r)
+	}
+	sort.Slice(repos, func(i, j int) bool { return repos[i].path < repos[j].path })
+	return repos
+}
+
+// lookupRepo returns the named repo, or the default repo if name is empty.
+func (s *Service) lookupRepo(name string) (*Repo, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if name == "" {
+		name = s.defaultRepo
+	}
+	r, ok := s.repos[name]
+	return r, ok
+}
+
+// readerFor returns a reader of the repo that a request names, as long as it
+// is ready to serve, or a gRPC status error if not. The reader must be
+// released once the request is done with it.
+func (s *Service) readerFor(name string) (*repoReader, error) {
+	r, ok := s.lookupRepo(name)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "repo %q not found", name)
+	}
+	rd, err := r.reader()
 	if err != nil {
-		return nil, status.Errorf(codes.NotFound, "commit %q not found in repo: %v", req.Commit, err)
+		return nil, status.Errorf(codes.Unavailable, "%v", err)
 	}
+	return rd, nil
+}
 
-	rootTree, err := commit.Tree()
+func (s *Service) GetFile(ctx context.Context, req *fspb.GetFileRequest) (*fspb.GetFileResponse, error) {
+	tree, _, release, err := s.treeFor(ctx, req.Repo, req.Commit, req.View)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "can't get tree for commit %q: %v", req.Commit, err)
+		return nil, err
 	}
+	defer release()
+	contents, err := tree.ReadFile(ctx, treePath(req.Path))
+	if err != nil {
+		return nil, treeStatus(err, req.Commit)
+	}
+	return &fspb.GetFileResponse{Contents: contents}, nil
+}
 
-	res := &fspb.GetAttributesResponse{
+func (s *Service) GetAttributes(ctx context.Context, req *fspb.GetAttributesRequest) (*fspb.GetAttributesResponse, error) {
+	tree, commit, release, err := s.treeFor(ctx, req.Repo, req.Commit, req.View)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	entry, err := tree.Stat(ctx, treePath(req.Path))
+	if err != nil {
+		return nil, treeStatus(err, req.Commit)
+	}
+	return &fspb.GetAttributesResponse{
+		Mode:       entry.Mode,
+		SizeBytes:  uint64(entry.Size),
 		AuthorTime: timestamppb.New(commit.Author.When),
 		CommitTime: timestamppb.New(commit.Committer.When),
+	}, nil
+}
+
+func (s *Service) ListCommits(ctx context.Context, req *fspb.ListCommitsRequest) (*fspb.ListCommitsResponse, error) {
+	if c, ok := s.lookupComposite(req.Repo); ok {
+		return s.listCompositeCommits(c, req.View)
 	}
-	if req.Path == "" {
-		// go-git doesn't have any concept of a "root directory" apparently, so
-		// this is a hack to simulate it.
-		res.Mode = fspb.FileMode_MODE_DIR
-	} else {
-		entry, err := rootTree.FindEntry(req.Path)
-		if err != nil {
-			return nil, status.Errorf(codes.NotFound, "can't get file %q at commit %q: %v", req.Path, req.Commit, err)
+	repo, err := s.readerFor(req.Repo)
+	if err != nil {
+		return nil, err
+	}
+	defer repo.release()
+	var filters []CommitFilter
+	if req.View == "" && repo.viewRequired() {
+		return nil, viewRequired(repo.path)
+	}
+	if req.View != "" {
+		transformers, ok := repo.view(req.View)
+		if !ok {
+			return nil, status.Errorf(codes.NotFound, "view %q not found in repo %q", req.View, req.Repo)
 		}
-		res.Mode = fromGitFileMode(entry.Mode)
-		if entry.Mode.IsFile() {
-			entryFile, err := rootTree.TreeEntryFile(entry)
-			if err != nil {
-				return nil, status.Errorf(codes.Internal, "can't get TreeEntry for file %q at commit %q: %v", req.Path, req.Commit, err)
+		for _, t := range transformers {
+			if f, ok := t.(CommitFilter); ok {
+				filters = append(filters, f)
 			}
-			res.SizeBytes = uint64(entryFile.Blob.Size)
 		}
 	}
-
-	return res, nil
-}
-
-func (s *Service) ListCommits(ctx context.Context, req *fspb.ListCommitsRequest) (*fspb.ListCommitsResponse, error) {
 	res := &fspb.ListCommitsResponse{}
-	iter, err := s.repo.repo.CommitObjects()
+	iter, err := repo.git.CommitObjects()
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to get commit iterator: %v", err)
 	}
 
 	err = iter.ForEach(func(c *gitobject.Commit) error {
+		for _, f := range filters {
+			keep, err := f.KeepCommit(ctx, c)
+			if err != nil {
+				return fmt.Errorf("view %q can't filter commit %s: %v", req.View, c.Hash, err)
+			}
+			if !keep {
+				return nil
+			}
+		}
 		res.Commits = append(res.Commits, c.Hash.String())
 		return nil
 	})
@@ -125,55 +372,37 @@ func (s *Service) ListCommits(ctx context.Context, req *fspb.ListCommitsRequest)
 }
 
 func (s *Service) ListDir(ctx context.Context, req *fspb.ListDirRequest) (*fspb.ListDirResponse, error) {
-	// Ensure the string is properly suffixed for a directory
-	if !strings.HasPrefix(req.Path, "/") {
-		req.Path = "/" + req.Path
-	}
-	if !strings.HasSuffix(req.Path, "/") {
-		req.Path = req.Path + "/"
-	}
-
-	res := &fspb.ListDirResponse{}
-
-	commit, err := s.repo.repo.CommitObject(gitplumbing.NewHash(req.Commit))
+	tree, _, release, err := s.treeFor(ctx, req.Repo, req.Commit, req.View)
 	if err != nil {
-		return nil, status.Errorf(codes.NotFound, "commit %q not found in repo: %v", req.Commit, err)
+		return nil, err
 	}
-
-	tree, err := commit.Tree()
+	defer release()
+	entries, err := tree.ReadDir(ctx, treePath(req.Path))
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "can't get tree for commit %q: %v", req.Commit, err)
+		return nil, treeStatus(err, req.Commit)
 	}
-	treeIter := gitobject.NewTreeWalker(tree, true /* recursive */, nil)
-	defer treeIter.Close()
-
-	var name string
-	var treeEntry gitobject.TreeEntry
-	for name, treeEntry, err = treeIter.Next(); err == nil; name, treeEntry, err = treeIter.Next() {
-		name = "/" + name
-		// Filter out all files not direct descendants of the specified dir
-		if !strings.HasPrefix(name, req.Path) {
-			continue
-		}
-		delta := strings.TrimPrefix(name, req.Path)
-		if strings.Contains(delta, "/") {
-			continue
-		}
-		// Return an entry for the remaining entries
-		res.Entries = append(res.Entries, &fspb.DirEntry{
-			Name: delta,
-			Mode: fromGitFileMode(treeEntry.Mode),
-		})
-	}
-	if err != nil && err != io.EOF {
-		return nil, status.Errorf(codes.Internal, "error while iterating through files for commit %q: %v", req.Commit, err)
+	res := &fspb.ListDirResponse{}
+	for _, e := range entries {
+		res.Entries = append(res.Entries, &fspb.DirEntry{Name: e.Name, Mode: e.Mode})
 	}
-
 	return res, nil
 }
 
 func (s *Service) ListBranches(ctx context.Context, req *fspb.ListBranchesRequest) (*fspb.ListBranchesResponse, error) {
-	branches, err := s.repo.repo.Branches()
+	if c, ok := s.lookupComposite(req.Repo); ok {
+		return s.compositeBranches(c)
+	}
+	repo, err := s.readerFor(req.Repo)
+	if err != nil {
+		return nil, err
+	}
+	defer repo.release()
+	return repo.branches()
+}
+
+// branches lists the repo's branches.
+func (rd *repoReader) branches() (*fspb.ListBranchesResponse, error) {
+	branches, err := rd.git.Branches()
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to iterate over branches: %v", err)
 	}
@@ -182,27 +411,208 @@ func (s *Service) ListBranches(ctx context.Context, req *fspb.ListBranchesReques
 		Branches: map[string]string{},
 	}
 
-	err = branches.ForEach(func (ref *gitplumbing.Reference) error {
+	err = branches.ForEach(func(ref *gitplumbing.Reference) error {
 		res.Branches[ref.Name().Short()] = ref.Hash().String()
 		return nil
 	})
-	
+
 	return res, nil
 }
 
-func (s *Service) PushHook(w http.ResponseWriter, r *http.Request) {
-	defer r.Body.Close()
-	var payload github.PushPayload
-	err := json.NewDecoder(r.Body).Decode(&payload)
+func (s *Service) ListTags(ctx context.Context, req *fspb.ListTagsRequest) (*fspb.ListTagsResponse, error) {
+	if _, ok := s.lookupComposite(req.Repo); ok {
+		// Composites have no tags.
+		return &fspb.ListTagsResponse{Tags: map[string]string{}}, nil
+	}
+	repo, err := s.readerFor(req.Repo)
 	if err != nil {
-		glog.Errorf("PushHook: Failed to decode payload: %v", err)
-		return
+		return nil, err
+	}
+	defer repo.release()
+	tags, err := repo.git.Tags()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to iterate over tags: %v", err)
 	}
-	err = s.repo.pull(payload.After)
+
+	res := &fspb.ListTagsResponse{
+		Tags: map[string]string{},
+	}
+	err = tags.ForEach(func(ref *gitplumbing.Reference) error {
+		// Tags of anything but a commit are left out.
+		if hash, ok := repo.peelTag(ref.Hash()); ok {
+			res.Tags[ref.Name().Short()] = hash.String()
+		}
+		return nil
+	})
 	if err != nil {
-		glog.Errorf("PushHook: Failed to pull %q: %v", payload.After, err)
+		return nil, status.Errorf(codes.Internal, "error while iterating over tags: %v", err)
+	}
+	return res, nil
+}
+
+// peelTag returns the commit that a tag ref points to, through the tag object
+// if the tag is annotated.
+func (rd *repoReader) peelTag(hash gitplumbing.Hash) (gitplumbing.Hash, bool) {
+	if tag, err := rd.git.TagObject(hash); err == nil {
+		commit, err := tag.Commit()
+		if err != nil {
+			return gitplumbing.ZeroHash, false
+		}
+		return commit.Hash, true
+	}
+	if _, err := rd.git.CommitObject(hash); err != nil {
+		return gitplumbing.ZeroHash, false
+	}
+	return hash, true
+}
+
+func (s *Service) ListRepos(ctx context.Context, req *fspb.ListReposRequest) (*fspb.ListReposResponse, error) {
+	res := &fspb.ListReposResponse{}
+	for _, r := range s.allRepos() {
+		res.Repos = append(res.Repos, r.path)
 	}
-	glog.Infof("PushHook: pulled %s from ref %s", payload.After, payload.Ref)
+	for _, c := range s.allComposites() {
+		res.Repos = append(res.Repos, c.name)
+	}
+	sort.Strings(res.Repos)
+	s.mu.RLock()
+	res.DefaultRepo = s.defaultRepo
+	s.mu.RUnlock()
+	return res, nil
+}
+
+func (s *Service) GetFetchStatus(ctx context.Context, req *fspb.GetFetchStatusRequest) (*fspb.GetFetchStatusResponse, error) {
+	if c, ok := s.lookupComposite(req.Repo); ok {
+		return s.compositeFetchStatus(c)
+	}
+	repo, ok := s.lookupRepo(req.Repo)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "repo %q not found", req.Repo)
+	}
+	return &fspb.GetFetchStatusResponse{
+		Status: repo.lastFetchStatus().proto(),
+	}, nil
+}
+
+// PushHook handles GitHub push webhooks without verifying their signature.
+func (s *Service) PushHook(w http.ResponseWriter, r *http.Request) {
+	s.WebhookHandler(github.ParsePush, "")(w, r)
+}
+
+// WebhookHandler returns a handler that parses push webhooks with parse,
+// verifying them against secret, or against the repo's own WebhookSecret if
+// the route names a repo that has one, and queues a job that fetches each
+// updated ref from origin or deletes it locally if the push deleted it. The
+// response describes the queued job, whose progress can then be followed with
+// FetchJobHandler.
+func (s *Service) WebhookHandler(parse webhook.ParseFunc, secret string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		if s.shuttingDown() {
+			// Tell the sender to redeliver the webhook once a replacement
+			// server is up.
+			w.Header().Set("Retry-After", "10")
+			httpErrorf(w, http.StatusServiceUnavailable, "Webhook: server is shutting down")
+			return
+		}
+		name := mux.Vars(r)["repo"]
+		key := secret
+		if name != "" {
+			if repo, ok := s.lookupRepo(name); ok && repo.ownWebhookSecret() != "" {
+				key = repo.ownWebhookSecret()
+			}
+		}
+		ev, err := parse(r, key)
+		switch {
+		case errors.Is(err, webhook.ErrPing):
+			fmt.Fprintln(w, "pong")
+			return
+		case errors.Is(err, webhook.ErrUnauthorized):
+			httpErrorf(w, http.StatusUnauthorized, "Webhook: %v", err)
+			return
+		case err != nil:
+			httpErrorf(w, http.StatusBadRequest, "Webhook: %v", err)
+			return
+		}
+		for _, u := range ev.Updates {
+			ref := gitplumbing.ReferenceName(u.Ref)
+			if !ref.IsBranch() && !ref.IsTag() {
+				httpErrorf(w, http.StatusBadRequest, "Webhook: ref %q is not a branch or tag", u.Ref)
+				return
+			}
+		}
+
+		repo, err := s.repoForEvent(name, ev)
+		if err != nil {
+			httpErrorf(w, http.StatusNotFound, "Webhook: %v", err)
+			return
+		}
+		if repoKey := repo.ownWebhookSecret(); repoKey != "" && repoKey != key {
+			httpErrorf(w, http.StatusUnauthorized, "Webhook: repo %q has its own webhook secret; deliver its webhooks to a route that names it", repo.path)
+			return
+		}
+		job := repo.queue.enqueue(ev)
+		glog.Infof("Webhook: queued delivery %s for refs %v of repo %q", job.DeliveryID, job.Refs, repo.path)
+		writeJSON(w, http.StatusAccepted, job)
+	}
+}
+
+// FetchJobHandler serves the status of the fetch job for the delivery ID in
+// the request path.
+func (s *Service) FetchJobHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["delivery_id"]
+	for _, repo := range s.allRepos() {
+		if job, ok := repo.queue.status(id); ok {
+			writeJSON(w, http.StatusOK, job)
+			return
+		}
+	}
+	httpErrorf(w, http.StatusNotFound, "FetchJob: no job for delivery %q", id)
+}
+
+// repoForEvent returns the repo that a webhook applies to: the repo named in
+// the route if there is one, otherwise the repo whose URL ends with the
+// provider's name for the repository. If only one repo is mirrored, it
+// receives every webhook.
+func (s *Service) repoForEvent(name string, ev *webhook.PushEvent) (*Repo, error) {
+	if name != "" {
+		r, ok := s.lookupRepo(name)
+		if !ok {
+			return nil, fmt.Errorf("repo %q not found", name)
+		}
+		return r, nil
+	}
+
+	repos := s.allRepos()
+	if ev.Repository != "" {
+		want := strings.ToLower(ev.Repository)
+		for _, r := range repos {
+			url := strings.ToLower(strings.TrimSuffix(strings.TrimSuffix(r.url, "/"), ".git"))
+			if strings.HasSuffix(url, "/"+want) || strings.HasSuffix(url, ":"+want) {
+				return r, nil
+			}
+		}
+	}
+	if len(repos) == 1 {
+		return repos[0], nil
+	}
+	return nil, fmt.Errorf("no repo matches repository %q", ev.Repository)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		glog.Errorf("failed to write JSON response: %v", err)
+	}
+}
+
+// httpErrorf logs the formatted error and replies to the request with it.
+func httpErrorf(w http.ResponseWriter, code int, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	glog.Error(msg)
+	http.Error(w, msg, code)
 }
 
 func fromGitFileMode(m gitfilemode.FileMode) fspb.FileMode {
@@ -0,0 +1,458 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/minorhacks/funhouse/github"
+	fspb "github.com/minorhacks/funhouse/proto/git_read_fs_proto"
+	"github.com/minorhacks/funhouse/webhook"
+
+	"github.com/bazelbuild/rules_go/go/tools/bazel"
+	git "github.com/go-git/go-git/v5"
+	gitplumbing "github.com/go-git/go-git/v5/plumbing"
+	gitobject "github.com/go-git/go-git/v5/plumbing/object"
+	gitclient "github.com/go-git/go-git/v5/plumbing/transport/client"
+	gitserver "github.com/go-git/go-git/v5/plumbing/transport/server"
+	"github.com/gorilla/mux"
+)
+
+func init() {
+	// Serve local origins in-process rather than shelling out to
+	// git-upload-pack, which may not be available in the test sandbox.
+	gitclient.InstallProtocol("file", gitserver.NewClient(gitserver.DefaultLoader))
+}
+
+// testOrigin is a non-bare repository standing in for a remote such as GitHub.
+type testOrigin struct {
+	t    *testing.T
+	dir  string
+	repo *git.Repository
+}
+
+func newTestOrigin(t *testing.T) *testOrigin {
+	t.Helper()
+	dir := t.TempDir()
+	repo, err := git.PlainInit(dir, false /* isBare */)
+	if err != nil {
+		t.Fatalf("failed to init origin: %v", err)
+	}
+	// go-git only writes a config file once something is set, but the
+	// in-process server won't recognize a repository without one.
+	cfg, err := repo.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.SetConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	return &testOrigin{t: t, dir: dir, repo: repo}
+}
+
+// url returns the URL that a Service should clone the origin from.
+func (o *testOrigin) url() string {
+	return filepath.Join(o.dir, ".git")
+}
+
+// commit writes files to the worktree of the origin and commits them to the
+// current branch.
+func (o *testOrigin) commit(files map[string]string) gitplumbing.Hash {
+	o.t.Helper()
+	wt, err := o.repo.Worktree()
+	if err != nil {
+		o.t.Fatalf("failed to get worktree: %v", err)
+	}
+	for name, contents := range files {
+		if err := wt.Filesystem.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			o.t.Fatalf("failed to create dir for %q: %v", name, err)
+		}
+		f, err := wt.Filesystem.Create(name)
+		if err != nil {
+			o.t.Fatalf("failed to create %q: %v", name, err)
+		}
+		if _, err := f.Write([]byte(contents)); err != nil {
+			o.t.Fatalf("failed to write %q: %v", name, err)
+		}
+		f.Close()
+		if _, err := wt.Add(name); err != nil {
+			o.t.Fatalf("failed to add %q: %v", name, err)
+		}
+	}
+	hash, err := wt.Commit("test commit", &git.CommitOptions{
+		Author: &gitobject.Signature{
+			Name:  "Funhouse Test",
+			Email: "test@example.com",
+			When:  time.Date(2021, 9, 18, 12, 0, 0, 0, time.UTC),
+		},
+	})
+	if err != nil {
+		o.t.Fatalf("failed to commit: %v", err)
+	}
+	return hash
+}
+
+func newTestService(t *testing.T, o *testOrigin) *Service {
+	t.Helper()
+	s := New(t.TempDir())
+	if err := s.AddRepo("test", o.url(), RepoOptions{}); err != nil {
+		t.Fatalf("AddRepo() got error %v; want no error", err)
+	}
+	t.Cleanup(func() {
+		for _, r := range s.allRepos() {
+			r.close(false /* deleteData */)
+		}
+	})
+	return s
+}
+
+// testRepo returns the default repo of a Service.
+func testRepo(t *testing.T, s *Service) *Repo {
+	t.Helper()
+	r, ok := s.lookupRepo("")
+	if !ok {
+		t.Fatalf("service has no default repo")
+	}
+	return r
+}
+
+func mustReadPayload(t *testing.T, filename string) github.PushPayload {
+	t.Helper()
+	f, err := bazel.Runfile(filename)
+	if err != nil {
+		t.Fatalf("can't get runfile %q: %v", filename, err)
+	}
+	contents, err := ioutil.ReadFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payload github.PushPayload
+	if err := json.Unmarshal(contents, &payload); err != nil {
+		t.Fatalf("can't unmarshal %q: %v", filename, err)
+	}
+	return payload
+}
+
+func postPayload(t *testing.T, s *Service, payload interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	body, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", "/push", bytes.NewReader(body))
+	req.Header.Set("X-GitHub-Event", "push")
+	rec := httptest.NewRecorder()
+	s.PushHook(rec, req)
+	return rec
+}
+
+// waitForJob waits for the fetch job described by a webhook response to
+// finish, returning its final status.
+func waitForJob(t *testing.T, s *Service, rec *httptest.ResponseRecorder) FetchJobStatus {
+	t.Helper()
+	var job FetchJobStatus
+	if err := json.NewDecoder(rec.Body).Decode(&job); err != nil {
+		t.Fatalf("can't decode job status: %v", err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		cur, ok := testRepo(t, s).queue.status(job.DeliveryID)
+		if !ok {
+			t.Fatalf("no job for delivery %q", job.DeliveryID)
+		}
+		if cur.State == JobSucceeded || cur.State == JobFailed {
+			return cur
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("fetch job %q still %q after 10s", cur.DeliveryID, cur.State)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func mustListBranches(t *testing.T, s *Service) map[string]string {
+	t.Helper()
+	res, err := s.ListBranches(context.Background(), &fspb.ListBranchesRequest{})
+	if err != nil {
+		t.Fatalf("ListBranches() got error %v; want no error", err)
+	}
+	return res.Branches
+}
+
+func TestPushHookUpdatesBranch(t *testing.T) {
+	origin := newTestOrigin(t)
+	before := origin.commit(map[string]string{"README.md": "v1"})
+	s := newTestService(t, origin)
+	after := origin.commit(map[string]string{"README.md": "v2"})
+
+	payload := mustReadPayload(t, "github/testdata/push_response.json")
+	payload.Before = before.String()
+	payload.After = after.String()
+
+	rec := postPayload(t, s, payload)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("PushHook() returned status %d; want %d: %s", rec.Code, http.StatusAccepted, rec.Body)
+	}
+	if job := waitForJob(t, s, rec); job.State != JobSucceeded {
+		t.Fatalf("fetch job finished in state %q; want %q: %s", job.State, JobSucceeded, job.Error)
+	}
+	if got, want := mustListBranches(t, s)["master"], after.String(); got != want {
+		t.Errorf("branch master = %q; want %q", got, want)
+	}
+}
+
+func TestPushHookDeletesBranch(t *testing.T) {
+	origin := newTestOrigin(t)
+	head := origin.commit(map[string]string{"README.md": "v1"})
+	s := newTestService(t, origin)
+	feature := gitplumbing.NewBranchReferenceName("feature")
+	if err := testRepo(t, s).repo.Storer.SetReference(gitplumbing.NewHashReference(feature, head)); err != nil {
+		t.Fatal(err)
+	}
+
+	payload := mustReadPayload(t, "github/testdata/push_delete_response.json")
+	payload.Before = head.String()
+
+	rec := postPayload(t, s, payload)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("PushHook() returned status %d; want %d: %s", rec.Code, http.StatusAccepted, rec.Body)
+	}
+	if job := waitForJob(t, s, rec); job.State != JobSucceeded {
+		t.Fatalf("fetch job finished in state %q; want %q: %s", job.State, JobSucceeded, job.Error)
+	}
+	if _, ok := mustListBranches(t, s)["feature"]; ok {
+		t.Errorf("branch feature still exists after deletion")
+	}
+}
+
+func TestPushHookCreatesTag(t *testing.T) {
+	origin := newTestOrigin(t)
+	head := origin.commit(map[string]string{"README.md": "v1"})
+	s := newTestService(t, origin)
+	if _, err := origin.repo.CreateTag("v1.0", head, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	payload := mustReadPayload(t, "github/testdata/push_tag_response.json")
+	payload.After = head.String()
+
+	rec := postPayload(t, s, payload)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("PushHook() returned status %d; want %d: %s", rec.Code, http.StatusAccepted, rec.Body)
+	}
+	if job := waitForJob(t, s, rec); job.State != JobSucceeded {
+		t.Fatalf("fetch job finished in state %q; want %q: %s", job.State, JobSucceeded, job.Error)
+	}
+	ref, err := testRepo(t, s).repo.Reference(gitplumbing.NewTagReferenceName("v1.0"), true)
+	if err != nil {
+		t.Fatalf("tag v1.0 not found after push: %v", err)
+	}
+	if got, want := ref.Hash(), head; got != want {
+		t.Errorf("tag v1.0 = %v; want %v", got, want)
+	}
+}
+
+func TestPushHookErrors(t *testing.T) {
+	origin := newTestOrigin(t)
+	head := origin.commit(map[string]string{"README.md": "v1"})
+	s := newTestService(t, origin)
+
+	testCases := []struct {
+		desc     string
+		event    string
+		body     string
+		wantCode int
+	}{
+		{
+			desc:     "ping",
+			event:    "ping",
+			body:     `{"zen": "Keep it logically awesome."}`,
+			wantCode: http.StatusOK,
+		},
+		{
+			desc:     "unsupported event",
+			event:    "issues",
+			body:     `{}`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			desc:     "malformed payload",
+			event:    "push",
+			body:     `{"ref": `,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			desc:     "non-branch ref",
+			event:    "push",
+			body:     `{"ref": "refs/pull/1/head", "after": "` + head.String() + `"}`,
+			wantCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/push", bytes.NewReader([]byte(tc.body)))
+			req.Header.Set("X-GitHub-Event", tc.event)
+			rec := httptest.NewRecorder()
+			s.PushHook(rec, req)
+			if rec.Code != tc.wantCode {
+				t.Errorf("PushHook() returned status %d; want %d: %s", rec.Code, tc.wantCode, rec.Body)
+			}
+		})
+	}
+}
+
+func TestWebhookHandlerRejectsUnsigned(t *testing.T) {
+	origin := newTestOrigin(t)
+	before := origin.commit(map[string]string{"README.md": "v1"})
+	s := newTestService(t, origin)
+	after := origin.commit(map[string]string{"README.md": "v2"})
+
+	payload := mustReadPayload(t, "github/testdata/push_response.json")
+	payload.Before = before.String()
+	payload.After = after.String()
+	body, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", "/hook/github", bytes.NewReader(body))
+	req.Header.Set("X-GitHub-Event", "push")
+	rec := httptest.NewRecorder()
+	s.WebhookHandler(github.ParsePush, "hunter2")(rec, req)
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("WebhookHandler() returned status %d; want %d: %s", rec.Code, http.StatusUnauthorized, rec.Body)
+	}
+	if got, want := mustListBranches(t, s)["master"], before.String(); got != want {
+		t.Errorf("branch master = %q; want %q", got, want)
+	}
+}
+
+func TestWebhookHandlerUsesRepoSecret(t *testing.T) {
+	origin := newTestOrigin(t)
+	before := origin.commit(map[string]string{"README.md": "v1"})
+	s := newTestService(t, origin)
+	if err := s.UpdateRepo("test", origin.url(), RepoOptions{WebhookSecret: "repo-secret"}); err != nil {
+		t.Fatalf("UpdateRepo() got error %v; want no error", err)
+	}
+	after := origin.commit(map[string]string{"README.md": "v2"})
+
+	payload := mustReadPayload(t, "github/testdata/push_response.json")
+	payload.Before = before.String()
+	payload.After = after.String()
+	body, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		desc     string
+		repo     string
+		secret   string
+		wantCode int
+	}{
+		{
+			desc:     "handler secret on repo route",
+			repo:     "test",
+			secret:   "handler-secret",
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			desc:     "repo secret on route without repo",
+			secret:   "repo-secret",
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			desc:     "repo secret on repo route",
+			repo:     "test",
+			secret:   "repo-secret",
+			wantCode: http.StatusAccepted,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/hook/github", bytes.NewReader(body))
+			req.Header.Set("X-GitHub-Event", "push")
+			req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(webhook.Sign(body, tc.secret)))
+			if tc.repo != "" {
+				req = mux.SetURLVars(req, map[string]string{"repo": tc.repo})
+			}
+			rec := httptest.NewRecorder()
+			s.WebhookHandler(github.ParsePush, "handler-secret")(rec, req)
+			if rec.Code != tc.wantCode {
+				t.Errorf("WebhookHandler() returned status %d; want %d: %s", rec.Code, tc.wantCode, rec.Body)
+			}
+		})
+	}
+}
+
+func TestAddRepoMigratesLegacyLayout(t *testing.T) {
+	origin := newTestOrigin(t)
+	head := origin.commit(map[string]string{"README.md": "v1"})
+	base := t.TempDir()
+	// Servers that mirrored a single repo kept its clone in the base path.
+	if _, err := git.PlainClone(base, true /* isBare */, &git.CloneOptions{URL: origin.url()}); err != nil {
+		t.Fatalf("failed to make legacy clone: %v", err)
+	}
+
+	s := New(base)
+	if err := s.AddRepo("test", origin.url(), RepoOptions{}); err != nil {
+		t.Fatalf("AddRepo() got error %v; want no error", err)
+	}
+	t.Cleanup(func() { testRepo(t, s).close(false /* deleteData */) })
+	if got, want := mustListBranches(t, s)["master"], head.String(); got != want {
+		t.Errorf("branch master = %q; want %q", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(base, "test", "HEAD")); err != nil {
+		t.Errorf("migrated repo has no HEAD: %v", err)
+	}
+	for _, f := range []string{"HEAD", "objects", "refs"} {
+		if _, err := os.Stat(filepath.Join(base, f)); !os.IsNotExist(err) {
+			t.Errorf("%q still exists in base path after migration", f)
+		}
+	}
+}
+
+func TestHasRepo(t *testing.T) {
+	origin := newTestOrigin(t)
+	origin.commit(map[string]string{"README.md": "v1"})
+	s := newTestService(t, origin)
+	if err := s.AddRepo("missing", "file://"+filepath.Join(t.TempDir(), "missing"), RepoOptions{}); err == nil {
+		t.Fatalf("AddRepo() of missing origin got no error; want error")
+	}
+
+	for name, want := range map[string]bool{"test": true, "missing": false, "other": false} {
+		if got := s.HasRepo(name); got != want {
+			t.Errorf("HasRepo(%q) = %v; want %v", name, got, want)
+		}
+	}
+}
+
+func TestRemoveRepoChoosesNewDefault(t *testing.T) {
+	origin := newTestOrigin(t)
+	origin.commit(map[string]string{"README.md": "v1"})
+	s := newTestService(t, origin)
+	for _, name := range []string{"zeta", "beta"} {
+		if err := s.AddRepo(name, origin.url(), RepoOptions{}); err != nil {
+			t.Fatalf("AddRepo(%q) got error %v; want no error", name, err)
+		}
+	}
+
+	if err := s.RemoveRepo("test", false /* keepData */); err != nil {
+		t.Fatalf("RemoveRepo() got error %v; want no error", err)
+	}
+	if got, want := testRepo(t, s).path, "beta"; got != want {
+		t.Errorf("default repo after removing it = %q; want %q", got, want)
+	}
+	if _, ok := mustListBranches(t, s)["master"]; !ok {
+		t.Errorf("requests without a repo name aren't served after removing the default repo")
+	}
+}
@@ -0,0 +1,81 @@
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/golang/glog"
+)
+
+// Shutdown stops the service accepting webhooks and new repos, then waits for
+// each repo's queued webhook fetches, and any fetch or maintenance in
+// progress, to finish. Reads are still served meanwhile. If ctx is done first,
+// the work in progress is cancelled, which leaves each repo as it was before
+// that work started, and an error is returned. Either way, the repos' background
+// work is stopped, and so are watches of composites.
+func (s *Service) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	s.mu.Unlock()
+
+	repos := s.allRepos()
+	errs := make(chan error, len(repos))
+	for _, r := range repos {
+		go func(r *Repo) {
+			errs <- r.shutdown(ctx)
+		}(r)
+	}
+	var firstErr error
+	for range repos {
+		if err := <-errs; err != nil {
+			glog.Errorf("Shutdown: %v", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	s.mu.Lock()
+	for _, c := range s.composites {
+		close(c.removed)
+	}
+	s.mu.Unlock()
+	return firstErr
+}
+
+// shuttingDown returns whether Shutdown has been called.
+func (s *Service) shuttingDown() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.closing
+}
+
+// shutdown drains the repo's fetch queue and waits for the fetch or
+// maintenance in progress, then stops the repo's background work. Work still
+// going on when ctx is done is cancelled.
+func (r *Repo) shutdown(ctx context.Context) error {
+	err := r.queue.drain(ctx)
+
+	r.statusMu.Lock()
+	r.closing = true
+	r.statusMu.Unlock()
+	idle := make(chan struct{})
+	go func() {
+		r.writeMu.Lock()
+		r.writeMu.Unlock()
+		close(idle)
+	}()
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		if err == nil {
+			err = fmt.Errorf("fetch in progress: %v", ctx.Err())
+		}
+	}
+	r.cancel()
+	<-idle
+	if err != nil {
+		return fmt.Errorf("repo %q didn't shut down cleanly: %v", r.path, err)
+	}
+	return nil
+}
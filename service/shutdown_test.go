@@ -0,0 +1,113 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/minorhacks/funhouse/github"
+	fspb "github.com/minorhacks/funhouse/proto/git_read_fs_proto"
+	"github.com/minorhacks/funhouse/webhook"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestShutdownFinishesQueuedFetches(t *testing.T) {
+	origin := newTestOrigin(t)
+	first := origin.commit(map[string]string{"README.md": "v1"})
+	s := newTestService(t, origin)
+	r := testRepo(t, s)
+	second := origin.commit(map[string]string{"README.md": "v2"})
+
+	r.queue.enqueue(&webhook.PushEvent{
+		DeliveryID: "queued",
+		Updates:    []webhook.RefUpdate{{Ref: "refs/heads/master", Before: first.String(), After: second.String()}},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() got error %v; want no error", err)
+	}
+
+	if job, _ := r.queue.status("queued"); job.State != JobSucceeded {
+		t.Errorf("queued job = %+v; want succeeded", job)
+	}
+	if got, want := mustListBranches(t, s)["master"], second.String(); got != want {
+		t.Errorf("branch master = %q; want %q", got, want)
+	}
+
+	// Nothing new starts once the service has shut down.
+	rec := postPayload(t, s, github.PushPayload{Ref: "refs/heads/master", Before: first.String(), After: second.String()})
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("webhook got status %d; want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if err := r.fetchAll(context.Background()); err == nil {
+		t.Errorf("fetchAll() got no error after Shutdown(); want error")
+	}
+	if err := s.AddRepo("other", origin.url(), RepoOptions{}); err == nil {
+		t.Errorf("AddRepo() got no error after Shutdown(); want error")
+	}
+}
+
+func TestShutdownCancelsWorkAfterDeadline(t *testing.T) {
+	origin := newTestOrigin(t)
+	origin.commit(map[string]string{"README.md": "v1"})
+	s := newTestService(t, origin)
+	r := testRepo(t, s)
+
+	// Stand in for a fetch that only stops when it is cancelled.
+	runCtx, done, err := r.beginWrite(context.Background())
+	if err != nil {
+		t.Fatalf("beginWrite() got error %v; want no error", err)
+	}
+	go func() {
+		<-runCtx.Done()
+		done()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err == nil {
+		t.Errorf("Shutdown() got no error; want error for the cancelled fetch")
+	}
+	if runCtx.Err() == nil {
+		t.Errorf("in-flight fetch was not cancelled")
+	}
+	// Reads still work on the repo as it was.
+	if _, ok := mustListBranches(t, s)["master"]; !ok {
+		t.Errorf("branch master missing after Shutdown()")
+	}
+}
+
+func TestShutdownStopsCompositeWatches(t *testing.T) {
+	origin := newTestOrigin(t)
+	origin.commit(map[string]string{"README.md": "v1"})
+	s := newTestService(t, origin)
+	if err := s.SetComposites(map[string][]CompositeMember{"workspace": {{Path: "a", Repo: "test"}}}); err != nil {
+		t.Fatalf("SetComposites() got error %v; want no error", err)
+	}
+	c, _ := s.lookupComposite("workspace")
+	done := make(chan error, 1)
+	go func() {
+		done <- s.watchCompositeBranches(context.Background(), c, func(*fspb.ListBranchesResponse) error { return nil })
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() got error %v; want no error", err)
+	}
+	select {
+	case err := <-done:
+		if status.Code(err) != codes.Unavailable {
+			t.Errorf("watchCompositeBranches() got error %v after Shutdown(); want Unavailable", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("watchCompositeBranches() still running after Shutdown()")
+	}
+	if err := s.SetComposites(map[string][]CompositeMember{}); err == nil {
+		t.Errorf("SetComposites() got no error after Shutdown(); want error")
+	}
+}
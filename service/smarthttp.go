@@ -0,0 +1,277 @@
+package service
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	gitplumbing "github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+	gitobject "github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/revlist"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	gitserver "github.com/go-git/go-git/v5/plumbing/transport/server"
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/status"
+)
+
+// GitInfoRefs serves the refs of the repo named in the route, as the first
+// step of a clone or fetch over the Git smart HTTP protocol. Only
+// git-upload-pack is served, so mirrors can't be pushed to.
+//
+// The server doesn't support multi_ack or side-band, so negotiation ends at
+// the first common commit and no progress is shown. Shallow clones aren't
+// supported.
+func (s *Service) GitInfoRefs(w http.ResponseWriter, r *http.Request) {
+	if svc := r.URL.Query().Get("service"); svc != transport.UploadPackServiceName {
+		httpErrorf(w, http.StatusForbidden, "Git: service %q isn't supported; mirrors can only be fetched with %s over smart HTTP", svc, transport.UploadPackServiceName)
+		return
+	}
+	rd, ok := s.gitReader(w, r)
+	if !ok {
+		return
+	}
+	defer rd.release()
+
+	ar, err := advertisedRefs(r.Context(), rd.git.Storer)
+	if err != nil {
+		httpErrorf(w, http.StatusInternalServerError, "Git: failed to list refs of repo %q: %v", rd.path, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+	w.Header().Set("Cache-Control", "no-cache")
+	e := pktline.NewEncoder(w)
+	if err := e.Encodef("# service=%s\n", transport.UploadPackServiceName); err != nil {
+		glog.Errorf("Git: failed to write refs of repo %q: %v", rd.path, err)
+		return
+	}
+	if err := e.Flush(); err != nil {
+		glog.Errorf("Git: failed to write refs of repo %q: %v", rd.path, err)
+		return
+	}
+	if err := ar.Encode(w); err != nil {
+		glog.Errorf("Git: failed to write refs of repo %q: %v", rd.path, err)
+	}
+}
+
+// GitUploadPack serves the objects that a client wants, as the second step of
+// a clone or fetch over the Git smart HTTP protocol. The repo's reader is held
+// until the whole pack is sent, so that maintenance can't remove objects from
+// under it.
+func (s *Service) GitUploadPack(w http.ResponseWriter, r *http.Request) {
+	rd, ok := s.gitReader(w, r)
+	if !ok {
+		return
+	}
+	defer rd.release()
+
+	body := io.Reader(r.Body)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			httpErrorf(w, http.StatusBadRequest, "Git: failed to decompress request: %v", err)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+	req, done, err := decodeUploadPackRequest(body)
+	if err != nil {
+		httpErrorf(w, http.StatusBadRequest, "Git: malformed upload-pack request: %v", err)
+		return
+	}
+	if len(req.Shallows) > 0 || !req.Depth.IsZero() {
+		httpErrorf(w, http.StatusBadRequest, "Git: shallow clones aren't supported")
+		return
+	}
+	ar, err := advertisedRefs(r.Context(), rd.git.Storer)
+	if err != nil {
+		httpErrorf(w, http.StatusInternalServerError, "Git: failed to list refs of repo %q: %v", rd.path, err)
+		return
+	}
+	if err := checkWants(rd.git.Storer, ar, req.Wants); err != nil {
+		httpErrorf(w, http.StatusBadRequest, "Git: %v in repo %q", err, rd.path)
+		return
+	}
+
+	// Without multi_ack, only the first have that the repo has is
+	// acknowledged, after which the client stops negotiating and asks for
+	// everything that isn't reachable from its common haves.
+	common := commonHaves(rd.git.Storer, req.Haves)
+	res := &packp.ServerResponse{}
+	if len(common) > 0 {
+		res.ACKs = common[:1]
+	}
+	w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+	w.Header().Set("Cache-Control", "no-cache")
+	if !done {
+		if err := res.Encode(w); err != nil {
+			glog.Errorf("Git: failed to write negotiation response for repo %q: %v", rd.path, err)
+		}
+		return
+	}
+	haveObjects, err := revlist.Objects(rd.git.Storer, common, nil)
+	if err != nil {
+		httpErrorf(w, http.StatusInternalServerError, "Git: failed to list objects to send from repo %q: %v", rd.path, err)
+		return
+	}
+	objs, err := revlist.Objects(rd.git.Storer, req.Wants, haveObjects)
+	if err != nil {
+		httpErrorf(w, http.StatusInternalServerError, "Git: failed to list objects to send from repo %q: %v", rd.path, err)
+		return
+	}
+	if err := res.Encode(w); err != nil {
+		glog.Errorf("Git: failed to write pack for repo %q: %v", rd.path, err)
+		return
+	}
+	if _, err := packfile.NewEncoder(w, rd.git.Storer, false /* useRefDeltas */).Encode(objs, 10 /* packWindow */); err != nil {
+		// The status has been sent already, so the client only sees a
+		// truncated pack.
+		glog.Errorf("Git: failed to write pack for repo %q: %v", rd.path, err)
+	}
+}
+
+// gitReader returns a reader of the repo named in the route, which may end in
+// .git, or replies with an error.
+func (s *Service) gitReader(w http.ResponseWriter, r *http.Request) (*repoReader, bool) {
+	name := mux.Vars(r)["repo"]
+	if _, ok := s.lookupRepo(name); !ok {
+		name = strings.TrimSuffix(name, ".git")
+	}
+	rd, err := s.readerFor(name)
+	if err != nil {
+		httpErrorf(w, readerStatus(err), "Git: %v", status.Convert(err).Message())
+		return nil, false
+	}
+	if rd.viewRequired() {
+		rd.release()
+		httpErrorf(w, http.StatusForbidden, "Git: repo %q can only be read through a view, so it can't be cloned from", name)
+		return nil, false
+	}
+	if rd.partial {
+		rd.release()
+		httpErrorf(w, http.StatusNotImplemented, "Git: repo %q is a partial clone, so it can't be cloned from", name)
+		return nil, false
+	}
+	return rd, true
+}
+
+// advertisedRefs lists the branches and tags of a repo, and its HEAD. The
+// refs that go-git keeps for origin aren't served.
+func advertisedRefs(ctx context.Context, st storer.Storer) (*packp.AdvRefs, error) {
+	session, err := gitserver.NewServer(storerLoader{st}).NewUploadPackSession(&transport.Endpoint{}, nil)
+	if err != nil {
+		return nil, err
+	}
+	ar, err := session.AdvertisedReferencesContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for name := range ar.References {
+		if !strings.HasPrefix(name, "refs/heads/") && !strings.HasPrefix(name, "refs/tags/") {
+			delete(ar.References, name)
+		}
+	}
+	return ar, nil
+}
+
+// storerLoader loads the same storer for every endpoint.
+type storerLoader struct {
+	storer.Storer
+}
+
+func (l storerLoader) Load(*transport.Endpoint) (storer.Storer, error) {
+	return l.Storer, nil
+}
+
+// decodeUploadPackRequest decodes the wants and haves of a request, and
+// whether the client is done sending haves.
+func decodeUploadPackRequest(r io.Reader) (*packp.UploadPackRequest, bool, error) {
+	req := packp.NewUploadPackRequest()
+	if err := req.UploadRequest.Decode(r); err != nil {
+		return nil, false, err
+	}
+	// go-git only decodes the wants, which end with a flush-pkt, so the haves
+	// that follow are decoded here.
+	scanner := pktline.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(string(scanner.Bytes()), "\n")
+		switch {
+		case line == "done":
+			return req, true, nil
+		case strings.HasPrefix(line, "have "):
+			hash := strings.TrimPrefix(line, "have ")
+			if !isFullHash(hash) {
+				return nil, false, fmt.Errorf("malformed have %q", hash)
+			}
+			req.Haves = append(req.Haves, gitplumbing.NewHash(hash))
+		case line == "":
+			// A flush-pkt ends each batch of haves.
+		default:
+			return nil, false, fmt.Errorf("unexpected line %q", line)
+		}
+	}
+	return req, false, scanner.Err()
+}
+
+// checkWants returns an error unless every want is an advertised ref's tip,
+// or a commit or tag reachable from one, as git's upload-pack requires over
+// stateless HTTP, where refs may move between advertising them and serving
+// the wants. Other objects in the store, such as those no ref points to any
+// more, aren't served.
+func checkWants(st storer.Storer, ar *packp.AdvRefs, wants []gitplumbing.Hash) error {
+	var queue []gitplumbing.Hash
+	for _, h := range ar.References {
+		queue = append(queue, h)
+	}
+	pending := map[gitplumbing.Hash]bool{}
+	for _, want := range wants {
+		pending[want] = true
+	}
+	for _, h := range queue {
+		delete(pending, h)
+	}
+	// Walk history from the tips until every want is found.
+	seen := map[gitplumbing.Hash]bool{}
+	for len(pending) > 0 && len(queue) > 0 {
+		h := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		if seen[h] {
+			continue
+		}
+		seen[h] = true
+		delete(pending, h)
+		obj, err := gitobject.GetObject(st, h)
+		if err != nil {
+			return fmt.Errorf("failed to read object %s: %v", h, err)
+		}
+		switch obj := obj.(type) {
+		case *gitobject.Tag:
+			queue = append(queue, obj.Target)
+		case *gitobject.Commit:
+			queue = append(queue, obj.ParentHashes...)
+		}
+	}
+	for want := range pending {
+		return fmt.Errorf("want %s isn't reachable from any branch or tag", want)
+	}
+	return nil
+}
+
+// commonHaves returns the haves that the repo has too.
+func commonHaves(st storer.Storer, haves []gitplumbing.Hash) []gitplumbing.Hash {
+	var common []gitplumbing.Hash
+	for _, have := range haves {
+		if st.HasEncodedObject(have) == nil {
+			common = append(common, have)
+		}
+	}
+	return common
+}
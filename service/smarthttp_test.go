@@ -0,0 +1,172 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	gitplumbing "github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+	gitobject "github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/gorilla/mux"
+)
+
+func TestSmartHTTP(t *testing.T) {
+	origin := newTestOrigin(t)
+	first := origin.commit(map[string]string{"README.md": "v1\n", "src/main.go": "package main\n"})
+	if err := origin.repo.Storer.SetReference(gitplumbing.NewHashReference("refs/heads/feature", first)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := origin.repo.CreateTag("v1.0", first, &git.CreateTagOptions{
+		Message: "annotated",
+		Tagger: &gitobject.Signature{
+			Name:  "Funhouse Test",
+			Email: "test@example.com",
+			When:  time.Date(2021, 9, 18, 12, 0, 0, 0, time.UTC),
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestService(t, origin)
+	ctx := context.Background()
+	if err := testRepo(t, s).fetchAll(ctx); err != nil {
+		t.Fatalf("fetchAll() got error %v; want no error", err)
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/git/{repo}/info/refs", s.GitInfoRefs).Methods("GET")
+	router.HandleFunc("/git/{repo}/git-upload-pack", s.GitUploadPack).Methods("POST")
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	dir := t.TempDir()
+	clone, err := git.PlainCloneContext(ctx, dir, false /* isBare */, &git.CloneOptions{URL: server.URL + "/git/test.git"})
+	if err != nil {
+		t.Fatalf("PlainClone() got error %v; want no error", err)
+	}
+	contents, err := ioutil.ReadFile(filepath.Join(dir, "src", "main.go"))
+	if err != nil {
+		t.Fatalf("ReadFile() got error %v; want no error", err)
+	}
+	if got, want := string(contents), "package main\n"; got != want {
+		t.Errorf("cloned src/main.go = %q; want %q", got, want)
+	}
+	wantRefs := map[gitplumbing.ReferenceName]gitplumbing.Hash{
+		"refs/remotes/origin/master":  first,
+		"refs/remotes/origin/feature": first,
+	}
+	for name, want := range wantRefs {
+		ref, err := clone.Reference(name, true)
+		if err != nil {
+			t.Errorf("Reference(%q) got error %v; want no error", name, err)
+			continue
+		}
+		if ref.Hash() != want {
+			t.Errorf("cloned %s = %s; want %s", name, ref.Hash(), want)
+		}
+	}
+	tag, err := clone.Tag("v1.0")
+	if err != nil {
+		t.Fatalf("Tag() got error %v; want no error", err)
+	}
+	if _, err := clone.TagObject(tag.Hash()); err != nil {
+		t.Errorf("TagObject() got error %v; want the annotated tag", err)
+	}
+
+	// A fetch only needs the objects that the clone doesn't have.
+	second := origin.commit(map[string]string{"README.md": "v2\n"})
+	if err := testRepo(t, s).fetchAll(ctx); err != nil {
+		t.Fatalf("fetchAll() got error %v; want no error", err)
+	}
+	if err := clone.FetchContext(ctx, &git.FetchOptions{}); err != nil {
+		t.Fatalf("Fetch() got error %v; want no error", err)
+	}
+	ref, err := clone.Reference("refs/remotes/origin/master", true)
+	if err != nil {
+		t.Fatalf("Reference() got error %v; want no error", err)
+	}
+	if ref.Hash() != second {
+		t.Errorf("fetched master = %s; want %s", ref.Hash(), second)
+	}
+	commit, err := clone.CommitObject(second)
+	if err != nil {
+		t.Fatalf("CommitObject() got error %v; want no error", err)
+	}
+	if _, err := commit.File("README.md"); err != nil {
+		t.Errorf("File() of fetched commit got error %v; want no error", err)
+	}
+
+	// Only commits reachable from branches and tags can be asked for.
+	unreachable := storeLooseBlob(t, testRepo(t, s), "unreachable", time.Now())
+	wants := []struct {
+		desc     string
+		want     gitplumbing.Hash
+		wantCode int
+	}{
+		{desc: "old commit", want: first, wantCode: http.StatusOK},
+		{desc: "blob", want: gitplumbing.ComputeHash(gitplumbing.BlobObject, []byte("v1\n")), wantCode: http.StatusBadRequest},
+		{desc: "unreachable object", want: unreachable, wantCode: http.StatusBadRequest},
+	}
+	for _, tc := range wants {
+		t.Run(tc.desc, func(t *testing.T) {
+			var body bytes.Buffer
+			e := pktline.NewEncoder(&body)
+			if err := e.Encodef("want %s\n", tc.want); err != nil {
+				t.Fatal(err)
+			}
+			if err := e.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if err := e.Encodef("done\n"); err != nil {
+				t.Fatal(err)
+			}
+			res, err := http.Post(server.URL+"/git/test/git-upload-pack", "application/x-git-upload-pack-request", &body)
+			if err != nil {
+				t.Fatalf("http.Post() got error %v; want no error", err)
+			}
+			res.Body.Close()
+			if res.StatusCode != tc.wantCode {
+				t.Errorf("upload-pack of want %s got status %d; want %d", tc.want, res.StatusCode, tc.wantCode)
+			}
+		})
+	}
+
+	testCases := []struct {
+		desc     string
+		path     string
+		wantCode int
+	}{
+		{
+			desc:     "push",
+			path:     "/git/test/info/refs?service=git-receive-pack",
+			wantCode: http.StatusForbidden,
+		},
+		{
+			desc:     "dumb protocol",
+			path:     "/git/test/info/refs",
+			wantCode: http.StatusForbidden,
+		},
+		{
+			desc:     "missing repo",
+			path:     "/git/nope/info/refs?service=git-upload-pack",
+			wantCode: http.StatusNotFound,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			res, err := http.Get(server.URL + tc.path)
+			if err != nil {
+				t.Fatalf("http.Get() got error %v; want no error", err)
+			}
+			res.Body.Close()
+			if res.StatusCode != tc.wantCode {
+				t.Errorf("GET %s got status %d; want %d", tc.path, res.StatusCode, tc.wantCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package service
+
+import (
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	fspb "github.com/minorhacks/funhouse/proto/git_read_fs_proto"
+
+	"github.com/golang/glog"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head><title>funhouse status</title></head>
+<body>
+<h1>funhouse status</h1>
+<table>
+<tr><th>Repo</th><th>URL</th><th>Last fetch</th><th>Last success</th><th>Failures</th><th>Next poll</th><th>Last error</th></tr>
+{{range .Repos}}<tr>
+<td>{{.Name}}</td>
+<td>{{.URL}}</td>
+<td>{{.LastFetch}}</td>
+<td>{{.LastSuccess}}</td>
+<td>{{.Failures}}</td>
+<td>{{.NextPoll}}</td>
+<td>{{.LastError}}</td>
+</tr>
+{{end}}</table>
+{{with .Redactions}}<h2>Redactions</h2>
+<table>
+<tr><th>Repo</th><th>View</th><th>Rule</th><th>Hidden paths</th><th>Pattern</th></tr>
+{{range .}}<tr>
+<td>{{.Repo}}</td>
+<td>{{.View}}</td>
+<td>{{.Name}}</td>
+<td>{{.Paths}}</td>
+<td>{{.Pattern}}</td>
+</tr>
+{{end}}</table>
+{{end}}</body>
+</html>
+`))
+
+type statusRow struct {
+	Name        string
+	URL         string
+	LastFetch   string
+	LastSuccess string
+	Failures    int
+	NextPoll    string
+	LastError   string
+}
+
+// redactionRow is a rule of a redacting view, so that what a view hides can
+// be checked without reading the config.
+type redactionRow struct {
+	Repo    string
+	View    string
+	Name    string
+	Paths   string
+	Pattern string
+}
+
+// StatusPage serves an HTML summary of each repo's fetch status, and the
+// rules of views that redact.
+func (s *Service) StatusPage(w http.ResponseWriter, r *http.Request) {
+	var rows []statusRow
+	var redactionRows []redactionRow
+	for _, r := range s.allRepos() {
+		st := r.lastFetchStatus()
+		row := statusRow{
+			Name:        r.path,
+			URL:         r.url,
+			LastFetch:   formatStatusTime(st.lastFetch),
+			LastSuccess: formatStatusTime(st.lastSuccess),
+			Failures:    st.failures,
+			NextPoll:    formatStatusTime(st.nextPoll),
+		}
+		if err := r.ready(); err != nil {
+			row.LastError = err.Error()
+		} else if st.lastErr != nil {
+			row.LastError = st.lastErr.Error()
+		}
+		rows = append(rows, row)
+
+		views := r.redactedViews()
+		var names []string
+		for name := range views {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			for _, rd := range views[name] {
+				row := redactionRow{Repo: r.path, View: name, Name: rd.Name, Paths: strings.Join(rd.Paths, " ")}
+				if rd.Pattern != nil {
+					row.Pattern = rd.Pattern.String()
+				}
+				redactionRows = append(redactionRows, row)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusTemplate.Execute(w, struct {
+		Repos      []statusRow
+		Redactions []redactionRow
+	}{rows, redactionRows}); err != nil {
+		glog.Errorf("StatusPage: failed to render: %v", err)
+	}
+}
+
+func formatStatusTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Format(time.RFC3339)
+}
+
+func (st fetchStatus) proto() *fspb.FetchStatus {
+	res := &fspb.FetchStatus{
+		ConsecutiveFailures: uint32(st.failures),
+	}
+	if !st.lastFetch.IsZero() {
+		res.LastFetchTime = timestamppb.New(st.lastFetch)
+	}
+	if !st.lastSuccess.IsZero() {
+		res.LastSuccessTime = timestamppb.New(st.lastSuccess)
+	}
+	if !st.nextPoll.IsZero() {
+		res.NextPollTime = timestamppb.New(st.nextPoll)
+	}
+	if st.lastErr != nil {
+		res.LastError = st.lastErr.Error()
+	}
+	return res
+}
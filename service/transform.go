@@ -0,0 +1,555 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	fspb "github.com/minorhacks/funhouse/proto/git_read_fs_proto"
+
+	gitplumbing "github.com/go-git/go-git/v5/plumbing"
+	gitobject "github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// A Transformer distorts the trees of a repo's commits for one of its views.
+// A view's transformers are applied in order, each to the tree returned by
+// the one before, so that GetFile, ListDir and GetAttributes all read the
+// same distorted tree.
+type Transformer interface {
+	// Transform returns tree as the view shows it at commit. Since a tree is
+	// transformed for every request, Transform should do little work itself
+	// and instead return a Tree that distorts tree as it is read.
+	Transform(ctx context.Context, commit *gitobject.Commit, tree Tree) (Tree, error)
+}
+
+// A CommitFilter is a Transformer that also limits the commits that its view
+// lists.
+type CommitFilter interface {
+	Transformer
+	// KeepCommit reports whether ListCommits lists commit in the view.
+	KeepCommit(ctx context.Context, commit *gitobject.Commit) (bool, error)
+}
+
+// TransformerFunc adapts a function to a Transformer.
+type TransformerFunc func(ctx context.Context, commit *gitobject.Commit, tree Tree) (Tree, error)
+
+func (f TransformerFunc) Transform(ctx context.Context, commit *gitobject.Commit, tree Tree) (Tree, error) {
+	return f(ctx, commit, tree)
+}
+
+// SubdirectoryRoot makes the directory at dir the root of the tree. Commits
+// without dir have no files at all.
+func SubdirectoryRoot(dir string) (Transformer, error) {
+	dir = treePath(dir)
+	if dir == "" {
+		return nil, fmt.Errorf("subdirectory is the root of the tree")
+	}
+	return TransformerFunc(func(ctx context.Context, commit *gitobject.Commit, tree Tree) (Tree, error) {
+		return &subTree{tree: tree, dir: dir}, nil
+	}), nil
+}
+
+// OnlyCommitsTouching limits the commits of a view to those that change what
+// is at p in the repo's own tree, which is checked before any transformer
+// runs. As with git log -- p, a commit is left out if p is the same as in any
+// of its parents, and root commits are listed if they have p. Trees are left
+// as they are.
+func OnlyCommitsTouching(p string) (Transformer, error) {
+	p = treePath(p)
+	if p == "" {
+		return nil, fmt.Errorf("every commit touches the root of the tree")
+	}
+	return &touchFilter{path: p, kept: map[gitplumbing.Hash]bool{}}, nil
+}
+
+// touchFilter lists the commits that change a path. Commits never change, so
+// it remembers what it decided for each one rather than diffing the whole
+// history again on every ListCommits.
+type touchFilter struct {
+	path string
+
+	mu   sync.Mutex
+	kept map[gitplumbing.Hash]bool
+}
+
+func (f *touchFilter) Transform(ctx context.Context, commit *gitobject.Commit, tree Tree) (Tree, error) {
+	return tree, nil
+}
+
+func (f *touchFilter) KeepCommit(ctx context.Context, commit *gitobject.Commit) (bool, error) {
+	f.mu.Lock()
+	keep, ok := f.kept[commit.Hash]
+	f.mu.Unlock()
+	if ok {
+		return keep, nil
+	}
+	keep, err := f.touches(commit)
+	if err != nil {
+		return false, err
+	}
+	f.mu.Lock()
+	f.kept[commit.Hash] = keep
+	f.mu.Unlock()
+	return keep, nil
+}
+
+// touches reports whether commit changes the path.
+func (f *touchFilter) touches(commit *gitobject.Commit) (bool, error) {
+	hash, err := f.hashIn(commit)
+	if err != nil {
+		return false, err
+	}
+	if commit.NumParents() == 0 {
+		return !hash.IsZero(), nil
+	}
+	for i := 0; i < commit.NumParents(); i++ {
+		parent, err := commit.Parent(i)
+		if err != nil {
+			return false, fmt.Errorf("can't get parent %d of commit %s: %v", i, commit.Hash, err)
+		}
+		parentHash, err := f.hashIn(parent)
+		if err != nil {
+			return false, err
+		}
+		if parentHash == hash {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// hashIn returns the hash of the object at the path in commit's tree, or the
+// zero hash if there is none.
+func (f *touchFilter) hashIn(commit *gitobject.Commit) (gitplumbing.Hash, error) {
+	tree, err := commit.Tree()
+	if err != nil {
+		return gitplumbing.ZeroHash, fmt.Errorf("can't get tree for commit %s: %v", commit.Hash, err)
+	}
+	entry, err := tree.FindEntry(f.path)
+	switch err {
+	case nil:
+		return entry.Hash, nil
+	case gitobject.ErrEntryNotFound, gitobject.ErrDirectoryNotFound, gitobject.ErrFileNotFound, gitplumbing.ErrObjectNotFound:
+		return gitplumbing.ZeroHash, nil
+	default:
+		return gitplumbing.ZeroHash, fmt.Errorf("can't find %q at commit %s: %v", f.path, commit.Hash, err)
+	}
+}
+
+// FilterPaths hides the files and directories whose paths keep rejects, along
+// with everything in hidden directories.
+func FilterPaths(keep func(path string) bool) Transformer {
+	return TransformerFunc(func(ctx context.Context, commit *gitobject.Commit, tree Tree) (Tree, error) {
+		return &filterTree{Tree: tree, keep: ignoreContext(keep)}, nil
+	})
+}
+
+// ExcludePaths hides the files and directories that match any of patterns,
+// as described by matchPaths.
+func ExcludePaths(patterns ...string) (Transformer, error) {
+	match, err := matchPaths(patterns)
+	if err != nil {
+		return nil, err
+	}
+	return FilterPaths(func(p string) bool { return !match(p) }), nil
+}
+
+// MovePath moves the file or directory at from to to, making any directories
+// above to that don't exist. Commits without from are left as they are.
+func MovePath(from string, to string) (Transformer, error) {
+	from, to = treePath(from), treePath(to)
+	if from == "" || to == "" {
+		return nil, fmt.Errorf("can't move the root of a tree")
+	}
+	return TransformerFunc(func(ctx context.Context, commit *gitobject.Commit, tree Tree) (Tree, error) {
+		if _, err := tree.Stat(ctx, from); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return tree, nil
+			}
+			return nil, err
+		}
+		return &mountTree{
+			base:   &filterTree{Tree: tree, keep: ignoreContext(func(p string) bool { return p != from })},
+			mounts: map[string]Tree{to: &subTree{tree: tree, dir: from}},
+		}, nil
+	}), nil
+}
+
+// AddFile adds a regular file with the given contents at p, replacing
+// whatever is there and making any directories above it that don't exist.
+func AddFile(p string, contents []byte) (Transformer, error) {
+	p = treePath(p)
+	if p == "" {
+		return nil, fmt.Errorf("can't replace the root of a tree with a file")
+	}
+	return TransformerFunc(func(ctx context.Context, commit *gitobject.Commit, tree Tree) (Tree, error) {
+		return &mountTree{base: tree, mounts: map[string]Tree{p: fileTree(contents)}}, nil
+	}), nil
+}
+
+// RewriteFunc returns the new contents of the file at path in commit.
+type RewriteFunc func(ctx context.Context, commit *gitobject.Commit, path string, contents []byte) ([]byte, error)
+
+// RewriteFiles rewrites the contents of the regular and executable files
+// whose paths match. Their sizes are those of the rewritten contents.
+func RewriteFiles(match func(path string) bool, rewrite RewriteFunc) Transformer {
+	return TransformerFunc(func(ctx context.Context, commit *gitobject.Commit, tree Tree) (Tree, error) {
+		return &rewriteTree{Tree: tree, commit: commit, match: ignoreContext(match), rewrite: rewrite}, nil
+	})
+}
+
+// ReplaceInFiles replaces the matches of re in the files that match any of
+// patterns with repl, which may refer to submatches as in
+// regexp.Regexp.Expand. Every file is matched if there are no patterns.
+func ReplaceInFiles(patterns []string, re *regexp.Regexp, repl string) (Transformer, error) {
+	match := func(string) bool { return true }
+	if len(patterns) > 0 {
+		var err error
+		if match, err = matchPaths(patterns); err != nil {
+			return nil, err
+		}
+	}
+	return RewriteFiles(match, func(ctx context.Context, commit *gitobject.Commit, p string, contents []byte) ([]byte, error) {
+		return re.ReplaceAll(contents, []byte(repl)), nil
+	}), nil
+}
+
+// matchPaths returns a function that reports whether a path matches any of
+// patterns. Patterns use path.Match syntax. A pattern with a slash is matched
+// against whole paths, while one without is matched against the name of each
+// file and directory, at any depth, as in .gitignore.
+func matchPaths(patterns []string) (func(p string) bool, error) {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid path pattern %q: %v", pattern, err)
+		}
+	}
+	return func(p string) bool {
+		for _, pattern := range patterns {
+			subject := p
+			if !strings.Contains(pattern, "/") {
+				subject = baseName(p)
+			}
+			if ok, _ := path.Match(strings.TrimPrefix(pattern, "/"), subject); ok {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// pathPredicate reports whether a path in a tree has some property, and may
+// need to read the tree to find out.
+type pathPredicate func(ctx context.Context, p string) (bool, error)
+
+func ignoreContext(f func(p string) bool) pathPredicate {
+	return func(ctx context.Context, p string) (bool, error) {
+		return f(p), nil
+	}
+}
+
+// filterTree hides the paths that keep rejects, and everything under them.
+type filterTree struct {
+	Tree
+	keep pathPredicate
+}
+
+// visible reports whether p and the directories above it are kept.
+func (t *filterTree) visible(ctx context.Context, p string) (bool, error) {
+	if p == "" {
+		return true, nil
+	}
+	for i, c := range p {
+		if c != '/' {
+			continue
+		}
+		if ok, err := t.keep(ctx, p[:i]); err != nil || !ok {
+			return false, err
+		}
+	}
+	return t.keep(ctx, p)
+}
+
+func (t *filterTree) Stat(ctx context.Context, p string) (TreeEntry, error) {
+	if ok, err := t.visible(ctx, p); err != nil || !ok {
+		return TreeEntry{}, hiddenError("stat", p, err)
+	}
+	return t.Tree.Stat(ctx, p)
+}
+
+func (t *filterTree) ReadDir(ctx context.Context, p string) ([]TreeEntry, error) {
+	if ok, err := t.visible(ctx, p); err != nil || !ok {
+		return nil, hiddenError("readdir", p, err)
+	}
+	entries, err := t.Tree.ReadDir(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	kept := entries[:0:0]
+	for _, e := range entries {
+		ok, err := t.keep(ctx, path.Join(p, e.Name))
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			kept = append(kept, e)
+		}
+	}
+	return kept, nil
+}
+
+func (t *filterTree) ReadFile(ctx context.Context, p string) ([]byte, error) {
+	if ok, err := t.visible(ctx, p); err != nil || !ok {
+		return nil, hiddenError("read", p, err)
+	}
+	return t.Tree.ReadFile(ctx, p)
+}
+
+// hiddenError returns err if a filter failed, or else the error for a hidden
+// path.
+func hiddenError(op string, p string, err error) error {
+	if err != nil {
+		return err
+	}
+	return notFound(op, p)
+}
+
+// subTree is the part of a tree at dir, which may be a file.
+type subTree struct {
+	tree Tree
+	dir  string
+}
+
+func (t *subTree) Stat(ctx context.Context, p string) (TreeEntry, error) {
+	e, err := t.tree.Stat(ctx, path.Join(t.dir, p))
+	if err == nil && p == "" {
+		e.Name = ""
+	}
+	return e, err
+}
+
+func (t *subTree) ReadDir(ctx context.Context, p string) ([]TreeEntry, error) {
+	return t.tree.ReadDir(ctx, path.Join(t.dir, p))
+}
+
+func (t *subTree) ReadFile(ctx context.Context, p string) ([]byte, error) {
+	return t.tree.ReadFile(ctx, path.Join(t.dir, p))
+}
+
+// fileTree is a tree whose root is a regular file, for mounting files.
+type fileTree []byte
+
+func (t fileTree) Stat(ctx context.Context, p string) (TreeEntry, error) {
+	if p != "" {
+		return TreeEntry{}, notFound("stat", p)
+	}
+	return TreeEntry{Mode: fspb.FileMode_MODE_REGULAR, Size: int64(len(t))}, nil
+}
+
+func (t fileTree) ReadDir(ctx context.Context, p string) ([]TreeEntry, error) {
+	if p != "" {
+		return nil, notFound("readdir", p)
+	}
+	return nil, &fs.PathError{Op: "readdir", Path: p, Err: errNotDir}
+}
+
+func (t fileTree) ReadFile(ctx context.Context, p string) ([]byte, error) {
+	if p != "" {
+		return nil, notFound("read", p)
+	}
+	return t, nil
+}
+
+// mountTree shows trees mounted at paths in a base tree, in place of whatever
+// the base has at each mount point. Directories above mount points are made
+// if the base doesn't have them.
+type mountTree struct {
+	base   Tree
+	mounts map[string]Tree
+}
+
+// mounted returns the tree mounted at or above p, and the path in it that p
+// refers to.
+func (t *mountTree) mounted(p string) (Tree, string, bool) {
+	for m := p; ; m = parentPath(m) {
+		if tree, ok := t.mounts[m]; ok {
+			return tree, strings.TrimPrefix(strings.TrimPrefix(p, m), "/"), true
+		}
+		if m == "" {
+			return nil, "", false
+		}
+	}
+}
+
+// childMounts returns the names of the entries in directory p that lead to
+// mount points.
+func (t *mountTree) childMounts(p string) []string {
+	prefix := p + "/"
+	if p == "" {
+		prefix = ""
+	}
+	var names []string
+	seen := map[string]bool{}
+	for m := range t.mounts {
+		if m == p || !strings.HasPrefix(m, prefix) {
+			continue
+		}
+		name := strings.SplitN(strings.TrimPrefix(m, prefix), "/", 2)[0]
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (t *mountTree) Stat(ctx context.Context, p string) (TreeEntry, error) {
+	if tree, rel, ok := t.mounted(p); ok {
+		e, err := tree.Stat(ctx, rel)
+		if err == nil && rel == "" {
+			e.Name = baseName(p)
+		}
+		return e, err
+	}
+	if len(t.childMounts(p)) > 0 {
+		return TreeEntry{Name: baseName(p), Mode: fspb.FileMode_MODE_DIR}, nil
+	}
+	return t.base.Stat(ctx, p)
+}
+
+func (t *mountTree) ReadDir(ctx context.Context, p string) ([]TreeEntry, error) {
+	if tree, rel, ok := t.mounted(p); ok {
+		return tree.ReadDir(ctx, rel)
+	}
+	entries, err := t.base.ReadDir(ctx, p)
+	children := t.childMounts(p)
+	if len(children) == 0 {
+		return entries, err
+	}
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, errNotDir) {
+			return nil, err
+		}
+		entries = nil
+	}
+	mounted := map[string]TreeEntry{}
+	for _, name := range children {
+		child := path.Join(p, name)
+		tree, ok := t.mounts[child]
+		if !ok {
+			mounted[name] = TreeEntry{Name: name, Mode: fspb.FileMode_MODE_DIR}
+			continue
+		}
+		e, err := tree.Stat(ctx, "")
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		e.Name, e.Size = name, 0
+		mounted[name] = e
+	}
+	var merged []TreeEntry
+	for _, e := range entries {
+		if _, ok := mounted[e.Name]; !ok {
+			merged = append(merged, e)
+		}
+	}
+	for _, e := range mounted {
+		merged = append(merged, e)
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Name < merged[j].Name })
+	return merged, nil
+}
+
+func (t *mountTree) ReadFile(ctx context.Context, p string) ([]byte, error) {
+	if tree, rel, ok := t.mounted(p); ok {
+		return tree.ReadFile(ctx, rel)
+	}
+	if len(t.childMounts(p)) > 0 {
+		return nil, &fs.PathError{Op: "read", Path: p, Err: errNotFile}
+	}
+	return t.base.ReadFile(ctx, p)
+}
+
+// rewriteTree rewrites the contents of the regular and executable files whose
+// paths match.
+type rewriteTree struct {
+	Tree
+	commit  *gitobject.Commit
+	match   pathPredicate
+	rewrite RewriteFunc
+}
+
+func rewritable(mode fspb.FileMode) bool {
+	return mode == fspb.FileMode_MODE_REGULAR || mode == fspb.FileMode_MODE_EXECUTABLE
+}
+
+// statMode returns the mode of the file or directory at p in t. It lists the
+// directory above p rather than calling Stat, since working out sizes reads
+// every file that a tree below rewrites.
+func statMode(ctx context.Context, t Tree, p string) (fspb.FileMode, error) {
+	if p == "" {
+		return fspb.FileMode_MODE_DIR, nil
+	}
+	entries, err := t.ReadDir(ctx, parentPath(p))
+	if errors.Is(err, errNotDir) {
+		return 0, notFound("stat", p)
+	}
+	if err != nil {
+		return 0, err
+	}
+	name := baseName(p)
+	for _, e := range entries {
+		if e.Name == name {
+			return e.Mode, nil
+		}
+	}
+	return 0, notFound("stat", p)
+}
+
+func (t *rewriteTree) Stat(ctx context.Context, p string) (TreeEntry, error) {
+	mode, err := statMode(ctx, t.Tree, p)
+	if err != nil || !rewritable(mode) {
+		return t.Tree.Stat(ctx, p)
+	}
+	if ok, err := t.match(ctx, p); err != nil || !ok {
+		if err != nil {
+			return TreeEntry{}, err
+		}
+		return t.Tree.Stat(ctx, p)
+	}
+	contents, err := t.ReadFile(ctx, p)
+	if err != nil {
+		return TreeEntry{}, err
+	}
+	return TreeEntry{Name: baseName(p), Mode: mode, Size: int64(len(contents))}, nil
+}
+
+func (t *rewriteTree) ReadFile(ctx context.Context, p string) ([]byte, error) {
+	contents, err := t.Tree.ReadFile(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	if ok, err := t.match(ctx, p); err != nil || !ok {
+		return contents, err
+	}
+	mode, err := statMode(ctx, t.Tree, p)
+	if err != nil {
+		return nil, err
+	}
+	if !rewritable(mode) {
+		return contents, nil
+	}
+	if contents, err = t.rewrite(ctx, t.commit, p, contents); err != nil {
+		return nil, &fs.PathError{Op: "rewrite", Path: p, Err: err}
+	}
+	return contents, nil
+}
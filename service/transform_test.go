@@ -0,0 +1,416 @@
+package service
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"testing"
+
+	fspb "github.com/minorhacks/funhouse/proto/git_read_fs_proto"
+
+	gitobject "github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/testing/protocmp"
+)
+
+func mustTransformer(t *testing.T) func(Transformer, error) Transformer {
+	return func(transformer Transformer, err error) Transformer {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return transformer
+	}
+}
+
+func TestViews(t *testing.T) {
+	origin := newTestOrigin(t)
+	head := origin.commit(map[string]string{
+		"README.md":           "See corp.example.com\n",
+		"docs/guide.md":       "Guide to corp.example.com\n",
+		"internal/secret.txt": "hunter2\n",
+		"src/main.go":         "package main // corp.example.com\n",
+		"src/server.pem":      "KEY\n",
+	})
+	s := newTestService(t, origin)
+	must := mustTransformer(t)
+	public := []Transformer{
+		must(ExcludePaths("internal", "*.pem")),
+		must(MovePath("docs", "documentation/v1")),
+		must(AddFile("NOTICE", []byte("Mirrored.\n"))),
+		must(ReplaceInFiles([]string{"*.md"}, regexp.MustCompile(`corp\.example\.com`), "example.com")),
+	}
+	if err := s.UpdateRepo("test", origin.url(), RepoOptions{Views: map[string][]Transformer{"public": public}}); err != nil {
+		t.Fatalf("UpdateRepo() got error %v; want no error", err)
+	}
+	ctx := context.Background()
+
+	dirTestCases := []struct {
+		desc        string
+		view        string
+		path        string
+		wantEntries []*fspb.DirEntry
+		wantCode    codes.Code
+	}{
+		{
+			desc: "root",
+			view: "public",
+			path: "/",
+			wantEntries: []*fspb.DirEntry{
+				{Name: "NOTICE", Mode: fspb.FileMode_MODE_REGULAR},
+				{Name: "README.md", Mode: fspb.FileMode_MODE_REGULAR},
+				{Name: "documentation", Mode: fspb.FileMode_MODE_DIR},
+				{Name: "src", Mode: fspb.FileMode_MODE_DIR},
+			},
+		},
+		{
+			desc:        "made directory",
+			view:        "public",
+			path:        "/documentation",
+			wantEntries: []*fspb.DirEntry{{Name: "v1", Mode: fspb.FileMode_MODE_DIR}},
+		},
+		{
+			desc:        "moved directory",
+			view:        "public",
+			path:        "/documentation/v1",
+			wantEntries: []*fspb.DirEntry{{Name: "guide.md", Mode: fspb.FileMode_MODE_REGULAR}},
+		},
+		{
+			desc:        "excluded file",
+			view:        "public",
+			path:        "/src",
+			wantEntries: []*fspb.DirEntry{{Name: "main.go", Mode: fspb.FileMode_MODE_REGULAR}},
+		},
+		{
+			desc:     "excluded directory",
+			view:     "public",
+			path:     "/internal",
+			wantCode: codes.NotFound,
+		},
+		{
+			desc:     "old path of moved directory",
+			view:     "public",
+			path:     "/docs",
+			wantCode: codes.NotFound,
+		},
+		{
+			desc: "without a view",
+			path: "/",
+			wantEntries: []*fspb.DirEntry{
+				{Name: "README.md", Mode: fspb.FileMode_MODE_REGULAR},
+				{Name: "docs", Mode: fspb.FileMode_MODE_DIR},
+				{Name: "internal", Mode: fspb.FileMode_MODE_DIR},
+				{Name: "src", Mode: fspb.FileMode_MODE_DIR},
+			},
+		},
+		{
+			desc:     "file without a view",
+			path:     "/README.md",
+			wantCode: codes.NotFound,
+		},
+		{
+			desc:     "unknown view",
+			view:     "private",
+			path:     "/",
+			wantCode: codes.NotFound,
+		},
+	}
+	for _, tc := range dirTestCases {
+		t.Run("ListDir/"+tc.desc, func(t *testing.T) {
+			res, err := s.ListDir(ctx, &fspb.ListDirRequest{Commit: head.String(), Path: tc.path, View: tc.view})
+			if got := status.Code(err); got != tc.wantCode {
+				t.Fatalf("ListDir() got code %v (error %v); want %v", got, err, tc.wantCode)
+			}
+			if diff := cmp.Diff(tc.wantEntries, res.GetEntries(), protocmp.Transform()); diff != "" {
+				t.Errorf("ListDir() returned diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	fileTestCases := []struct {
+		desc         string
+		path         string
+		wantContents string
+		wantCode     codes.Code
+	}{
+		{
+			desc:         "rewritten file",
+			path:         "/README.md",
+			wantContents: "See example.com\n",
+		},
+		{
+			desc:         "moved and rewritten file",
+			path:         "/documentation/v1/guide.md",
+			wantContents: "Guide to example.com\n",
+		},
+		{
+			desc:         "file that doesn't match the rewrite",
+			path:         "/src/main.go",
+			wantContents: "package main // corp.example.com\n",
+		},
+		{
+			desc:         "added file",
+			path:         "/NOTICE",
+			wantContents: "Mirrored.\n",
+		},
+		{
+			desc:     "excluded file",
+			path:     "/src/server.pem",
+			wantCode: codes.NotFound,
+		},
+		{
+			desc:     "file in excluded directory",
+			path:     "/internal/secret.txt",
+			wantCode: codes.NotFound,
+		},
+	}
+	for _, tc := range fileTestCases {
+		t.Run("GetFile/"+tc.desc, func(t *testing.T) {
+			file, err := s.GetFile(ctx, &fspb.GetFileRequest{Commit: head.String(), Path: tc.path, View: "public"})
+			if got := status.Code(err); got != tc.wantCode {
+				t.Fatalf("GetFile() got code %v (error %v); want %v", got, err, tc.wantCode)
+			}
+			attrs, err := s.GetAttributes(ctx, &fspb.GetAttributesRequest{Commit: head.String(), Path: tc.path, View: "public"})
+			if tc.wantCode != codes.OK {
+				if got := status.Code(err); got != tc.wantCode {
+					t.Errorf("GetAttributes() got code %v (error %v); want %v", got, err, tc.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetAttributes() got error %v; want no error", err)
+			}
+			if got, want := string(file.Contents), tc.wantContents; got != want {
+				t.Errorf("GetFile() = %q; want %q", got, want)
+			}
+			if got, want := attrs.SizeBytes, uint64(len(tc.wantContents)); got != want {
+				t.Errorf("GetAttributes().SizeBytes = %d; want %d", got, want)
+			}
+			if got, want := attrs.Mode, fspb.FileMode_MODE_REGULAR; got != want {
+				t.Errorf("GetAttributes().Mode = %v; want %v", got, want)
+			}
+		})
+	}
+
+	if _, err := s.GetFile(ctx, &fspb.GetFileRequest{Commit: head.String(), Path: "/documentation", View: "public"}); status.Code(err) != codes.NotFound {
+		t.Errorf("GetFile() of made directory got error %v; want code %v", err, codes.NotFound)
+	}
+	attrs, err := s.GetAttributes(ctx, &fspb.GetAttributesRequest{Commit: head.String(), Path: "/documentation", View: "public"})
+	if err != nil {
+		t.Fatalf("GetAttributes() of made directory got error %v; want no error", err)
+	}
+	if got, want := attrs.Mode, fspb.FileMode_MODE_DIR; got != want {
+		t.Errorf("GetAttributes().Mode of made directory = %v; want %v", got, want)
+	}
+}
+
+func TestMatchPaths(t *testing.T) {
+	match, err := matchPaths([]string{"*.pem", "docs/*.md", "/build"})
+	if err != nil {
+		t.Fatalf("matchPaths() got error %v; want no error", err)
+	}
+	for p, want := range map[string]bool{
+		"server.pem":         true,
+		"certs/server.pem":   true,
+		"docs/guide.md":      true,
+		"docs/api/guide.md":  false,
+		"src/docs/guide.md":  false,
+		"build":              true,
+		"src/build":          false,
+		"README.md":          false,
+		"certs/server.pem.1": false,
+	} {
+		if got := match(p); got != want {
+			t.Errorf("match(%q) = %v; want %v", p, got, want)
+		}
+	}
+}
+
+// countingTree is a Tree of files in a single directory that counts its reads.
+type countingTree struct {
+	files map[string]string
+	reads int
+}
+
+func (t *countingTree) Stat(ctx context.Context, p string) (TreeEntry, error) {
+	if p == "" {
+		return TreeEntry{Mode: fspb.FileMode_MODE_DIR}, nil
+	}
+	contents, err := t.ReadFile(ctx, p)
+	if err != nil {
+		return TreeEntry{}, err
+	}
+	return TreeEntry{Name: p, Mode: fspb.FileMode_MODE_REGULAR, Size: int64(len(contents))}, nil
+}
+
+func (t *countingTree) ReadDir(ctx context.Context, p string) ([]TreeEntry, error) {
+	if p != "" {
+		return nil, notFound("readdir", p)
+	}
+	var entries []TreeEntry
+	for name := range t.files {
+		entries = append(entries, TreeEntry{Name: name, Mode: fspb.FileMode_MODE_REGULAR})
+	}
+	return entries, nil
+}
+
+func (t *countingTree) ReadFile(ctx context.Context, p string) ([]byte, error) {
+	contents, ok := t.files[p]
+	if !ok {
+		return nil, notFound("read", p)
+	}
+	t.reads++
+	return []byte(contents), nil
+}
+
+func TestStackedRewritesReadOnce(t *testing.T) {
+	base := &countingTree{files: map[string]string{"a.txt": "a"}}
+	tree := Tree(base)
+	for i := 0; i < 4; i++ {
+		tree = &rewriteTree{
+			Tree:  tree,
+			match: ignoreContext(func(string) bool { return true }),
+			rewrite: func(ctx context.Context, commit *gitobject.Commit, p string, contents []byte) ([]byte, error) {
+				return append(contents, '!'), nil
+			},
+		}
+	}
+	ctx := context.Background()
+
+	contents, err := tree.ReadFile(ctx, "a.txt")
+	if err != nil {
+		t.Fatalf("ReadFile() got error %v; want no error", err)
+	}
+	if got, want := string(contents), "a!!!!"; got != want {
+		t.Errorf("ReadFile() = %q; want %q", got, want)
+	}
+	if base.reads != 1 {
+		t.Errorf("ReadFile() through 4 rewrites read the file %d times; want 1", base.reads)
+	}
+
+	base.reads = 0
+	e, err := tree.Stat(ctx, "a.txt")
+	if err != nil {
+		t.Fatalf("Stat() got error %v; want no error", err)
+	}
+	if e.Size != 5 || e.Mode != fspb.FileMode_MODE_REGULAR {
+		t.Errorf("Stat() = %+v; want a regular file of size 5", e)
+	}
+	if base.reads != 1 {
+		t.Errorf("Stat() through 4 rewrites read the file %d times; want 1", base.reads)
+	}
+}
+
+func TestSubdirectoryViews(t *testing.T) {
+	origin := newTestOrigin(t)
+	before := origin.commit(map[string]string{"README.md": "Services\n"})
+	added := origin.commit(map[string]string{
+		"services/auth/main.go":     "package auth\n",
+		"services/payments/main.go": "package payments\n",
+	})
+	untouched := origin.commit(map[string]string{"services/auth/main.go": "package auth // v2\n"})
+	changed := origin.commit(map[string]string{"services/payments/main.go": "package payments // v2\n"})
+	s := newTestService(t, origin)
+	must := mustTransformer(t)
+	views := map[string][]Transformer{
+		"payments": {
+			must(OnlyCommitsTouching("services/payments")),
+			must(SubdirectoryRoot("services/payments")),
+		},
+		"payments-all": {must(SubdirectoryRoot("/services/payments/"))},
+	}
+	if err := s.UpdateRepo("test", origin.url(), RepoOptions{Views: views}); err != nil {
+		t.Fatalf("UpdateRepo() got error %v; want no error", err)
+	}
+	ctx := context.Background()
+
+	commitTestCases := []struct {
+		view        string
+		wantCommits []string
+		wantCode    codes.Code
+	}{
+		{
+			view:        "payments",
+			wantCommits: []string{added.String(), changed.String()},
+		},
+		{
+			view:        "payments-all",
+			wantCommits: []string{before.String(), added.String(), untouched.String(), changed.String()},
+		},
+		{
+			view:     "unknown",
+			wantCode: codes.NotFound,
+		},
+	}
+	for _, tc := range commitTestCases {
+		t.Run("ListCommits/"+tc.view, func(t *testing.T) {
+			res, err := s.ListCommits(ctx, &fspb.ListCommitsRequest{View: tc.view})
+			if got := status.Code(err); got != tc.wantCode {
+				t.Fatalf("ListCommits() got code %v (error %v); want %v", got, err, tc.wantCode)
+			}
+			got := res.GetCommits()
+			sort.Strings(got)
+			sort.Strings(tc.wantCommits)
+			if diff := cmp.Diff(tc.wantCommits, got); diff != "" {
+				t.Errorf("ListCommits() returned diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	res, err := s.ListDir(ctx, &fspb.ListDirRequest{Commit: changed.String(), Path: "/", View: "payments"})
+	if err != nil {
+		t.Fatalf("ListDir() got error %v; want no error", err)
+	}
+	if diff := cmp.Diff([]*fspb.DirEntry{{Name: "main.go", Mode: fspb.FileMode_MODE_REGULAR}}, res.Entries, protocmp.Transform()); diff != "" {
+		t.Errorf("ListDir() returned diff (-want +got):\n%s", diff)
+	}
+	file, err := s.GetFile(ctx, &fspb.GetFileRequest{Commit: changed.String(), Path: "/main.go", View: "payments"})
+	if err != nil {
+		t.Fatalf("GetFile() got error %v; want no error", err)
+	}
+	if got, want := string(file.Contents), "package payments // v2\n"; got != want {
+		t.Errorf("GetFile() = %q; want %q", got, want)
+	}
+	attrs, err := s.GetAttributes(ctx, &fspb.GetAttributesRequest{Commit: changed.String(), Path: "/", View: "payments"})
+	if err != nil {
+		t.Fatalf("GetAttributes() of root got error %v; want no error", err)
+	}
+	if got, want := attrs.Mode, fspb.FileMode_MODE_DIR; got != want {
+		t.Errorf("GetAttributes().Mode of root = %v; want %v", got, want)
+	}
+	if _, err := s.ListDir(ctx, &fspb.ListDirRequest{Commit: before.String(), Path: "/", View: "payments"}); status.Code(err) != codes.NotFound {
+		t.Errorf("ListDir() of commit without the subdirectory got error %v; want code %v", err, codes.NotFound)
+	}
+}
+
+func TestOnlyCommitsTouchingRemembersCommits(t *testing.T) {
+	origin := newTestOrigin(t)
+	origin.commit(map[string]string{"README.md": "Services\n"})
+	added := origin.commit(map[string]string{"services/payments/main.go": "package payments\n"})
+	changed := origin.commit(map[string]string{"services/payments/main.go": "package payments // v2\n"})
+	s := newTestService(t, origin)
+	filter := mustTransformer(t)(OnlyCommitsTouching("services/payments")).(*touchFilter)
+	if err := s.UpdateRepo("test", origin.url(), RepoOptions{Views: map[string][]Transformer{"payments": {filter}}}); err != nil {
+		t.Fatalf("UpdateRepo() got error %v; want no error", err)
+	}
+	ctx := context.Background()
+	if _, err := s.ListCommits(ctx, &fspb.ListCommitsRequest{View: "payments"}); err != nil {
+		t.Fatalf("ListCommits() got error %v; want no error", err)
+	}
+	if got, want := len(filter.kept), 3; got != want {
+		t.Fatalf("after ListCommits(), filter remembered %d commits; want %d", got, want)
+	}
+
+	// Flip what the filter remembered for one commit: if the second listing
+	// walks history again, it will list that commit anyway.
+	filter.kept[added] = false
+	res, err := s.ListCommits(ctx, &fspb.ListCommitsRequest{View: "payments"})
+	if err != nil {
+		t.Fatalf("ListCommits() got error %v; want no error", err)
+	}
+	if diff := cmp.Diff([]string{changed.String()}, res.GetCommits()); diff != "" {
+		t.Errorf("second ListCommits() returned diff (-want +got):\n%s", diff)
+	}
+}
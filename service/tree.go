@@ -0,0 +1,199 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	fspb "github.com/minorhacks/funhouse/proto/git_read_fs_proto"
+
+	gitplumbing "github.com/go-git/go-git/v5/plumbing"
+	gitfilemode "github.com/go-git/go-git/v5/plumbing/filemode"
+	gitobject "github.com/go-git/go-git/v5/plumbing/object"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Tree is a read-only view of the files at a commit, which transformers can
+// distort. Paths are slash-separated and relative to the root of the tree,
+// which is "".
+//
+// Errors for paths that don't exist wrap fs.ErrNotExist.
+type Tree interface {
+	// Stat describes the file or directory at path.
+	Stat(ctx context.Context, path string) (TreeEntry, error)
+	// ReadDir lists the directory at path. The entries' sizes are left
+	// unset, since they may be costly to work out.
+	ReadDir(ctx context.Context, path string) ([]TreeEntry, error)
+	// ReadFile returns the contents of the file or symlink at path.
+	ReadFile(ctx context.Context, path string) ([]byte, error)
+}
+
+// TreeEntry describes a file or directory in a Tree.
+type TreeEntry struct {
+	Name string
+	Mode fspb.FileMode
+	// Size is the length of a file's or symlink's contents.
+	Size int64
+}
+
+var (
+	errNotDir  = errors.New("not a directory")
+	errNotFile = errors.New("not a file")
+)
+
+func notFound(op string, p string) error {
+	return &fs.PathError{Op: op, Path: p, Err: fs.ErrNotExist}
+}
+
+// treePath cleans a path from a request into a Tree path.
+func treePath(p string) string {
+	return strings.Trim(path.Clean("/"+p), "/")
+}
+
+// parentPath returns the directory above a Tree path.
+func parentPath(p string) string {
+	if i := strings.LastIndex(p, "/"); i >= 0 {
+		return p[:i]
+	}
+	return ""
+}
+
+// baseName returns the last element of a Tree path.
+func baseName(p string) string {
+	return p[strings.LastIndex(p, "/")+1:]
+}
+
+// treeStatus converts an error from a Tree into a gRPC status error.
+func treeStatus(err error, commit string) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, errNotDir) || errors.Is(err, errNotFile) {
+		return status.Errorf(codes.NotFound, "%v at commit %q", err, commit)
+	}
+	return status.Errorf(codes.Internal, "%v at commit %q", err, commit)
+}
+
+// tree returns the tree of a commit as the named view shows it, along with
+// the commit. The empty view shows the tree as it is.
+func (rd *repoReader) tree(ctx context.Context, hash string, view string) (Tree, *gitobject.Commit, error) {
+	commit, err := rd.git.CommitObject(gitplumbing.NewHash(hash))
+	if err != nil {
+		return nil, nil, status.Errorf(codes.NotFound, "commit %q not found in repo: %v", hash, err)
+	}
+	root, err := commit.Tree()
+	if err != nil {
+		return nil, nil, status.Errorf(codes.Internal, "can't get tree for commit %q: %v", hash, err)
+	}
+	var tree Tree = &gitTree{rd: rd, root: root}
+	if view == "" {
+		if rd.viewRequired() {
+			return nil, nil, viewRequired(rd.path)
+		}
+		return tree, commit, nil
+	}
+	transformers, ok := rd.view(view)
+	if !ok {
+		return nil, nil, status.Errorf(codes.NotFound, "view %q not found in repo %q", view, rd.path)
+	}
+	for _, t := range transformers {
+		if tree, err = t.Transform(ctx, commit, tree); err != nil {
+			return nil, nil, status.Errorf(codes.Internal, "view %q can't show commit %q: %v", view, hash, err)
+		}
+	}
+	return tree, commit, nil
+}
+
+// viewRequired is the error for a read of a repo that requires a view which
+// doesn't name one.
+func viewRequired(repo string) error {
+	return status.Errorf(codes.PermissionDenied, "repo %q can only be read through a view", repo)
+}
+
+// gitTree is the tree of a commit as the repo stores it.
+type gitTree struct {
+	rd   *repoReader
+	root *gitobject.Tree
+}
+
+func (t *gitTree) find(op string, p string) (*gitobject.TreeEntry, error) {
+	entry, err := t.root.FindEntry(p)
+	switch err {
+	case nil:
+		return entry, nil
+	case gitobject.ErrEntryNotFound, gitobject.ErrDirectoryNotFound, gitobject.ErrFileNotFound,
+		// Returned when a file in p is looked up as a directory.
+		gitplumbing.ErrObjectNotFound:
+		return nil, notFound(op, p)
+	default:
+		return nil, &fs.PathError{Op: op, Path: p, Err: err}
+	}
+}
+
+func (t *gitTree) Stat(ctx context.Context, p string) (TreeEntry, error) {
+	if p == "" {
+		return TreeEntry{Mode: fspb.FileMode_MODE_DIR}, nil
+	}
+	entry, err := t.find("stat", p)
+	if err != nil {
+		return TreeEntry{}, err
+	}
+	res := TreeEntry{Name: entry.Name, Mode: fromGitFileMode(entry.Mode)}
+	if entry.Mode.IsFile() {
+		size, err := t.rd.blobSize(ctx, entry.Hash)
+		if err != nil {
+			return TreeEntry{}, status.Errorf(codes.Unavailable, "can't get blob for file %q: %v", p, err)
+		}
+		res.Size = size
+	}
+	return res, nil
+}
+
+func (t *gitTree) ReadDir(ctx context.Context, p string) ([]TreeEntry, error) {
+	dir := t.root
+	if p != "" {
+		entry, err := t.find("readdir", p)
+		if err != nil {
+			return nil, err
+		}
+		if entry.Mode != gitfilemode.Dir {
+			return nil, &fs.PathError{Op: "readdir", Path: p, Err: errNotDir}
+		}
+		if dir, err = t.rd.git.TreeObject(entry.Hash); err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: p, Err: err}
+		}
+	}
+	entries := make([]TreeEntry, 0, len(dir.Entries))
+	for _, e := range dir.Entries {
+		entries = append(entries, TreeEntry{Name: e.Name, Mode: fromGitFileMode(e.Mode)})
+	}
+	return entries, nil
+}
+
+func (t *gitTree) ReadFile(ctx context.Context, p string) ([]byte, error) {
+	entry, err := t.find("read", p)
+	if err != nil {
+		return nil, err
+	}
+	if !entry.Mode.IsFile() {
+		return nil, &fs.PathError{Op: "read", Path: p, Err: errNotFile}
+	}
+	blob, err := t.rd.blob(ctx, entry.Hash)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "can't get blob for file %q: %v", p, err)
+	}
+	rdr, err := blob.Reader()
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: p, Err: err}
+	}
+	defer rdr.Close()
+	contents, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: p, Err: err}
+	}
+	return contents, nil
+}
@@ -0,0 +1,83 @@
+package service
+
+import (
+	"context"
+
+	fspb "github.com/minorhacks/funhouse/proto/git_read_fs_proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// WatchBranches sends the repo's branches, and sends them again each time a
+// fetch changes them, until the client goes away or the repo stops being
+// served.
+func (s *Service) WatchBranches(req *fspb.WatchBranchesRequest, stream fspb.GitReadFs_WatchBranchesServer) error {
+	if c, ok := s.lookupComposite(req.Repo); ok {
+		return s.watchCompositeBranches(stream.Context(), c, stream.Send)
+	}
+	r, ok := s.lookupRepo(req.Repo)
+	if !ok {
+		return status.Errorf(codes.NotFound, "repo %q not found", req.Repo)
+	}
+	return r.watchBranches(stream.Context(), stream.Send)
+}
+
+// watchBranches calls send with the repo's branches whenever they change.
+func (r *Repo) watchBranches(ctx context.Context, send func(*fspb.ListBranchesResponse) error) error {
+	var last map[string]string
+	for {
+		updated := r.refsUpdatedChan()
+		rd, err := r.reader()
+		if err != nil {
+			return status.Errorf(codes.Unavailable, "%v", err)
+		}
+		res, err := rd.branches()
+		rd.release()
+		if err != nil {
+			return err
+		}
+		if !sameBranches(res.Branches, last) {
+			if err := send(res); err != nil {
+				return err
+			}
+			last = res.Branches
+		}
+
+		select {
+		case <-updated:
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-r.ctx.Done():
+			return status.Errorf(codes.Unavailable, "repo %q is no longer served", r.path)
+		}
+	}
+}
+
+func sameBranches(a, b map[string]string) bool {
+	if a == nil || b == nil || len(a) != len(b) {
+		return false
+	}
+	for name, hash := range a {
+		if b[name] != hash {
+			return false
+		}
+	}
+	return true
+}
+
+// refsChanged wakes the repo's watchers after a fetch has published refs.
+func (r *Repo) refsChanged() {
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+	close(r.refsUpdated)
+	r.refsUpdated = make(chan struct{})
+}
+
+// refsUpdatedChan returns a channel that is closed the next time a fetch
+// publishes refs.
+func (r *Repo) refsUpdatedChan() <-chan struct{} {
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+	return r.refsUpdated
+}
@@ -0,0 +1,68 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	fspb "github.com/minorhacks/funhouse/proto/git_read_fs_proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestWatchBranches(t *testing.T) {
+	origin := newTestOrigin(t)
+	first := origin.commit(map[string]string{"README.md": "v1"})
+	s := newTestService(t, origin)
+	r := testRepo(t, s)
+
+	sent := make(chan *fspb.ListBranchesResponse, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- r.watchBranches(context.Background(), func(res *fspb.ListBranchesResponse) error {
+			sent <- res
+			return nil
+		})
+	}()
+	next := func() map[string]string {
+		t.Helper()
+		select {
+		case res := <-sent:
+			return res.Branches
+		case <-time.After(10 * time.Second):
+			t.Fatalf("watchBranches() sent nothing")
+			return nil
+		}
+	}
+
+	if got, want := next()["master"], first.String(); got != want {
+		t.Errorf("first branch master = %q; want %q", got, want)
+	}
+	second := origin.commit(map[string]string{"README.md": "v2"})
+	if err := r.fetchAll(context.Background()); err != nil {
+		t.Fatalf("fetchAll() got error %v; want no error", err)
+	}
+	if got, want := next()["master"], second.String(); got != want {
+		t.Errorf("next branch master = %q; want %q", got, want)
+	}
+	// A fetch that changes nothing isn't sent.
+	if err := r.fetchAll(context.Background()); err != nil {
+		t.Fatalf("fetchAll() got error %v; want no error", err)
+	}
+
+	if err := s.RemoveRepo("test", true /* keepData */); err != nil {
+		t.Fatalf("RemoveRepo() got error %v; want no error", err)
+	}
+	select {
+	case err := <-done:
+		if status.Code(err) != codes.Unavailable {
+			t.Errorf("watchBranches() got error %v after RemoveRepo(); want Unavailable", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("watchBranches() still running after RemoveRepo()")
+	}
+	if len(sent) > 0 {
+		t.Errorf("watchBranches() sent %v; want nothing after a fetch that changed nothing", (<-sent).Branches)
+	}
+}
@@ -0,0 +1,131 @@
+package web
+
+import (
+	"html/template"
+	"strings"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var templates = template.Must(template.New("").Funcs(template.FuncMap{
+	"link": link,
+	"short": func(hash string) string {
+		if len(hash) > 7 {
+			return hash[:7]
+		}
+		return hash
+	},
+	"subject": func(message string) string {
+		return strings.SplitN(strings.TrimSpace(message), "\n", 2)[0]
+	},
+	"time": func(t *timestamppb.Timestamp) string {
+		if t == nil {
+			return ""
+		}
+		return t.AsTime().UTC().Format("2006-01-02 15:04 MST")
+	},
+	"inc": func(i int) int { return i + 1 },
+}).Parse(`
+{{define "header"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.}} - funhouse</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; }
+table { border-collapse: collapse; }
+td, th { padding: 0.1em 0.8em 0.1em 0; text-align: left; vertical-align: top; }
+pre, code, .code td { font-family: monospace; }
+.code td { padding: 0 0.5em; white-space: pre; }
+.code td.num { color: #888; text-align: right; user-select: none; }
+.code td.num a { color: inherit; text-decoration: none; }
+.code tr:target { background: #ffc; }
+.header { font-weight: bold; }
+.hunk { color: #07a; }
+.add { background: #dfd; }
+.del { background: #fdd; }
+.message { white-space: pre-wrap; }
+nav { margin-bottom: 1em; }
+</style>
+</head>
+<body>
+<nav><a href="{{link}}">funhouse</a></nav>
+{{end}}
+
+{{define "footer"}}</body>
+</html>
+{{end}}
+
+{{define "repos"}}{{template "header" "Repos"}}
+<h1>Repos</h1>
+<ul>
+{{range .Repos}}<li><a href="{{link .}}">{{.}}</a>{{if eq . $.DefaultRepo}} (default){{end}}</li>
+{{else}}<li>No repos are mirrored.</li>
+{{end}}</ul>
+{{template "footer"}}{{end}}
+
+{{define "refs"}}{{template "header" .Repo}}
+<h1>{{.Repo}}</h1>
+<h2>Branches</h2>
+<table>
+{{range .Branches}}<tr><td>{{.Name}}</td><td><a href="{{link $.Repo "tree" .Commit}}">files</a></td><td><a href="{{link $.Repo "log" .Commit}}">log</a></td><td><a href="{{link $.Repo "commit" .Commit}}"><code>{{short .Commit}}</code></a></td></tr>
+{{end}}</table>
+<h2>Tags</h2>
+<table>
+{{range .Tags}}<tr><td>{{.Name}}</td><td><a href="{{link $.Repo "tree" .Commit}}">files</a></td><td><a href="{{link $.Repo "log" .Commit}}">log</a></td><td><a href="{{link $.Repo "commit" .Commit}}"><code>{{short .Commit}}</code></a></td></tr>
+{{else}}<tr><td>No tags.</td></tr>
+{{end}}</table>
+{{template "footer"}}{{end}}
+
+{{define "log"}}{{template "header" (print "Log of " .Repo)}}
+<h1><a href="{{link .Repo}}">{{.Repo}}</a>: log</h1>
+<table>
+{{range .Commits}}<tr><td><a href="{{link $.Repo "commit" .Hash}}"><code>{{short .Hash}}</code></a></td><td>{{subject .Message}}</td><td>{{.Author.Name}}</td><td>{{time .Author.Time}}</td></tr>
+{{end}}</table>
+{{if .Next}}<p><a href="{{link .Repo "log" .Next}}">Older</a></p>{{end}}
+{{template "footer"}}{{end}}
+
+{{define "commit"}}{{template "header" (print "Commit " (short .Commit.Hash))}}
+<h1><a href="{{link .Repo}}">{{.Repo}}</a>: commit <code>{{.Commit.Hash}}</code></h1>
+<table>
+<tr><th>Author</th><td>{{.Commit.Author.Name}} &lt;{{.Commit.Author.Email}}&gt;</td><td>{{time .Commit.Author.Time}}</td></tr>
+<tr><th>Committer</th><td>{{.Commit.Committer.Name}} &lt;{{.Commit.Committer.Email}}&gt;</td><td>{{time .Commit.Committer.Time}}</td></tr>
+<tr><th>Parents</th><td>{{range .Commit.ParentHashes}}<a href="{{link $.Repo "commit" .}}"><code>{{short .}}</code></a> {{end}}</td></tr>
+<tr><th>Files</th><td><a href="{{link .Repo "tree" .Commit.Hash}}">browse</a></td></tr>
+</table>
+<p class="message">{{.Commit.Message}}</p>
+{{range .Files}}<h3>{{.Name}}</h3>
+{{if .Binary}}<p>Binary file changed.</p>
+{{else}}<table class="code">
+{{range .Lines}}<tr class="{{.Class}}"><td>{{.Text}}</td></tr>
+{{end}}</table>
+{{end}}{{end}}
+{{template "footer"}}{{end}}
+
+{{define "crumbs"}}<h1>{{range .Crumbs}}<a href="{{.Link}}">{{.Name}}</a> / {{end}}{{if .Path}}{{.Name}}{{end}}</h1>
+<p>At commit <a href="{{link .Repo "commit" .Commit}}"><code>{{.Commit}}</code></a></p>
+{{end}}
+
+{{define "tree"}}{{template "header" (print .Repo "/" .Path)}}
+{{template "crumbs" .}}
+<table>
+{{range .Entries}}<tr><td>{{if .Link}}<a href="{{.Link}}">{{.Name}}{{if .Dir}}/{{end}}</a>{{else}}{{.Name}}{{end}}</td></tr>
+{{else}}<tr><td>Empty directory.</td></tr>
+{{end}}</table>
+{{template "footer"}}{{end}}
+
+{{define "blob"}}{{template "header" (print .Repo "/" .Path)}}
+{{template "crumbs" .}}
+<p>{{.Size}} bytes · <a href="{{.RawLink}}">download</a></p>
+{{if .Lines}}<table class="code">
+{{range $i, $line := .Lines}}<tr id="L{{inc $i}}"><td class="num"><a href="#L{{inc $i}}">{{inc $i}}</a></td><td>{{$line}}</td></tr>
+{{end}}</table>
+{{else}}<p>This file is binary or too large to show.</p>
+{{end}}
+{{template "footer"}}{{end}}
+
+{{define "error"}}{{template "header" "Error"}}
+<h1>Error {{.Code}}</h1>
+<p>{{.Message}}</p>
+{{template "footer"}}{{end}}
+`))
@@ -0,0 +1,370 @@
+// Package web serves an HTML browser of mirrored repos under /ui, for people
+// who want to look at them without access to the git host.
+//
+// Pages are rendered on the server from GitReadFs calls, so the browser shows
+// exactly what clients of the API see. Commits are always named by their full
+// hash in URLs; branches and tags link to the commits they point to.
+package web
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/minorhacks/funhouse/gateway"
+	fspb "github.com/minorhacks/funhouse/proto/git_read_fs_proto"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// logPageSize is the number of commits on each page of a log.
+	logPageSize = 30
+	// maxRenderBytes is the size above which files are linked to rather than
+	// shown.
+	maxRenderBytes = 1 << 20
+)
+
+// UI renders pages from a GitReadFs server.
+type UI struct {
+	server fspb.GitReadFsServer
+}
+
+// Register adds the UI's pages for server to router.
+func Register(router *mux.Router, server fspb.GitReadFsServer) {
+	ui := &UI{server: server}
+	router.HandleFunc("/ui", ui.repos).Methods("GET")
+	router.HandleFunc("/ui/{repo}", ui.refs).Methods("GET")
+	router.HandleFunc("/ui/{repo}/log/{commit}", ui.log).Methods("GET")
+	router.HandleFunc("/ui/{repo}/commit/{commit}", ui.commit).Methods("GET")
+	router.HandleFunc("/ui/{repo}/tree/{commit}", ui.tree).Methods("GET")
+	router.HandleFunc("/ui/{repo}/tree/{commit}/{path:.*}", ui.tree).Methods("GET")
+	router.HandleFunc("/ui/{repo}/blob/{commit}/{path:.+}", ui.blob).Methods("GET")
+	router.HandleFunc("/ui/{repo}/raw/{commit}/{path:.+}", ui.raw).Methods("GET")
+}
+
+// link returns the path of a UI page, escaping each part.
+func link(parts ...string) string {
+	escaped := []string{"/ui"}
+	for _, part := range parts {
+		for _, segment := range strings.Split(strings.Trim(part, "/"), "/") {
+			if segment != "" {
+				escaped = append(escaped, url.PathEscape(segment))
+			}
+		}
+	}
+	return strings.Join(escaped, "/")
+}
+
+func (ui *UI) repos(w http.ResponseWriter, r *http.Request) {
+	res, err := ui.server.ListRepos(r.Context(), &fspb.ListReposRequest{})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	render(w, "repos", res)
+}
+
+type refsPage struct {
+	Repo     string
+	Branches []ref
+	Tags     []ref
+}
+
+type ref struct {
+	Name   string
+	Commit string
+}
+
+func sortedRefs(refs map[string]string) []ref {
+	var sorted []ref
+	for name, commit := range refs {
+		sorted = append(sorted, ref{Name: name, Commit: commit})
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	return sorted
+}
+
+func (ui *UI) refs(w http.ResponseWriter, r *http.Request) {
+	repo := mux.Vars(r)["repo"]
+	branches, err := ui.server.ListBranches(r.Context(), &fspb.ListBranchesRequest{Repo: repo})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	tags, err := ui.server.ListTags(r.Context(), &fspb.ListTagsRequest{Repo: repo})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	render(w, "refs", refsPage{
+		Repo:     repo,
+		Branches: sortedRefs(branches.Branches),
+		Tags:     sortedRefs(tags.Tags),
+	})
+}
+
+type logPage struct {
+	Repo    string
+	Commits []*fspb.GetCommitResponse
+	// Next is the commit that the next page starts from, if there is one.
+	Next string
+}
+
+// log lists commits by following first parents from the commit in the path.
+func (ui *UI) log(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	page := logPage{Repo: vars["repo"]}
+	next := vars["commit"]
+	for len(page.Commits) < logPageSize && next != "" {
+		commit, err := ui.server.GetCommit(r.Context(), &fspb.GetCommitRequest{Repo: page.Repo, Commit: next})
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		page.Commits = append(page.Commits, commit)
+		next = ""
+		if len(commit.ParentHashes) > 0 {
+			next = commit.ParentHashes[0]
+		}
+	}
+	page.Next = next
+	render(w, "log", page)
+}
+
+type commitPage struct {
+	Repo   string
+	Commit *fspb.GetCommitResponse
+	Files  []fileDiff
+}
+
+type fileDiff struct {
+	Name   string
+	Binary bool
+	Lines  []diffLine
+}
+
+// diffLine is a line of a unified diff, with the class it is styled with.
+type diffLine struct {
+	Class string
+	Text  string
+}
+
+func diffLines(patch string) []diffLine {
+	var lines []diffLine
+	inHunk := false
+	for _, text := range strings.SplitAfter(patch, "\n") {
+		if text == "" {
+			continue
+		}
+		class := ""
+		switch {
+		case strings.HasPrefix(text, "@@"):
+			class = "hunk"
+			inHunk = true
+		case !inHunk:
+			class = "header"
+		case strings.HasPrefix(text, "+"):
+			class = "add"
+		case strings.HasPrefix(text, "-"):
+			class = "del"
+		}
+		lines = append(lines, diffLine{Class: class, Text: strings.TrimSuffix(text, "\n")})
+	}
+	return lines
+}
+
+func (ui *UI) commit(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	commit, err := ui.server.GetCommit(r.Context(), &fspb.GetCommitRequest{
+		Repo:        vars["repo"],
+		Commit:      vars["commit"],
+		IncludeDiff: true,
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	page := commitPage{Repo: vars["repo"], Commit: commit}
+	for _, d := range commit.Diff {
+		name := d.ToPath
+		if d.FromPath != d.ToPath {
+			switch {
+			case d.ToPath == "":
+				name = d.FromPath
+			case d.FromPath != "":
+				name = d.FromPath + " → " + d.ToPath
+			}
+		}
+		page.Files = append(page.Files, fileDiff{Name: name, Binary: d.Binary, Lines: diffLines(d.Patch)})
+	}
+	render(w, "commit", page)
+}
+
+// location is the position of a tree or blob page in a commit's tree.
+type location struct {
+	Repo   string
+	Commit string
+	// Path is the path from the root of the tree, without a leading slash.
+	Path string
+}
+
+func pageLocation(r *http.Request) location {
+	vars := mux.Vars(r)
+	return location{
+		Repo:   vars["repo"],
+		Commit: vars["commit"],
+		Path:   strings.Trim(vars["path"], "/"),
+	}
+}
+
+type crumb struct {
+	Name string
+	Link string
+}
+
+// Crumbs links to each directory above the location.
+func (l location) Crumbs() []crumb {
+	crumbs := []crumb{{Name: l.Repo, Link: link(l.Repo, "tree", l.Commit)}}
+	if l.Path == "" {
+		return crumbs
+	}
+	parts := strings.Split(l.Path, "/")
+	for i, part := range parts[:len(parts)-1] {
+		crumbs = append(crumbs, crumb{Name: part, Link: link(l.Repo, "tree", l.Commit, path.Join(parts[:i+1]...))})
+	}
+	return crumbs
+}
+
+// Name is the last element of the location's path.
+func (l location) Name() string {
+	return path.Base("/" + l.Path)
+}
+
+type treePage struct {
+	location
+	Entries []treeEntry
+}
+
+type treeEntry struct {
+	Name string
+	// Link is empty for entries that can't be browsed, such as submodules.
+	Link string
+	Dir  bool
+}
+
+func (ui *UI) tree(w http.ResponseWriter, r *http.Request) {
+	loc := pageLocation(r)
+	res, err := ui.server.ListDir(r.Context(), &fspb.ListDirRequest{Repo: loc.Repo, Commit: loc.Commit, Path: "/" + loc.Path})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	page := treePage{location: loc}
+	for _, e := range res.Entries {
+		entry := treeEntry{Name: e.Name}
+		entryPath := path.Join(loc.Path, e.Name)
+		switch e.Mode {
+		case fspb.FileMode_MODE_DIR:
+			entry.Dir = true
+			entry.Link = link(loc.Repo, "tree", loc.Commit, entryPath)
+		case fspb.FileMode_MODE_REGULAR, fspb.FileMode_MODE_EXECUTABLE, fspb.FileMode_MODE_SYMLINK:
+			entry.Link = link(loc.Repo, "blob", loc.Commit, entryPath)
+		}
+		page.Entries = append(page.Entries, entry)
+	}
+	// Directories first, as most browsers of code do.
+	sort.SliceStable(page.Entries, func(i, j int) bool {
+		if page.Entries[i].Dir != page.Entries[j].Dir {
+			return page.Entries[i].Dir
+		}
+		return page.Entries[i].Name < page.Entries[j].Name
+	})
+	render(w, "tree", page)
+}
+
+type blobPage struct {
+	location
+	Size int
+	// Lines holds the file's lines, unless it is binary or too large to
+	// show.
+	Lines   []string
+	RawLink string
+}
+
+func (ui *UI) blob(w http.ResponseWriter, r *http.Request) {
+	loc := pageLocation(r)
+	res, err := ui.server.GetFile(r.Context(), &fspb.GetFileRequest{Repo: loc.Repo, Commit: loc.Commit, Path: "/" + loc.Path})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	page := blobPage{
+		location: loc,
+		Size:     len(res.Contents),
+		RawLink:  link(loc.Repo, "raw", loc.Commit, loc.Path),
+	}
+	if isText(res.Contents) && len(res.Contents) <= maxRenderBytes {
+		page.Lines = strings.Split(strings.TrimSuffix(string(res.Contents), "\n"), "\n")
+	}
+	render(w, "blob", page)
+}
+
+// isText reports whether contents look like text that can be shown as is.
+func isText(contents []byte) bool {
+	return utf8.Valid(contents) && !bytes.ContainsRune(contents, 0)
+}
+
+func (ui *UI) raw(w http.ResponseWriter, r *http.Request) {
+	loc := pageLocation(r)
+	res, err := ui.server.GetFile(r.Context(), &fspb.GetFileRequest{Repo: loc.Repo, Commit: loc.Commit, Path: "/" + loc.Path})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	// Served as a download, so that files in the repo can't run scripts on
+	// this origin.
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": loc.Name()}))
+	w.Write(res.Contents)
+}
+
+type errorPage struct {
+	Code    int
+	Message string
+}
+
+// writeError renders a gRPC status error, with the HTTP status that best
+// matches its code.
+func writeError(w http.ResponseWriter, err error) {
+	st := status.Convert(err)
+	code := gateway.HTTPStatus(st.Code())
+	if code >= http.StatusInternalServerError {
+		glog.Errorf("Web: %v", err)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	if err := templates.ExecuteTemplate(w, "error", errorPage{Code: code, Message: st.Message()}); err != nil {
+		glog.Errorf("Web: failed to render error page: %v", err)
+	}
+}
+
+// render renders a page into a buffer first, so that a failure can still be
+// reported with an error status.
+func render(w http.ResponseWriter, name string, data interface{}) {
+	var buf bytes.Buffer
+	if err := templates.ExecuteTemplate(&buf, name, data); err != nil {
+		glog.Errorf("Web: failed to render page %q: %v", name, err)
+		http.Error(w, "failed to render page", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(w)
+}
@@ -0,0 +1,287 @@
+package web
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	fspb "github.com/minorhacks/funhouse/proto/git_read_fs_proto"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	commitA = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	commitB = "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+)
+
+// fakeServer serves a repo named "repo" with two commits, A and its child B,
+// which both have the same files.
+type fakeServer struct {
+	fspb.GitReadFsServer
+}
+
+var (
+	files = map[string]string{
+		"/README.md":   "hello\n<world>\n",
+		"/logo.png":    "\x89PNG\x00\x00",
+		"/src/main.go": "package main\n",
+	}
+	dirs = map[string][]*fspb.DirEntry{
+		"/": {
+			{Name: "logo.png", Mode: fspb.FileMode_MODE_REGULAR},
+			{Name: "README.md", Mode: fspb.FileMode_MODE_REGULAR},
+			{Name: "src", Mode: fspb.FileMode_MODE_DIR},
+			{Name: "vendor", Mode: fspb.FileMode_MODE_SUBMODULE},
+		},
+		"/src": {{Name: "main.go", Mode: fspb.FileMode_MODE_REGULAR}},
+	}
+	commits = map[string]*fspb.GetCommitResponse{
+		commitA: {
+			Hash:      commitA,
+			Author:    &fspb.Signature{Name: "Ada", Email: "ada@example.com"},
+			Committer: &fspb.Signature{Name: "Ada", Email: "ada@example.com"},
+			Message:   "Initial commit\n",
+		},
+		commitB: {
+			Hash:         commitB,
+			ParentHashes: []string{commitA},
+			Author:       &fspb.Signature{Name: "Grace", Email: "grace@example.com"},
+			Committer:    &fspb.Signature{Name: "Grace", Email: "grace@example.com"},
+			Message:      "Say hello\n\nIn more detail.\n",
+		},
+	}
+)
+
+func check(repo string, commit string) error {
+	if repo != "repo" {
+		return status.Errorf(codes.NotFound, "repo %q not found", repo)
+	}
+	if commits[commit] == nil {
+		return status.Errorf(codes.NotFound, "commit %q not found", commit)
+	}
+	return nil
+}
+
+func (fakeServer) ListRepos(ctx context.Context, req *fspb.ListReposRequest) (*fspb.ListReposResponse, error) {
+	return &fspb.ListReposResponse{Repos: []string{"repo"}, DefaultRepo: "repo"}, nil
+}
+
+func (fakeServer) ListBranches(ctx context.Context, req *fspb.ListBranchesRequest) (*fspb.ListBranchesResponse, error) {
+	if err := check(req.Repo, commitB); err != nil {
+		return nil, err
+	}
+	return &fspb.ListBranchesResponse{Branches: map[string]string{"master": commitB}}, nil
+}
+
+func (fakeServer) ListTags(ctx context.Context, req *fspb.ListTagsRequest) (*fspb.ListTagsResponse, error) {
+	if err := check(req.Repo, commitA); err != nil {
+		return nil, err
+	}
+	return &fspb.ListTagsResponse{Tags: map[string]string{"v1.0": commitA}}, nil
+}
+
+func (fakeServer) GetCommit(ctx context.Context, req *fspb.GetCommitRequest) (*fspb.GetCommitResponse, error) {
+	if err := check(req.Repo, req.Commit); err != nil {
+		return nil, err
+	}
+	res := proto.Clone(commits[req.Commit]).(*fspb.GetCommitResponse)
+	if req.IncludeDiff && req.Commit == commitB {
+		res.Diff = []*fspb.FileDiff{
+			{
+				FromPath: "README.md",
+				ToPath:   "README.md",
+				Patch:    "diff --git a/README.md b/README.md\n--- a/README.md\n+++ b/README.md\n@@ -1 +1,2 @@\n hello\n+<world>\n",
+			},
+			{FromPath: "logo.png", Binary: true},
+		}
+	}
+	return res, nil
+}
+
+func (fakeServer) ListDir(ctx context.Context, req *fspb.ListDirRequest) (*fspb.ListDirResponse, error) {
+	if err := check(req.Repo, req.Commit); err != nil {
+		return nil, err
+	}
+	entries, ok := dirs[req.Path]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "dir %q not found", req.Path)
+	}
+	return &fspb.ListDirResponse{Entries: entries}, nil
+}
+
+func (fakeServer) GetFile(ctx context.Context, req *fspb.GetFileRequest) (*fspb.GetFileResponse, error) {
+	if err := check(req.Repo, req.Commit); err != nil {
+		return nil, err
+	}
+	contents, ok := files[req.Path]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "file %q not found", req.Path)
+	}
+	return &fspb.GetFileResponse{Contents: []byte(contents)}, nil
+}
+
+func TestPages(t *testing.T) {
+	router := mux.NewRouter()
+	Register(router, fakeServer{})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	testCases := []struct {
+		desc     string
+		path     string
+		wantCode int
+		// wantContains are snippets of HTML that the page must contain, in
+		// order.
+		wantContains []string
+		wantMissing  []string
+	}{
+		{
+			desc:         "repos",
+			path:         "/ui",
+			wantCode:     http.StatusOK,
+			wantContains: []string{`<a href="/ui/repo">repo</a> (default)`},
+		},
+		{
+			desc:     "refs",
+			path:     "/ui/repo",
+			wantCode: http.StatusOK,
+			wantContains: []string{
+				"<td>master</td>", `href="/ui/repo/tree/` + commitB + `"`, `href="/ui/repo/log/` + commitB + `"`,
+				"<td>v1.0</td>", `href="/ui/repo/commit/` + commitA + `"`,
+			},
+		},
+		{
+			desc:     "log",
+			path:     "/ui/repo/log/" + commitB,
+			wantCode: http.StatusOK,
+			wantContains: []string{
+				"<code>bbbbbbb</code>", "<td>Say hello</td>", "<td>Grace</td>",
+				"<code>aaaaaaa</code>", "<td>Initial commit</td>",
+			},
+			wantMissing: []string{"In more detail", "Older"},
+		},
+		{
+			desc:     "commit",
+			path:     "/ui/repo/commit/" + commitB,
+			wantCode: http.StatusOK,
+			wantContains: []string{
+				"Grace &lt;grace@example.com&gt;",
+				`<a href="/ui/repo/commit/` + commitA + `"><code>aaaaaaa</code></a>`,
+				"In more detail.",
+				"<h3>README.md</h3>",
+				`<tr class="header"><td>diff --git a/README.md b/README.md</td></tr>`,
+				`<tr class="hunk"><td>@@ -1 &#43;1,2 @@</td></tr>`,
+				`<tr class=""><td> hello</td></tr>`,
+				`<tr class="add"><td>&#43;&lt;world&gt;</td></tr>`,
+				"<h3>logo.png</h3>",
+				"Binary file changed.",
+			},
+		},
+		{
+			desc:     "root tree",
+			path:     "/ui/repo/tree/" + commitB,
+			wantCode: http.StatusOK,
+			wantContains: []string{
+				`<a href="/ui/repo/tree/` + commitB + `/src">src/</a>`,
+				`<a href="/ui/repo/blob/` + commitB + `/README.md">README.md</a>`,
+				`<a href="/ui/repo/blob/` + commitB + `/logo.png">logo.png</a>`,
+				`<td>vendor</td>`,
+			},
+		},
+		{
+			desc:     "subdirectory",
+			path:     "/ui/repo/tree/" + commitB + "/src",
+			wantCode: http.StatusOK,
+			wantContains: []string{
+				`<a href="/ui/repo/tree/` + commitB + `">repo</a> / src`,
+				`<a href="/ui/repo/blob/` + commitB + `/src/main.go">main.go</a>`,
+			},
+		},
+		{
+			desc:     "text file",
+			path:     "/ui/repo/blob/" + commitB + "/README.md",
+			wantCode: http.StatusOK,
+			wantContains: []string{
+				`href="/ui/repo/raw/` + commitB + `/README.md"`,
+				`<tr id="L1"><td class="num"><a href="#L1">1</a></td><td>hello</td></tr>`,
+				`<tr id="L2"><td class="num"><a href="#L2">2</a></td><td>&lt;world&gt;</td></tr>`,
+			},
+			wantMissing: []string{`id="L3"`},
+		},
+		{
+			desc:         "binary file",
+			path:         "/ui/repo/blob/" + commitB + "/logo.png",
+			wantCode:     http.StatusOK,
+			wantContains: []string{"6 bytes", "This file is binary"},
+		},
+		{
+			desc:         "missing commit",
+			path:         "/ui/repo/tree/cccccccccccccccccccccccccccccccccccccccc",
+			wantCode:     http.StatusNotFound,
+			wantContains: []string{"Error 404", "commit &#34;cccccccccccccccccccccccccccccccccccccccc&#34; not found"},
+		},
+		{
+			desc:         "missing repo",
+			path:         "/ui/nope",
+			wantCode:     http.StatusNotFound,
+			wantContains: []string{"repo &#34;nope&#34; not found"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			res, err := http.Get(server.URL + tc.path)
+			if err != nil {
+				t.Fatalf("http.Get() got error %v; want no error", err)
+			}
+			defer res.Body.Close()
+			body, err := ioutil.ReadAll(res.Body)
+			if err != nil {
+				t.Fatalf("ReadAll() got error %v; want no error", err)
+			}
+			if res.StatusCode != tc.wantCode {
+				t.Errorf("GET %s got status %d; want %d", tc.path, res.StatusCode, tc.wantCode)
+			}
+			page := string(body)
+			rest := page
+			for _, want := range tc.wantContains {
+				i := strings.Index(rest, want)
+				if i < 0 {
+					t.Errorf("GET %s is missing %q in order; page:\n%s", tc.path, want, page)
+					break
+				}
+				rest = rest[i+len(want):]
+			}
+			for _, missing := range tc.wantMissing {
+				if strings.Contains(page, missing) {
+					t.Errorf("GET %s contains %q; want it missing", tc.path, missing)
+				}
+			}
+		})
+	}
+}
+
+func TestRaw(t *testing.T) {
+	router := mux.NewRouter()
+	Register(router, fakeServer{})
+	req := httptest.NewRequest("GET", "/ui/repo/raw/"+commitB+"/src/main.go", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET raw file got status %d; want %d", rec.Code, http.StatusOK)
+	}
+	if got, want := rec.Body.String(), files["/src/main.go"]; got != want {
+		t.Errorf("GET raw file = %q; want %q", got, want)
+	}
+	if got, want := rec.Header().Get("Content-Disposition"), "attachment; filename=main.go"; got != want {
+		t.Errorf("GET raw file got Content-Disposition %q; want %q", got, want)
+	}
+}
@@ -0,0 +1,93 @@
+// Package webhook defines a provider-neutral representation of push
+// notifications, which the provider-specific packages parse their payloads
+// into.
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ZeroHash is the hash providers send as the old or new value of a ref when the
+// ref is being created or deleted.
+const ZeroHash = "0000000000000000000000000000000000000000"
+
+var (
+	// ErrPing is returned by parsers for events sent only to check that the
+	// hook is reachable.
+	ErrPing = errors.New("ping event")
+	// ErrUnsupportedEvent is returned by parsers for events that don't
+	// describe a change to refs.
+	ErrUnsupportedEvent = errors.New("unsupported event")
+	// ErrUnauthorized is returned by parsers when the request's token or
+	// signature doesn't match the configured secret.
+	ErrUnauthorized = errors.New("token or signature mismatch")
+)
+
+// ParseFunc parses a webhook request into a PushEvent, verifying it against
+// secret if secret is non-empty.
+type ParseFunc func(r *http.Request, secret string) (*PushEvent, error)
+
+// PushEvent describes one or more refs that changed in a repository.
+type PushEvent struct {
+	// DeliveryID is the provider's unique ID for the webhook delivery, if it
+	// sends one.
+	DeliveryID string
+	// Repository is the provider's name for the repository, e.g.
+	// "minorhacks/funhouse".
+	Repository string
+	Updates    []RefUpdate
+}
+
+// RefUpdate describes a single ref moving from Before to After.
+type RefUpdate struct {
+	// Ref is the fully-qualified ref name, e.g. "refs/heads/master".
+	Ref    string
+	Before string
+	After  string
+}
+
+// Deleted returns whether the update removes the ref.
+func (u RefUpdate) Deleted() bool {
+	return u.After == ZeroHash
+}
+
+// CheckToken verifies a shared-secret token sent verbatim in a header.
+func CheckToken(got string, secret string) error {
+	if secret == "" {
+		return nil
+	}
+	if subtle.ConstantTimeCompare([]byte(got), []byte(secret)) != 1 {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+// CheckSignature verifies a hex-encoded HMAC-SHA256 of body, optionally
+// prefixed with "sha256=".
+func CheckSignature(body []byte, sig string, secret string) error {
+	if secret == "" {
+		return nil
+	}
+	got, err := hex.DecodeString(strings.TrimPrefix(sig, "sha256="))
+	if err != nil {
+		return fmt.Errorf("%w: malformed signature %q", ErrUnauthorized, sig)
+	}
+	if !hmac.Equal(got, Sign(body, secret)) {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+// Sign returns the HMAC-SHA256 of body keyed with secret.
+func Sign(body []byte, secret string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,24 @@
+// Package webhooktest helps test the provider-specific webhook parsers.
+package webhooktest
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/bazelbuild/rules_go/go/tools/bazel"
+)
+
+// ReadFile returns the contents of a test's runfile, such as a captured
+// payload, failing the test if it can't be read.
+func ReadFile(t testing.TB, filename string) []byte {
+	t.Helper()
+	f, err := bazel.Runfile(filename)
+	if err != nil {
+		t.Fatalf("can't get runfile %q: %v", filename, err)
+	}
+	contents, err := ioutil.ReadFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return contents
+}